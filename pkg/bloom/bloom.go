@@ -69,7 +69,12 @@ func (f *Filter) Insert(v []byte) {
 // Contains returns true if the filter possibly contains v.
 // Returns false if the filter definitely does not contain v.
 func (f *Filter) Contains(v []byte) bool {
-	h := hash(v)
+	return f.ContainsHash(NewHash(v))
+}
+
+// ContainsHash returns true if the filter possibly contains the value with
+// hash h. Returns false if the filter definitely does not contain the value.
+func (f *Filter) ContainsHash(h Hash) bool {
 	for i := uint64(0); i < f.k; i++ {
 		loc := f.location(h, i)
 		if f.b[loc/8]&(1<<(loc%8)) == 0 {
@@ -120,6 +125,13 @@ func pow2(v uint64) uint64 {
 	panic("unreachable")
 }
 
+// Hash is the set of base hashes of a value. A value can be hashed once with
+// NewHash & checked against several filters with ContainsHash.
+type Hash [4]uint64
+
+// NewHash returns the base hashes of v.
+func NewHash(v []byte) Hash { return Hash(hash(v)) }
+
 // hash returns a set of 4 based hashes.
 func hash(data []byte) [4]uint64 {
 	h := murmur3.New128()
@@ -27,3 +27,26 @@ func TestFilter_InsertContains(t *testing.T) {
 		t.Fatal("expected false")
 	}
 }
+
+// Ensure a value hashed once can be checked against multiple filters.
+func TestFilter_ContainsHash(t *testing.T) {
+	f0, f1 := bloom.NewFilter(1000, 4), bloom.NewFilter(64, 2)
+	f0.Insert([]byte("Bess"))
+	f1.Insert([]byte("Emma"))
+
+	for _, tt := range []struct {
+		v      string
+		f0, f1 bool
+	}{
+		{v: "Bess", f0: true, f1: false},
+		{v: "Emma", f0: false, f1: true},
+		{v: "Jane", f0: false, f1: false},
+	} {
+		h := bloom.NewHash([]byte(tt.v))
+		if v := f0.ContainsHash(h); v != tt.f0 || v != f0.Contains([]byte(tt.v)) {
+			t.Fatalf("%s: unexpected f0 result: %v", tt.v, v)
+		} else if v := f1.ContainsHash(h); v != tt.f1 || v != f1.Contains([]byte(tt.v)) {
+			t.Fatalf("%s: unexpected f1 result: %v", tt.v, v)
+		}
+	}
+}
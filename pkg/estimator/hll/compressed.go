@@ -81,6 +81,10 @@ func (v *compressedList) MarshalBinary() (data []byte, err error) {
 }
 
 func (v *compressedList) UnmarshalBinary(data []byte) error {
+	if len(data) < 12 {
+		return ErrInvalidData
+	}
+
 	// Set the count.
 	v.count, data = binary.BigEndian.Uint32(data[:4]), data[4:]
 
@@ -89,6 +93,9 @@ func (v *compressedList) UnmarshalBinary(data []byte) error {
 
 	// Set the list.
 	sz, data := binary.BigEndian.Uint32(data[:4]), data[4:]
+	if uint64(sz) > uint64(len(data)) {
+		return ErrInvalidData
+	}
 	v.b = make([]uint8, sz)
 	for i := uint32(0); i < sz; i++ {
 		v.b[i] = uint8(data[i])
@@ -28,6 +28,10 @@ import (
 // Current version of HLL implementation.
 const version uint8 = 2
 
+// ErrInvalidData is returned when unmarshaling data which is too short for the
+// sizes it encodes.
+var ErrInvalidData = errors.New("invalid sketch data")
+
 // DefaultPrecision is the default precision.
 const DefaultPrecision = 16
 
@@ -138,6 +142,76 @@ func (h *Plus) Clone() *Plus {
 	return hll
 }
 
+// Precision returns the precision of h.
+func (h *Plus) Precision() uint8 { return h.p }
+
+// Reduce returns a copy of h with the lower precision p. The copy estimates
+// the same set of values as if they had been added at precision p, so it can
+// be merged with other sketches of precision p. h is not modified.
+func (h *Plus) Reduce(p uint8) (*Plus, error) {
+	if p > h.p {
+		return nil, errors.New("precision must not be greater than sketch precision")
+	}
+
+	other, err := NewPlus(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.sparse {
+		// Sparse values are encoded at p' precision. Only values which relied
+		// on the lower bits of the index being zero at precision h.p need to
+		// be re-encoded.
+		for k := range h.tmpSet {
+			other.tmpSet.add(other.reduceHash(k))
+		}
+		for iter := h.sparseList.Iter(); iter.HasNext(); {
+			other.tmpSet.add(other.reduceHash(iter.Next()))
+		}
+		other.mergeSparse()
+		if uint32(other.sparseList.Len()) > other.m {
+			other.toNormal()
+		}
+		return other, nil
+	}
+
+	// Fold registers. The dropped index bits become the leading bits of the
+	// value used to determine a register's rank.
+	d := h.p - p
+	other.toNormal()
+	for i, r := range h.denseList {
+		if r == 0 {
+			continue
+		}
+
+		if low := uint64(i) & (1<<d - 1); low != 0 {
+			r = d - uint8(64-bits.Clz(low)) + 1
+		} else {
+			r += d
+		}
+
+		if j := i >> d; other.denseList[j] < r {
+			other.denseList[j] = r
+		}
+	}
+	return other, nil
+}
+
+// reduceHash re-encodes a sparse value from a sketch with a higher precision.
+func (h *Plus) reduceHash(k uint32) uint32 {
+	if k&1 == 0 {
+		return k
+	}
+
+	// The value stores zeros following the p' index. Keep it only if the
+	// index bits below precision h.p are still zero.
+	idx := k >> 7
+	if bextr32(idx, 0, h.pp-h.p) == 0 {
+		return k
+	}
+	return idx << 1
+}
+
 // Add adds a new value to the HLL.
 func (h *Plus) Add(v []byte) {
 	x := h.hash(v)
@@ -275,6 +349,10 @@ func (h *Plus) MarshalBinary() (data []byte, err error) {
 
 // UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
 func (h *Plus) UnmarshalBinary(data []byte) error {
+	if len(data) < 7 {
+		return ErrInvalidData
+	}
+
 	// Unmarshal version. We may need this in the future if we make
 	// non-compatible changes.
 	_ = data[0]
@@ -296,11 +374,14 @@ func (h *Plus) UnmarshalBinary(data []byte) error {
 
 		// Unmarshal the tmp_set.
 		tssz := binary.BigEndian.Uint32(data[3:7])
+		if uint64(tssz)*4 > uint64(len(data)-7) {
+			return ErrInvalidData
+		}
 		h.tmpSet = make(map[uint32]struct{}, tssz)
 
 		// We need to unmarshal tssz values in total, and each value requires us
 		// to read 4 bytes.
-		tsLastByte := int((tssz * 4) + 7)
+		tsLastByte := int(tssz)*4 + 7
 		for i := 7; i < tsLastByte; i += 4 {
 			k := binary.BigEndian.Uint32(data[i : i+4])
 			h.tmpSet[k] = struct{}{}
@@ -313,6 +394,9 @@ func (h *Plus) UnmarshalBinary(data []byte) error {
 	// Using the dense representation.
 	h.sparse = false
 	dsz := int(binary.BigEndian.Uint32(data[3:7]))
+	if dsz > len(data)-7 {
+		return ErrInvalidData
+	}
 	h.denseList = make([]uint8, 0, dsz)
 	for i := 7; i < dsz+7; i++ {
 		h.denseList = append(h.denseList, uint8(data[i]))
@@ -419,6 +503,12 @@ func (p uint64Slice) Len() int           { return len(p) }
 func (p uint64Slice) Less(i, j int) bool { return p[i] < p[j] }
 func (p uint64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+type uint32Slice []uint32
+
+func (p uint32Slice) Len() int           { return len(p) }
+func (p uint32Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 type set map[uint32]struct{}
 
 func (s set) Clone() set {
@@ -448,8 +538,15 @@ func (s set) MarshalBinary() (data []byte, err error) {
 		byte(sl),
 	}...)
 
-	// Marshal each element in the set.
+	// Marshal each element in the set in sorted order so the encoding is
+	// deterministic.
+	keys := make([]uint32, 0, len(s))
 	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Sort(uint32Slice(keys))
+
+	for _, k := range keys {
 		data = append(data, []byte{
 			byte(k >> 24),
 			byte(k >> 16),
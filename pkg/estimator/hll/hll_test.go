@@ -176,6 +176,35 @@ func TestHLLPP_Merge_Error(t *testing.T) {
 	}
 }
 
+func TestHLLPP_Reduce(t *testing.T) {
+	for _, n := range []int{1000, 200000} {
+		h, exp := MustNewPlus(16), MustNewPlus(12)
+		for i := 0; i < n; i++ {
+			v := toByte(rand.Uint64())
+			h.Add(v)
+			exp.Add(v)
+		}
+
+		other, err := h.Reduce(12)
+		if err != nil {
+			t.Fatal(err)
+		} else if other.Precision() != 12 {
+			t.Fatalf("unexpected precision: %d", other.Precision())
+		} else if got, exp := other.Count(), exp.Count(); got != exp {
+			t.Fatalf("unexpected count (n=%d): %d, expected %d", n, got, exp)
+		}
+
+		// A reduced sketch can be merged with sketches of the same precision.
+		if err := exp.Merge(other); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := MustNewPlus(12).Reduce(16); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
 func TestHLL_Merge_Sparse(t *testing.T) {
 	h := NewTestPlus(16)
 	h.Add(toByte(0x00010fffffffffff))
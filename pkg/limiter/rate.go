@@ -0,0 +1,110 @@
+package limiter
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Rate is a token bucket rate limiter. Tokens are added at a fixed rate per
+// second up to a maximum burst. It is safe for concurrent use so a single Rate
+// can be shared to limit the combined rate of several callers.
+type Rate struct {
+	mu     sync.Mutex
+	limit  float64 // tokens per second
+	burst  float64 // maximum tokens
+	tokens float64 // available tokens, negative if reserved ahead
+	last   time.Time
+}
+
+// NewRate returns a Rate which allows limit tokens per second with a maximum
+// burst of burst tokens. A burst of zero or less is set to limit. Panics if
+// limit is not greater than zero.
+func NewRate(limit, burst int) *Rate {
+	if limit <= 0 {
+		panic("limiter: rate limit must be greater than zero")
+	} else if burst <= 0 {
+		burst = limit
+	}
+	return &Rate{
+		limit:  float64(limit),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Burst returns the maximum number of tokens.
+func (r *Rate) Burst() int { return int(r.burst) }
+
+// WaitN blocks until n tokens are available or ctx is done. Requests larger
+// than the burst are allowed but delay later requests. If ctx is done before
+// the tokens are available then the tokens are returned & ctx.Err() is
+// returned.
+func (r *Rate) WaitN(ctx context.Context, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.limit
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	wait := time.Duration(-r.tokens / r.limit * float64(time.Second))
+	r.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		r.tokens += float64(n)
+		r.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// NewWriter returns a writer which waits for a token from r for each byte
+// before writing it to w. Writes are split so that no single wait exceeds the
+// burst of r. Writes stop with ctx.Err() once ctx is done.
+func NewWriter(ctx context.Context, w io.Writer, r *Rate) io.Writer {
+	return &writer{ctx: ctx, w: w, r: r}
+}
+
+type writer struct {
+	ctx context.Context
+	w   io.Writer
+	r   *Rate
+}
+
+func (w *writer) Write(p []byte) (n int, err error) {
+	burst := w.r.Burst()
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		if err := w.r.WaitN(w.ctx, len(chunk)); err != nil {
+			return n, err
+		}
+
+		nn, err := w.w.Write(chunk)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		p = p[nn:]
+	}
+	return n, nil
+}
@@ -0,0 +1,148 @@
+package limiter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/pkg/limiter"
+)
+
+// Ensure a rate cannot be created without a positive limit.
+func TestNewRate_InvalidLimit(t *testing.T) {
+	for _, limit := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected panic: limit=%d", limit)
+				}
+			}()
+			limiter.NewRate(limit, 10)
+		}()
+	}
+
+	if n := limiter.NewRate(5, 0).Burst(); n != 5 {
+		t.Fatalf("unexpected burst: %d", n)
+	}
+}
+
+// Ensure tokens are refilled at the limit once the burst is used.
+func TestRate_WaitN(t *testing.T) {
+	r := limiter.NewRate(100, 10)
+
+	start := time.Now()
+	if err := r.WaitN(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	} else if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("burst throttled: %s", d)
+	}
+
+	// Ten more tokens take 100ms to refill.
+	start = time.Now()
+	if err := r.WaitN(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	} else if d := time.Since(start); d < 80*time.Millisecond || d > time.Second {
+		t.Fatalf("unexpected wait: %s", d)
+	}
+}
+
+// Ensure idle time does not accumulate more tokens than the burst.
+func TestRate_WaitN_BurstCap(t *testing.T) {
+	r := limiter.NewRate(100, 5)
+	time.Sleep(100 * time.Millisecond)
+
+	if err := r.WaitN(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// The burst is used so five more tokens take 50ms to refill.
+	start := time.Now()
+	if err := r.WaitN(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	} else if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("burst not capped: %s", d)
+	}
+}
+
+// Ensure tokens are returned when the context is done before they are available.
+func TestRate_WaitN_Canceled(t *testing.T) {
+	r := limiter.NewRate(10, 10)
+	if err := r.WaitN(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// A done context fails immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.WaitN(ctx, 1); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Waiting for 10 tokens takes a second so the deadline is reached first.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := r.WaitN(ctx, 10); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The refunded tokens are not owed so a single token takes 100ms, not 1.1s.
+	start := time.Now()
+	if err := r.WaitN(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	} else if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("tokens not returned: %s", d)
+	}
+}
+
+// Ensure writes are split into chunks of at most the burst.
+func TestWriter_Write(t *testing.T) {
+	var w chunkWriter
+	lw := limiter.NewWriter(context.Background(), &w, limiter.NewRate(1<<30, 4))
+	if n, err := lw.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	} else if n != 10 {
+		t.Fatalf("unexpected bytes written: %d", n)
+	} else if got := w.buf.String(); got != "0123456789" {
+		t.Fatalf("unexpected data: %q", got)
+	} else if len(w.sizes) != 3 || w.sizes[0] != 4 || w.sizes[1] != 4 || w.sizes[2] != 2 {
+		t.Fatalf("unexpected chunks: %v", w.sizes)
+	}
+
+	// Errors from the underlying writer stop the write.
+	failure := errors.New("marker")
+	w = chunkWriter{err: failure}
+	if n, err := lw.Write([]byte("0123456789")); err != failure {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n != 4 {
+		t.Fatalf("unexpected bytes written: %d", n)
+	}
+
+	// Writes stop once the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = chunkWriter{}
+	lw = limiter.NewWriter(ctx, &w, limiter.NewRate(1<<30, 4))
+	if n, err := lw.Write([]byte("0123456789")); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n != 0 || len(w.sizes) != 0 {
+		t.Fatalf("unexpected write: n=%d, chunks=%v", n, w.sizes)
+	}
+}
+
+// chunkWriter records the size of each write. Writes after the first fail
+// with err, if set.
+type chunkWriter struct {
+	buf   bytes.Buffer
+	sizes []int
+	err   error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.err != nil && len(w.sizes) > 0 {
+		return 0, w.err
+	}
+	w.sizes = append(w.sizes, len(p))
+	return w.buf.Write(p)
+}
@@ -0,0 +1,21 @@
+package mmap
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// mapping returns the whole mapping that data was sliced from by MapRange.
+// Mappings begin at a multiple of align & data begins less than align bytes
+// after the start of its mapping, so the start is recovered from the address.
+func mapping(data []byte, align int) []byte {
+	addr := uintptr(unsafe.Pointer(&data[0]))
+	pad := int(addr % uintptr(align))
+
+	var b []byte
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	hdr.Data = addr - uintptr(pad)
+	hdr.Len = len(data) + pad
+	hdr.Cap = len(data) + pad
+	return b
+}
@@ -3,6 +3,7 @@
 package mmap
 
 import (
+	"fmt"
 	"os"
 	"syscall"
 
@@ -19,22 +20,46 @@ func Map(path string) ([]byte, error) {
 	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
-	} else if fi.Size() == 0 {
-		return nil, nil
 	}
+	return mapRange(f, 0, fi.Size())
+}
 
-	data, err := unix.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+// MapRange memory-maps length bytes of a file from offset, which does not
+// need to be page aligned.
+func MapRange(path string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
+	return mapRange(f, offset, length)
+}
 
-	return data, nil
+func mapRange(f *os.File, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("mmap: invalid range: %s (offset %d, length %d)", f.Name(), offset, length)
+	} else if length == 0 {
+		return nil, nil
+	}
+
+	// The mapping must start on a page boundary.
+	pad := offset % int64(os.Getpagesize())
+	if int64(int(length+pad)) != length+pad {
+		return nil, fmt.Errorf("mmap: file too large to map: %s (%d bytes)", f.Name(), length)
+	}
+
+	data, err := unix.Mmap(int(f.Fd()), offset-pad, int(length+pad), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return data[pad:], nil
 }
 
-// Unmap closes the memory-map.
+// Unmap closes the memory-map. The data must have been returned by Map or
+// MapRange.
 func Unmap(data []byte) error {
 	if data == nil {
 		return nil
 	}
-	return unix.Munmap(data)
+	return unix.Munmap(mapping(data, os.Getpagesize()))
 }
@@ -3,6 +3,7 @@ package mmap_test
 import (
 	"bytes"
 	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/influxdata/influxdb/pkg/mmap"
@@ -20,3 +21,66 @@ func TestMap(t *testing.T) {
 		t.Fatalf("got %q\nwant %q", string(data), string(exp))
 	}
 }
+
+func TestMapRange(t *testing.T) {
+	f, err := ioutil.TempFile("", "mmap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	exp := make([]byte, 3*os.Getpagesize()+100)
+	for i := range exp {
+		exp[i] = byte(i % 251)
+	}
+	if _, err := f.Write(exp); err != nil {
+		t.Fatal(err)
+	} else if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranges need not start on a page boundary.
+	for _, r := range [][2]int64{{0, int64(len(exp))}, {1, 10}, {int64(os.Getpagesize()) + 7, int64(os.Getpagesize())}, {int64(len(exp)) - 1, 1}} {
+		data, err := mmap.MapRange(f.Name(), r[0], r[1])
+		if err != nil {
+			t.Fatalf("MapRange(%d, %d): %v", r[0], r[1], err)
+		} else if !bytes.Equal(data, exp[r[0]:r[0]+r[1]]) {
+			t.Fatalf("MapRange(%d, %d): unexpected data", r[0], r[1])
+		} else if err := mmap.Unmap(data); err != nil {
+			t.Fatalf("Unmap(%d, %d): %v", r[0], r[1], err)
+		}
+	}
+
+	if data, err := mmap.MapRange(f.Name(), 5, 0); err != nil || data != nil {
+		t.Fatalf("unexpected empty range: %v %v", data, err)
+	} else if _, err := mmap.MapRange(f.Name(), -1, 1); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure ranges beyond the 32-bit offset range can be mapped, such as the end
+// of files over 4GB on 32-bit platforms.
+func TestMapRange_LargeOffset(t *testing.T) {
+	f, err := ioutil.TempFile("", "mmap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// Write to the end of a sparse file.
+	offset := int64(5<<30) + 3
+	if _, err := f.WriteAt([]byte("tail"), offset); err != nil {
+		t.Skipf("sparse file not supported: %v", err)
+	} else if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := mmap.MapRange(f.Name(), offset, 4)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "tail" {
+		t.Fatalf("unexpected data: %q", data)
+	} else if err := mmap.Unmap(data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,11 +1,17 @@
 package mmap
 
 import (
+	"fmt"
 	"os"
+	"reflect"
 	"syscall"
 	"unsafe"
 )
 
+// Views of a file mapping must start on a multiple of the allocation
+// granularity, which is 64KB on all versions of Windows.
+const allocationGranularity = 64 * 1024
+
 // Map memory-maps a file.
 func Map(path string) ([]byte, error) {
 	f, err := os.Open(path)
@@ -17,30 +23,59 @@ func Map(path string) ([]byte, error) {
 	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
-	} else if fi.Size() == 0 {
+	}
+	return mapRange(f, 0, fi.Size())
+}
+
+// MapRange memory-maps length bytes of a file from offset, which does not
+// need to be aligned.
+func MapRange(path string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return mapRange(f, offset, length)
+}
+
+func mapRange(f *os.File, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("mmap: invalid range: %s (offset %d, length %d)", f.Name(), offset, length)
+	} else if length == 0 {
 		return nil, nil
 	}
 
-	lo, hi := uint32(fi.Size()), uint32(fi.Size()>>32)
-	fmap, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, hi, lo, nil)
+	pad := offset % allocationGranularity
+	if int64(int(length+pad)) != length+pad {
+		return nil, fmt.Errorf("mmap: file too large to map: %s (%d bytes)", f.Name(), length)
+	}
+
+	end := offset + length
+	fmap, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, uint32(end>>32), uint32(end), nil)
 	if err != nil {
 		return nil, err
 	}
 	defer syscall.CloseHandle(fmap)
 
-	ptr, err := syscall.MapViewOfFile(fmap, syscall.FILE_MAP_READ, 0, 0, uintptr(fi.Size()))
+	start := offset - pad
+	ptr, err := syscall.MapViewOfFile(fmap, syscall.FILE_MAP_READ, uint32(start>>32), uint32(start), uintptr(length+pad))
 	if err != nil {
 		return nil, err
 	}
-	data := (*[1 << 30]byte)(unsafe.Pointer(ptr))[:fi.Size()]
 
+	var data []byte
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	hdr.Data = ptr + uintptr(pad)
+	hdr.Len = int(length)
+	hdr.Cap = int(length)
 	return data, nil
 }
 
-// Unmap closes the memory-map.
+// Unmap closes the memory-map. The data must have been returned by Map or
+// MapRange.
 func Unmap(data []byte) error {
 	if data == nil {
 		return nil
 	}
-	return syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&data[0])))
+	return syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&mapping(data, allocationGranularity)[0])))
 }
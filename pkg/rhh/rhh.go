@@ -2,6 +2,7 @@ package rhh
 
 import (
 	"bytes"
+	"hash/fnv"
 	"sort"
 
 	"github.com/cespare/xxhash"
@@ -18,12 +19,17 @@ type HashMap struct {
 	threshold  int64
 	mask       int64
 	loadFactor int
+	hash       func([]byte) int64
 }
 
 func NewHashMap(opt Options) *HashMap {
 	m := &HashMap{
 		capacity:   pow2(opt.Capacity), // Limited to 2^64.
 		loadFactor: opt.LoadFactor,
+		hash:       opt.Hash,
+	}
+	if m.hash == nil {
+		m.hash = HashKey
 	}
 	m.alloc()
 	return m
@@ -54,7 +60,7 @@ func (m *HashMap) Put(key []byte, val interface{}) {
 	}
 
 	// If the key was overwritten then decrement the size.
-	overwritten := m.insert(HashKey(key), key, val)
+	overwritten := m.insert(m.hash(key), key, val)
 	if overwritten {
 		m.n--
 	}
@@ -131,7 +137,7 @@ func (m *HashMap) grow() {
 
 // index returns the position of key in the hash map.
 func (m *HashMap) index(key []byte) int64 {
-	hash := HashKey(key)
+	hash := m.hash(key)
 	pos := hash & m.mask
 
 	var dist int64
@@ -222,6 +228,10 @@ func (e *hashElem) setKey(v []byte) {
 type Options struct {
 	Capacity   int64
 	LoadFactor int
+
+	// Hash function used to position keys. The hash must be positive.
+	// Defaults to HashKey if nil.
+	Hash func([]byte) int64
 }
 
 // DefaultOptions represents a default set of options to pass to NewHashMap().
@@ -232,7 +242,21 @@ var DefaultOptions = Options{
 
 // HashKey computes a hash of key. Hash is always non-zero.
 func HashKey(key []byte) int64 {
-	h := int64(xxhash.Sum64(key))
+	return positiveHash(xxhash.Sum64(key))
+}
+
+// HashKeyFNV computes a hash of key using 64-bit FNV-1a. It is an alternative
+// to HashKey for key sets which hash poorly with xxhash. Hash is always
+// non-zero.
+func HashKeyFNV(key []byte) int64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return positiveHash(h.Sum64())
+}
+
+// positiveHash converts a 64-bit hash to a non-zero, non-negative value.
+func positiveHash(v uint64) int64 {
+	h := int64(v)
 	if h == 0 {
 		h = 1
 	} else if h < 0 {
@@ -31,6 +31,27 @@ func TestHashMap(t *testing.T) {
 	}
 }
 
+// Ensure hash map can use a custom hash function, even a degenerate one.
+func TestHashMap_Hash(t *testing.T) {
+	for _, hash := range []func([]byte) int64{
+		rhh.HashKeyFNV,
+		func([]byte) int64 { return 1 },
+	} {
+		m := rhh.NewHashMap(rhh.Options{Capacity: 4, LoadFactor: 90, Hash: hash})
+		for i := 0; i < 100; i++ {
+			m.Put([]byte{byte(i)}, i)
+		}
+		for i := 0; i < 100; i++ {
+			if v := m.Get([]byte{byte(i)}); v != i {
+				t.Fatalf("unexpected value: %v", v)
+			}
+		}
+		if v := m.Get([]byte("missing")); v != nil {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	}
+}
+
 // Ensure hash map can insert random data.
 func TestHashMap_Quick(t *testing.T) {
 	if testing.Short() {
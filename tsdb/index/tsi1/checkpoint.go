@@ -0,0 +1,203 @@
+package tsi1
+
+import (
+	"context"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CompactCheckpointExt is the extension of the checkpoint written alongside
+// a resumable compaction.
+const CompactCheckpointExt = ".checkpoint"
+
+// CompactFile is a file that a resumable compaction can be written to.
+type CompactFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Truncate(size int64) error
+}
+
+// compactCheckpoint records a series block which has been written & synced
+// by a resumable compaction.
+type compactCheckpoint struct {
+	Size        int64 `json:"size"`
+	SeriesBlock struct {
+		Offset   int64  `json:"offset"`
+		Size     int64  `json:"size"`
+		Checksum uint32 `json:"checksum"`
+	} `json:"seriesBlock"`
+}
+
+// CompactToResumable writes the compacted file to f like CompactTo but can
+// resume after a crash.
+//
+// Once the series block has been written & synced a checkpoint is written to
+// checkpointPath. If a later call finds a checkpoint matching the planned
+// file size, series block offset, size & checksum, and the series block in f
+// has that checksum, then the series block is not rewritten. The planning done
+// by Layout is still repeated because the tagset & measurement blocks require
+// the series offsets, so resuming only saves writing the series block. The
+// tagset & measurement blocks are always rewritten. A checkpoint which does
+// not match is ignored & replaced.
+//
+// The checkpoint is removed once the file is complete & synced.
+func (l *IndexFileLayout) CompactToResumable(ctx context.Context, f CompactFile, checkpointPath string) (IndexFileTrailer, error) {
+	t := l.trailer
+	t.SeriesBlock.Checksum = l.seriesSum
+
+	resumed, err := l.resumeSeriesBlock(f, checkpointPath)
+	if err != nil {
+		return t, err
+	} else if err := f.Truncate(l.size); err != nil {
+		return t, err
+	}
+
+	var wg sync.WaitGroup
+	var errs [2]error
+	if !resumed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[0] = l.checkpointSeriesBlock(ctx, f, checkpointPath)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.TagsetBlock.Checksum, t.MeasurementBlock.Checksum, errs[1] = l.writeMeasurementBlocksAt(ctx, f)
+	}()
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return t, err
+		}
+	}
+
+	if err := l.writeTrailerAt(f, t); err != nil {
+		return t, err
+	} else if err := f.Sync(); err != nil {
+		return t, err
+	} else if err := os.Remove(checkpointPath); err != nil && !os.IsNotExist(err) {
+		return t, err
+	}
+	return t, nil
+}
+
+// resumeSeriesBlock returns true if the checkpoint at path matches the layout
+// & the series block in f is intact. Any other checkpoint is removed.
+func (l *IndexFileLayout) resumeSeriesBlock(f CompactFile, path string) (bool, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var c compactCheckpoint
+	if err := json.Unmarshal(buf, &c); err == nil &&
+		c.Size == l.size &&
+		c.SeriesBlock.Offset == l.trailer.SeriesBlock.Offset &&
+		c.SeriesBlock.Size == l.trailer.SeriesBlock.Size &&
+		c.SeriesBlock.Checksum == l.seriesSum {
+
+		h := crc32.NewIEEE()
+		r := io.NewSectionReader(f, c.SeriesBlock.Offset, c.SeriesBlock.Size)
+		if n, err := io.Copy(h, r); err == nil && n == c.SeriesBlock.Size && h.Sum32() == c.SeriesBlock.Checksum {
+			return true, nil
+		}
+	}
+
+	// Discard the checkpoint before the series block is rewritten.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return false, nil
+}
+
+// checkpointSeriesBlock writes & syncs the series block and then writes a
+// checkpoint to path.
+func (l *IndexFileLayout) checkpointSeriesBlock(ctx context.Context, f CompactFile, path string) error {
+	var c compactCheckpoint
+	c.Size = l.size
+	c.SeriesBlock.Offset = l.trailer.SeriesBlock.Offset
+	c.SeriesBlock.Size = l.trailer.SeriesBlock.Size
+	c.SeriesBlock.Checksum = l.seriesSum
+
+	if _, err := l.writeSeriesBlockAt(ctx, f); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(path, buf)
+}
+
+// CompactToFileResumable atomically writes the merged index files to path
+// like CompactToFileWithOptions but checkpoints the series block so the
+// compaction can resume after a crash. See IndexFileLayout.CompactToResumable.
+//
+// The temporary file & its checkpoint are kept if the compaction fails so a
+// later call with the same files & options can resume. Callers abandoning the
+// compaction should remove path+TempFileExt & path+TempFileExt+CompactCheckpointExt.
+func (p IndexFiles) CompactToFileResumable(ctx context.Context, path string, m, k uint64, overwrite bool, opt CompactOptions) (n int64, err error) {
+	if !overwrite {
+		if _, err := os.Stat(path); err == nil {
+			return 0, &ErrIndexFileExists{Path: path}
+		} else if !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	l, err := p.Layout(m, k, opt)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	tmpPath := path + TempFileExt
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := l.CompactToResumable(ctx, f, tmpPath+CompactCheckpointExt); err != nil {
+		f.Close()
+		return 0, err
+	} else if err := f.Close(); err != nil {
+		return 0, err
+	} else if err := renameFile(tmpPath, path); err != nil {
+		return 0, err
+	}
+	return l.Size(), syncDir(filepath.Dir(path))
+}
+
+// writeFileSync atomically writes buf to path via a synced temporary file.
+func writeFileSync(path string, buf []byte) error {
+	tmpPath := path + TempFileExt
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return renameFile(tmpPath, path)
+}
@@ -0,0 +1,238 @@
+package tsi1_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// errCrash is returned by crashFile to simulate a crash.
+var errCrash = errors.New("crash")
+
+// Ensure a compaction which crashes after the series block resumes without
+// rewriting it.
+func TestIndexFileLayout_CompactToResumable(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path, checkpointPath := filepath.Join(dir, "index"), filepath.Join(dir, "index.checkpoint")
+
+	a := MustGenerateIndexFiles(t)
+	var exp bytes.Buffer
+	if _, err := a.CompactTo(&exp, M, K); err != nil {
+		t.Fatal(err)
+	}
+
+	l := MustLayout(t, a)
+	planned := l.Trailer()
+
+	// Crash once the tagset block is written to.
+	f := MustOpenCompactFile(t, path)
+	if _, err := l.CompactToResumable(context.Background(), &crashFile{File: f, after: planned.TagsetBlock.Offset}, checkpointPath); !isCrash(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+	l.Close()
+
+	// The series block is written concurrently & checkpointed before the
+	// error is returned.
+	if _, err := os.Stat(checkpointPath); err != nil {
+		t.Fatalf("expected checkpoint: %v", err)
+	}
+
+	// Restart using a new layout & ensure the series block is not written.
+	l = MustLayout(t, a)
+	defer l.Close()
+	f = MustOpenCompactFile(t, path)
+	defer f.Close()
+	rf := &recordFile{File: f}
+	if _, err := l.CompactToResumable(context.Background(), rf, checkpointPath); err != nil {
+		t.Fatal(err)
+	} else if rf.written(planned.SeriesBlock.Offset, planned.SeriesBlock.Size) {
+		t.Fatal("expected series block to be resumed")
+	} else if _, err := os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Fatalf("expected checkpoint to be removed: %v", err)
+	}
+
+	if buf, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, exp.Bytes()) {
+		t.Fatal("unexpected data")
+	}
+}
+
+// Ensure a series block which does not match its checkpoint is rewritten.
+func TestIndexFileLayout_CompactToResumable_Corrupt(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path, checkpointPath := filepath.Join(dir, "index"), filepath.Join(dir, "index.checkpoint")
+
+	a := MustGenerateIndexFiles(t)
+	var exp bytes.Buffer
+	if _, err := a.CompactTo(&exp, M, K); err != nil {
+		t.Fatal(err)
+	}
+
+	l := MustLayout(t, a)
+	defer l.Close()
+	planned := l.Trailer()
+
+	f := MustOpenCompactFile(t, path)
+	defer f.Close()
+	if _, err := l.CompactToResumable(context.Background(), &crashFile{File: f, after: planned.TagsetBlock.Offset}, checkpointPath); !isCrash(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Corrupt a byte in the series block.
+	if _, err := f.WriteAt([]byte{0xFF}, planned.SeriesBlock.Offset+planned.SeriesBlock.Size/2); err != nil {
+		t.Fatal(err)
+	}
+
+	rf := &recordFile{File: f}
+	if _, err := l.CompactToResumable(context.Background(), rf, checkpointPath); err != nil {
+		t.Fatal(err)
+	} else if !rf.written(planned.SeriesBlock.Offset, planned.SeriesBlock.Size) {
+		t.Fatal("expected series block to be rewritten")
+	}
+
+	if buf, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, exp.Bytes()) {
+		t.Fatal("unexpected data")
+	}
+}
+
+// Ensure a crash before the series block is complete leaves no checkpoint.
+func TestIndexFileLayout_CompactToResumable_SeriesBlockCrash(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path, checkpointPath := filepath.Join(dir, "index"), filepath.Join(dir, "index.checkpoint")
+
+	l := MustLayout(t, MustGenerateIndexFiles(t))
+	defer l.Close()
+	planned := l.Trailer()
+
+	f := MustOpenCompactFile(t, path)
+	defer f.Close()
+	if _, err := l.CompactToResumable(context.Background(), &crashFile{File: f, after: planned.SeriesBlock.Offset + 1}, checkpointPath); !isCrash(err) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Fatalf("unexpected checkpoint: %v", err)
+	}
+}
+
+// Ensure a resumable compaction to a file can be opened.
+func TestIndexFiles_CompactToFileResumable(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	a := MustGenerateIndexFiles(t)
+	n, err := a.CompactToFileResumable(context.Background(), path, M, K, false, tsi1.CompactOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := tsi1.NewIndexFile()
+	f.SetPath(path)
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if f.Size() != n {
+		t.Fatalf("unexpected size: %d, expected %d", f.Size(), n)
+	} else if err := a.VerifyCompaction(f); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(path + tsi1.TempFileExt + tsi1.CompactCheckpointExt); !os.IsNotExist(err) {
+		t.Fatalf("unexpected checkpoint: %v", err)
+	}
+
+	if _, err := a.CompactToFileResumable(context.Background(), path, M, K, false, tsi1.CompactOptions{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// MustGenerateIndexFiles returns a set of two generated index files.
+func MustGenerateIndexFiles(tb testing.TB) tsi1.IndexFiles {
+	f0, err := GenerateIndexFile(4, 3, 3)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	f1, err := GenerateIndexFile(2, 3, 4)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tsi1.IndexFiles{f1, f0}
+}
+
+// MustLayout returns the layout of a compaction of a.
+func MustLayout(tb testing.TB, a tsi1.IndexFiles) *tsi1.IndexFileLayout {
+	l, err := a.Layout(M, K, tsi1.CompactOptions{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return l
+}
+
+// MustOpenCompactFile opens path for a resumable compaction.
+func MustOpenCompactFile(tb testing.TB, path string) *os.File {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return f
+}
+
+// isCrash returns true if a compaction failed because of crashFile.
+func isCrash(err error) bool {
+	if e, ok := err.(*tsi1.CompactError); ok {
+		err = e.Err
+	}
+	return err == errCrash
+}
+
+// crashFile fails every write which extends past an offset.
+type crashFile struct {
+	*os.File
+	after int64
+}
+
+func (f *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > f.after {
+		return 0, errCrash
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// recordFile records the ranges written to a file.
+type recordFile struct {
+	*os.File
+	mu     sync.Mutex
+	ranges [][2]int64
+}
+
+func (f *recordFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	f.ranges = append(f.ranges, [2]int64{off, off + int64(len(p))})
+	f.mu.Unlock()
+	return f.File.WriteAt(p, off)
+}
+
+// written returns true if any byte in the range was written.
+func (f *recordFile) written(off, size int64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.ranges {
+		if r[0] < off+size && r[1] > off {
+			return true
+		}
+	}
+	return false
+}
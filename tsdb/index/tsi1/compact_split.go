@@ -0,0 +1,155 @@
+package tsi1
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CompactSplit merges all index files like CompactToFileWithOptions but
+// splits the output into files of at most maxSize bytes, such as to keep each
+// file small enough to map on constrained hosts or to read files in parallel.
+// Files are written to the paths returned by nextPath, which is called once
+// per file, and the paths are returned in measurement order.
+//
+// The output is split on measurement boundaries so each file is
+// self-contained: every series, tag & tombstone of a measurement is written to
+// the same file. The measurements are halved until the planned size of each
+// range fits, so the files are planned with Layout once per halving. Every
+// file has its own bloom filter & sketches so splitting adds to the total
+// size. A single measurement larger than maxSize is written to its own file,
+// which exceeds the limit.
+//
+// If any file fails then the files already written are removed.
+func (p IndexFiles) CompactSplit(ctx context.Context, nextPath func() string, m, k uint64, maxSize int64, opt CompactOptions) (paths []string, err error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid max file size: %d", maxSize)
+	} else if opt.SeriesOffsetTable != nil {
+		return nil, errors.New("series offset table not supported by split compactions")
+	}
+
+	// Every file measures the age of tombstones from the same time.
+	if opt.Now.IsZero() {
+		opt.Now = time.Now()
+	}
+
+	ranges, err := p.splitMeasurementRanges(ctx, m, k, maxSize, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			for _, path := range paths {
+				os.Remove(path)
+			}
+			paths = nil
+		}
+	}()
+
+	for _, rng := range ranges {
+		path := nextPath()
+
+		var info indexCompactInfo
+		info.names = rng
+		if _, _, err := p.compactToFile(ctx, path, m, k, false, opt, &info); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// splitMeasurementRanges returns consecutive ranges covering every
+// measurement whose planned compactions are at most maxSize bytes, unless the
+// range holds a single measurement.
+func (p IndexFiles) splitMeasurementRanges(ctx context.Context, m, k uint64, maxSize int64, opt CompactOptions) ([]measurementRange, error) {
+	var names [][]byte
+	info := indexCompactInfo{opt: opt}
+	if mitr := p.measurementIterator(); mitr != nil {
+		for e := mitr.Next(); e != nil; e = mitr.Next() {
+			if !p.dropMeasurement(e, &info) {
+				names = append(names, copyBytes(e.Name()))
+			}
+		}
+	}
+	if len(names) == 0 {
+		return []measurementRange{{}}, nil
+	}
+
+	var split func(i, j int, dst []measurementRange) ([]measurementRange, error)
+	split = func(i, j int, dst []measurementRange) ([]measurementRange, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// The outer ranges are unbounded so dropped measurements sorting
+		// before the first or after the last name are still dropped.
+		var rng measurementRange
+		if i > 0 {
+			rng.min = names[i]
+		}
+		if j < len(names) {
+			rng.max = names[j]
+		}
+
+		if j-i > 1 {
+			l, err := p.layout(m, k, opt, rng)
+			if err != nil {
+				return nil, err
+			}
+			size := l.Size()
+			if err := l.Close(); err != nil {
+				return nil, err
+			} else if size > maxSize {
+				mid := i + (j-i)/2
+				if dst, err = split(i, mid, dst); err != nil {
+					return nil, err
+				}
+				return split(mid, j, dst)
+			}
+		}
+		return append(dst, rng), nil
+	}
+	return split(0, len(names), nil)
+}
+
+// measurementRange is a range of measurement names from min, inclusive, to
+// max, exclusive. A nil bound is unbounded.
+type measurementRange struct {
+	min, max []byte
+}
+
+// all returns true if the range is unbounded.
+func (r measurementRange) all() bool { return r.min == nil && r.max == nil }
+
+// contains returns true if name is within the range.
+func (r measurementRange) contains(name []byte) bool {
+	return (r.min == nil || bytes.Compare(name, r.min) >= 0) && !r.past(name)
+}
+
+// past returns true if name sorts after the range.
+func (r measurementRange) past(name []byte) bool {
+	return r.max != nil && bytes.Compare(name, r.max) >= 0
+}
+
+// measurementRangeIterator returns the measurements of itr within a range.
+type measurementRangeIterator struct {
+	itr MeasurementIterator
+	rng measurementRange
+}
+
+// Next returns the next measurement in the range.
+func (itr *measurementRangeIterator) Next() MeasurementElem {
+	for e := itr.itr.Next(); e != nil; e = itr.itr.Next() {
+		if itr.rng.past(e.Name()) {
+			return nil
+		} else if itr.rng.contains(e.Name()) {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package tsi1_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure a compaction split by size writes every measurement to exactly one
+// file & the files merge to the same contents.
+func TestIndexFiles_CompactSplit(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	a := MustGenerateIndexFiles(t)
+	size, err := a.EstimateSize(M, K)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		maxSize int64
+		fileN   int
+	}{
+		{maxSize: size, fileN: 1},
+		{maxSize: size * 3 / 4},
+		{maxSize: 1, fileN: 4},
+	} {
+		var id int
+		nextPath := func() string {
+			id++
+			return filepath.Join(dir, fmt.Sprintf("%d-%s", tt.maxSize, tsi1.FormatIndexFileName(id, 1)))
+		}
+
+		paths, err := a.CompactSplit(context.Background(), nextPath, M, K, tt.maxSize, tsi1.CompactOptions{})
+		if err != nil {
+			t.Fatal(err)
+		} else if tt.fileN != 0 && len(paths) != tt.fileN {
+			t.Fatalf("%d: unexpected file count: %d", tt.maxSize, len(paths))
+		} else if tt.fileN == 0 && len(paths) < 2 {
+			t.Fatalf("%d: unexpected file count: %d", tt.maxSize, len(paths))
+		}
+
+		files := make(tsi1.IndexFiles, len(paths))
+		seen := make(map[string]int)
+		for i, path := range paths {
+			f := tsi1.NewIndexFile()
+			f.SetPath(path)
+			if err := f.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			files[i] = f
+
+			if f.Size() > tt.maxSize && f.MeasurementN() > 1 {
+				t.Fatalf("%d: file %d too large: %d", tt.maxSize, i, f.Size())
+			}
+
+			itr := f.MeasurementIterator()
+			for e := itr.Next(); e != nil; e = itr.Next() {
+				seen[string(e.Name())]++
+			}
+		}
+
+		if len(seen) != 4 {
+			t.Fatalf("%d: unexpected measurements: %v", tt.maxSize, seen)
+		}
+		for name, n := range seen {
+			if n != 1 {
+				t.Fatalf("%d: measurement %s in %d files", tt.maxSize, name, n)
+			}
+		}
+
+		// Files are in measurement order so the newest-first order of the
+		// merge does not matter.
+		if ok, diff := a.Equal(files); !ok {
+			t.Fatalf("%d: %s", tt.maxSize, diff)
+		}
+	}
+}
+
+// Ensure tombstoned measurements are dropped from whichever file covers them
+// & files written before a failure are removed.
+func TestIndexFiles_CompactSplit_DropTombstones(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("a"), Tags: models.NewTags(map[string]string{"host": "a"})},
+		{Name: []byte("b"), Tags: models.NewTags(map[string]string{"host": "a"})},
+		{Name: []byte("c"), Tags: models.NewTags(map[string]string{"host": "a"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f}
+
+	var id int
+	nextPath := func() string {
+		id++
+		return filepath.Join(dir, tsi1.FormatIndexFileName(id, 1))
+	}
+	paths, err := a.CompactSplit(context.Background(), nextPath, M, K, 1, tsi1.CompactOptions{DropTombstones: true})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(paths) != 2 {
+		t.Fatalf("unexpected file count: %d", len(paths))
+	}
+
+	for i, path := range paths {
+		f := tsi1.NewIndexFile()
+		f.SetPath(path)
+		if err := f.Open(); err != nil {
+			t.Fatal(err)
+		}
+		itr := f.SeriesIterator()
+		if e := itr.Next(); e == nil || string(e.Name()) != []string{"b", "c"}[i] {
+			t.Fatalf("%d: unexpected series: %v", i, e)
+		} else if e := itr.Next(); e != nil {
+			t.Fatalf("%d: unexpected series: %s", i, e.Name())
+		}
+		f.Close()
+	}
+
+	// The second path already exists so the first file is removed.
+	fresh := filepath.Join(dir, "fresh")
+	id = 0
+	nextPath = func() string {
+		if id++; id == 1 {
+			return fresh
+		}
+		return paths[0]
+	}
+	if _, err := a.CompactSplit(context.Background(), nextPath, M, K, 1, tsi1.CompactOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if _, err := os.Stat(fresh); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be removed: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package tsi1
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// CompactionInput combines a log file with index files so they are compacted
+// as one logical set of files. The log file is newer than every index file so
+// its series & tombstones take precedence.
+//
+// Unlike a FileSet, the iterators include tombstoned elements so a
+// compaction carries deletions forward to files older than the input.
+type CompactionInput struct {
+	logFile    *LogFile
+	indexFiles IndexFiles
+}
+
+// NewCompactionInput returns the input for compacting logFile & files, which
+// must be ordered newest first. The log file may be nil. The caller must hold
+// a reference to every file while the input is in use.
+func NewCompactionInput(logFile *LogFile, files IndexFiles) *CompactionInput {
+	return &CompactionInput{logFile: logFile, indexFiles: files}
+}
+
+// Files returns the files of the input, newest first.
+func (in *CompactionInput) Files() []File {
+	var a []File
+	if in.logFile != nil {
+		a = append(a, in.logFile)
+	}
+	return append(a, in.indexFiles.Files()...)
+}
+
+// Retain adds a reference count to all files.
+func (in *CompactionInput) Retain() {
+	for _, f := range in.Files() {
+		f.Retain()
+	}
+}
+
+// Release removes a reference count from all files.
+func (in *CompactionInput) Release() {
+	for _, f := range in.Files() {
+		f.Release()
+	}
+}
+
+// MeasurementIterator returns an iterator over the measurements of every
+// file, including tombstoned measurements.
+func (in *CompactionInput) MeasurementIterator() MeasurementIterator {
+	var a []MeasurementIterator
+	for _, f := range in.Files() {
+		if itr := f.MeasurementIterator(); itr != nil {
+			a = append(a, itr)
+		}
+	}
+	return MergeMeasurementIterators(a...)
+}
+
+// SeriesIterator returns an iterator over the series of every file, including
+// tombstoned series.
+func (in *CompactionInput) SeriesIterator() SeriesIterator {
+	var a []SeriesIterator
+	for _, f := range in.Files() {
+		if itr := f.SeriesIterator(); itr != nil {
+			a = append(a, itr)
+		}
+	}
+	return MergeSeriesIterators(a...)
+}
+
+// MeasurementSeriesIterator returns an iterator over the series of a
+// measurement in every file, including tombstoned series.
+func (in *CompactionInput) MeasurementSeriesIterator(name []byte) SeriesIterator {
+	var a []SeriesIterator
+	for _, f := range in.Files() {
+		if itr := f.MeasurementSeriesIterator(name); itr != nil {
+			a = append(a, itr)
+		}
+	}
+	return MergeSeriesIterators(a...)
+}
+
+// TagKeyIterator returns an iterator over the tag keys of a measurement in
+// every file, including tombstoned keys.
+func (in *CompactionInput) TagKeyIterator(name []byte) TagKeyIterator {
+	var a []TagKeyIterator
+	for _, f := range in.Files() {
+		if itr := f.TagKeyIterator(name); itr != nil {
+			a = append(a, itr)
+		}
+	}
+	return MergeTagKeyIterators(a...)
+}
+
+// CompactTo merges the log file & index files and writes them to w.
+func (in *CompactionInput) CompactTo(w io.Writer, m, k uint64) (n int64, err error) {
+	return in.CompactToWithOptions(context.Background(), w, m, k, CompactOptions{})
+}
+
+// CompactToWithOptions merges the log file & index files and writes them to
+// w using the settings in opt, like IndexFiles.CompactToWithOptions.
+//
+// The log file is first compacted in memory to a temporary index file so the
+// memory used is about the size of the log file.
+func (in *CompactionInput) CompactToWithOptions(ctx context.Context, w io.Writer, m, k uint64, opt CompactOptions) (n int64, err error) {
+	if in.logFile == nil {
+		return in.indexFiles.CompactToWithOptions(ctx, w, m, k, opt)
+	}
+
+	var buf bytes.Buffer
+	if _, err := in.logFile.CompactTo(&buf, m, k); err != nil {
+		return 0, err
+	}
+
+	f := NewIndexFile()
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	files := append(IndexFiles{f}, in.indexFiles...)
+	return files.CompactToWithOptions(ctx, w, m, k, opt)
+}
@@ -0,0 +1,92 @@
+package tsi1_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure a log file & index files are merged with the log file taking
+// precedence for tombstones.
+func TestCompactionInput(t *testing.T) {
+	f := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+
+	// The log file deletes a series of the index file & adds a measurement.
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"host": "a"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+
+	in := tsi1.NewCompactionInput(lf.LogFile, tsi1.IndexFiles{f})
+	if files := in.Files(); len(files) != 2 || files[0] != lf.LogFile || files[1] != f {
+		t.Fatalf("unexpected files: %v", files)
+	}
+
+	var series []string
+	itr := in.SeriesIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		s := string(models.MakeKey(e.Name(), e.Tags()))
+		if e.Deleted() {
+			s += " deleted"
+		}
+		series = append(series, s)
+	}
+	if exp := []string{"cpu,region=east", "cpu,region=west deleted", "disk,host=a", "mem,region=east"}; !reflect.DeepEqual(series, exp) {
+		t.Fatalf("unexpected series: %v", series)
+	}
+
+	var names []string
+	mitr := in.MeasurementIterator()
+	for e := mitr.Next(); e != nil; e = mitr.Next() {
+		names = append(names, string(e.Name()))
+	}
+	if !reflect.DeepEqual(names, []string{"cpu", "disk", "mem"}) {
+		t.Fatalf("unexpected measurements: %v", names)
+	}
+
+	if kitr := in.TagKeyIterator([]byte("disk")); kitr == nil {
+		t.Fatal("expected tag keys")
+	} else if e := kitr.Next(); e == nil || string(e.Key()) != "host" {
+		t.Fatalf("unexpected tag key: %v", e)
+	} else if e := kitr.Next(); e != nil {
+		t.Fatalf("unexpected tag key: %s", e.Key())
+	}
+
+	// The compacted file keeps the tombstone.
+	var buf bytes.Buffer
+	if _, err := in.CompactTo(&buf, M, K); err != nil {
+		t.Fatal(err)
+	}
+	var other tsi1.IndexFile
+	if err := other.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if exists, tombstoned := other.HasSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "west"}), nil); !exists || !tombstoned {
+		t.Fatalf("unexpected series: exists=%v, tombstoned=%v", exists, tombstoned)
+	} else if exists, tombstoned := other.HasSeries([]byte("disk"), models.NewTags(map[string]string{"host": "a"}), nil); !exists || tombstoned {
+		t.Fatalf("unexpected series: exists=%v, tombstoned=%v", exists, tombstoned)
+	} else if exists, tombstoned := other.HasSeries([]byte("mem"), models.NewTags(map[string]string{"region": "east"}), nil); !exists || tombstoned {
+		t.Fatalf("unexpected series: exists=%v, tombstoned=%v", exists, tombstoned)
+	}
+
+	// Without a log file the index files are compacted alone.
+	buf.Reset()
+	if _, err := tsi1.NewCompactionInput(nil, tsi1.IndexFiles{f}).CompactTo(&buf, M, K); err != nil {
+		t.Fatal(err)
+	} else if err := other.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if exists, tombstoned := other.HasSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "west"}), nil); !exists || tombstoned {
+		t.Fatalf("unexpected series: exists=%v, tombstoned=%v", exists, tombstoned)
+	}
+}
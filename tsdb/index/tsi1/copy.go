@@ -0,0 +1,106 @@
+package tsi1
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// CopyChunkSize is the maximum number of bytes read & written at a time by
+// CopyIndexFile.
+const CopyChunkSize = 64 * 1024
+
+// CopyIndexFile copies the index file at srcPath to dst byte for byte, such as
+// to back up or copy a shard, and verifies the file in the same pass. The
+// signature & trailer are checked before anything is written and the checksum
+// of each block is checked as soon as the block has been copied. Returns the
+// number of bytes written to dst, including when an error occurs mid-stream.
+// The series block trailer is also read so a block with an unsupported codec
+// fails with ErrUnsupportedSeriesBlockCodec before anything is written.
+//
+// Returns *ErrChecksumMismatch if a block is corrupt. The data of the corrupt
+// block has already been written by then, however, the copy stops before the
+// data following the block so dst never receives a complete file with bad
+// data. The caller must discard dst on error. Files without checksums, which
+// were written before version 2, only have their signature & trailer checked.
+func CopyIndexFile(dst io.Writer, srcPath string) (n int64, err error) {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+
+	t, err := readIndexFileTrailerFrom(f, size)
+	if err != nil {
+		return 0, err
+	} else if err := t.validate(srcPath, size); err != nil {
+		return 0, err
+	}
+
+	// Reject series blocks which cannot be read back before writing.
+	if st, err := readSeriesBlockTrailerAt(f, &t); err != nil {
+		return 0, err
+	} else if !st.Codec.valid() {
+		return 0, ErrUnsupportedSeriesBlockCodec
+	}
+
+	var blks []indexFileBlock
+	if t.Checksummed() {
+		blks = t.blocks()
+	}
+
+	// Verify each block once all of its data has been copied. Chunks never
+	// span the start or end of a block so the checksum only covers the block.
+	h := crc32.NewIEEE()
+	verify := func() error {
+		for len(blks) > 0 && n == blks[0].offset+blks[0].size {
+			if checksum := h.Sum32(); checksum != blks[0].checksum {
+				return &ErrChecksumMismatch{Path: srcPath, Block: blks[0].name, Expected: blks[0].checksum, Actual: checksum}
+			}
+			h.Reset()
+			blks = blks[1:]
+		}
+		return nil
+	}
+
+	r := io.NewSectionReader(f, 0, size)
+	buf := make([]byte, CopyChunkSize)
+	for n < size {
+		if err := verify(); err != nil {
+			return n, err
+		}
+
+		end, inBlock := size, false
+		if len(blks) > 0 {
+			if n < blks[0].offset {
+				end = blks[0].offset
+			} else {
+				end, inBlock = blks[0].offset+blks[0].size, true
+			}
+		}
+
+		chunk := buf
+		if int64(len(chunk)) > end-n {
+			chunk = chunk[:end-n]
+		}
+		if _, err := io.ReadFull(r, chunk); err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return n, err
+		}
+
+		if inBlock {
+			h.Write(chunk)
+		}
+		if err := writeTo(dst, chunk, &n); err != nil {
+			return n, err
+		}
+	}
+	return n, verify()
+}
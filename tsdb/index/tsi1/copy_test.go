@@ -0,0 +1,85 @@
+package tsi1_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure an index file is copied verbatim & corruption stops the copy.
+func TestCopyIndexFile(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	data := MustCompactIndexFileData(t)
+	path := filepath.Join(dir, "index.tsi")
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := tsi1.CopyIndexFile(&buf, path); err != nil {
+		t.Fatal(err)
+	} else if n != int64(len(data)) {
+		t.Fatalf("unexpected bytes copied: %d", n)
+	} else if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("unexpected data")
+	}
+
+	// Corrupt the first byte of the tagset block. The copy stops at the end of
+	// the tagset block.
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[trailer.TagsetBlock.Offset] ^= 0xFF
+	if err := ioutil.WriteFile(path, corrupt, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	n, err := tsi1.CopyIndexFile(&buf, path)
+	if e, ok := err.(*tsi1.ErrChecksumMismatch); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if e.Block != "tagset" || e.Path != path {
+		t.Fatalf("unexpected mismatch: %s %s", e.Block, e.Path)
+	} else if end := trailer.TagsetBlock.Offset + trailer.TagsetBlock.Size; n != end || int64(buf.Len()) != end {
+		t.Fatalf("unexpected bytes copied: %d/%d, expected %d", n, buf.Len(), end)
+	}
+
+	// A bad signature is rejected before anything is copied.
+	corrupt = append([]byte(nil), data...)
+	corrupt[0] = 'X'
+	if err := ioutil.WriteFile(path, corrupt, 0666); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if n, err := tsi1.CopyIndexFile(&buf, path); err != tsi1.ErrInvalidIndexFile {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n != 0 || buf.Len() != 0 {
+		t.Fatalf("unexpected bytes copied: %d", n)
+	}
+
+	// A series block with an unsupported codec is rejected before anything
+	// is copied.
+	corrupt = append([]byte(nil), data...)
+	corrupt[trailer.SeriesBlock.Offset+trailer.SeriesBlock.Size-tsi1.SeriesBlockTrailerSize] = 0xFF
+	if err := ioutil.WriteFile(path, corrupt, 0666); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if n, err := tsi1.CopyIndexFile(&buf, path); err != tsi1.ErrUnsupportedSeriesBlockCodec {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n != 0 || buf.Len() != 0 {
+		t.Fatalf("unexpected bytes copied: %d", n)
+	}
+
+	if _, err := tsi1.CopyIndexFile(&buf, filepath.Join(dir, "no_such_file")); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -40,7 +40,10 @@ Log File Layout
 The write-ahead file that series initially are inserted into simply appends
 all new operations sequentially. It is simply composed of a series of log
 entries. An entry contains a flag to specify the operation type, the measurement
-name, the tag set, and a checksum.
+name, the tag set, and a checksum. Series tombstones written since the
+LogEntryTimeFlag was added also hold their deletion time, as a big-endian
+int64 of nanoseconds since the epoch, between the tag set and the checksum.
+Older entries without the flag have no deletion time.
 
 	┏━━━━━━━━━LogEntry━━━━━━━━━┓
 	┃ ┌──────────────────────┐ ┃
@@ -68,6 +71,23 @@ The index file is composed of 3 main block types: one series block, one or more
 tag blocks, and one measurement block. At the end of the index file is a
 trailer that records metadata such as the offsets to these blocks.
 
+Since version 2, the trailer also records a CRC32 checksum of the series block,
+of the contiguous region of tag blocks, and of the measurement block, followed
+by a checksum of the trailer itself. Version 1 files have no checksums and are
+treated as unverified. Version 3 added the generation and level of the file.
+
+Version 4 added the tombstone block, which follows the measurement block and
+is recorded in the trailer after the level with its own checksum. It holds the
+deletion time of series tombstones as fixed size entries of a series id and a
+big-endian int64 of nanoseconds since the epoch, sorted by series id.
+Tombstones without a recorded time have no entry. Files from earlier versions
+are still read; their tombstones have no deletion time.
+
+Version 5 records the codec of the series keys as the first field of the
+series block trailer. Earlier series block trailers have no codec; their
+prefix-compressed keys are still flagged on each element. The high bit of the
+codec is set when the series are ordered by hash.
+
 
 Series Block Layout
 
@@ -77,6 +97,12 @@ periodically so that memory size is limited at write time. Once all the series
 and hash indexes have been written then a list of index entries are written
 so that hash indexes can be looked up via binary search.
 
+Blocks may instead be written ordered by hash. The series before each hash
+index are then written in the order of the index slots rather than by key,
+while each hash index still covers the range of keys from its minimum key to
+the next index's. Readers sort the series of each index, & the series ids of
+each measurement & tag value, by key when iterating them.
+
 The end of the block contains two HyperLogLog++ sketches which track the
 estimated number of created series and deleted series. After the sketches is
 a trailer which contains metadata about the block.
@@ -170,6 +196,11 @@ measurements and their tags.
 This block also contains HyperLogLog++ sketches for new and deleted
 measurements.
 
+Blocks written with version 2 replace the hash index with a radix trie over
+the measurement names. The trie only stores the positions and bytes where names
+diverge so it is smaller than the hash index for names with long shared
+prefixes and it can seek directly to the first measurement with a prefix.
+
 	┏━━━━Measurement Block━━━━━┓
 	┃ ┌──────────────────────┐ ┃
 	┃ │     Measurement      │ ┃
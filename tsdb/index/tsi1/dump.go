@@ -0,0 +1,272 @@
+package tsi1
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// DumpFormat specifies the output format of IndexFiles.DumpTo.
+type DumpFormat int
+
+const (
+	// DumpFormatText writes one tab-indented element per line. Measurements
+	// are followed by their tag keys, tag values & series. Tombstoned
+	// elements end with " deleted".
+	DumpFormatText DumpFormat = iota
+
+	// DumpFormatJSON writes one JSON object per line. Each object has a
+	// "type" of "measurement", "tagKey", "tagValue" or "series".
+	DumpFormatJSON
+)
+
+// String returns the name of the format.
+func (f DumpFormat) String() string {
+	switch f {
+	case DumpFormatText:
+		return "text"
+	case DumpFormatJSON:
+		return "json"
+	default:
+		return fmt.Sprintf("DumpFormat(%d)", int(f))
+	}
+}
+
+// DumpTo writes the logical contents of the files to w in the given format.
+// Elements are merged across the files, including tombstoned elements, and
+// are streamed from the iterators so memory use does not grow with the size
+// of the files.
+func (p IndexFiles) DumpTo(w io.Writer, format DumpFormat) error {
+	var enc dumpEncoder
+	switch format {
+	case DumpFormatText:
+		enc = &textDumpEncoder{}
+	case DumpFormatJSON:
+		enc = &jsonDumpEncoder{}
+	default:
+		return fmt.Errorf("unknown dump format: %s", format)
+	}
+
+	bw := bufio.NewWriter(w)
+	enc.init(bw)
+
+	mitr := p.measurementIterator()
+	for m := nextMeasurementElem(mitr); m != nil; m = mitr.Next() {
+		name := m.Name()
+		if err := enc.measurement(name, m.Deleted()); err != nil {
+			return err
+		}
+
+		// Write tag keys & values.
+		kitr, err := p.tagKeyIterator(name)
+		if err != nil {
+			return err
+		}
+		for k := nextTagKeyElem(kitr); k != nil; k = kitr.Next() {
+			if err := enc.tagKey(name, k.Key(), k.Deleted()); err != nil {
+				return err
+			}
+
+			vitr, err := p.tagValueIterator(name, k.Key())
+			if err != nil {
+				return err
+			}
+			for v := nextTagValueElem(vitr); v != nil; v = vitr.Next() {
+				if err := enc.tagValue(name, k.Key(), v.Value(), v.Deleted()); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Write series.
+		sitr := p.measurementSeriesIterator(name)
+		for e := nextSeriesElem(sitr); e != nil; e = sitr.Next() {
+			if err := enc.series(e.Name(), e.Tags(), e.Deleted()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// dumpEncoder writes the elements of a dump.
+type dumpEncoder interface {
+	init(w io.Writer)
+	measurement(name []byte, deleted bool) error
+	tagKey(name, key []byte, deleted bool) error
+	tagValue(name, key, value []byte, deleted bool) error
+	series(name []byte, tags models.Tags, deleted bool) error
+}
+
+// textDumpEncoder writes elements in DumpFormatText.
+type textDumpEncoder struct {
+	w io.Writer
+}
+
+func (enc *textDumpEncoder) init(w io.Writer) { enc.w = w }
+
+func (enc *textDumpEncoder) measurement(name []byte, deleted bool) error {
+	return enc.write("measurement %s", name, deleted)
+}
+
+func (enc *textDumpEncoder) tagKey(name, key []byte, deleted bool) error {
+	return enc.write("\ttagkey %s", key, deleted)
+}
+
+func (enc *textDumpEncoder) tagValue(name, key, value []byte, deleted bool) error {
+	return enc.write("\t\ttagvalue %s", value, deleted)
+}
+
+func (enc *textDumpEncoder) series(name []byte, tags models.Tags, deleted bool) error {
+	return enc.write("\tseries %s", models.MakeKey(name, tags), deleted)
+}
+
+func (enc *textDumpEncoder) write(format string, v []byte, deleted bool) error {
+	if deleted {
+		format += " deleted"
+	}
+	_, err := fmt.Fprintf(enc.w, format+"\n", v)
+	return err
+}
+
+// jsonDumpEncoder writes elements in DumpFormatJSON.
+type jsonDumpEncoder struct {
+	enc *json.Encoder
+}
+
+// jsonDumpElem is a single element in DumpFormatJSON.
+type jsonDumpElem struct {
+	Type        string            `json:"type"`
+	Name        string            `json:"name,omitempty"`
+	Measurement string            `json:"measurement,omitempty"`
+	Key         string            `json:"key,omitempty"`
+	Value       *string           `json:"value,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Deleted     bool              `json:"deleted"`
+}
+
+func (enc *jsonDumpEncoder) init(w io.Writer) { enc.enc = json.NewEncoder(w) }
+
+func (enc *jsonDumpEncoder) measurement(name []byte, deleted bool) error {
+	return enc.enc.Encode(jsonDumpElem{Type: "measurement", Name: string(name), Deleted: deleted})
+}
+
+func (enc *jsonDumpEncoder) tagKey(name, key []byte, deleted bool) error {
+	return enc.enc.Encode(jsonDumpElem{Type: "tagKey", Measurement: string(name), Key: string(key), Deleted: deleted})
+}
+
+func (enc *jsonDumpEncoder) tagValue(name, key, value []byte, deleted bool) error {
+	v := string(value)
+	return enc.enc.Encode(jsonDumpElem{Type: "tagValue", Measurement: string(name), Key: string(key), Value: &v, Deleted: deleted})
+}
+
+func (enc *jsonDumpEncoder) series(name []byte, tags models.Tags, deleted bool) error {
+	return enc.enc.Encode(jsonDumpElem{Type: "series", Name: string(name), Tags: tags.Map(), Deleted: deleted})
+}
+
+// ErrInvalidFileSignature is returned by ReadTrailerJSON when a file does not
+// begin with the index file signature.
+type ErrInvalidFileSignature struct {
+	Path      string
+	Signature []byte // leading bytes of the file
+}
+
+// Error returns the error message.
+func (e *ErrInvalidFileSignature) Error() string {
+	return fmt.Sprintf("not an index file: %s: signature %q, expected %q", e.Path, e.Signature, FileSignature)
+}
+
+// trailerJSON is the JSON encoding of an index file trailer.
+type trailerJSON struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Version     int    `json:"version"`
+	Generation  uint64 `json:"generation"`
+	Level       int    `json:"level"`
+	Checksummed bool   `json:"checksummed"`
+
+	SeriesBlock      trailerBlockJSON `json:"seriesBlock"`
+	TagsetBlock      trailerBlockJSON `json:"tagsetBlock"`
+	MeasurementBlock trailerBlockJSON `json:"measurementBlock"`
+	TombstoneBlock   trailerBlockJSON `json:"tombstoneBlock"`
+
+	// Counts of live & tombstoned series from the series block trailer.
+	SeriesN    int32 `json:"seriesN"`
+	TombstoneN int32 `json:"tombstoneN"`
+
+	// Codec of the series keys & order of the series from the series block
+	// trailer. Omitted for files before version 5, which do not record them.
+	SeriesCodec string `json:"seriesCodec,omitempty"`
+	SeriesOrder string `json:"seriesOrder,omitempty"`
+}
+
+// trailerBlockJSON is the JSON encoding of a block in the trailer.
+type trailerBlockJSON struct {
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// ReadTrailerJSON returns the trailer of the index file at path as indented
+// JSON, for tools that inspect index files. Only the signature, the trailer &
+// the series block trailer are read. Returns *ErrInvalidFileSignature if the
+// file is not an index file & *ErrBlockOutOfBounds if the blocks of the
+// trailer are not within the file.
+func ReadTrailerJSON(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the signature first so other files are reported clearly.
+	sig := make([]byte, len(FileSignature))
+	if n, err := f.ReadAt(sig, 0); err != nil && err != io.EOF {
+		return nil, err
+	} else if !bytes.Equal(sig[:n], []byte(FileSignature)) {
+		return nil, &ErrInvalidFileSignature{Path: path, Signature: sig[:n]}
+	}
+
+	t, err := readIndexFileTrailerFrom(f, fi.Size())
+	if err != nil {
+		return nil, err
+	} else if err := t.validate(path, fi.Size()); err != nil {
+		return nil, err
+	}
+
+	v := trailerJSON{
+		Path:             path,
+		Size:             fi.Size(),
+		Version:          t.Version,
+		Generation:       t.Generation,
+		Level:            t.Level,
+		Checksummed:      t.Checksummed(),
+		SeriesBlock:      trailerBlockJSON{Offset: t.SeriesBlock.Offset, Size: t.SeriesBlock.Size, Checksum: t.SeriesBlock.Checksum},
+		TagsetBlock:      trailerBlockJSON{Offset: t.TagsetBlock.Offset, Size: t.TagsetBlock.Size, Checksum: t.TagsetBlock.Checksum},
+		MeasurementBlock: trailerBlockJSON{Offset: t.MeasurementBlock.Offset, Size: t.MeasurementBlock.Size, Checksum: t.MeasurementBlock.Checksum},
+		TombstoneBlock:   trailerBlockJSON{Offset: t.TombstoneBlock.Offset, Size: t.TombstoneBlock.Size, Checksum: t.TombstoneBlock.Checksum},
+	}
+
+	// Read the series counts & codec from the end of the series block.
+	if st, err := readSeriesBlockTrailerAt(f, &t); err == nil {
+		v.SeriesN, v.TombstoneN = st.SeriesN, st.TombstoneN
+		if t.Version >= IndexFileVersion5 {
+			v.SeriesCodec, v.SeriesOrder = st.Codec.String(), st.Order.String()
+		}
+	} else if err != ErrInvalidSeriesBlock {
+		return nil, err
+	}
+
+	return json.MarshalIndent(v, "", "  ")
+}
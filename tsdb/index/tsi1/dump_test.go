@@ -0,0 +1,158 @@
+package tsi1_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure index files can be dumped in each format.
+func TestIndexFiles_DumpTo(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"host": "a b"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	t.Run("Text", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := a.DumpTo(&buf, tsi1.DumpFormatText); err != nil {
+			t.Fatal(err)
+		} else if got, exp := buf.String(), `measurement cpu
+	tagkey region
+		tagvalue east
+		tagvalue north
+		tagvalue west
+	series cpu,region=east
+	series cpu,region=north
+	series cpu,region=west deleted
+measurement mem
+	tagkey host
+		tagvalue a b
+	series mem,host=a\ b
+`; got != exp {
+			t.Fatalf("unexpected output:\n%s", got)
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := a.DumpTo(&buf, tsi1.DumpFormatJSON); err != nil {
+			t.Fatal(err)
+		} else if got, exp := buf.String(), `{"type":"measurement","name":"cpu","deleted":false}
+{"type":"tagKey","measurement":"cpu","key":"region","deleted":false}
+{"type":"tagValue","measurement":"cpu","key":"region","value":"east","deleted":false}
+{"type":"tagValue","measurement":"cpu","key":"region","value":"north","deleted":false}
+{"type":"tagValue","measurement":"cpu","key":"region","value":"west","deleted":false}
+{"type":"series","name":"cpu","tags":{"region":"east"},"deleted":false}
+{"type":"series","name":"cpu","tags":{"region":"north"},"deleted":false}
+{"type":"series","name":"cpu","tags":{"region":"west"},"deleted":true}
+{"type":"measurement","name":"mem","deleted":false}
+{"type":"tagKey","measurement":"mem","key":"host","deleted":false}
+{"type":"tagValue","measurement":"mem","key":"host","value":"a b","deleted":false}
+{"type":"series","name":"mem","tags":{"host":"a b"},"deleted":false}
+`; got != exp {
+			t.Fatalf("unexpected output:\n%s", got)
+		}
+	})
+
+	if err := a.DumpTo(&bytes.Buffer{}, tsi1.DumpFormat(100)); err == nil || err.Error() != "unknown dump format: DumpFormat(100)" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the trailer of an index file can be read as JSON.
+func TestReadTrailerJSON(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	f := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(7, 2))
+	if _, err := (tsi1.IndexFiles{f}).CompactInto(context.Background(), path, M, K, 7, 2, tsi1.CompactOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := tsi1.ReadTrailerJSON(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		Path        string `json:"path"`
+		Size        int64  `json:"size"`
+		Version     int    `json:"version"`
+		Generation  uint64 `json:"generation"`
+		Level       int    `json:"level"`
+		Checksummed bool   `json:"checksummed"`
+		SeriesBlock struct {
+			Offset   int64  `json:"offset"`
+			Size     int64  `json:"size"`
+			Checksum uint32 `json:"checksum"`
+		} `json:"seriesBlock"`
+		MeasurementBlock struct {
+			Offset int64 `json:"offset"`
+			Size   int64 `json:"size"`
+		} `json:"measurementBlock"`
+		SeriesN     int32  `json:"seriesN"`
+		TombstoneN  int32  `json:"tombstoneN"`
+		SeriesCodec string `json:"seriesCodec"`
+		SeriesOrder string `json:"seriesOrder"`
+	}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		t.Fatal(err)
+	} else if v.Path != path || v.Size != int64(len(data)) || v.Version != tsi1.IndexFileVersion || !v.Checksummed {
+		t.Fatalf("unexpected trailer: %s", buf)
+	} else if v.Generation != 7 || v.Level != 2 {
+		t.Fatalf("unexpected generation/level: %d/%d", v.Generation, v.Level)
+	} else if v.SeriesBlock.Offset != trailer.SeriesBlock.Offset || v.SeriesBlock.Size != trailer.SeriesBlock.Size || v.SeriesBlock.Checksum != trailer.SeriesBlock.Checksum {
+		t.Fatalf("unexpected series block: %+v", v.SeriesBlock)
+	} else if v.MeasurementBlock.Offset != trailer.MeasurementBlock.Offset || v.MeasurementBlock.Size != trailer.MeasurementBlock.Size {
+		t.Fatalf("unexpected measurement block: %+v", v.MeasurementBlock)
+	} else if v.SeriesN != 2 || v.TombstoneN != 1 {
+		t.Fatalf("unexpected series counts: %d/%d", v.SeriesN, v.TombstoneN)
+	} else if v.SeriesCodec != "none" || v.SeriesOrder != "lexical" {
+		t.Fatalf("unexpected series codec/order: %s/%s", v.SeriesCodec, v.SeriesOrder)
+	}
+
+	// Other files are rejected by their signature.
+	other := filepath.Join(dir, "other")
+	if err := ioutil.WriteFile(other, []byte("TSM1"), 0666); err != nil {
+		t.Fatal(err)
+	} else if _, err := tsi1.ReadTrailerJSON(other); err == nil {
+		t.Fatal("expected error")
+	} else if e, ok := err.(*tsi1.ErrInvalidFileSignature); !ok || string(e.Signature) != "TSM1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := tsi1.ReadTrailerJSON(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+// +build linux
+
+package tsi1
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE. Blocks are reserved without changing
+// the reported size of the file.
+const fallocKeepSize = 0x01
+
+// fallocate reserves size bytes of f starting at off. Filesystems which do not
+// support preallocation are ignored.
+func fallocate(f *os.File, off, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, off, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package tsi1
+
+import "os"
+
+// fallocate is a no-op on platforms without preallocation support.
+func fallocate(f *os.File, off, size int64) error { return nil }
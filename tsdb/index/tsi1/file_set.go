@@ -221,6 +221,18 @@ func (fs *FileSet) TagKeyIterator(name []byte) TagKeyIterator {
 	return MergeTagKeyIterators(a...)
 }
 
+// LiveTagKeyIterator returns an iterator over the tag keys for a measurement
+// which have at least one live value. See FilterLiveTagKeyIterator.
+func (fs *FileSet) LiveTagKeyIterator(name []byte) TagKeyIterator {
+	return FilterLiveTagKeyIterator(fs.TagKeyIterator(name))
+}
+
+// TagKeyFileCounts returns the number of files containing each tag key of a
+// measurement. See IndexFiles.TagKeyFileCounts.
+func (fs *FileSet) TagKeyFileCounts(name []byte) map[string]int {
+	return tagKeyFileCounts(fs.TagKeyIterator(name))
+}
+
 // MeasurementTagKeysByExpr extracts the tag keys wanted by the expression.
 func (fs *FileSet) MeasurementTagKeysByExpr(name []byte, expr influxql.Expr) (map[string]struct{}, error) {
 	switch e := expr.(type) {
@@ -328,8 +340,8 @@ func (fs *FileSet) tagValuesByKeyAndExpr(name []byte, keys []string, expr influx
 // tagKeysByFilter will filter the tag keys for the measurement.
 func (fs *FileSet) tagKeysByFilter(name []byte, op influxql.Token, val []byte, regex *regexp.Regexp) map[string]struct{} {
 	ss := make(map[string]struct{})
-	itr := fs.TagKeyIterator(name)
-	for e := itr.Next(); e != nil; e = itr.Next() {
+	itr := fs.LiveTagKeyIterator(name)
+	for e := nextTagKeyElem(itr); e != nil; e = itr.Next() {
 		var matched bool
 		switch op {
 		case influxql.EQ:
@@ -362,6 +374,31 @@ func (fs *FileSet) TagKeySeriesIterator(name, key []byte) SeriesIterator {
 	return FilterUndeletedSeriesIterator(MergeSeriesIterators(a...))
 }
 
+// TagKeyExcludeValueSeriesIterator returns a series iterator for every value
+// of a key except excludeValue, such as for `key != 'value'` where the key
+// must be set. Series without the key are not returned.
+//
+// The series of each remaining value are merged so a series listed under more
+// than one value, such as by files written before & after its value changed,
+// is only returned once. The excluded value's series are never read.
+func (fs *FileSet) TagKeyExcludeValueSeriesIterator(name, key, excludeValue []byte) SeriesIterator {
+	vitr := fs.TagValueIterator(name, key)
+	if vitr == nil {
+		return nil
+	}
+
+	var itrs []SeriesIterator
+	for e := vitr.Next(); e != nil; e = vitr.Next() {
+		if e.Deleted() || bytes.Equal(e.Value(), excludeValue) {
+			continue
+		}
+		if itr := fs.TagValueSeriesIterator(name, key, e.Value()); itr != nil {
+			itrs = append(itrs, itr)
+		}
+	}
+	return FilterUndeletedSeriesIterator(MergeSeriesIterators(itrs...))
+}
+
 // HasTagKey returns true if the tag key exists.
 func (fs *FileSet) HasTagKey(name, key []byte) bool {
 	for _, f := range fs.files {
@@ -751,6 +788,7 @@ func (fs *FileSet) MeasurementSeriesKeysByExpr(name []byte, expr influxql.Expr,
 	} else if itr == nil {
 		return nil, nil
 	}
+	defer ReleaseSeriesIterator(itr)
 
 	// Iterate over all series and generate keys.
 	var keys [][]byte
@@ -919,13 +957,14 @@ func (fs *FileSet) buildFilters() error {
 
 	// Generate filters for each level.
 	fs.filters = make([]*bloom.Filter, len(fs.levels))
+	unfiltered := make([]bool, len(fs.levels))
 
 	// Merge filters at each level.
 	for _, f := range fs.files {
 		level := f.Level()
 
 		// Skip if file has no bloom filter.
-		if f.Filter() == nil {
+		if f.Filter() == nil || unfiltered[level] {
 			continue
 		}
 
@@ -935,6 +974,13 @@ func (fs *FileSet) buildFilters() error {
 			fs.filters[level] = bloom.NewFilter(lvl.M, lvl.K)
 		}
 
+		// Files compacted with a different filter size cannot be merged so
+		// the level is checked without a filter.
+		if filter := fs.filters[level]; filter.Len() != f.Filter().Len() || filter.K() != f.Filter().K() {
+			fs.filters[level], unfiltered[level] = nil, true
+			continue
+		}
+
 		// Merge filter.
 		if err := fs.filters[level].Merge(f.Filter()); err != nil {
 			return err
@@ -2,6 +2,7 @@ package tsi1_test
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/influxdata/influxdb/models"
@@ -265,6 +266,63 @@ func TestFileSet_TagKeyIterator(t *testing.T) {
 	})
 }
 
+// Ensure fileset can return the series of every value of a key except one.
+func TestFileSet_TagKeyExcludeValueSeriesIterator(t *testing.T) {
+	idx := MustOpenIndex()
+	defer idx.Close()
+
+	if err := idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "a"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "b"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "host": "c"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "host": "d"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "e"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "north", "host": "a"})},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add series in a second file & delete one.
+	if err := idx.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if err := idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north", "host": "f"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "host": "c"})},
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := idx.DropSeries(models.MakeKey([]byte("cpu"), models.NewTags(map[string]string{"region": "west", "host": "d"}))); err != nil {
+		t.Fatal(err)
+	}
+
+	idx.Run(t, func(t *testing.T) {
+		fs := idx.RetainFileSet()
+		defer fs.Release()
+
+		for _, tt := range []struct {
+			exclude string
+			exp     []string
+		}{
+			{exclude: "east", exp: []string{"[{host c} {region west}]", "[{host f} {region north}]"}},
+			{exclude: "west", exp: []string{"[{host a} {region east}]", "[{host b} {region east}]", "[{host f} {region north}]"}},
+			{exclude: "south", exp: []string{"[{host a} {region east}]", "[{host b} {region east}]", "[{host c} {region west}]", "[{host f} {region north}]"}},
+		} {
+			var a []string
+			if itr := fs.TagKeyExcludeValueSeriesIterator([]byte("cpu"), []byte("region"), []byte(tt.exclude)); itr != nil {
+				for e := itr.Next(); e != nil; e = itr.Next() {
+					a = append(a, e.Tags().String())
+				}
+			}
+			if !reflect.DeepEqual(a, tt.exp) {
+				t.Fatalf("unexpected series excluding %s: %v", tt.exclude, a)
+			}
+		}
+
+		if itr := fs.TagKeyExcludeValueSeriesIterator([]byte("cpu"), []byte("no_such_key"), nil); itr != nil {
+			t.Fatal("expected nil iterator")
+		}
+	})
+}
+
 var (
 	byteSliceResult [][]byte
 	tagsSliceResult []models.Tags
@@ -0,0 +1,50 @@
+package tsi1
+
+import (
+	"io"
+	"os"
+)
+
+// FileSystem opens index files for reading. It allows index files to be read
+// from somewhere other than the local disk, such as memory in tests or object
+// storage.
+type FileSystem interface {
+	// Open opens the named file for reading.
+	Open(name string) (ReadAtFile, error)
+}
+
+// ReadAtFile is a file opened by a FileSystem. *os.File implements it.
+type ReadAtFile interface {
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// OSFileSystem is a FileSystem backed by the local disk. Index files on the
+// local disk are memory mapped by IndexFile.Open so this is only needed where
+// a FileSystem is required.
+type OSFileSystem struct{}
+
+// Open opens the named file with os.Open.
+func (OSFileSystem) Open(name string) (ReadAtFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readAll reads the first size bytes of f starting at offset.
+func readAll(f io.ReaderAt, offset, size int64) ([]byte, error) {
+	if int64(int(size)) != size {
+		return nil, ErrInvalidIndexFile
+	}
+
+	data := make([]byte, size)
+	if n, err := f.ReadAt(data, offset); err == io.EOF && int64(n) == size {
+		return data, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,67 @@
+// +build gofuzz
+
+package tsi1
+
+// Fuzz targets for go-fuzz. Seeds for each target are kept in
+// testdata/fuzz/<target>/corpus and are also decoded by the package tests.
+// To fuzz the trailer, for example:
+//
+//	go-fuzz-build -func FuzzIndexFileTrailer github.com/influxdata/influxdb/tsdb/index/tsi1
+//	go-fuzz -bin tsi1-fuzz.zip -workdir testdata/fuzz/trailer
+//
+// Each target returns 1 if the input decoded & 0 otherwise. Series, tag keys
+// & tag values are decoded lazily and are not bounds checked so only the
+// headers of those blocks are fuzzed.
+
+// FuzzIndexFileTrailer decodes data as an index file trailer.
+func FuzzIndexFileTrailer(data []byte) int {
+	t, err := ReadIndexFileTrailer(data)
+	if err != nil {
+		return 0
+	} else if err := t.validate("", int64(len(data))); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzIndexFile decodes data as an index file.
+func FuzzIndexFile(data []byte) int {
+	var f IndexFile
+	if err := f.UnmarshalBinary(data); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzSeriesBlock decodes data as a series block.
+func FuzzSeriesBlock(data []byte) int {
+	var blk SeriesBlock
+	if err := blk.UnmarshalBinary(data); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzTagBlock decodes data as a tag block.
+func FuzzTagBlock(data []byte) int {
+	var blk TagBlock
+	if err := blk.UnmarshalBinary(data); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzMeasurementBlock decodes data as a measurement block & looks up every
+// measurement, which are checked when the block is decoded.
+func FuzzMeasurementBlock(data []byte) int {
+	var blk MeasurementBlock
+	if err := blk.UnmarshalBinary(data); err != nil {
+		return 0
+	}
+
+	itr := blk.Iterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		blk.Elem(e.Name())
+	}
+	return 1
+}
@@ -0,0 +1,120 @@
+package tsi1_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// fuzzDecoders decode the input of each fuzz target in fuzz.go.
+var fuzzDecoders = map[string]func(data []byte) error{
+	"trailer": func(data []byte) error {
+		_, err := tsi1.ReadIndexFileTrailer(data)
+		return err
+	},
+	"file": func(data []byte) error {
+		var f tsi1.IndexFile
+		return f.UnmarshalBinary(data)
+	},
+	"series": func(data []byte) error {
+		var blk tsi1.SeriesBlock
+		return blk.UnmarshalBinary(data)
+	},
+	"tag": func(data []byte) error {
+		var blk tsi1.TagBlock
+		return blk.UnmarshalBinary(data)
+	},
+	"measurement": func(data []byte) error {
+		var blk tsi1.MeasurementBlock
+		if err := blk.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		itr := blk.Iterator()
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			blk.Elem(e.Name())
+		}
+		return nil
+	},
+}
+
+// Ensure the committed fuzz corpus decodes without panicking.
+func TestFuzzCorpus(t *testing.T) {
+	for name, decode := range fuzzDecoders {
+		paths, err := filepath.Glob(filepath.Join("testdata", "fuzz", name, "corpus", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, path := range paths {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decode(data)
+		}
+	}
+}
+
+// Ensure truncated & corrupted blocks return errors rather than panicking and
+// that the valid blocks still decode.
+func TestDecoders_Malformed(t *testing.T) {
+	for name, data := range MustFuzzSeeds(t) {
+		decode := fuzzDecoders[name]
+		if err := decode(data); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for i := 0; i < len(data); i++ {
+			decode(data[:i])
+		}
+
+		// Corrupt each byte of the trailer & the start of the block, which
+		// hold the section offsets & sizes.
+		for i := 0; i < len(data); i++ {
+			if i >= 64 && i < len(data)-128 {
+				continue
+			}
+			for _, v := range []byte{0x00, 0x01, 0x7F, 0xFF} {
+				other := append([]byte(nil), data...)
+				other[i] = v
+				decode(other)
+			}
+		}
+	}
+}
+
+// MustFuzzSeeds returns valid input for each fuzz target from a small index
+// file with a single measurement.
+func MustFuzzSeeds(tb testing.TB) map[string][]byte {
+	f, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "host": "a"})},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	opt := tsi1.CompactOptions{SketchPrecision: 4}
+	if _, err := (tsi1.IndexFiles{f}).CompactToWithOptions(context.Background(), &buf, 64, 4, opt); err != nil {
+		tb.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	t, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return map[string][]byte{
+		"trailer":     data[len(data)-tsi1.IndexFileTrailerSize:],
+		"file":        data,
+		"series":      data[t.SeriesBlock.Offset:][:t.SeriesBlock.Size],
+		"tag":         data[t.TagsetBlock.Offset:][:t.TagsetBlock.Size],
+		"measurement": data[t.MeasurementBlock.Offset:][:t.MeasurementBlock.Size],
+	}
+}
@@ -1,6 +1,7 @@
 package tsi1
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
@@ -18,6 +19,7 @@ import (
 	"github.com/influxdata/influxdb/influxql"
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/pkg/estimator"
+	"github.com/influxdata/influxdb/pkg/limiter"
 	"github.com/influxdata/influxdb/query"
 	"github.com/influxdata/influxdb/tsdb"
 	"github.com/uber-go/zap"
@@ -48,6 +50,7 @@ const (
 	IndexFileExt = ".tsi"
 
 	CompactingExt = ".compacting"
+	TempFileExt   = ".tmp"
 )
 
 // ManifestFileName is the name of the index manifest file.
@@ -90,10 +93,34 @@ type Index struct {
 	// Log file compaction thresholds.
 	MaxLogFileSize int64
 
+	// If true, block checksums of each index file are verified when the
+	// index is opened. Files without checksums are opened unverified.
+	VerifyChecksumsOnOpen bool
+
+	// Determines how index files are loaded when opened. Index files are
+	// memory mapped by default. See IndexFileLoadMode for the tradeoffs.
+	IndexFileLoadMode IndexFileLoadMode
+
 	// Frequency of compaction checks.
 	CompactionEnabled         bool
 	CompactionMonitorInterval time.Duration
 
+	// Limits the rate index files are written by level compactions, if set.
+	// The limiter may be shared by the indexes of every shard on a node.
+	CompactionRateLimiter *limiter.Rate
+
+	// Frequency the block checksums of every index file are verified in the
+	// background, if set. Scrubbing catches corruption of files which are
+	// not reopened or compacted for a long time.
+	ScrubInterval time.Duration
+
+	// Limits the rate index files are read by the scrubber, if set. The
+	// limiter may be shared by the indexes of every shard on a node.
+	ScrubRateLimiter *limiter.Rate
+
+	scrubWG    sync.WaitGroup
+	scrubStats ScrubStatistics
+
 	logger zap.Logger
 }
 
@@ -193,6 +220,12 @@ func (i *Index) Open() error {
 	// Send a compaction request on start up.
 	i.compact()
 
+	// Start the background scrubber.
+	if i.ScrubInterval > 0 {
+		i.scrubWG.Add(1)
+		go i.runScrubber(i.ScrubInterval)
+	}
+
 	return nil
 }
 
@@ -209,9 +242,17 @@ func (i *Index) openLogFile(path string) (*LogFile, error) {
 func (i *Index) openIndexFile(path string) (*IndexFile, error) {
 	f := NewIndexFile()
 	f.SetPath(path)
+	f.SetLoadMode(i.IndexFileLoadMode)
 	if err := f.Open(); err != nil {
 		return nil, err
 	}
+
+	if i.VerifyChecksumsOnOpen {
+		if err := f.VerifyChecksums(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
 	return f, nil
 }
 
@@ -253,6 +294,7 @@ func (i *Index) Close() error {
 	// Wait for goroutines to finish.
 	i.once.Do(func() { close(i.closing) })
 	i.wg.Wait()
+	i.scrubWG.Wait()
 
 	// Lock index and close remaining
 	i.mu.Lock()
@@ -670,12 +712,13 @@ func (i *Index) MeasurementTagKeyValuesByExpr(name []byte, keys []string, expr i
 	return results, nil
 }
 
-// ForEachMeasurementTagKey iterates over all tag keys in a measurement.
+// ForEachMeasurementTagKey iterates over all tag keys in a measurement which
+// have at least one live value.
 func (i *Index) ForEachMeasurementTagKey(name []byte, fn func(key []byte) error) error {
 	fs := i.RetainFileSet()
 	defer fs.Release()
 
-	itr := fs.TagKeyIterator(name)
+	itr := fs.LiveTagKeyIterator(name)
 	if itr == nil {
 		return nil
 	}
@@ -714,6 +757,7 @@ func (i *Index) TagSets(name []byte, opt query.IteratorOptions) ([]*query.TagSet
 	} else if itr == nil {
 		return nil, nil
 	}
+	defer ReleaseSeriesIterator(itr)
 
 	// For every series, get the tag values for the requested tag keys i.e.
 	// dimensions. This is the TagSet for that series. Series with the same
@@ -892,37 +936,52 @@ func (i *Index) compactToLevel(files []*IndexFile, level int) {
 	// Track time to compact.
 	start := time.Now()
 
-	// Create new index file.
-	path := filepath.Join(i.Path, FormatIndexFileName(i.NextSequence(), level))
-	f, err := os.Create(path)
-	if err != nil {
-		logger.Error("cannot create compation files", zap.Error(err))
-		return
-	}
-	defer f.Close()
+	// Determine path of new index file.
+	id := i.NextSequence()
+	path := filepath.Join(i.Path, FormatIndexFileName(id, level))
 
 	logger.Info("performing full compaction",
 		zap.String("src", joinIntSlice(IndexFiles(files).IDs(), ",")),
 		zap.String("dst", path),
 	)
 
+	// Stop the compaction, including waits for the rate limiter, if the index
+	// is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-i.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	// Compact all index files to new index file.
+	// Warn if the new file is mostly tombstones since they are never dropped.
+	opt := CompactOptions{
+		RateLimiter:        i.CompactionRateLimiter,
+		TombstoneThreshold: 0.5,
+		OnTombstoneThreshold: func(tombstoneN, seriesN int) {
+			logger.Warn("compacted index file is mostly tombstones",
+				zap.String("path", path),
+				zap.Int("tombstones", tombstoneN),
+				zap.Int("series", seriesN),
+			)
+		},
+	}
+
 	lvl := i.levels[level]
-	n, err := IndexFiles(files).CompactTo(f, lvl.M, lvl.K)
+	n, err := IndexFiles(files).CompactInto(ctx, path, lvl.M, lvl.K, uint64(id), level, opt)
 	if err != nil {
 		logger.Error("cannot compact index files", zap.Error(err))
 		return
 	}
 
-	// Close file.
-	if err := f.Close(); err != nil {
-		logger.Error("error closing index file", zap.Error(err))
-		return
-	}
-
 	// Reopen as an index file.
 	file := NewIndexFile()
 	file.SetPath(path)
+	file.SetLoadMode(i.IndexFileLoadMode)
 	if err := file.Open(); err != nil {
 		logger.Error("cannot open new index file", zap.Error(err))
 		return
@@ -1054,6 +1113,7 @@ func (i *Index) compactLogFile(logFile *LogFile) {
 	// Reopen as an index file.
 	file := NewIndexFile()
 	file.SetPath(path)
+	file.SetLoadMode(i.IndexFileLoadMode)
 	if err := file.Open(); err != nil {
 		logger.Error("cannot open compacted index file", zap.Error(err), zap.String("path", file.Path()))
 		return
@@ -5,17 +5,42 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/pkg/bloom"
 	"github.com/influxdata/influxdb/pkg/estimator"
+	"github.com/influxdata/influxdb/pkg/estimator/hll"
 	"github.com/influxdata/influxdb/pkg/mmap"
 )
 
 // IndexFileVersion is the current TSI1 index file version.
-const IndexFileVersion = 1
+const IndexFileVersion = IndexFileVersion5
+
+// IndexFileVersion5 is the index file version which added the series key
+// codec to the series block trailer.
+const IndexFileVersion5 = 5
+
+// IndexFileVersion4 is the index file version which added the tombstone
+// block, which holds the deletion time of series tombstones.
+const IndexFileVersion4 = 4
+
+// IndexFileVersion3 is the index file version which added the generation &
+// level of the file to the trailer.
+const IndexFileVersion3 = 3
+
+// IndexFileVersion2 is the index file version which added block checksums &
+// the tagset block to the trailer.
+const IndexFileVersion2 = 2
+
+// IndexFileVersion1 is the original index file version. Its trailer does
+// not include block checksums so version 1 files cannot be verified.
+const IndexFileVersion1 = 1
 
 // FileSignature represents a magic number at the header of the index file.
 const FileSignature = "TSI1"
@@ -23,13 +48,48 @@ const FileSignature = "TSI1"
 // IndexFile field size constants.
 const (
 	// IndexFile trailer fields
-	IndexFileVersionSize       = 2
-	SeriesBlockOffsetSize      = 8
-	SeriesBlockSizeSize        = 8
-	MeasurementBlockOffsetSize = 8
-	MeasurementBlockSizeSize   = 8
+	IndexFileVersionSize         = 2
+	IndexFileTrailerChecksumSize = 4
+	SeriesBlockOffsetSize        = 8
+	SeriesBlockSizeSize          = 8
+	SeriesBlockChecksumSize      = 4
+	TagsetBlockOffsetSize        = 8
+	TagsetBlockSizeSize          = 8
+	TagsetBlockChecksumSize      = 4
+	MeasurementBlockOffsetSize   = 8
+	MeasurementBlockSizeSize     = 8
+	MeasurementBlockChecksumSize = 4
+	IndexFileGenerationSize      = 8
+	IndexFileLevelSize           = 2
+	TombstoneBlockOffsetSize     = 8
+	TombstoneBlockSizeSize       = 8
+	TombstoneBlockChecksumSize   = 4
+
+	IndexFileTrailerSize = IndexFileTrailerV3Size +
+		TombstoneBlockOffsetSize +
+		TombstoneBlockSizeSize +
+		TombstoneBlockChecksumSize
+
+	// Size of the version 3 trailer, which has no tombstone block.
+	IndexFileTrailerV3Size = IndexFileTrailerV2Size +
+		IndexFileGenerationSize +
+		IndexFileLevelSize
+
+	// Size of the version 2 trailer, which has no generation or level.
+	IndexFileTrailerV2Size = IndexFileVersionSize +
+		IndexFileTrailerChecksumSize +
+		SeriesBlockOffsetSize +
+		SeriesBlockSizeSize +
+		SeriesBlockChecksumSize +
+		TagsetBlockOffsetSize +
+		TagsetBlockSizeSize +
+		TagsetBlockChecksumSize +
+		MeasurementBlockOffsetSize +
+		MeasurementBlockSizeSize +
+		MeasurementBlockChecksumSize
 
-	IndexFileTrailerSize = IndexFileVersionSize +
+	// Size of the version 1 trailer, which has no checksums or tagset info.
+	IndexFileTrailerV1Size = IndexFileVersionSize +
 		SeriesBlockOffsetSize +
 		SeriesBlockSizeSize +
 		MeasurementBlockOffsetSize +
@@ -40,8 +100,41 @@ const (
 var (
 	ErrInvalidIndexFile            = errors.New("invalid index file")
 	ErrUnsupportedIndexFileVersion = errors.New("unsupported index file version")
+	ErrIndexFileTrailerChecksum    = errors.New("index file trailer checksum mismatch")
+	ErrUnknownIndexFileSize        = errors.New("unknown index file size")
+	ErrSeriesBlockNotLoaded        = errors.New("series block not loaded")
 )
 
+// ErrChecksumMismatch is returned when the data of a block does not match
+// the checksum recorded in the index file trailer.
+type ErrChecksumMismatch struct {
+	Path     string
+	Block    string
+	Expected uint32
+	Actual   uint32
+}
+
+// Error returns the string representation of the error.
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("%s block checksum mismatch: %s (expected %08x, got %08x)", e.Block, e.Path, e.Expected, e.Actual)
+}
+
+// ErrBlockOutOfBounds is returned when a block recorded in the index file
+// trailer does not lie between the end of the previous block & the start of
+// the trailer. Min & Max are the bounds the block must lie within.
+type ErrBlockOutOfBounds struct {
+	Path     string
+	Block    string
+	Offset   int64
+	Size     int64
+	Min, Max int64
+}
+
+// Error returns the string representation of the error.
+func (e *ErrBlockOutOfBounds) Error() string {
+	return fmt.Sprintf("%s block out of bounds: %s (offset %d, size %d, expected within %d-%d)", e.Block, e.Path, e.Offset, e.Size, e.Min, e.Max)
+}
+
 // IndexFile represents a collection of measurement, tag, and series data.
 type IndexFile struct {
 	wg   sync.WaitGroup // ref count
@@ -52,6 +145,12 @@ type IndexFile struct {
 	tblks map[string]*TagBlock // tag blocks by measurement name
 	mblk  MeasurementBlock
 
+	// Trailer read from the end of the data.
+	trailer IndexFileTrailer
+
+	// Deletion times of series tombstones. Empty before version 4.
+	tombstones tombstoneBlock
+
 	// Sortable identifier & filepath to the log file.
 	level int
 	id    int
@@ -65,26 +164,274 @@ type IndexFile struct {
 
 	// Path to data file.
 	path string
+
+	// File info captured when the file was opened. Index files are
+	// immutable once written so the size & modtime do not change.
+	fi os.FileInfo
+
+	// Set if opened with OpenMetadataOnly. The data then starts at the
+	// tagset block, which is at offset base in the file, & is not mapped.
+	metadataOnly bool
+	base         int64
+
+	// Series block data, if the file was too large to load as a single
+	// slice. The data then starts at the tagset block, as above.
+	sdata []byte
+
+	// Set if the data was memory mapped by Open & must be unmapped on close.
+	mapped bool
+
+	// Determines how Open loads the data file.
+	loadMode IndexFileLoadMode
 }
 
+// IndexFileLoadMode determines how IndexFile.Open loads the data file.
+//
+// Memory mapping is the default. Blocks are paged in by the kernel on demand,
+// the pages are shared with the page cache & can be reclaimed under memory
+// pressure, so large files cost little resident memory. However, some
+// environments forbid or limit mmap, and accessing a mapping beyond the end of
+// a file which was truncated after it was opened raises SIGBUS, which crashes
+// the process instead of returning an error.
+//
+// Reading into the heap copies the whole file into memory with pread when it
+// is opened. This works wherever the file can be read & a later truncation of
+// the file cannot affect the loaded data, at the cost of holding the whole
+// file in memory for as long as it is open & of reading it all up front.
+type IndexFileLoadMode int
+
+const (
+	// IndexFileLoadMmap memory maps the data file.
+	IndexFileLoadMmap IndexFileLoadMode = iota
+
+	// IndexFileLoadHeap reads the data file into a heap buffer.
+	IndexFileLoadHeap
+)
+
+// String returns the name of the load mode.
+func (m IndexFileLoadMode) String() string {
+	switch m {
+	case IndexFileLoadMmap:
+		return "mmap"
+	case IndexFileLoadHeap:
+		return "heap"
+	default:
+		return fmt.Sprintf("IndexFileLoadMode(%d)", int(m))
+	}
+}
+
+// maxIndexFileDataSize is the largest file loaded as a single slice. Larger
+// files, such as files over 2GB on 32-bit platforms, are loaded as two
+// slices: the series block & the rest of the file from the tagset block.
+var maxIndexFileDataSize = int64(^uint(0) >> 1)
+
 // NewIndexFile returns a new instance of IndexFile.
 func NewIndexFile() *IndexFile {
 	return &IndexFile{}
 }
 
-// Open memory maps the data file at the file's path.
+// Open loads the data file at the file's path using the file's load mode. The
+// data file is memory mapped by default.
 func (f *IndexFile) Open() error {
+	switch f.loadMode {
+	case IndexFileLoadMmap:
+	case IndexFileLoadHeap:
+		return f.OpenFS(OSFileSystem{})
+	default:
+		return fmt.Errorf("invalid index file load mode: %d", int(f.loadMode))
+	}
+
 	// Extract identifier from path name.
 	f.id, f.level = ParseFilename(f.Path())
 
+	// Files too large to map whole are mapped in two windows.
+	fi, statErr := os.Stat(f.Path())
+	if statErr == nil && fi.Size() > maxIndexFileDataSize {
+		return f.openMmapWindows(fi)
+	}
+
 	data, err := mmap.Map(f.Path())
 	if err != nil {
 		return err
 	}
 
-	return f.UnmarshalBinary(data)
+	// The data is only retained by the file if it unmarshals successfully.
+	if err := f.UnmarshalBinary(data); err != nil {
+		mmap.Unmap(data)
+		return err
+	}
+	f.mapped = true
+
+	// Cache the file info. Stat falls back to os.Stat if this fails.
+	if statErr == nil {
+		f.fi = fi
+	}
+	return nil
+}
+
+// openMmapWindows maps the series block & the rest of the file from the
+// tagset block separately, for files too large to map as a single slice.
+// Each window must still fit in a slice & in the address space.
+func (f *IndexFile) openMmapWindows(fi os.FileInfo) error {
+	file, err := os.Open(f.Path())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	t, err := readIndexFileTrailerFrom(file, fi.Size())
+	if err != nil {
+		return err
+	} else if err := t.validate(f.path, fi.Size()); err != nil {
+		return err
+	}
+
+	base := t.TagsetBlock.Offset
+	data, err := mmap.MapRange(f.Path(), base, fi.Size()-base)
+	if err != nil {
+		return err
+	}
+	sdata, err := mmap.MapRange(f.Path(), t.SeriesBlock.Offset, t.SeriesBlock.Size)
+	if err != nil {
+		mmap.Unmap(data)
+		return err
+	}
+
+	if err := f.unmarshalWindows(sdata, data, base, t); err != nil {
+		mmap.Unmap(sdata)
+		mmap.Unmap(data)
+		return err
+	}
+	f.mapped = true
+	f.fi = fi
+	return nil
+}
+
+// OpenFS reads the data file at the file's path from fsys into memory. This
+// allows files to be opened from a FileSystem other than the local disk,
+// such as memory in tests. Use Open to memory map files on the local disk.
+func (f *IndexFile) OpenFS(fsys FileSystem) error {
+	f.id, f.level = ParseFilename(f.Path())
+
+	file, err := fsys.Open(f.Path())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	} else if fi.Size() > maxIndexFileDataSize {
+		if err := f.readWindows(file, fi.Size()); err != nil {
+			return err
+		}
+		f.setFileInfo(fi)
+		return nil
+	}
+	data, err := readAll(file, 0, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	if err := f.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	f.setFileInfo(fi)
+	return nil
+}
+
+// readWindows reads the series block & the rest of the file from the tagset
+// block separately, for files too large to read into a single slice.
+func (f *IndexFile) readWindows(file io.ReaderAt, size int64) error {
+	t, err := readIndexFileTrailerFrom(file, size)
+	if err != nil {
+		return err
+	} else if err := t.validate(f.path, size); err != nil {
+		return err
+	}
+
+	base := t.TagsetBlock.Offset
+	data, err := readAll(file, base, size-base)
+	if err != nil {
+		return err
+	}
+	sdata, err := readAll(file, t.SeriesBlock.Offset, t.SeriesBlock.Size)
+	if err != nil {
+		return err
+	}
+	return f.unmarshalWindows(sdata, data, base, t)
+}
+
+// OpenMetadataOnly reads the tagset & measurement blocks of the data file at
+// path without the series block, for consumers such as schema discovery
+// which only need measurements & tags. The blocks are located using the
+// trailer & read into memory so the series block is never mapped or paged in.
+//
+// Measurement, tag key & tag value lookups & iterators, TagValueSeriesIDSet,
+// MergeMeasurementsSketches & VerifyChecksums, which skips the series block,
+// are available in this mode. The series APIs are not. Those with an error
+// return, such as MergeSeriesSketches, MeasurementSketch & the IndexFiles
+// series counts, return ErrSeriesBlockNotLoaded. The others cannot report
+// the missing block & must not be used: HasSeries & Series report every
+// series as absent, SeriesN returns zero, Filter returns nil & the series
+// iterators return nil. Check MetadataOnly before calling them. The file
+// cannot be compacted.
+func (f *IndexFile) OpenMetadataOnly(path string) error {
+	return f.OpenMetadataOnlyFS(OSFileSystem{}, path)
+}
+
+// OpenMetadataOnlyFS reads the tagset & measurement blocks of the data file
+// at path from fsys, like OpenMetadataOnly.
+func (f *IndexFile) OpenMetadataOnlyFS(fsys FileSystem, path string) error {
+	f.path = path
+	f.id, f.level = ParseFilename(path)
+
+	file, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	t, err := readIndexFileTrailerFrom(file, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	// Read from the tagset block to the end of the file.
+	base := t.TagsetBlock.Offset
+	if err := t.validate(path, fi.Size()); err != nil {
+		return err
+	}
+	data, err := readAll(file, base, fi.Size()-base)
+	if err != nil {
+		return err
+	}
+
+	if err := f.unmarshalMetadata(data, base, t); err != nil {
+		f.mblk, f.tblks = MeasurementBlock{}, nil
+		return err
+	}
+	f.data, f.base, f.metadataOnly = data, base, true
+	f.trailer = t
+	f.setFileInfo(fi)
+	return nil
 }
 
+// LoadMode returns the mode used by Open to load the data file.
+func (f *IndexFile) LoadMode() IndexFileLoadMode { return f.loadMode }
+
+// SetLoadMode sets the mode used by Open to load the data file. It must be set
+// before the file is opened.
+func (f *IndexFile) SetLoadMode(mode IndexFileLoadMode) { f.loadMode = mode }
+
+// MetadataOnly returns true if the file was opened with OpenMetadataOnly.
+func (f *IndexFile) MetadataOnly() bool { return f.metadataOnly }
+
 // Close unmaps the data file.
 func (f *IndexFile) Close() error {
 	// Wait until all references are released.
@@ -93,8 +440,22 @@ func (f *IndexFile) Close() error {
 	f.sblk = SeriesBlock{}
 	f.tblks = nil
 	f.mblk = MeasurementBlock{}
+	f.trailer = IndexFileTrailer{}
+	f.tombstones = nil
 	f.seriesN = 0
-	return mmap.Unmap(f.data)
+	f.setFileInfo(nil)
+
+	// Only data opened by Open is mapped.
+	data, sdata, mapped := f.data, f.sdata, f.mapped
+	f.data, f.sdata, f.base, f.metadataOnly, f.mapped = nil, nil, 0, false, false
+	if !mapped {
+		return nil
+	}
+	err := mmap.Unmap(sdata)
+	if e := mmap.Unmap(data); err == nil {
+		err = e
+	}
+	return err
 }
 
 // ID returns the file sequence identifier.
@@ -106,20 +467,114 @@ func (f *IndexFile) Path() string { return f.path }
 // SetPath sets the file's path.
 func (f *IndexFile) SetPath(path string) { f.path = path }
 
-// Level returns the compaction level for the file.
-func (f *IndexFile) Level() int { return f.level }
+// Level returns the compaction level for the file. The level stamped into
+// the trailer is used if the file has one, otherwise the level is parsed from
+// the filename.
+func (f *IndexFile) Level() int {
+	if f.trailer.Generation != 0 {
+		return f.trailer.Level
+	}
+	return f.level
+}
+
+// Generation returns the generation stamped into the trailer when the file
+// was compacted. Falls back to the sequence identifier in the filename if the
+// file has no generation.
+func (f *IndexFile) Generation() uint64 {
+	if f.trailer.Generation != 0 {
+		return f.trailer.Generation
+	}
+	return uint64(f.id)
+}
 
 // Filter returns the series existence filter for the file.
 func (f *IndexFile) Filter() *bloom.Filter { return f.sblk.filter }
 
 // Retain adds a reference count to the file.
-func (f *IndexFile) Retain() { f.wg.Add(1) }
+func (f *IndexFile) Retain() {
+	f.wg.Add(1)
+	trackRetain(f)
+}
 
 // Release removes a reference count from the file.
-func (f *IndexFile) Release() { f.wg.Done() }
+func (f *IndexFile) Release() {
+	trackRelease(f)
+	f.wg.Done()
+}
 
 // Size returns the size of the index file, in bytes.
-func (f *IndexFile) Size() int64 { return int64(len(f.data)) }
+func (f *IndexFile) Size() int64 { return f.base + int64(len(f.data)) }
+
+// Approximate sizes of the heap structures of an open index file.
+const (
+	indexFileHeapSize = 512 // file, series block & measurement block structs
+	tagBlockHeapSize  = 160 // tag block struct & map entry, excluding the name
+)
+
+// MemUsage is the approximate memory used by open index files, in bytes.
+type MemUsage struct {
+	// Memory mapped file data. The pages are only resident once read & may be
+	// reclaimed by the OS, however, the whole file is counted.
+	Mapped int64
+
+	// Structures allocated when the file is opened, such as the series
+	// index, sketches & tag block lookup, plus file data read into memory
+	// rather than mapped. This memory is only released when the file is
+	// closed.
+	Heap int64
+}
+
+// Total returns the sum of the mapped & heap memory.
+func (u MemUsage) Total() int64 { return u.Mapped + u.Heap }
+
+// MemSize returns the approximate memory used by the open file, in bytes.
+// See MemUsage for the mapped & heap portions.
+func (f *IndexFile) MemSize() int64 { return f.MemUsage().Total() }
+
+// MemUsage returns the approximate memory used by the open file. The bloom
+// filter & hash indexes are read directly from the file data so they are
+// included in the data size. A closed file uses no memory.
+func (f *IndexFile) MemUsage() MemUsage {
+	var u MemUsage
+	if f.data == nil {
+		return u
+	} else if f.mapped {
+		u.Mapped = int64(len(f.data)) + int64(len(f.sdata))
+	} else {
+		u.Heap = int64(len(f.data)) + int64(len(f.sdata))
+	}
+
+	u.Heap += indexFileHeapSize + f.sblk.heapSize() + f.mblk.heapSize()
+	for name := range f.tblks {
+		u.Heap += tagBlockHeapSize + int64(len(name))
+	}
+	return u
+}
+
+// stat returns the file info of the data file. The info cached when the file
+// was opened is used if available, otherwise the file is stat'd & cached.
+func (f *IndexFile) stat() (os.FileInfo, error) {
+	f.mu.RLock()
+	fi := f.fi
+	f.mu.RUnlock()
+	if fi != nil {
+		return fi, nil
+	}
+
+	fi, err := os.Stat(f.Path())
+	if err != nil {
+		return nil, err
+	}
+	f.setFileInfo(fi)
+	return fi, nil
+}
+
+// setFileInfo sets the cached file info.
+func (f *IndexFile) setFileInfo(fi os.FileInfo) {
+	f.mu.Lock()
+	f.fi = fi
+	f.mu.Unlock()
+}
 
 // Compacting returns true if the file is being compacted.
 func (f *IndexFile) Compacting() bool {
@@ -150,10 +605,51 @@ func (f *IndexFile) UnmarshalBinary(data []byte) error {
 	t, err := ReadIndexFileTrailer(data)
 	if err != nil {
 		return err
+	} else if err := t.validate(f.path, int64(len(data))); err != nil {
+		return err
+	}
+
+	// Unmarshal measurement & tag blocks.
+	if err := f.unmarshalMetadata(data, 0, t); err != nil {
+		return err
 	}
 
+	// Slice series list data.
+	buf := data[t.SeriesBlock.Offset:]
+	buf = buf[:t.SeriesBlock.Size]
+
+	// Unmarshal series list.
+	if err := f.sblk.unmarshalBinary(buf, t.Version); err != nil {
+		return err
+	}
+
+	// Save reference to entire data block.
+	f.data = data
+	f.trailer = t
+
+	return nil
+}
+
+// unmarshalWindows opens an index from the series block data & the rest of
+// the file from the tagset block, which is at offset base in the file. Both
+// byte slices are retained.
+func (f *IndexFile) unmarshalWindows(sdata, data []byte, base int64, t IndexFileTrailer) error {
+	if err := f.unmarshalMetadata(data, base, t); err != nil {
+		return err
+	} else if err := f.sblk.unmarshalBinary(sdata, t.Version); err != nil {
+		return err
+	}
+
+	f.data, f.sdata, f.base = data, sdata, base
+	f.trailer = t
+	return nil
+}
+
+// unmarshalMetadata unpacks the measurement block & each tag block from data,
+// which starts at offset base in the file.
+func (f *IndexFile) unmarshalMetadata(data []byte, base int64, t IndexFileTrailer) error {
 	// Slice measurement block data.
-	buf := data[t.MeasurementBlock.Offset:]
+	buf := data[t.MeasurementBlock.Offset-base:]
 	buf = buf[:t.MeasurementBlock.Size]
 
 	// Unmarshal measurement block.
@@ -161,6 +657,15 @@ func (f *IndexFile) UnmarshalBinary(data []byte) error {
 		return err
 	}
 
+	// Slice tombstone block data.
+	if t.Version >= IndexFileVersion4 {
+		buf, ok := blockSection(data, t.TombstoneBlock.Offset-base, t.TombstoneBlock.Size)
+		if !ok || len(buf)%TombstoneBlockEntrySize != 0 {
+			return ErrInvalidIndexFile
+		}
+		f.tombstones = tombstoneBlock(buf)
+	}
+
 	// Unmarshal each tag block.
 	f.tblks = make(map[string]*TagBlock)
 	itr := f.mblk.Iterator()
@@ -168,33 +673,89 @@ func (f *IndexFile) UnmarshalBinary(data []byte) error {
 	for m := itr.Next(); m != nil; m = itr.Next() {
 		e := m.(*MeasurementBlockElem)
 
-		// Slice measurement block data.
-		buf := data[e.tagBlock.offset:]
-		buf = buf[:e.tagBlock.size]
+		// Slice tag block data.
+		buf, ok := blockSection(data, e.tagBlock.offset-base, e.tagBlock.size)
+		if !ok {
+			return ErrInvalidIndexFile
+		}
 
-		// Unmarshal measurement block.
+		// Unmarshal tag block.
 		var tblk TagBlock
 		if err := tblk.UnmarshalBinary(buf); err != nil {
 			return err
 		}
 		f.tblks[string(e.name)] = &tblk
 	}
+	return nil
+}
 
-	// Slice series list data.
-	buf = data[t.SeriesBlock.Offset:]
-	buf = buf[:t.SeriesBlock.Size]
+// Validate returns *ErrBlockOutOfBounds if a block recorded in the trailer
+// lies outside the file or overlaps another block. Files are validated when
+// they are opened or unmarshaled so corrupt trailers fail fast rather than
+// panicking when the blocks are read.
+func (f *IndexFile) Validate() error {
+	return f.trailer.validate(f.path, f.Size())
+}
 
-	// Unmarshal series list.
-	if err := f.sblk.UnmarshalBinary(buf); err != nil {
+// Trailer returns the trailer read from the end of the file.
+func (f *IndexFile) Trailer() IndexFileTrailer { return f.trailer }
+
+// Checksummed returns true if the file's trailer contains block checksums.
+// Files written before checksums were introduced are considered unverified.
+func (f *IndexFile) Checksummed() bool { return f.trailer.Checksummed() }
+
+// VerifyChecksums recomputes the checksum of each block and compares it to
+// the checksum stored in the trailer. Returns *ErrChecksumMismatch for the
+// first block that differs. Unverified files always return nil. The series
+// block is not verified if the file was opened with OpenMetadataOnly.
+func (f *IndexFile) VerifyChecksums() error {
+	blks, err := f.checksummedBlocks()
+	if err != nil {
 		return err
 	}
 
-	// Save reference to entire data block.
-	f.data = data
-
+	for _, blk := range blks {
+		if checksum := crc32.ChecksumIEEE(blk.data); checksum != blk.checksum {
+			return &ErrChecksumMismatch{Path: f.path, Block: blk.name, Expected: blk.checksum, Actual: checksum}
+		}
+	}
 	return nil
 }
 
+// checksummedBlock is the data of a block & the checksum from the trailer.
+type checksummedBlock struct {
+	name     string
+	data     []byte
+	checksum uint32
+}
+
+// checksummedBlocks returns the blocks with checksums in the trailer. Returns
+// no blocks for unverified files & skips the series block if the file was
+// opened with OpenMetadataOnly.
+func (f *IndexFile) checksummedBlocks() ([]checksummedBlock, error) {
+	t := &f.trailer
+	if !t.Checksummed() {
+		return nil, nil
+	}
+
+	var a []checksummedBlock
+	for _, blk := range t.blocks() {
+		if f.metadataOnly && blk.name == "series" {
+			continue
+		} else if f.sdata != nil && blk.name == "series" {
+			a = append(a, checksummedBlock{name: blk.name, data: f.sdata, checksum: blk.checksum})
+			continue
+		}
+
+		offset := blk.offset - f.base
+		if offset < 0 || blk.size < 0 || offset+blk.size > int64(len(f.data)) {
+			return nil, ErrInvalidIndexFile
+		}
+		a = append(a, checksummedBlock{name: blk.name, data: f.data[offset : offset+blk.size], checksum: blk.checksum})
+	}
+	return a, nil
+}
+
 // Measurement returns a measurement element.
 func (f *IndexFile) Measurement(name []byte) MeasurementElem {
 	e, ok := f.mblk.Elem(name)
@@ -231,6 +792,16 @@ func (f *IndexFile) TagValueIterator(name, key []byte) TagValueIterator {
 	return ke.TagValueIterator()
 }
 
+// TagValueIteratorFrom returns an iterator over the values of a tag key which
+// sort after the value after. See TagBlock.TagValueIteratorFrom.
+func (f *IndexFile) TagValueIteratorFrom(name, key, after []byte) TagValueIterator {
+	tblk := f.tblks[string(name)]
+	if tblk == nil {
+		return nil
+	}
+	return tblk.TagValueIteratorFrom(key, after)
+}
+
 // TagKeySeriesIterator returns a series iterator for a tag key and a flag
 // indicating if a tombstone exists on the measurement or key.
 func (f *IndexFile) TagKeySeriesIterator(name, key []byte) SeriesIterator {
@@ -245,11 +816,19 @@ func (f *IndexFile) TagKeySeriesIterator(name, key []byte) SeriesIterator {
 		return nil
 	}
 
+	// Series cannot be decoded without the series block.
+	if f.metadataOnly {
+		return nil
+	}
+
 	// Merge all value series iterators together.
 	vitr := ke.TagValueIterator()
 	var itrs []SeriesIterator
 	for ve := vitr.Next(); ve != nil; ve = vitr.Next() {
-		sitr := &rawSeriesIDIterator{data: ve.(*TagBlockValueElem).series.data}
+		sitr := &rawSeriesIDIterator{
+			n:    ve.(*TagBlockValueElem).series.n,
+			data: ve.(*TagBlockValueElem).series.data,
+		}
 		itrs = append(itrs, newSeriesDecodeIterator(&f.sblk, sitr))
 	}
 
@@ -266,7 +845,7 @@ func (f *IndexFile) TagValueSeriesIterator(name, key, value []byte) SeriesIterat
 
 	// Find value element.
 	ve := tblk.TagValueElem(key, value)
-	if ve == nil {
+	if ve == nil || f.metadataOnly {
 		return nil
 	}
 
@@ -280,6 +859,32 @@ func (f *IndexFile) TagValueSeriesIterator(name, key, value []byte) SeriesIterat
 	)
 }
 
+// TagValueSeriesIDSet returns the set of series ids for a tag value. Returns
+// an empty set if the tag value does not exist. The ids are only valid
+// within this file.
+func (f *IndexFile) TagValueSeriesIDSet(name, key, value []byte) (*SeriesIDSet, error) {
+	tblk := f.tblks[string(name)]
+	if tblk == nil {
+		return NewSeriesIDSet(), nil
+	}
+
+	ve := tblk.TagValueElem(key, value)
+	if ve == nil {
+		return NewSeriesIDSet(), nil
+	}
+	e := ve.(*TagBlockValueElem)
+	return decodeSeriesIDSet(e.series.n, e.series.data)
+}
+
+// SeriesIDSetIterator returns an iterator over the series in a set of ids
+// from this file.
+func (f *IndexFile) SeriesIDSetIterator(set *SeriesIDSet) SeriesIterator {
+	if f.metadataOnly {
+		return nil
+	}
+	return newSeriesDecodeIterator(&f.sblk, &seriesIDSetIterator{a: set.Slice()})
+}
+
 // TagKey returns a tag key.
 func (f *IndexFile) TagKey(name, key []byte) TagKeyElem {
 	tblk := f.tblks[string(name)]
@@ -309,6 +914,35 @@ func (f *IndexFile) Series(name []byte, tags models.Tags) SeriesElem {
 	return f.sblk.Series(name, tags)
 }
 
+// SeriesTombstoneTime returns the time the series was deleted. Returns false
+// if the series is not a tombstone in this file or its deletion time was not
+// recorded, such as in files written before version 4 or by a log file entry
+// without a time. Always returns false if the file was opened with
+// OpenMetadataOnly.
+func (f *IndexFile) SeriesTombstoneTime(name []byte, tags models.Tags, buf []byte) (time.Time, bool) {
+	if _, deletedAt := f.seriesTombstoneTime(name, tags, buf); deletedAt != 0 {
+		return time.Unix(0, deletedAt).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// seriesTombstoneTime returns true if the series exists in the file & its
+// deletion time in nanoseconds since the epoch. The time is zero if the series
+// is live or its deletion time was not recorded.
+func (f *IndexFile) seriesTombstoneTime(name []byte, tags models.Tags, buf []byte) (exists bool, deletedAt int64) {
+	if f.metadataOnly {
+		return false, 0
+	}
+
+	offset, tombstoned := f.sblk.Offset(name, tags, buf)
+	if offset == 0 {
+		return false, 0
+	} else if !tombstoned {
+		return true, 0
+	}
+	return true, f.tombstones.time(offset)
+}
+
 // TagValueElem returns an element for a measurement/tag/value.
 func (f *IndexFile) TagValueElem(name, key, value []byte) TagValueElem {
 	tblk, ok := f.tblks[string(name)]
@@ -323,6 +957,24 @@ func (f *IndexFile) MeasurementIterator() MeasurementIterator {
 	return f.mblk.Iterator()
 }
 
+// MeasurementPrefixIterator returns an iterator over the measurements whose
+// names begin with prefix.
+func (f *IndexFile) MeasurementPrefixIterator(prefix []byte) MeasurementIterator {
+	return f.mblk.PrefixIterator(prefix)
+}
+
+// MeasurementFoldPrefixIterator returns an iterator over the measurements
+// whose names begin with prefix, ignoring ASCII case.
+func (f *IndexFile) MeasurementFoldPrefixIterator(prefix []byte) MeasurementIterator {
+	return f.mblk.FoldPrefixIterator(prefix)
+}
+
+// ReverseMeasurementIterator returns an iterator over all measurements in
+// descending order.
+func (f *IndexFile) ReverseMeasurementIterator() MeasurementIterator {
+	return f.mblk.ReverseIterator()
+}
+
 // TagKeyIterator returns an iterator over all tag keys for a measurement.
 func (f *IndexFile) TagKeyIterator(name []byte) TagKeyIterator {
 	blk := f.tblks[string(name)]
@@ -334,38 +986,208 @@ func (f *IndexFile) TagKeyIterator(name []byte) TagKeyIterator {
 
 // MeasurementSeriesIterator returns an iterator over a measurement's series.
 func (f *IndexFile) MeasurementSeriesIterator(name []byte) SeriesIterator {
-	return &seriesDecodeIterator{
-		itr:  f.mblk.seriesIDIterator(name),
-		sblk: &f.sblk,
+	if f.metadataOnly {
+		return nil
 	}
+	return newSeriesDecodeIterator(&f.sblk, f.mblk.seriesIDIterator(name))
 }
 
 // MergeMeasurementsSketches merges the index file's series sketches into the provided
-// sketches.
+// sketches. Returns ErrMeasurementSketchNotAvailable if the file was written
+// without measurement sketches.
 func (f *IndexFile) MergeMeasurementsSketches(s, t estimator.Sketch) error {
-	if err := s.Merge(f.mblk.sketch); err != nil {
+	if f.mblk.sketch == nil {
+		return ErrMeasurementSketchNotAvailable
+	}
+	if err := mergeSketch(s, f.mblk.sketch); err != nil {
 		return err
 	}
-	return t.Merge(f.mblk.tSketch)
+	return mergeSketch(t, f.mblk.tSketch)
 }
 
 // SeriesN returns the total number of non-tombstoned series for the index file.
 func (f *IndexFile) SeriesN() uint64 {
-	return uint64(f.sblk.seriesN - f.sblk.tombstoneN)
+	return uint64(f.sblk.seriesN)
 }
 
 // SeriesIterator returns an iterator over all series.
 func (f *IndexFile) SeriesIterator() SeriesIterator {
+	if f.metadataOnly {
+		return nil
+	}
 	return f.sblk.SeriesIterator()
 }
 
 // MergeSeriesSketches merges the index file's series sketches into the provided
 // sketches.
 func (f *IndexFile) MergeSeriesSketches(s, t estimator.Sketch) error {
-	if err := s.Merge(f.sblk.sketch); err != nil {
+	if f.metadataOnly {
+		return ErrSeriesBlockNotLoaded
+	}
+	if err := mergeSketch(s, f.sblk.sketch); err != nil {
 		return err
 	}
-	return t.Merge(f.sblk.tsketch)
+	return mergeSketch(t, f.sblk.tsketch)
+}
+
+// MeasurementSketch returns an estimate sketch of the live series in a
+// measurement. Index files do not store per-measurement sketches so the
+// sketch is built from the keys of the measurement's series ids without
+// decoding tags. It uses the precision of the file's series sketch. Returns a
+// nil sketch if the measurement does not exist in the file.
+func (f *IndexFile) MeasurementSketch(name []byte) (estimator.Sketch, error) {
+	if _, ok := f.mblk.Elem(name); !ok {
+		return nil, nil
+	} else if f.metadataOnly {
+		return nil, ErrSeriesBlockNotLoaded
+	}
+
+	p := uint8(hll.DefaultPrecision)
+	if s, ok := f.sblk.sketch.(*hll.Plus); ok {
+		p = s.Precision()
+	}
+	sketch, err := hll.NewPlus(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	itr := f.mblk.seriesIDIterator(name)
+	for id := itr.next(); id != 0; id = itr.next() {
+		flag, key, _ := readSeriesBlockElem(f.sblk.data, id, buf[:0])
+		if flag&SeriesPrefixFlag != 0 {
+			buf = key
+		}
+		if flag&SeriesTombstoneFlag != 0 {
+			continue
+		}
+		sketch.Add(key)
+	}
+	return sketch, nil
+}
+
+// IndexFileFormatVersion returns the format version of the index file in r by
+// reading only its signature & the version at the end of the trailer. The
+// size of r is determined from a Size() or Stat() method, such as those of
+// *io.SectionReader, *bytes.Reader & *os.File.
+//
+// If the version is not supported by this package then the version is
+// returned with ErrUnsupportedIndexFileVersion.
+func IndexFileFormatVersion(r io.ReaderAt) (version int, err error) {
+	var size int64
+	switch r := r.(type) {
+	case interface {
+		Size() int64
+	}:
+		size = r.Size()
+	case interface {
+		Stat() (os.FileInfo, error)
+	}:
+		fi, err := r.Stat()
+		if err != nil {
+			return 0, err
+		}
+		size = fi.Size()
+	default:
+		return 0, ErrUnknownIndexFileSize
+	}
+
+	// Verify the signature.
+	if size < int64(len(FileSignature)+IndexFileVersionSize) {
+		return 0, io.ErrShortBuffer
+	}
+	buf := make([]byte, len(FileSignature))
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return 0, err
+	} else if !bytes.Equal(buf, []byte(FileSignature)) {
+		return 0, ErrInvalidIndexFile
+	}
+
+	// Read the version from the end of the file.
+	buf = buf[:IndexFileVersionSize]
+	if _, err := r.ReadAt(buf, size-IndexFileVersionSize); err != nil {
+		return 0, err
+	}
+	version = int(binary.BigEndian.Uint16(buf))
+
+	switch version {
+	case IndexFileVersion1, IndexFileVersion2, IndexFileVersion3, IndexFileVersion4, IndexFileVersion5:
+		return version, nil
+	default:
+		return version, ErrUnsupportedIndexFileVersion
+	}
+}
+
+// ReadIndexFileMeasurements returns an iterator over the measurements of the
+// index file at path. Only the signature, trailer & measurement block are read
+// so the series & tag blocks are not paged in. The measurement block is
+// verified against its checksum if the file has checksums.
+//
+// Unlike IndexFile.MeasurementIterator, the file does not need to be open and
+// the returned iterator remains valid after the file is removed.
+func ReadIndexFileMeasurements(path string) (MeasurementIterator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	t, err := readIndexFileTrailerFrom(f, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read & verify the measurement block.
+	if t.MeasurementBlock.Offset < 0 || t.MeasurementBlock.Size < 0 || t.MeasurementBlock.Offset+t.MeasurementBlock.Size > size {
+		return nil, ErrInvalidIndexFile
+	}
+	data := make([]byte, t.MeasurementBlock.Size)
+	if _, err := f.ReadAt(data, t.MeasurementBlock.Offset); err != nil {
+		return nil, err
+	}
+	if t.Checksummed() {
+		if checksum := crc32.ChecksumIEEE(data); checksum != t.MeasurementBlock.Checksum {
+			return nil, &ErrChecksumMismatch{Path: path, Block: "measurement", Expected: t.MeasurementBlock.Checksum, Actual: checksum}
+		}
+	}
+
+	var blk MeasurementBlock
+	if err := blk.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return blk.Iterator(), nil
+}
+
+// readIndexFileTrailerFrom verifies the signature of the index file in r &
+// reads the trailer from its end.
+func readIndexFileTrailerFrom(r io.ReaderAt, size int64) (IndexFileTrailer, error) {
+	// Verify the signature.
+	buf := make([]byte, len(FileSignature))
+	if size < int64(len(FileSignature)) {
+		return IndexFileTrailer{}, io.ErrShortBuffer
+	} else if _, err := r.ReadAt(buf, 0); err != nil {
+		return IndexFileTrailer{}, err
+	} else if !bytes.Equal(buf, []byte(FileSignature)) {
+		return IndexFileTrailer{}, ErrInvalidIndexFile
+	}
+
+	// Read the trailer from the end of the file. The version 1 trailer is
+	// shorter so reading the current trailer size covers both.
+	n := int64(IndexFileTrailerSize)
+	if n > size-int64(len(FileSignature)) {
+		n = size - int64(len(FileSignature))
+	}
+	buf = make([]byte, n)
+	if _, err := r.ReadAt(buf, size-n); err != nil {
+		return IndexFileTrailer{}, err
+	}
+	return ReadIndexFileTrailer(buf)
 }
 
 // ReadIndexFileTrailer returns the index file trailer from data.
@@ -373,13 +1195,93 @@ func ReadIndexFileTrailer(data []byte) (IndexFileTrailer, error) {
 	var t IndexFileTrailer
 
 	// Read version.
+	if len(data) < IndexFileVersionSize {
+		return t, io.ErrShortBuffer
+	}
 	t.Version = int(binary.BigEndian.Uint16(data[len(data)-IndexFileVersionSize:]))
-	if t.Version != IndexFileVersion {
+
+	size := IndexFileTrailerSize
+	switch t.Version {
+	case IndexFileVersion1:
+		return readIndexFileTrailerV1(data, t)
+	case IndexFileVersion2:
+		size = IndexFileTrailerV2Size
+	case IndexFileVersion3:
+		size = IndexFileTrailerV3Size
+	case IndexFileVersion4, IndexFileVersion5:
+	default:
 		return t, ErrUnsupportedIndexFileVersion
 	}
 
 	// Slice trailer data.
-	buf := data[len(data)-IndexFileTrailerSize:]
+	if len(data) < size {
+		return t, io.ErrShortBuffer
+	}
+	buf := data[len(data)-size:]
+
+	// Verify the trailer has not been corrupted.
+	checksumOffset := size - IndexFileVersionSize - IndexFileTrailerChecksumSize
+	if crc32.ChecksumIEEE(buf[:checksumOffset]) != binary.BigEndian.Uint32(buf[checksumOffset:]) {
+		return t, ErrIndexFileTrailerChecksum
+	}
+
+	// Read series list info.
+	t.SeriesBlock.Offset = int64(binary.BigEndian.Uint64(buf[0:SeriesBlockOffsetSize]))
+	buf = buf[SeriesBlockOffsetSize:]
+	t.SeriesBlock.Size = int64(binary.BigEndian.Uint64(buf[0:SeriesBlockSizeSize]))
+	buf = buf[SeriesBlockSizeSize:]
+	t.SeriesBlock.Checksum = binary.BigEndian.Uint32(buf[0:SeriesBlockChecksumSize])
+	buf = buf[SeriesBlockChecksumSize:]
+
+	// Read tagset block info.
+	t.TagsetBlock.Offset = int64(binary.BigEndian.Uint64(buf[0:TagsetBlockOffsetSize]))
+	buf = buf[TagsetBlockOffsetSize:]
+	t.TagsetBlock.Size = int64(binary.BigEndian.Uint64(buf[0:TagsetBlockSizeSize]))
+	buf = buf[TagsetBlockSizeSize:]
+	t.TagsetBlock.Checksum = binary.BigEndian.Uint32(buf[0:TagsetBlockChecksumSize])
+	buf = buf[TagsetBlockChecksumSize:]
+
+	// Read measurement block info.
+	t.MeasurementBlock.Offset = int64(binary.BigEndian.Uint64(buf[0:MeasurementBlockOffsetSize]))
+	buf = buf[MeasurementBlockOffsetSize:]
+	t.MeasurementBlock.Size = int64(binary.BigEndian.Uint64(buf[0:MeasurementBlockSizeSize]))
+	buf = buf[MeasurementBlockSizeSize:]
+	t.MeasurementBlock.Checksum = binary.BigEndian.Uint32(buf[0:MeasurementBlockChecksumSize])
+	buf = buf[MeasurementBlockChecksumSize:]
+
+	if t.Version == IndexFileVersion2 {
+		return t, nil
+	}
+
+	// Read generation & level.
+	t.Generation = binary.BigEndian.Uint64(buf[0:IndexFileGenerationSize])
+	buf = buf[IndexFileGenerationSize:]
+	t.Level = int(binary.BigEndian.Uint16(buf[0:IndexFileLevelSize]))
+	buf = buf[IndexFileLevelSize:]
+
+	if t.Version == IndexFileVersion3 {
+		return t, nil
+	}
+
+	// Read tombstone block info.
+	t.TombstoneBlock.Offset = int64(binary.BigEndian.Uint64(buf[0:TombstoneBlockOffsetSize]))
+	buf = buf[TombstoneBlockOffsetSize:]
+	t.TombstoneBlock.Size = int64(binary.BigEndian.Uint64(buf[0:TombstoneBlockSizeSize]))
+	buf = buf[TombstoneBlockSizeSize:]
+	t.TombstoneBlock.Checksum = binary.BigEndian.Uint32(buf[0:TombstoneBlockChecksumSize])
+	buf = buf[TombstoneBlockChecksumSize:]
+
+	return t, nil
+}
+
+// readIndexFileTrailerV1 reads a version 1 trailer from data. The tagset
+// block position is derived from the series & measurement blocks.
+func readIndexFileTrailerV1(data []byte, t IndexFileTrailer) (IndexFileTrailer, error) {
+	// Slice trailer data.
+	if len(data) < IndexFileTrailerV1Size {
+		return t, io.ErrShortBuffer
+	}
+	buf := data[len(data)-IndexFileTrailerV1Size:]
 
 	// Read series list info.
 	t.SeriesBlock.Offset = int64(binary.BigEndian.Uint64(buf[0:SeriesBlockOffsetSize]))
@@ -393,35 +1295,154 @@ func ReadIndexFileTrailer(data []byte) (IndexFileTrailer, error) {
 	t.MeasurementBlock.Size = int64(binary.BigEndian.Uint64(buf[0:MeasurementBlockSizeSize]))
 	buf = buf[MeasurementBlockSizeSize:]
 
+	// Tagsets are written between the series & measurement blocks.
+	t.TagsetBlock.Offset = t.SeriesBlock.Offset + t.SeriesBlock.Size
+	t.TagsetBlock.Size = t.MeasurementBlock.Offset - t.TagsetBlock.Offset
+
 	return t, nil
 }
 
 // IndexFileTrailer represents meta data written to the end of the index file.
+//
+// The tagset block is the contiguous region holding every measurement's tag
+// block. Checksums are CRC32 (IEEE) of each block's data and are only present
+// in version 2 and later files. The generation & level are only present in
+// version 3 and later files; a zero generation means they were not set. The
+// tombstone block follows the measurement block & is only present in version
+// 4 and later files.
 type IndexFileTrailer struct {
 	Version     int
 	SeriesBlock struct {
-		Offset int64
-		Size   int64
+		Offset   int64
+		Size     int64
+		Checksum uint32
+	}
+	TagsetBlock struct {
+		Offset   int64
+		Size     int64
+		Checksum uint32
 	}
 	MeasurementBlock struct {
-		Offset int64
-		Size   int64
+		Offset   int64
+		Size     int64
+		Checksum uint32
+	}
+	Generation     uint64
+	Level          int
+	TombstoneBlock struct {
+		Offset   int64
+		Size     int64
+		Checksum uint32
+	}
+}
+
+// validate returns *ErrBlockOutOfBounds if the blocks are not in order,
+// overlap, or lie outside a file of size bytes. The arithmetic is done in
+// int64 so offsets outside the range of int, such as in files over 2GB on
+// 32-bit platforms, are rejected rather than truncated when the data is sliced.
+func (t *IndexFileTrailer) validate(path string, size int64) error {
+	max := size - int64(t.size())
+	min := int64(len(FileSignature))
+	for _, blk := range t.blocks() {
+		if blk.offset < min || blk.size < 0 || blk.offset > max || blk.size > max-blk.offset {
+			return &ErrBlockOutOfBounds{Path: path, Block: blk.name, Offset: blk.offset, Size: blk.size, Min: min, Max: max}
+		}
+		min = blk.offset + blk.size
+	}
+	return nil
+}
+
+// indexFileBlock is the position & checksum of a block from the trailer.
+type indexFileBlock struct {
+	name         string
+	offset, size int64
+	checksum     uint32
+}
+
+// blocks returns the series, tagset, measurement & tombstone blocks in file
+// order. The tombstone block is omitted before version 4.
+func (t *IndexFileTrailer) blocks() []indexFileBlock {
+	a := []indexFileBlock{
+		{"series", t.SeriesBlock.Offset, t.SeriesBlock.Size, t.SeriesBlock.Checksum},
+		{"tagset", t.TagsetBlock.Offset, t.TagsetBlock.Size, t.TagsetBlock.Checksum},
+		{"measurement", t.MeasurementBlock.Offset, t.MeasurementBlock.Size, t.MeasurementBlock.Checksum},
+	}
+	if t.Version >= IndexFileVersion4 {
+		a = append(a, indexFileBlock{"tombstone", t.TombstoneBlock.Offset, t.TombstoneBlock.Size, t.TombstoneBlock.Checksum})
+	}
+	return a
+}
+
+// size returns the encoded size of the trailer for its version.
+func (t *IndexFileTrailer) size() int {
+	switch t.Version {
+	case IndexFileVersion1:
+		return IndexFileTrailerV1Size
+	case IndexFileVersion2:
+		return IndexFileTrailerV2Size
+	case IndexFileVersion3:
+		return IndexFileTrailerV3Size
+	default:
+		return IndexFileTrailerSize
 	}
 }
 
-// WriteTo writes the trailer to w.
+// Checksummed returns true if the trailer was read from a file with checksums.
+func (t *IndexFileTrailer) Checksummed() bool { return t.Version >= IndexFileVersion2 }
+
+// WriteTo writes the trailer to w using the current version.
 func (t *IndexFileTrailer) WriteTo(w io.Writer) (n int64, err error) {
+	// Checksum all trailer fields up to the trailer checksum.
+	h := crc32.NewIEEE()
+	mw := io.MultiWriter(w, h)
+
 	// Write series list info.
-	if err := writeUint64To(w, uint64(t.SeriesBlock.Offset), &n); err != nil {
+	if err := writeUint64To(mw, uint64(t.SeriesBlock.Offset), &n); err != nil {
+		return n, err
+	} else if err := writeUint64To(mw, uint64(t.SeriesBlock.Size), &n); err != nil {
+		return n, err
+	} else if err := writeUint32To(mw, t.SeriesBlock.Checksum, &n); err != nil {
 		return n, err
-	} else if err := writeUint64To(w, uint64(t.SeriesBlock.Size), &n); err != nil {
+	}
+
+	// Write tagset block info.
+	if err := writeUint64To(mw, uint64(t.TagsetBlock.Offset), &n); err != nil {
+		return n, err
+	} else if err := writeUint64To(mw, uint64(t.TagsetBlock.Size), &n); err != nil {
+		return n, err
+	} else if err := writeUint32To(mw, t.TagsetBlock.Checksum, &n); err != nil {
 		return n, err
 	}
 
 	// Write measurement block info.
-	if err := writeUint64To(w, uint64(t.MeasurementBlock.Offset), &n); err != nil {
+	if err := writeUint64To(mw, uint64(t.MeasurementBlock.Offset), &n); err != nil {
+		return n, err
+	} else if err := writeUint64To(mw, uint64(t.MeasurementBlock.Size), &n); err != nil {
+		return n, err
+	} else if err := writeUint32To(mw, t.MeasurementBlock.Checksum, &n); err != nil {
 		return n, err
-	} else if err := writeUint64To(w, uint64(t.MeasurementBlock.Size), &n); err != nil {
+	}
+
+	// Write generation & level.
+	if t.Level < 0 || t.Level > math.MaxUint16 {
+		return n, fmt.Errorf("invalid index file level: %d", t.Level)
+	} else if err := writeUint64To(mw, t.Generation, &n); err != nil {
+		return n, err
+	} else if err := writeUint16To(mw, uint16(t.Level), &n); err != nil {
+		return n, err
+	}
+
+	// Write tombstone block info.
+	if err := writeUint64To(mw, uint64(t.TombstoneBlock.Offset), &n); err != nil {
+		return n, err
+	} else if err := writeUint64To(mw, uint64(t.TombstoneBlock.Size), &n); err != nil {
+		return n, err
+	} else if err := writeUint32To(mw, t.TombstoneBlock.Checksum, &n); err != nil {
+		return n, err
+	}
+
+	// Write trailer checksum.
+	if err := writeUint32To(w, h.Sum32(), &n); err != nil {
 		return n, err
 	}
 
@@ -0,0 +1,111 @@
+package tsi1
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// Ensure files too large to load as a single slice are loaded in windows in
+// each load mode.
+func TestIndexFile_Open_Windows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsi1-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Write a small file with a deleted series.
+	lf := NewLogFile(filepath.Join(dir, FormatLogFileName(1)))
+	if err := lf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	east := models.NewTags(map[string]string{"region": "east"})
+	west := models.NewTags(map[string]string{"region": "west"})
+	if err := lf.AddSeries([]byte("cpu"), east); err != nil {
+		t.Fatal(err)
+	} else if err := lf.AddSeries([]byte("cpu"), west); err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("cpu"), west); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := lf.CompactTo(&buf, 4096, 6); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	trailer, err := ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, FormatIndexFileName(2, 1))
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(v int64) { maxIndexFileDataSize = v }(maxIndexFileDataSize)
+	maxIndexFileDataSize = int64(len(data)) - 1
+
+	for _, mode := range []IndexFileLoadMode{IndexFileLoadMmap, IndexFileLoadHeap} {
+		f := NewIndexFile()
+		f.SetPath(path)
+		f.SetLoadMode(mode)
+		if err := f.Open(); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+
+		if f.base != trailer.TagsetBlock.Offset || int64(len(f.sdata)) != trailer.SeriesBlock.Size {
+			t.Fatalf("%s: unexpected windows: base=%d, series=%d", mode, f.base, len(f.sdata))
+		} else if f.Size() != int64(len(data)) {
+			t.Fatalf("%s: unexpected size: %d", mode, f.Size())
+		} else if err := f.Validate(); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		} else if err := f.VerifyChecksums(); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+
+		if exists, tombstoned := f.HasSeries([]byte("cpu"), east, nil); !exists || tombstoned {
+			t.Fatalf("%s: unexpected east: exists=%v, tombstoned=%v", mode, exists, tombstoned)
+		} else if exists, tombstoned := f.HasSeries([]byte("cpu"), west, nil); !exists || !tombstoned {
+			t.Fatalf("%s: unexpected west: exists=%v, tombstoned=%v", mode, exists, tombstoned)
+		} else if e := f.TagValueElem([]byte("cpu"), []byte("region"), []byte("east")); e == nil {
+			t.Fatalf("%s: expected tag value", mode)
+		}
+
+		u := f.MemUsage()
+		if mode == IndexFileLoadMmap && u.Mapped != int64(len(data))-trailer.TagsetBlock.Offset+trailer.SeriesBlock.Size {
+			t.Fatalf("%s: unexpected mapped size: %d", mode, u.Mapped)
+		} else if mode == IndexFileLoadHeap && (u.Mapped != 0 || u.Heap <= int64(len(data))-trailer.TagsetBlock.Offset+trailer.SeriesBlock.Size) {
+			t.Fatalf("%s: unexpected memory usage: %+v", mode, u)
+		}
+
+		if err := f.Close(); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		} else if f.sdata != nil || f.data != nil {
+			t.Fatalf("%s: expected windows to be released", mode)
+		}
+	}
+
+	// A corrupt series key is found in the series block window.
+	corrupt := append([]byte(nil), data...)
+	sblk := corrupt[trailer.SeriesBlock.Offset:][:trailer.SeriesBlock.Size]
+	sblk[bytes.Index(sblk, []byte("east"))] = 'b'
+	if err := ioutil.WriteFile(path, corrupt, 0666); err != nil {
+		t.Fatal(err)
+	}
+	f := NewIndexFile()
+	f.SetPath(path)
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err, ok := f.VerifyChecksums().(*ErrChecksumMismatch); !ok || err.Block != "series" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
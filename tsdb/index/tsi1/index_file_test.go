@@ -2,7 +2,16 @@ package tsi1_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/tsdb/index/tsi1"
@@ -42,6 +51,346 @@ func TestGenerateIndexFile(t *testing.T) {
 	}
 }
 
+// Ensure the series count excludes tombstoned series exactly once.
+func TestIndexFile_SeriesN(t *testing.T) {
+	f, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"}), Deleted: true},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := f.SeriesN(); n != 3 {
+		t.Fatalf("unexpected series count: %d", n)
+	}
+}
+
+// Ensure block checksums are written and verified.
+func TestIndexFile_VerifyChecksums(t *testing.T) {
+	data := MustCompactIndexFileData(t)
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	} else if !f.Checksummed() {
+		t.Fatal("expected checksummed file")
+	} else if err := f.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the trailer with a bad tagset checksum.
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer.TagsetBlock.Checksum++
+
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-tsi1.IndexFileTrailerSize])
+	if _, err := trailer.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var other tsi1.IndexFile
+	if err := other.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if err, ok := other.VerifyChecksums().(*tsi1.ErrChecksumMismatch); !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if err.Block != "tagset" {
+		t.Fatalf("unexpected block: %s", err.Block)
+	}
+}
+
+// Ensure a corrupt trailer is detected when reading it.
+func TestReadIndexFileTrailer_ErrTrailerChecksum(t *testing.T) {
+	data := MustCompactIndexFileData(t)
+	data[len(data)-tsi1.IndexFileTrailerSize]++
+	if _, err := tsi1.ReadIndexFileTrailer(data); err != tsi1.ErrIndexFileTrailerChecksum {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the format version can be read without loading the file.
+func TestIndexFileFormatVersion(t *testing.T) {
+	data := MustCompactIndexFileData(t)
+	if v, err := tsi1.IndexFileFormatVersion(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	} else if v != tsi1.IndexFileVersion {
+		t.Fatalf("unexpected version: %d", v)
+	}
+
+	// Files are sized using Stat().
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if v, err := tsi1.IndexFileFormatVersion(fd); err != nil {
+		t.Fatal(err)
+	} else if v != tsi1.IndexFileVersion {
+		t.Fatalf("unexpected version: %d", v)
+	}
+
+	// Unsupported versions are returned with an error.
+	other := append([]byte{}, data...)
+	binary.BigEndian.PutUint16(other[len(other)-tsi1.IndexFileVersionSize:], 100)
+	if v, err := tsi1.IndexFileFormatVersion(bytes.NewReader(other)); err != tsi1.ErrUnsupportedIndexFileVersion || v != 100 {
+		t.Fatalf("unexpected version: %d, err=%v", v, err)
+	}
+
+	for _, tt := range []struct {
+		r   io.ReaderAt
+		err error
+	}{
+		{r: bytes.NewReader([]byte("TSI")), err: io.ErrShortBuffer},
+		{r: bytes.NewReader([]byte("ABCD\x00\x02")), err: tsi1.ErrInvalidIndexFile},
+		{r: struct{ io.ReaderAt }{bytes.NewReader(data)}, err: tsi1.ErrUnknownIndexFileSize},
+	} {
+		if _, err := tsi1.IndexFileFormatVersion(tt.r); err != tt.err {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+// Ensure version 1 files without checksums can still be opened.
+func TestIndexFile_UnmarshalBinary_V1(t *testing.T) {
+	data := MustCompactIndexFileData(t)
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace trailer with the version 1 encoding.
+	buf := append([]byte{}, data[:len(data)-tsi1.IndexFileTrailerSize]...)
+	for _, v := range []int64{trailer.SeriesBlock.Offset, trailer.SeriesBlock.Size, trailer.MeasurementBlock.Offset, trailer.MeasurementBlock.Size} {
+		buf = append(buf, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(v))
+	}
+	buf = append(buf, 0, tsi1.IndexFileVersion1)
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	} else if f.Checksummed() {
+		t.Fatal("expected unverified file")
+	} else if err := f.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	} else if e := f.TagValueElem([]byte("cpu"), []byte("region"), []byte("west")); e == nil {
+		t.Fatal("expected element")
+	}
+
+	// Tagset block position is derived from the other blocks.
+	if v1, err := tsi1.ReadIndexFileTrailer(buf); err != nil {
+		t.Fatal(err)
+	} else if v1.TagsetBlock.Offset != trailer.TagsetBlock.Offset || v1.TagsetBlock.Size != trailer.TagsetBlock.Size {
+		t.Fatalf("unexpected tagset block: %+v", v1.TagsetBlock)
+	}
+}
+
+// Ensure trailers with blocks beyond the file, including past the 32-bit
+// range, or overlapping blocks are rejected rather than sliced.
+func TestIndexFile_Validate(t *testing.T) {
+	data := MustCompactIndexFileData(t)
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	} else if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		fn    func(t *tsi1.IndexFileTrailer)
+		block string
+	}{
+		{fn: func(t *tsi1.IndexFileTrailer) { t.MeasurementBlock.Offset += 1 << 32 }, block: "measurement"},
+		{fn: func(t *tsi1.IndexFileTrailer) { t.MeasurementBlock.Size += 1 << 32 }, block: "measurement"},
+		{fn: func(t *tsi1.IndexFileTrailer) { t.MeasurementBlock.Size++ }, block: "measurement"},
+		{fn: func(t *tsi1.IndexFileTrailer) { t.SeriesBlock.Size = 1<<63 - 1 }, block: "series"},
+		{fn: func(t *tsi1.IndexFileTrailer) { t.SeriesBlock.Offset = 0 }, block: "series"},
+		{fn: func(t *tsi1.IndexFileTrailer) { t.TagsetBlock.Offset = -1 }, block: "tagset"},
+		{fn: func(t *tsi1.IndexFileTrailer) { t.TagsetBlock.Offset = t.SeriesBlock.Offset }, block: "tagset"},
+	} {
+		other := trailer
+		tt.fn(&other)
+
+		var buf bytes.Buffer
+		buf.Write(data[:len(data)-tsi1.IndexFileTrailerSize])
+		if _, err := other.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		var f tsi1.IndexFile
+		if err, ok := f.UnmarshalBinary(buf.Bytes()).(*tsi1.ErrBlockOutOfBounds); !ok {
+			t.Fatalf("%d. unexpected error: %v", i, err)
+		} else if err.Block != tt.block {
+			t.Fatalf("%d. unexpected block: %s", i, err.Block)
+		}
+	}
+
+	// Opening a corrupt file fails with the path.
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+
+	other := trailer
+	other.MeasurementBlock.Offset += 1 << 32
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-tsi1.IndexFileTrailerSize])
+	if _, err := other.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	f = tsi1.IndexFile{}
+	f.SetPath(path)
+	if err, ok := f.Open().(*tsi1.ErrBlockOutOfBounds); !ok || err.Path != path {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure version 2 files without a generation or level can still be opened.
+func TestIndexFile_UnmarshalBinary_V2(t *testing.T) {
+	data := MustCompactIndexFileData(t)
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace trailer with the version 2 encoding, which ends after the
+	// measurement block checksum.
+	buf := append([]byte{}, data[:len(data)-tsi1.IndexFileTrailerSize]...)
+	fields := data[len(data)-tsi1.IndexFileTrailerSize:]
+	fields = fields[:tsi1.IndexFileTrailerV2Size-tsi1.IndexFileTrailerChecksumSize-tsi1.IndexFileVersionSize]
+	buf = append(buf, fields...)
+	buf = append(buf, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], crc32.ChecksumIEEE(fields))
+	buf = append(buf, 0, tsi1.IndexFileVersion2)
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	} else if !f.Checksummed() {
+		t.Fatal("expected checksummed file")
+	} else if err := f.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	} else if f.Trailer().MeasurementBlock != trailer.MeasurementBlock {
+		t.Fatalf("unexpected measurement block: %+v", f.Trailer().MeasurementBlock)
+	} else if f.Trailer().Generation != 0 {
+		t.Fatalf("unexpected generation: %d", f.Trailer().Generation)
+	} else if v, err := tsi1.IndexFileFormatVersion(bytes.NewReader(buf)); err != nil || v != tsi1.IndexFileVersion2 {
+		t.Fatalf("unexpected version: %d, err=%v", v, err)
+	}
+}
+
+// Ensure version 4 files, whose series block trailer has no codec, can still
+// be opened & their prefix-compressed keys read.
+func TestIndexFile_UnmarshalBinary_V4(t *testing.T) {
+	f0 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	var v5 bytes.Buffer
+	if _, err := (tsi1.IndexFiles{f0}).CompactToWithOptions(context.Background(), &v5, M, K, tsi1.CompactOptions{SeriesBlockCodec: tsi1.SeriesBlockCodecPrefix}); err != nil {
+		t.Fatal(err)
+	}
+	data := v5.Bytes()
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the codec from the series block trailer. A byte of padding after
+	// the signature keeps the offsets of the later blocks.
+	sblkEnd := trailer.SeriesBlock.Offset + trailer.SeriesBlock.Size
+	codecOffset := sblkEnd - tsi1.SeriesBlockTrailerSize
+	buf := append([]byte{}, data[:len(tsi1.FileSignature)]...)
+	buf = append(buf, 0)
+	buf = append(buf, data[len(tsi1.FileSignature):codecOffset]...)
+	buf = append(buf, data[codecOffset+1:len(data)-tsi1.IndexFileTrailerSize]...)
+
+	trailer.SeriesBlock.Offset++
+	trailer.SeriesBlock.Size--
+	trailer.SeriesBlock.Checksum = crc32.ChecksumIEEE(buf[trailer.SeriesBlock.Offset:sblkEnd])
+	other := bytes.NewBuffer(buf)
+	if _, err := trailer.WriteTo(other); err != nil {
+		t.Fatal(err)
+	}
+	buf = other.Bytes()
+	buf[len(buf)-1] = tsi1.IndexFileVersion4
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	} else if err := f.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	} else if v, err := tsi1.IndexFileFormatVersion(bytes.NewReader(buf)); err != nil || v != tsi1.IndexFileVersion4 {
+		t.Fatalf("unexpected version: %d, err=%v", v, err)
+	} else if n := f.SeriesN(); n != 3 {
+		t.Fatalf("unexpected series count: %d", n)
+	}
+
+	var exp []string
+	itr := f0.SeriesIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		if exists, tombstoned := f.HasSeries(e.Name(), e.Tags(), nil); !exists || tombstoned != e.Deleted() {
+			t.Fatalf("unexpected existence: %s %s, exists=%v, tombstoned=%v", e.Name(), e.Tags(), exists, tombstoned)
+		}
+		exp = append(exp, seriesReaderKey(e))
+	}
+
+	// The series reader decodes the same keys but reports no codec.
+	r, err := tsi1.NewSeriesReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	} else if r.Codec() != tsi1.SeriesBlockCodecNone {
+		t.Fatalf("unexpected codec: %s", r.Codec())
+	}
+	var got []string
+	for {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		} else if e == nil {
+			break
+		}
+		got = append(got, seriesReaderKey(e))
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected series: %v", got)
+	}
+
+	// The trailer JSON omits the codec.
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if js, err := tsi1.ReadTrailerJSON(path); err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(js, []byte("seriesCodec")) {
+		t.Fatalf("unexpected codec: %s", js)
+	}
+}
+
 func BenchmarkIndexFile_TagValueSeries(b *testing.B) {
 	b.Run("M=1,K=2,V=3", func(b *testing.B) {
 		benchmarkIndexFile_TagValueSeries(b, MustFindOrGenerateIndexFile(1, 2, 3))
@@ -67,6 +416,458 @@ func benchmarkIndexFile_TagValueSeries(b *testing.B, idx *tsi1.IndexFile) {
 	}
 }
 
+// BenchmarkIndexFile_HasSeries_Parallel measures concurrent point lookups on
+// an immutable file. Lookups take no locks, so run with -cpu 1,2,4,8,16 on a
+// multi-core machine to check that throughput scales with cores.
+func BenchmarkIndexFile_HasSeries_Parallel(b *testing.B) {
+	f := MustFindOrGenerateIndexFile(10, 3, 10)
+
+	var series []Series
+	itr := f.SeriesIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		series = append(series, Series{Name: e.Name(), Tags: e.Tags()})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var buf []byte
+		for i := 0; pb.Next(); i++ {
+			s := series[(i*7919)%len(series)]
+			if exists, _ := f.HasSeries(s.Name, s.Tags, buf); !exists {
+				b.Fatal("expected series")
+			}
+		}
+	})
+}
+
+// BenchmarkIndexFile_SeriesIterator_Parallel measures concurrent full scans of
+// the series block while retaining the file, as queries do. Run it with the
+// same -cpu list as BenchmarkIndexFile_HasSeries_Parallel.
+func BenchmarkIndexFile_SeriesIterator_Parallel(b *testing.B) {
+	f := MustFindOrGenerateIndexFile(10, 3, 10)
+	exp := int(f.SeriesN())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			f.Retain()
+			var n int
+			itr := f.SeriesIterator()
+			for e := itr.Next(); e != nil; e = itr.Next() {
+				n++
+			}
+			f.Release()
+
+			if n != exp {
+				b.Fatalf("unexpected series count: %d", n)
+			}
+		}
+	})
+}
+
+// Ensure a file opened without its series block serves measurements & tags.
+func TestIndexFile_OpenMetadataOnly(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if _, err := (tsi1.IndexFiles{MustGenerateIndexFile(3, 2, 2)}).CompactToFile(path, M, K, false); err != nil {
+		t.Fatal(err)
+	}
+	full := tsi1.NewIndexFile()
+	full.SetPath(path)
+	if err := full.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer full.Close()
+
+	f := tsi1.NewIndexFile()
+	if err := f.OpenMetadataOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if !f.MetadataOnly() || full.MetadataOnly() {
+		t.Fatal("unexpected metadata only flag")
+	} else if f.Size() != full.Size() {
+		t.Fatalf("unexpected size: %d, expected %d", f.Size(), full.Size())
+	} else if err := f.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Measurements, tag keys & tag values are available.
+	var names []string
+	itr := f.MeasurementIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		names = append(names, string(e.Name()))
+	}
+	if exp := []string{"measurement0", "measurement1", "measurement2"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	var keys []string
+	kitr := f.TagKeyIterator([]byte("measurement1"))
+	for e := kitr.Next(); e != nil; e = kitr.Next() {
+		keys = append(keys, string(e.Key()))
+	}
+	if exp := []string{"key0", "key1"}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	if set, err := f.TagValueSeriesIDSet([]byte("measurement1"), []byte("key0"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if exp, err := full.TagValueSeriesIDSet([]byte("measurement1"), []byte("key0"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(set.Slice(), exp.Slice()) {
+		t.Fatalf("unexpected series ids: %v", set.Slice())
+	}
+
+	// Series are unavailable.
+	if f.SeriesIterator() != nil || f.MeasurementSeriesIterator([]byte("measurement1")) != nil {
+		t.Fatal("expected no series iterator")
+	} else if f.TagValueSeriesIterator([]byte("measurement1"), []byte("key0"), []byte("value1")) != nil {
+		t.Fatal("expected no tag value series iterator")
+	} else if f.SeriesN() != 0 {
+		t.Fatalf("unexpected series count: %d", f.SeriesN())
+	} else if _, err := f.MeasurementSketch([]byte("measurement1")); err != tsi1.ErrSeriesBlockNotLoaded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := (tsi1.IndexFiles{f}).CompactTo(&buf, M, K); err == nil {
+		t.Fatal("expected error")
+	} else if e, ok := err.(*tsi1.CompactError); !ok || e.Err != tsi1.ErrSeriesBlockNotLoaded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure index files can be opened from a file system other than the disk.
+func TestIndexFile_OpenFS(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := (tsi1.IndexFiles{MustGenerateIndexFile(3, 2, 2)}).CompactTo(&buf, M, K); err != nil {
+		t.Fatal(err)
+	}
+	name := tsi1.FormatIndexFileName(4, 2)
+	fsys := MemFileSystem{name: buf.Bytes()}
+
+	f := tsi1.NewIndexFile()
+	f.SetPath(name)
+	if err := f.OpenFS(fsys); err != nil {
+		t.Fatal(err)
+	} else if f.ID() != 4 || f.Level() != 2 {
+		t.Fatalf("unexpected id/level: %d/%d", f.ID(), f.Level())
+	} else if f.Size() != int64(buf.Len()) {
+		t.Fatalf("unexpected size: %d", f.Size())
+	} else if f.SeriesN() != 12 {
+		t.Fatalf("unexpected series count: %d", f.SeriesN())
+	} else if err := f.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	} else if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := tsi1.NewIndexFile()
+	if err := meta.OpenMetadataOnlyFS(fsys, name); err != nil {
+		t.Fatal(err)
+	} else if !meta.MetadataOnly() {
+		t.Fatal("expected metadata only")
+	} else if meta.Measurement([]byte("measurement1")) == nil {
+		t.Fatal("expected measurement")
+	} else if err := meta.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing & corrupt files fail to open.
+	fsys["bad"] = []byte("bad")
+	missing := tsi1.NewIndexFile()
+	missing.SetPath("missing")
+	if err := missing.OpenFS(fsys); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	corrupt := tsi1.NewIndexFile()
+	corrupt.SetPath("bad")
+	if err := corrupt.OpenFS(fsys); err != io.ErrShortBuffer {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the memory used by open files is split between mapped & heap memory.
+func TestIndexFile_MemUsage(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if _, err := (tsi1.IndexFiles{MustGenerateIndexFile(3, 2, 2)}).CompactToFile(path, M, K, false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapped := tsi1.NewIndexFile()
+	mapped.SetPath(path)
+	if err := mapped.Open(); err != nil {
+		t.Fatal(err)
+	}
+	u := mapped.MemUsage()
+	if u.Mapped != int64(len(data)) || u.Heap <= 0 {
+		t.Fatalf("unexpected mapped usage: %+v", u)
+	} else if n := mapped.MemSize(); n != u.Mapped+u.Heap {
+		t.Fatalf("unexpected size: %d", n)
+	}
+
+	// Data read into memory is heap memory.
+	inMem := tsi1.NewIndexFile()
+	inMem.SetPath(path)
+	if err := inMem.OpenFS(tsi1.OSFileSystem{}); err != nil {
+		t.Fatal(err)
+	} else if v := inMem.MemUsage(); v.Mapped != 0 || v.Heap != u.Mapped+u.Heap {
+		t.Fatalf("unexpected in-memory usage: %+v", v)
+	}
+
+	// Metadata-only files have no series block structures.
+	meta := tsi1.NewIndexFile()
+	if err := meta.OpenMetadataOnly(path); err != nil {
+		t.Fatal(err)
+	} else if v := meta.MemUsage(); v.Mapped != 0 || v.Heap >= u.Mapped+u.Heap {
+		t.Fatalf("unexpected metadata only usage: %+v", v)
+	}
+
+	a := tsi1.IndexFiles{mapped, inMem, meta}
+	if v := a.MemUsage(); v.Mapped != u.Mapped || v.Heap != u.Heap+inMem.MemUsage().Heap+meta.MemUsage().Heap {
+		t.Fatalf("unexpected total usage: %+v", v)
+	} else if n := a.MemSize(); n != v.Mapped+v.Heap {
+		t.Fatalf("unexpected total size: %d", n)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	} else if v := a.MemUsage(); v != (tsi1.MemUsage{}) {
+		t.Fatalf("unexpected usage after close: %+v", v)
+	}
+}
+
+// Ensure index files behave identically when memory mapped or read into heap.
+func TestIndexFile_LoadMode(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(4, 2))
+	if _, err := (tsi1.IndexFiles{MustGenerateIndexFile(3, 2, 2)}).CompactToFile(path, M, K, false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []tsi1.IndexFileLoadMode{tsi1.IndexFileLoadMmap, tsi1.IndexFileLoadHeap} {
+		t.Run("mode="+mode.String(), func(t *testing.T) {
+			f := tsi1.NewIndexFile()
+			f.SetPath(path)
+			f.SetLoadMode(mode)
+			if err := f.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			if f.LoadMode() != mode {
+				t.Fatalf("unexpected load mode: %s", f.LoadMode())
+			} else if f.ID() != 4 || f.Level() != 2 {
+				t.Fatalf("unexpected id/level: %d/%d", f.ID(), f.Level())
+			} else if f.Size() != int64(len(data)) {
+				t.Fatalf("unexpected size: %d", f.Size())
+			} else if err := f.VerifyChecksums(); err != nil {
+				t.Fatal(err)
+			} else if n := f.SeriesN(); n != 12 {
+				t.Fatalf("unexpected series count: %d", n)
+			} else if n := f.MeasurementN(); n != 3 {
+				t.Fatalf("unexpected measurement count: %d", n)
+			}
+
+			tags := models.NewTags(map[string]string{"key0": "value1", "key1": "value0"})
+			if exists, tombstoned := f.HasSeries([]byte("measurement2"), tags, nil); !exists || tombstoned {
+				t.Fatalf("unexpected series state: exists=%v tombstoned=%v", exists, tombstoned)
+			} else if exists, _ := f.HasSeries([]byte("measurement3"), tags, nil); exists {
+				t.Fatal("expected no series")
+			} else if e := f.TagValue([]byte("measurement1"), []byte("key1"), []byte("value1")); e == nil {
+				t.Fatal("expected tag value")
+			}
+
+			var values []string
+			itr := f.TagValueIterator([]byte("measurement0"), []byte("key0"))
+			for e := itr.Next(); e != nil; e = itr.Next() {
+				values = append(values, string(e.Value()))
+			}
+			if !reflect.DeepEqual(values, []string{"value0", "value1"}) {
+				t.Fatalf("unexpected tag values: %v", values)
+			}
+
+			var n int
+			sitr := f.MeasurementSeriesIterator([]byte("measurement1"))
+			for e := sitr.Next(); e != nil; e = sitr.Next() {
+				n++
+			}
+			if n != 4 {
+				t.Fatalf("unexpected measurement series count: %d", n)
+			}
+
+			switch u := f.MemUsage(); mode {
+			case tsi1.IndexFileLoadMmap:
+				if u.Mapped != int64(len(data)) {
+					t.Fatalf("unexpected mapped usage: %+v", u)
+				}
+			case tsi1.IndexFileLoadHeap:
+				if u.Mapped != 0 || u.Heap <= int64(len(data)) {
+					t.Fatalf("unexpected heap usage: %+v", u)
+				}
+			}
+		})
+	}
+
+	// Data read into heap is unaffected by the file being truncated after it
+	// is opened, whereas accessing a truncated mapping would raise SIGBUS.
+	t.Run("truncated", func(t *testing.T) {
+		tpath := filepath.Join(dir, tsi1.FormatIndexFileName(5, 2))
+		if err := ioutil.WriteFile(tpath, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		f := tsi1.NewIndexFile()
+		f.SetPath(tpath)
+		f.SetLoadMode(tsi1.IndexFileLoadHeap)
+		if err := f.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := os.Truncate(tpath, 0); err != nil {
+			t.Fatal(err)
+		} else if err := f.VerifyChecksums(); err != nil {
+			t.Fatal(err)
+		} else if f.Measurement([]byte("measurement2")) == nil {
+			t.Fatal("expected measurement")
+		}
+
+		// A file truncated before it is opened fails to open in either mode.
+		for _, mode := range []tsi1.IndexFileLoadMode{tsi1.IndexFileLoadMmap, tsi1.IndexFileLoadHeap} {
+			if err := os.Truncate(tpath, int64(len(data)/2)); err != nil {
+				t.Fatal(err)
+			}
+			other := tsi1.NewIndexFile()
+			other.SetPath(tpath)
+			other.SetLoadMode(mode)
+			if err := other.Open(); err == nil {
+				other.Close()
+				t.Fatalf("expected error: mode=%s", mode)
+			}
+		}
+	})
+
+	// Unknown modes are rejected.
+	f := tsi1.NewIndexFile()
+	f.SetPath(path)
+	f.SetLoadMode(tsi1.IndexFileLoadMode(99))
+	if err := f.Open(); err == nil || err.Error() != "invalid index file load mode: 99" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure measurements can be read from a file without opening it.
+func TestReadIndexFileMeasurements(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	f, err := GenerateIndexFile(3, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if _, err := (tsi1.IndexFiles{f}).CompactToFile(path, M, K, false); err != nil {
+		t.Fatal(err)
+	}
+
+	itr, err := tsi1.ReadIndexFileMeasurements(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		names = append(names, string(e.Name()))
+	}
+	if exp := []string{"measurement0", "measurement1", "measurement2"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	// Corrupt the measurement block.
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[trailer.MeasurementBlock.Offset]++
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tsi1.ReadIndexFileMeasurements(path); err == nil {
+		t.Fatal("expected error")
+	} else if err, ok := err.(*tsi1.ErrChecksumMismatch); !ok || err.Block != "measurement" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func BenchmarkReadIndexFileMeasurements(b *testing.B) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if _, err := (tsi1.IndexFiles{MustFindOrGenerateIndexFile(10, 5, 5)}).CompactToFile(path, M, K, false); err != nil {
+		b.Fatal(err)
+	}
+
+	// Open the whole file & list its measurements.
+	b.Run("Open", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f := tsi1.NewIndexFile()
+			f.SetPath(path)
+			if err := f.Open(); err != nil {
+				b.Fatal(err)
+			}
+			benchmarkMeasurementIterator(b, f.MeasurementIterator())
+			f.Close()
+		}
+	})
+
+	// Read only the measurement block.
+	b.Run("MeasurementBlock", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			itr, err := tsi1.ReadIndexFileMeasurements(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchmarkMeasurementIterator(b, itr)
+		}
+	})
+}
+
+func benchmarkMeasurementIterator(b *testing.B, itr tsi1.MeasurementIterator) {
+	var n int
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		n++
+	}
+	if n != 10 {
+		b.Fatalf("unexpected measurement count: %d", n)
+	}
+}
+
 // CreateIndexFile creates an index file with a given set of series.
 func CreateIndexFile(series []Series) (*tsi1.IndexFile, error) {
 	lf, err := CreateLogFile(series)
@@ -88,6 +889,47 @@ func CreateIndexFile(series []Series) (*tsi1.IndexFile, error) {
 	return &f, nil
 }
 
+// MustCreateIndexFile returns a new index file with a list of series or panics.
+func MustCreateIndexFile(series []Series) *tsi1.IndexFile {
+	f, err := CreateIndexFile(series)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// CompactLogFile compacts a log file into an in-memory index file.
+func CompactLogFile(lf *LogFile) (*tsi1.IndexFile, error) {
+	var buf bytes.Buffer
+	if _, err := lf.CompactTo(&buf, M, K); err != nil {
+		return nil, err
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// MustCompactIndexFileData returns the encoded bytes of a small index file.
+func MustCompactIndexFileData(tb testing.TB) []byte {
+	f, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := (tsi1.IndexFiles{f}).CompactTo(&buf, M, K); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
 // GenerateIndexFile generates an index file from a set of series based on the count arguments.
 // Total series returned will equal measurementN * tagN * valueN.
 func GenerateIndexFile(measurementN, tagN, valueN int) (*tsi1.IndexFile, error) {
@@ -152,3 +994,40 @@ func pow(x, y int) int {
 	}
 	return r
 }
+
+// MemFileSystem is an in-memory file system of file data by name.
+type MemFileSystem map[string][]byte
+
+// Open opens the named file.
+func (fsys MemFileSystem) Open(name string) (tsi1.ReadAtFile, error) {
+	data, ok := fsys[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{Reader: bytes.NewReader(data), name: name}, nil
+}
+
+// memFile is a file opened from a MemFileSystem.
+type memFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *memFile) Close() error { return nil }
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return memFileInfo{name: f.name, size: f.Size()}, nil
+}
+
+// memFileInfo is the os.FileInfo of a memFile.
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return filepath.Base(fi.name) }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
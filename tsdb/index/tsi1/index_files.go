@@ -2,19 +2,75 @@ package tsi1
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/pkg/bloom"
+	"github.com/influxdata/influxdb/pkg/estimator"
 	"github.com/influxdata/influxdb/pkg/estimator/hll"
+	"github.com/influxdata/influxdb/pkg/limiter"
 	"github.com/influxdata/influxdb/pkg/mmap"
 )
 
 // IndexFiles represents a layered set of index files.
+//
+// Files are ordered newest first. When a measurement, tag key, tag value or
+// series exists in multiple files the element from the earliest file in the
+// slice is used so its tombstone state is the most recent. The order is not
+// derived from the file IDs because a compacted file is assigned a new ID
+// while newer files at lower levels may still exist. Callers must keep the
+// order of the file set, as FileSet does.
+//
+// Iterators returned by IndexFiles retain every file in the set when they are
+// created & release them when closed so the files cannot be unmapped while an
+// iterator is in use. Callers must close each iterator when finished with it,
+// otherwise IndexFile.Close blocks. Elements returned by an iterator are only
+// valid until it is closed. Methods which iterate internally, such as
+// CompactTo, expect the caller to retain the files for their duration.
 type IndexFiles []*IndexFile
 
+// OpenIndexFiles opens the index files at each path in order. If any file
+// cannot be opened then the files already opened are closed and the error
+// is returned. The returned set should be closed with Close.
+func OpenIndexFiles(paths ...string) (IndexFiles, error) {
+	p := make(IndexFiles, 0, len(paths))
+	for _, path := range paths {
+		f := NewIndexFile()
+		f.SetPath(path)
+		if err := f.Open(); err != nil {
+			p.Close()
+			return nil, err
+		}
+		p = append(p, f)
+	}
+	return p, nil
+}
+
+// Close closes all files. Each file waits for its references to be released.
+// The first error is returned, however, every file is closed.
+func (p IndexFiles) Close() error {
+	var err error
+	for _, f := range p {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 // IDs returns the ids for all index files.
 func (p IndexFiles) IDs() []int {
 	a := make([]int, len(p))
@@ -24,6 +80,38 @@ func (p IndexFiles) IDs() []int {
 	return a
 }
 
+// Select returns the files with an id in ids, in the order of p. The returned
+// files are retained & must be released by the caller.
+func (p IndexFiles) Select(ids ...int) IndexFiles {
+	return p.filter(func(id int) bool {
+		for _, v := range ids {
+			if v == id {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// SelectRange returns the files with an id between minID & maxID, inclusive,
+// in the order of p. The returned files are retained & must be released by
+// the caller.
+func (p IndexFiles) SelectRange(minID, maxID int) IndexFiles {
+	return p.filter(func(id int) bool { return id >= minID && id <= maxID })
+}
+
+// filter returns the retained files with an id matching fn.
+func (p IndexFiles) filter(fn func(id int) bool) IndexFiles {
+	var other IndexFiles
+	for _, f := range p {
+		if fn(f.ID()) {
+			other = append(other, f)
+		}
+	}
+	other.Retain()
+	return other
+}
+
 // Retain adds a reference count to all files.
 func (p IndexFiles) Retain() {
 	for _, f := range p {
@@ -49,264 +137,2160 @@ func (p IndexFiles) Files() []File {
 
 // MeasurementNames returns a sorted list of all measurement names for all files.
 func (p *IndexFiles) MeasurementNames() [][]byte {
-	itr := p.MeasurementIterator()
+	return p.AppendMeasurementNames(nil)
+}
+
+// AppendMeasurementNames appends a sorted list of all measurement names for
+// all files to dst and returns the extended slice.
+//
+// Names are copied into a single backing byte slice instead of being copied
+// individually. Each returned name has its capacity limited to its length so
+// appending to one name does not overwrite the next.
+func (p IndexFiles) AppendMeasurementNames(dst [][]byte) [][]byte {
+	itr := p.measurementIterator()
+	if itr == nil {
+		return dst
+	}
+
+	// Copy names into a shared buffer and track where each name ends.
+	var buf []byte
+	var ends []int
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		buf = append(buf, e.Name()...)
+		ends = append(ends, len(buf))
+	}
+
+	// Slice names out of the buffer now that it will no longer be reallocated.
+	var start int
+	for _, end := range ends {
+		dst = append(dst, buf[start:end:end])
+		start = end
+	}
+	return dst
+}
+
+// MeasurementNamesN returns the first limit measurement names in sorted order.
+// All names are returned if limit is zero or less.
+func (p IndexFiles) MeasurementNamesN(limit int) [][]byte {
+	return p.MeasurementNamesFrom(nil, limit)
+}
+
+// MeasurementNamesFrom returns up to limit measurement names which sort after
+// the given name. All remaining names are returned if limit is zero or less.
+//
+// The merged measurement iterator is already sorted so names are collected in
+// order and no sort is required. Passing the last name of a page as after
+// returns the next page.
+func (p IndexFiles) MeasurementNamesFrom(after []byte, limit int) [][]byte {
+	itr := p.measurementIterator()
+	if itr == nil {
+		return nil
+	}
+
 	var names [][]byte
 	for e := itr.Next(); e != nil; e = itr.Next() {
+		if after != nil && bytes.Compare(e.Name(), after) <= 0 {
+			continue
+		}
+
 		names = append(names, copyBytes(e.Name()))
+		if limit > 0 && len(names) >= limit {
+			break
+		}
 	}
-	sort.Sort(byteSlices(names))
 	return names
 }
 
-// MeasurementIterator returns an iterator that merges measurements across all files.
-func (p IndexFiles) MeasurementIterator() MeasurementIterator {
+// MeasurementNamesByPrefix returns up to limit measurement names beginning
+// with prefix in sorted order. All matching names are returned if limit is
+// zero or less. Like MeasurementNamesFrom, deleted measurements are included.
+//
+// Each file is positioned at the prefix before the iterators are merged & the
+// merge stops at the first name past the prefix, so names outside the prefix
+// are never merged or copied.
+func (p IndexFiles) MeasurementNamesByPrefix(prefix []byte, limit int) [][]byte {
 	a := make([]MeasurementIterator, 0, len(p))
-	for i := range p {
-		itr := p[i].MeasurementIterator()
-		if itr == nil {
-			continue
-		}
-		a = append(a, itr)
+	for _, f := range p {
+		a = append(a, f.MeasurementPrefixIterator(prefix))
 	}
-	return MergeMeasurementIterators(a...)
+	return measurementNames(MergeMeasurementIterators(a...), limit)
 }
 
-// TagKeyIterator returns an iterator that merges tag keys across all files.
-func (p *IndexFiles) TagKeyIterator(name []byte) (TagKeyIterator, error) {
-	a := make([]TagKeyIterator, 0, len(*p))
-	for _, f := range *p {
-		itr := f.TagKeyIterator(name)
-		if itr == nil {
-			continue
+// MeasurementNamesByFoldPrefix returns up to limit measurement names beginning
+// with prefix, ignoring ASCII case, in sorted order. All matching names are
+// returned if limit is zero or less. Like MeasurementNamesByPrefix, deleted
+// measurements are included.
+//
+// Only ASCII letters are folded. See FilterFoldMeasurementIterator for the
+// differences from the (?i) flag of a regular expression.
+func (p IndexFiles) MeasurementNamesByFoldPrefix(prefix []byte, limit int) [][]byte {
+	a := make([]MeasurementIterator, 0, len(p))
+	for _, f := range p {
+		a = append(a, f.MeasurementFoldPrefixIterator(prefix))
+	}
+	return measurementNames(MergeMeasurementIterators(a...), limit)
+}
+
+// MeasurementNamesFold returns the measurement names equal to name, ignoring
+// ASCII case, in sorted order. Deleted measurements are included.
+func (p IndexFiles) MeasurementNamesFold(name []byte) [][]byte {
+	a := make([]MeasurementIterator, 0, len(p))
+	for _, f := range p {
+		a = append(a, FilterFoldMeasurementIterator(f.MeasurementFoldPrefixIterator(name), name, false))
+	}
+	return measurementNames(MergeMeasurementIterators(a...), 0)
+}
+
+// measurementNames returns copies of up to limit names from itr. All names are
+// returned if limit is zero or less.
+func measurementNames(itr MeasurementIterator, limit int) [][]byte {
+	if itr == nil {
+		return nil
+	}
+
+	var names [][]byte
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		names = append(names, copyBytes(e.Name()))
+		if limit > 0 && len(names) >= limit {
+			break
 		}
-		a = append(a, itr)
 	}
-	return MergeTagKeyIterators(a...), nil
+	return names
 }
 
-// SeriesIterator returns an iterator that merges series across all files.
-func (p IndexFiles) SeriesIterator() SeriesIterator {
-	a := make([]SeriesIterator, 0, len(p))
+// CountMeasurements returns the number of distinct measurement names across
+// all files, which is len(MeasurementNames()) without copying or collecting
+// the names. Like MeasurementNames, deleted measurements are included.
+//
+// If the name ranges of the files do not overlap then no name is in more than
+// one file and the count of each file's measurement block is summed. When
+// ranges overlap the per-file sum is only an upper bound so the names are
+// merged across the files to remove duplicates instead.
+func (p IndexFiles) CountMeasurements() (int, error) {
+	var sum int
+	bounds := make([][2][]byte, 0, len(p))
 	for _, f := range p {
-		itr := f.SeriesIterator()
-		if itr == nil {
+		min, max, n := f.mblk.nameRange()
+		if n == 0 {
 			continue
 		}
-		a = append(a, itr)
+
+		for _, b := range bounds {
+			if bytes.Compare(min, b[1]) <= 0 && bytes.Compare(b[0], max) <= 0 {
+				return p.countMeasurementsByIterator(), nil
+			}
+		}
+		bounds = append(bounds, [2][]byte{min, max})
+		sum += n
 	}
-	return MergeSeriesIterators(a...)
+	return sum, nil
 }
 
-// MeasurementSeriesIterator returns an iterator that merges series across all files.
-func (p IndexFiles) MeasurementSeriesIterator(name []byte) SeriesIterator {
-	a := make([]SeriesIterator, 0, len(p))
-	for _, f := range p {
-		itr := f.MeasurementSeriesIterator(name)
+// countMeasurementsByIterator counts the distinct measurement names of the
+// merged iterator.
+func (p IndexFiles) countMeasurementsByIterator() (n int) {
+	itr := p.measurementIterator()
+	if itr == nil {
+		return 0
+	}
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		n++
+	}
+	return n
+}
+
+// MeasurementIterator returns an iterator that merges measurements across all files.
+func (p IndexFiles) MeasurementIterator() MeasurementIteratorCloser {
+	return retainMeasurementIterator(p, p.measurementIterator())
+}
+
+// measurementIterator returns a merged measurement iterator which does not
+// retain the files.
+func (p IndexFiles) measurementIterator() MeasurementIterator {
+	a := make([]MeasurementIterator, 0, len(p))
+	for i := range p {
+		itr := p[i].MeasurementIterator()
 		if itr == nil {
 			continue
 		}
 		a = append(a, itr)
 	}
-	return MergeSeriesIterators(a...)
+	return MergeMeasurementIterators(a...)
 }
 
-// TagValueSeriesIterator returns an iterator that merges series across all files.
-func (p IndexFiles) TagValueSeriesIterator(name, key, value []byte) SeriesIterator {
-	a := make([]SeriesIterator, 0, len(p))
-	for i := range p {
-		itr := p[i].TagValueSeriesIterator(name, key, value)
-		if itr != nil {
-			a = append(a, itr)
+// HasMeasurement returns true if the most recent state of the measurement is
+// not deleted. Each file is checked with its measurement hash index so no
+// iterators are created.
+func (p IndexFiles) HasMeasurement(name []byte) bool {
+	for _, f := range p {
+		if e := f.Measurement(name); e != nil {
+			return !e.Deleted()
 		}
 	}
-	return MergeSeriesIterators(a...)
+	return false
 }
 
-// CompactTo merges all index files and writes them to w.
-func (p IndexFiles) CompactTo(w io.Writer, m, k uint64) (n int64, err error) {
-	var t IndexFileTrailer
-
-	// Wrap writer in buffered I/O.
-	bw := bufio.NewWriter(w)
-
-	// Setup context object to track shared data for this compaction.
-	var info indexCompactInfo
-	info.tagSets = make(map[string]indexTagSetPos)
+// AnyMeasurement returns true if the set contains at least one measurement
+// which is not deleted. Measurements are read from each file in turn rather
+// than merged & the first live measurement not tombstoned by a newer file is
+// returned, so a set without tombstones is answered from its first element.
+func (p IndexFiles) AnyMeasurement() bool {
+	for i, f := range p {
+		itr := f.mblk.Iterator()
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			if e.Deleted() {
+				continue
+			}
 
-	// Write magic number.
-	if err := writeTo(bw, []byte(FileSignature), &n); err != nil {
-		return n, err
+			// Newer files take precedence over this file.
+			if !p[:i].hasMeasurementElem(e.Name()) {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	// Write combined series list.
-	t.SeriesBlock.Offset = n
-	if err := p.writeSeriesBlockTo(bw, m, k, &info, &n); err != nil {
-		return n, err
+// FirstMeasurement returns the smallest measurement name whose most recent
+// state is not deleted. Returns nil if there is none.
+//
+// The first element of each file's measurement block is read directly so if
+// the smallest name in the set is live it is returned without merging the
+// files. Otherwise the merged measurements are iterated until a live name is
+// found.
+func (p IndexFiles) FirstMeasurement() ([]byte, error) {
+	var min []byte
+	for _, f := range p {
+		if e, ok := f.mblk.first(); ok && (min == nil || bytes.Compare(e.name, min) < 0) {
+			min = e.name
+		}
 	}
-	t.SeriesBlock.Size = n - t.SeriesBlock.Offset
-
-	// Flush buffer before re-mapping.
-	if err := bw.Flush(); err != nil {
-		return n, err
+	if min == nil {
+		return nil, nil
+	} else if p.HasMeasurement(min) {
+		return copyBytes(min), nil
 	}
+	return firstLiveMeasurementName(p.measurementIterator()), nil
+}
 
-	// Open series block as memory-mapped data.
-	sblk, data, err := mapIndexFileSeriesBlock(w)
-	if data != nil {
-		defer mmap.Unmap(data)
+// LastMeasurement returns the largest measurement name whose most recent
+// state is not deleted. Returns nil if there is none.
+//
+// Like FirstMeasurement, the last element of each file's measurement block is
+// read directly using the offset found when the block was opened. Otherwise the
+// merged measurements are iterated in descending order until a live name is
+// found.
+func (p IndexFiles) LastMeasurement() ([]byte, error) {
+	var max []byte
+	for _, f := range p {
+		if e, ok := f.mblk.last(); ok && (max == nil || bytes.Compare(e.name, max) > 0) {
+			max = e.name
+		}
 	}
-	if err != nil {
-		return n, err
+	if max == nil {
+		return nil, nil
+	} else if p.HasMeasurement(max) {
+		return copyBytes(max), nil
 	}
-	info.sblk = sblk
 
-	// Write tagset blocks in measurement order.
-	if err := p.writeTagsetsTo(bw, &info, &n); err != nil {
-		return n, err
+	a := make([]MeasurementIterator, 0, len(p))
+	for _, f := range p {
+		a = append(a, f.ReverseMeasurementIterator())
 	}
+	return firstLiveMeasurementName(MergeReverseMeasurementIterators(a...)), nil
+}
 
-	// Write measurement block.
-	t.MeasurementBlock.Offset = n
-	if err := p.writeMeasurementBlockTo(bw, &info, &n); err != nil {
-		return n, err
+// firstLiveMeasurementName returns a copy of the first name from itr which is
+// not deleted. Returns nil if there is none.
+func firstLiveMeasurementName(itr MeasurementIterator) []byte {
+	if itr == nil {
+		return nil
 	}
-	t.MeasurementBlock.Size = n - t.MeasurementBlock.Offset
-
-	// Write trailer.
-	nn, err := t.WriteTo(bw)
-	n += nn
-	if err != nil {
-		return n, err
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		if !e.Deleted() {
+			return copyBytes(e.Name())
+		}
 	}
+	return nil
+}
 
-	// Flush file.
-	if err := bw.Flush(); err != nil {
-		return n, err
+// hasMeasurementElem returns true if any file contains an element for name.
+func (p IndexFiles) hasMeasurementElem(name []byte) bool {
+	for _, f := range p {
+		if f.Measurement(name) != nil {
+			return true
+		}
 	}
-
-	return n, nil
+	return false
 }
 
-func (p IndexFiles) writeSeriesBlockTo(w io.Writer, m, k uint64, info *indexCompactInfo, n *int64) error {
-	// Estimate series cardinality.
-	sketch := hll.NewDefaultPlus()
+// ReverseMeasurementIterator returns an iterator that merges measurements
+// across all files in descending order. Each file reads the offsets of its
+// measurements up front, using 8 bytes of memory per measurement.
+func (p IndexFiles) ReverseMeasurementIterator() MeasurementIteratorCloser {
+	a := make([]MeasurementIterator, 0, len(p))
 	for _, f := range p {
-		if err := f.MergeSeriesSketches(sketch, sketch); err != nil {
-			return err
-		}
+		a = append(a, f.ReverseMeasurementIterator())
 	}
+	return retainMeasurementIterator(p, MergeReverseMeasurementIterators(a...))
+}
 
-	itr := p.SeriesIterator()
-	enc := NewSeriesBlockEncoder(w, uint32(sketch.Count()), m, k)
+// RegexMeasurementIterator returns an iterator over all measurements with names
+// matching re. Names are filtered lazily as the merged iterator is consumed.
+func (p IndexFiles) RegexMeasurementIterator(re *regexp.Regexp) MeasurementIteratorCloser {
+	return retainMeasurementIterator(p, FilterRegexMeasurementIterator(p.measurementIterator(), re))
+}
 
-	// Write all series.
-	for e := itr.Next(); e != nil; e = itr.Next() {
-		if err := enc.Encode(e.Name(), e.Tags(), e.Deleted()); err != nil {
-			return err
-		}
+// TagKeyIterator returns an iterator that merges tag keys across all files.
+func (p IndexFiles) TagKeyIterator(name []byte) (TagKeyIteratorCloser, error) {
+	itr, err := p.tagKeyIterator(name)
+	if err != nil {
+		return nil, err
 	}
+	return retainTagKeyIterator(p, itr), nil
+}
 
-	// Close and flush block.
-	err := enc.Close()
-	*n += int64(enc.N())
+// LiveTagKeyIterator returns an iterator that merges tag keys across all
+// files & skips keys which are deleted or have no live values, such as a key
+// whose only value has been deleted. See FilterLiveTagKeyIterator.
+func (p IndexFiles) LiveTagKeyIterator(name []byte) (TagKeyIteratorCloser, error) {
+	itr, err := p.tagKeyIterator(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return nil
+	return retainTagKeyIterator(p, FilterLiveTagKeyIterator(itr)), nil
 }
 
-func (p IndexFiles) writeTagsetsTo(w io.Writer, info *indexCompactInfo, n *int64) error {
-	mitr := p.MeasurementIterator()
-	for m := mitr.Next(); m != nil; m = mitr.Next() {
-		if err := p.writeTagsetTo(w, m.Name(), info, n); err != nil {
-			return err
+// tagKeyIterator returns a merged tag key iterator which does not retain the
+// files.
+func (p IndexFiles) tagKeyIterator(name []byte) (TagKeyIterator, error) {
+	a := make([]TagKeyIterator, 0, len(p))
+	for _, f := range p {
+		itr := f.TagKeyIterator(name)
+		if itr == nil {
+			continue
 		}
+		a = append(a, itr)
 	}
-	return nil
+	return MergeTagKeyIterators(a...), nil
 }
 
-// writeTagsetTo writes a single tagset to w and saves the tagset offset.
-func (p IndexFiles) writeTagsetTo(w io.Writer, name []byte, info *indexCompactInfo, n *int64) error {
-	var seriesKey []byte
-
-	kitr, err := p.TagKeyIterator(name)
+// TagValueIterator returns an iterator that merges tag values for a key across
+// all files. The series block is not accessed.
+//
+// As with TagKeyIterator, deleted values are not removed. A value that exists
+// in multiple files is returned once using the element from the earliest file
+// so Deleted() reflects the most recent state.
+func (p IndexFiles) TagValueIterator(name, key []byte) (TagValueIteratorCloser, error) {
+	itr, err := p.tagValueIterator(name, key)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return retainTagValueIterator(p, itr), nil
+}
 
-	enc := NewTagBlockEncoder(w)
-	for ke := kitr.Next(); ke != nil; ke = kitr.Next() {
-		// Encode key.
-		if err := enc.EncodeKey(ke.Key(), ke.Deleted()); err != nil {
-			return err
+// tagValueIterator returns a merged tag value iterator which does not retain
+// the files.
+func (p IndexFiles) tagValueIterator(name, key []byte) (TagValueIterator, error) {
+	a := make([]TagValueIterator, 0, len(p))
+	for _, f := range p {
+		itr := f.TagValueIterator(name, key)
+		if itr == nil {
+			continue
 		}
+		a = append(a, itr)
+	}
+	return MergeTagValueIterators(a...), nil
+}
 
-		// Iterate over tag values.
-		vitr := ke.TagValueIterator()
-		for ve := vitr.Next(); ve != nil; ve = vitr.Next() {
-			// Merge all series together.
-			sitr := p.TagValueSeriesIterator(name, ke.Key(), ve.Value())
-			var seriesIDs []uint32
-			for se := sitr.Next(); se != nil; se = sitr.Next() {
-				seriesID, _ := info.sblk.Offset(se.Name(), se.Tags(), seriesKey[:0])
-				if seriesID == 0 {
-					return fmt.Errorf("expected series id: %s/%s", se.Name(), se.Tags().String())
-				}
-				seriesIDs = append(seriesIDs, seriesID)
-			}
-			sort.Sort(uint32Slice(seriesIDs))
+// TagKeyHasValue returns true if the most recent state of the tag value is not
+// deleted. A value is also reported missing if its measurement or tag key is
+// deleted by the same or a newer file. Each file is checked with its tag block
+// hash indexes, newest first, so no iterators are created & the series block
+// is not accessed.
+func (p IndexFiles) TagKeyHasValue(name, key, value []byte) (bool, error) {
+	for _, f := range p {
+		if e := f.Measurement(name); e == nil {
+			continue
+		} else if e.Deleted() {
+			return false, nil
+		}
 
-			// Encode value.
-			if err := enc.EncodeValue(ve.Value(), ve.Deleted(), seriesIDs); err != nil {
-				return err
-			}
+		if e := f.TagKey(name, key); e == nil {
+			continue
+		} else if e.Deleted() {
+			return false, nil
+		}
+
+		if e := f.TagValue(name, key, value); e != nil {
+			return !e.Deleted(), nil
 		}
 	}
+	return false, nil
+}
 
-	// Save tagset offset to measurement.
-	pos := info.tagSets[string(name)]
-	pos.offset = *n
+// TagValueIteratorFrom returns a merged iterator over the values of a tag key
+// which sort after the value after, such as to resume a paginated listing
+// after the last value returned. Each file is positioned past after before
+// merging so values which exist in several files are still returned once.
+// The files are retained until the iterator is closed.
+func (p IndexFiles) TagValueIteratorFrom(name, key, after []byte) (TagValueIteratorCloser, error) {
+	a := make([]TagValueIterator, 0, len(p))
+	for _, f := range p {
+		if itr := f.TagValueIteratorFrom(name, key, after); itr != nil {
+			a = append(a, itr)
+		}
+	}
+	return retainTagValueIterator(p, MergeTagValueIterators(a...)), nil
+}
 
-	// Flush data to writer.
-	err = enc.Close()
-	*n += enc.N()
-	if err != nil {
-		return err
+// TagPairIterator returns an iterator over every tag key/value pair of every
+// measurement across all files, sorted by measurement, key & value. Pairs that
+// exist in multiple files are returned once. A pair is marked deleted if its
+// measurement, key or value is tombstoned.
+//
+// Pairs are streamed from the underlying iterators and the returned pair is
+// only valid until the next call to Next().
+func (p IndexFiles) TagPairIterator() TagPairIteratorCloser {
+	return &retainedTagPairIterator{
+		indexFilesRef: newIndexFilesRef(p),
+		itr:           &tagPairIterator{p: p, mitr: p.measurementIterator()},
 	}
+}
 
-	// Save tagset size to measurement.
-	pos.size = *n - pos.offset
+// indexFilesRef holds a reference to a set of index files until closed.
+type indexFilesRef struct {
+	p      IndexFiles
+	once   sync.Once
+	closed bool
+}
 
-	info.tagSets[string(name)] = pos
+// newIndexFilesRef retains p & returns a reference which releases it on Close.
+func newIndexFilesRef(p IndexFiles) *indexFilesRef {
+	p = append(IndexFiles(nil), p...)
+	p.Retain()
+	return &indexFilesRef{p: p}
+}
 
+// Close releases the files. Subsequent calls have no effect.
+func (r *indexFilesRef) Close() error {
+	r.once.Do(func() {
+		r.closed = true
+		r.p.Release()
+	})
 	return nil
 }
 
-func (p IndexFiles) writeMeasurementBlockTo(w io.Writer, info *indexCompactInfo, n *int64) error {
-	var seriesKey []byte
-	mw := NewMeasurementBlockWriter()
-
-	// Add measurement data & compute sketches.
-	mitr := p.MeasurementIterator()
-	for m := mitr.Next(); m != nil; m = mitr.Next() {
-		name := m.Name()
-
-		// Look-up series ids.
-		itr := p.MeasurementSeriesIterator(name)
-		var seriesIDs []uint32
-		for e := itr.Next(); e != nil; e = itr.Next() {
-			seriesID, _ := info.sblk.Offset(e.Name(), e.Tags(), seriesKey[:0])
-			if seriesID == 0 {
-				panic(fmt.Sprintf("expected series id: %s %s", e.Name(), e.Tags().String()))
-			}
-			seriesIDs = append(seriesIDs, seriesID)
-		}
-		sort.Sort(uint32Slice(seriesIDs))
+// retainedMeasurementIterator is a measurement iterator which retains its files.
+type retainedMeasurementIterator struct {
+	*indexFilesRef
+	itr MeasurementIterator
+}
 
-		// Add measurement to writer.
-		pos := info.tagSets[string(name)]
-		mw.Add(name, m.Deleted(), pos.offset, pos.size, seriesIDs)
+// retainMeasurementIterator wraps itr so that p is retained until it is closed.
+// Returns nil if itr is nil.
+func retainMeasurementIterator(p IndexFiles, itr MeasurementIterator) MeasurementIteratorCloser {
+	if itr == nil {
+		return nil
+	}
+	return &retainedMeasurementIterator{indexFilesRef: newIndexFilesRef(p), itr: itr}
+}
+
+// Next returns the next measurement. Returns nil once closed.
+func (itr *retainedMeasurementIterator) Next() MeasurementElem {
+	if itr.closed {
+		return nil
+	}
+	return itr.itr.Next()
+}
+
+// retainedTagKeyIterator is a tag key iterator which retains its files.
+type retainedTagKeyIterator struct {
+	*indexFilesRef
+	itr TagKeyIterator
+}
+
+// retainTagKeyIterator wraps itr so that p is retained until it is closed.
+// Returns nil if itr is nil.
+func retainTagKeyIterator(p IndexFiles, itr TagKeyIterator) TagKeyIteratorCloser {
+	if itr == nil {
+		return nil
+	}
+	return &retainedTagKeyIterator{indexFilesRef: newIndexFilesRef(p), itr: itr}
+}
+
+// Next returns the next tag key. Returns nil once closed.
+func (itr *retainedTagKeyIterator) Next() TagKeyElem {
+	if itr.closed {
+		return nil
+	}
+	return itr.itr.Next()
+}
+
+// retainedTagValueIterator is a tag value iterator which retains its files.
+type retainedTagValueIterator struct {
+	*indexFilesRef
+	itr TagValueIterator
+}
+
+// retainTagValueIterator wraps itr so that p is retained until it is closed.
+// Returns nil if itr is nil.
+func retainTagValueIterator(p IndexFiles, itr TagValueIterator) TagValueIteratorCloser {
+	if itr == nil {
+		return nil
+	}
+	return &retainedTagValueIterator{indexFilesRef: newIndexFilesRef(p), itr: itr}
+}
+
+// Next returns the next tag value. Returns nil once closed.
+func (itr *retainedTagValueIterator) Next() TagValueElem {
+	if itr.closed {
+		return nil
+	}
+	return itr.itr.Next()
+}
+
+// retainedSeriesIterator is a series iterator which retains its files.
+type retainedSeriesIterator struct {
+	*indexFilesRef
+	itr SeriesIterator
+}
+
+// retainSeriesIterator wraps itr so that p is retained until it is closed.
+// Returns nil if itr is nil.
+func retainSeriesIterator(p IndexFiles, itr SeriesIterator) SeriesIteratorCloser {
+	if itr == nil {
+		return nil
+	}
+	return &retainedSeriesIterator{indexFilesRef: newIndexFilesRef(p), itr: itr}
+}
+
+// Next returns the next series. Returns nil once closed.
+func (itr *retainedSeriesIterator) Next() SeriesElem {
+	if itr.closed {
+		return nil
+	}
+	return itr.itr.Next()
+}
+
+// Err returns the error from the underlying iterator.
+func (itr *retainedSeriesIterator) Err() error { return SeriesIteratorErr(itr.itr) }
+
+// EstimatedCount returns the estimate of the underlying iterator. Returns zero
+// once closed.
+func (itr *retainedSeriesIterator) EstimatedCount() (uint64, bool) {
+	if itr.closed {
+		return 0, true
+	}
+	return SeriesIteratorEstimatedCount(itr.itr)
+}
+
+// Close releases the pooled structures of the iterator & then the files.
+// Subsequent calls have no effect.
+func (itr *retainedSeriesIterator) Close() error {
+	itr.once.Do(func() {
+		itr.closed = true
+		ReleaseSeriesIterator(itr.itr)
+		itr.itr = nil
+		itr.p.Release()
+	})
+	return nil
+}
+
+// retainedTagPairIterator is a tag pair iterator which retains its files.
+type retainedTagPairIterator struct {
+	*indexFilesRef
+	itr TagPairIterator
+}
+
+// Next returns the next tag pair. Returns nil once closed.
+func (itr *retainedTagPairIterator) Next() *TagPair {
+	if itr.closed {
+		return nil
+	}
+	return itr.itr.Next()
+}
+
+// tagPairIterator iterates over the tag values of each tag key of each
+// measurement in a set of index files.
+type tagPairIterator struct {
+	p    IndexFiles
+	mitr MeasurementIterator
+	kitr TagKeyIterator
+	vitr TagValueIterator
+
+	mdeleted bool
+	kdeleted bool
+	pair     TagPair
+}
+
+// Next returns the next tag pair. Returns nil when iterator is complete.
+func (itr *tagPairIterator) Next() *TagPair {
+	for {
+		// Return next value for the current key.
+		if itr.vitr != nil {
+			if v := itr.vitr.Next(); v != nil {
+				itr.pair.Value = v.Value()
+				itr.pair.Deleted = itr.mdeleted || itr.kdeleted || v.Deleted()
+				return &itr.pair
+			}
+			itr.vitr = nil
+		}
+
+		// Move to next key for the current measurement.
+		if itr.kitr != nil {
+			if k := itr.kitr.Next(); k != nil {
+				itr.pair.Key = k.Key()
+				itr.kdeleted = k.Deleted()
+				itr.vitr = k.TagValueIterator()
+				continue
+			}
+			itr.kitr = nil
+		}
+
+		// Move to next measurement.
+		if itr.mitr == nil {
+			return nil
+		}
+		m := itr.mitr.Next()
+		if m == nil {
+			itr.mitr = nil
+			return nil
+		}
+		itr.pair.Name = m.Name()
+		itr.mdeleted = m.Deleted()
+		itr.kitr, _ = itr.p.tagKeyIterator(m.Name())
+	}
+}
+
+// SeriesIterator returns an iterator that merges series across all files.
+//
+// The iterator includes tombstoned series. A series that appears in multiple
+// files is returned once using the element from the earliest file so Deleted()
+// reflects the most recent state. Use LiveSeriesIterator to skip tombstones.
+func (p IndexFiles) SeriesIterator() SeriesIteratorCloser {
+	return retainSeriesIterator(p, p.seriesIterator())
+}
+
+// seriesIterator returns a merged series iterator which does not retain the
+// files.
+func (p IndexFiles) seriesIterator() SeriesIterator {
+	a := make([]SeriesIterator, 0, len(p))
+	for _, f := range p {
+		itr := f.SeriesIterator()
+		if itr == nil {
+			continue
+		}
+		a = append(a, itr)
+	}
+	return MergeSeriesIterators(a...)
+}
+
+// LiveSeriesIterator returns an iterator that merges series across all files
+// and excludes tombstoned series.
+func (p IndexFiles) LiveSeriesIterator() SeriesIteratorCloser {
+	return retainSeriesIterator(p, FilterUndeletedSeriesIterator(p.seriesIterator()))
+}
+
+// SeriesDiff returns an iterator over the series whose most recent state in
+// the receiver differs from base, such as to ship only the changes since an
+// older set of files in an incremental backup. Series which are live in the
+// receiver & absent or tombstoned in base are returned. Series tombstoned in
+// the receiver but live in base are returned with Deleted set so deletions can
+// be shipped too; wrap the iterator with FilterUndeletedSeriesIterator to only
+// return additions. Series in base but not in the receiver are skipped.
+//
+// Both sets are merged in series order & read in step so only the current
+// series of each set is held in memory. The iterator retains both sets until
+// it is closed. Returns nil if the receiver has no series.
+func (p IndexFiles) SeriesDiff(base IndexFiles) SeriesIteratorCloser {
+	itr := p.seriesIterator()
+	if itr == nil {
+		return nil
+	}
+
+	files := make(IndexFiles, 0, len(p)+len(base))
+	files = append(append(files, p...), base...)
+	return retainSeriesIterator(files, &seriesDiffIterator{itrs: [2]SeriesIterator{itr, base.seriesIterator()}})
+}
+
+// HasSeries returns true if the series exists and is not tombstoned. Each file
+// is checked with its series hash index, newest first, so a tombstone in a
+// newer file masks the series in older files.
+func (p IndexFiles) HasSeries(name []byte, tags models.Tags, buf []byte) bool {
+	for _, f := range p {
+		if exists, tombstoned := f.HasSeries(name, tags, buf); exists {
+			return !tombstoned
+		}
+	}
+	return false
+}
+
+// HasSeriesBatch returns whether each series, given by the name & tags at the
+// same index, exists and is not tombstoned, the same as calling HasSeries for
+// each series. Each series key is encoded & hashed for the bloom filters once
+// rather than once per file. The files are checked newest first & for each
+// file the bloom filter is probed for every unresolved key before the hash
+// index is searched for the possible hits, so series found in a newer file are
+// not looked up in older files. Returns ErrSeriesBlockNotLoaded if any file
+// was opened with OpenMetadataOnly.
+func (p IndexFiles) HasSeriesBatch(names [][]byte, tagsSlice []models.Tags) ([]bool, error) {
+	if len(names) != len(tagsSlice) {
+		return nil, fmt.Errorf("series batch length mismatch: %d names, %d tag sets", len(names), len(tagsSlice))
+	} else if err := p.seriesBlocksLoaded(); err != nil {
+		return nil, err
+	}
+
+	// Encode every key into a single buffer. Keys are encoded into a scratch
+	// buffer first as AppendSeriesKey grows its buffer to the exact size.
+	var buf, tmp []byte
+	ends := make([]int, len(names))
+	hashes := make([]bloom.Hash, len(names))
+	for i := range names {
+		tmp = AppendSeriesKey(tmp[:0], names[i], tagsSlice[i])
+		buf = append(buf, tmp...)
+		ends[i] = len(buf)
+		hashes[i] = bloom.NewHash(tmp)
+	}
+	key := func(i int) []byte {
+		start := 0
+		if i > 0 {
+			start = ends[i-1]
+		}
+		return buf[start:ends[i]]
+	}
+
+	// Indexes of the series not yet found in a file.
+	pending := make([]int, len(names))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	a := make([]bool, len(names))
+	hits := make([]int, 0, len(names))
+	for _, f := range p {
+		if len(pending) == 0 {
+			break
+		}
+		sblk := &f.sblk
+
+		hits = hits[:0]
+		for _, i := range pending {
+			if sblk.mayContainHash(hashes[i]) {
+				hits = append(hits, i)
+			}
+		}
+		if len(hits) == 0 {
+			continue
+		}
+
+		// Remove the series found in this file from the pending list. Both
+		// lists are in index order so they are merged in a single pass.
+		other := pending[:0]
+		var j int
+		for _, i := range pending {
+			if j < len(hits) && hits[j] == i {
+				j++
+				if offset, tombstoned := sblk.keyOffset(key(i)); offset != 0 {
+					a[i] = !tombstoned
+					continue
+				}
+			}
+			other = append(other, i)
+		}
+		pending = other
+	}
+	return a, nil
+}
+
+// seriesBlocksLoaded returns ErrSeriesBlockNotLoaded if any file was opened
+// with OpenMetadataOnly. The series APIs check this first so a file without
+// its series block fails rather than appearing to have no series.
+func (p IndexFiles) seriesBlocksLoaded() error {
+	for _, f := range p {
+		if f.MetadataOnly() {
+			return ErrSeriesBlockNotLoaded
+		}
+	}
+	return nil
+}
+
+// SeriesN returns the exact number of unique, non-tombstoned series across
+// all files. A single file returns the count stored in its series block.
+// Otherwise every series is merged across the files to remove duplicates &
+// tombstones so the cost is proportional to the total number of series.
+// Use ApproximateSeriesN when an estimate is sufficient. Returns
+// ErrSeriesBlockNotLoaded if any file was opened with OpenMetadataOnly.
+func (p IndexFiles) SeriesN() (uint64, error) {
+	if err := p.seriesBlocksLoaded(); err != nil {
+		return 0, err
+	} else if len(p) == 1 {
+		return p[0].SeriesN(), nil
+	}
+
+	itr := FilterUndeletedSeriesIterator(p.seriesIterator())
+	if itr == nil {
+		return 0, nil
+	}
+
+	var n uint64
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		n++
+	}
+	return n, nil
+}
+
+// OverlapStats returns the number of series in more than one file, both
+// overall & for each pair of files, along with the number of series in each
+// file. Indexes in the stats are positions in p. Tombstones are counted like
+// live series since compaction merges them the same way.
+//
+// Every series of every file is merged in a single pass, the same as SeriesN,
+// with the files containing each series tracked as it is merged.
+func (p IndexFiles) OverlapStats() (*OverlapStats, error) {
+	a := make([]SeriesIterator, 0, len(p))
+	for _, f := range p {
+		itr := f.SeriesIterator()
+		if itr == nil {
+			return nil, ErrSeriesBlockNotLoaded
+		}
+		a = append(a, itr)
+	}
+
+	stats := newOverlapStats(len(a))
+	itr := &seriesMergeIterator{buf: make([]SeriesElem, len(a)), itrs: a, overlap: stats}
+	defer itr.releaseInputs()
+	for itr.Next() != nil {
+	}
+	if err := itr.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ApproximateSeriesN returns an estimate of the number of unique,
+// non-tombstoned series across all files without iterating any series.
+//
+// The estimate is the difference between the merged series sketch and the
+// merged tombstone sketch computed during compaction. Sketches are merged at
+// the lowest precision of any file. At the default precision each
+// HyperLogLog++ sketch has a typical relative error below 1%, however, the
+// error of the difference grows when a large fraction of series are
+// tombstoned. Series that were deleted and then re-created are
+// counted in both sketches so they may be under-counted.
+func (p IndexFiles) ApproximateSeriesN() (uint64, error) {
+	sketch, tsketch := hll.NewDefaultPlus(), hll.NewDefaultPlus()
+	for _, f := range p {
+		if err := f.MergeSeriesSketches(sketch, tsketch); err != nil {
+			return 0, err
+		}
+	}
+
+	n, tn := sketch.Count(), tsketch.Count()
+	if tn >= n {
+		return 0, nil
+	}
+	return n - tn, nil
+}
+
+// MeasurementSeriesIterator returns an iterator that merges series across all files.
+func (p IndexFiles) MeasurementSeriesIterator(name []byte) SeriesIteratorCloser {
+	return retainSeriesIterator(p, p.measurementSeriesIterator(name))
+}
+
+// measurementSeriesIterator returns a merged measurement series iterator which
+// does not retain the files.
+func (p IndexFiles) measurementSeriesIterator(name []byte) SeriesIterator {
+	a := make([]SeriesIterator, 0, len(p))
+	for _, f := range p {
+		itr := f.MeasurementSeriesIterator(name)
+		if itr == nil {
+			continue
+		}
+		a = append(a, itr)
+	}
+	return MergeSeriesIterators(a...)
+}
+
+// MeasurementSeriesN returns the number of non-tombstoned series for a measurement.
+//
+// If only one file contains the measurement and that file has no tombstoned
+// series then the count stored in the measurement block is returned directly.
+// Otherwise the series are iterated so that duplicates and tombstones across
+// files are handled correctly. Returns ErrSeriesBlockNotLoaded if any file
+// was opened with OpenMetadataOnly since its tombstones cannot be seen.
+func (p IndexFiles) MeasurementSeriesN(name []byte) (uint64, error) {
+	if err := p.seriesBlocksLoaded(); err != nil {
+		return 0, err
+	}
+
+	var elem MeasurementBlockElem
+	var file *IndexFile
+	for _, f := range p {
+		e, ok := f.mblk.Elem(name)
+		if !ok {
+			continue
+		} else if file != nil {
+			return p.measurementSeriesNByIterator(name), nil
+		}
+		elem, file = e, f
+	}
+
+	if file == nil || elem.Deleted() {
+		return 0, nil
+	} else if file.sblk.tombstoneN != 0 {
+		return p.measurementSeriesNByIterator(name), nil
+	}
+	return uint64(elem.SeriesN()), nil
+}
+
+// MeasurementSketch returns an estimate sketch of the live series in a
+// measurement by merging IndexFile.MeasurementSketch across the files. Files
+// older than a tombstone of the measurement are skipped but series tombstoned
+// in a newer file are still counted if they are live in an older file.
+//
+// Sketches can only be merged at the same precision so files written with
+// different precisions are reduced to the lowest precision before merging.
+// Returns a nil sketch if no file contains the measurement.
+func (p IndexFiles) MeasurementSketch(name []byte) (estimator.Sketch, error) {
+	var sketch estimator.Sketch
+	for _, f := range p {
+		e, ok := f.mblk.Elem(name)
+		if !ok {
+			continue
+		}
+
+		s, err := f.MeasurementSketch(name)
+		if err != nil {
+			return nil, err
+		} else if sketch == nil {
+			sketch = s
+		} else if err := mergeSketch(sketch, s); err != nil {
+			return nil, err
+		}
+
+		if e.Deleted() {
+			break
+		}
+	}
+	return sketch, nil
+}
+
+// measurementSeriesNByIterator counts the non-tombstoned series for a measurement.
+func (p IndexFiles) measurementSeriesNByIterator(name []byte) (n uint64) {
+	// Exit if the measurement has been deleted by the newest file containing it.
+	for _, f := range p {
+		if e, ok := f.mblk.Elem(name); ok {
+			if e.Deleted() {
+				return 0
+			}
+			break
+		}
+	}
+
+	itr := FilterUndeletedSeriesIterator(p.measurementSeriesIterator(name))
+	if itr == nil {
+		return 0
+	}
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		n++
+	}
+	return n
+}
+
+// TagKeyCardinality returns the number of non-tombstoned series with each tag
+// key of a measurement. Each series has one value per key so the count is the
+// sum of the series for each of the key's values. Keys without live series
+// are omitted.
+//
+// The counts are exact. As with MeasurementSeriesN, if only one file contains
+// the measurement and that file has no tombstoned series then the series
+// counts stored with each tag value are summed without reading any series.
+// Otherwise the series of every tag value are merged across the files so the
+// cost is proportional to the number of series times the number of tag keys.
+// Returns ErrSeriesBlockNotLoaded if any file was opened with OpenMetadataOnly.
+func (p IndexFiles) TagKeyCardinality(name []byte) (map[string]uint64, error) {
+	if err := p.seriesBlocksLoaded(); err != nil {
+		return nil, err
+	}
+
+	var file *IndexFile
+	var deleted bool
+	for _, f := range p {
+		e, ok := f.mblk.Elem(name)
+		if !ok {
+			continue
+		} else if file != nil {
+			return p.tagKeyCardinalityByIterator(name)
+		}
+		file, deleted = f, e.Deleted()
+	}
+
+	m := make(map[string]uint64)
+	if file == nil || deleted {
+		return m, nil
+	} else if file.sblk.tombstoneN != 0 {
+		return p.tagKeyCardinalityByIterator(name)
+	}
+
+	kitr := file.TagKeyIterator(name)
+	for k := nextTagKeyElem(kitr); k != nil; k = kitr.Next() {
+		if k.Deleted() {
+			continue
+		}
+
+		var n uint64
+		vitr := k.TagValueIterator()
+		for v := nextTagValueElem(vitr); v != nil; v = vitr.Next() {
+			if !v.Deleted() {
+				n += uint64(v.(*TagBlockValueElem).SeriesN())
+			}
+		}
+		if n > 0 {
+			m[string(k.Key())] = n
+		}
+	}
+	return m, nil
+}
+
+// TagKeyFileCounts returns the number of files containing each tag key of a
+// measurement, such as to find measurements whose tag schema has changed
+// over time. Only the tag blocks are read. Keys which are tombstoned in the
+// most recent file containing them are omitted and files in which a key is
+// tombstoned do not count towards it.
+func (p IndexFiles) TagKeyFileCounts(name []byte) (map[string]int, error) {
+	itr, err := p.tagKeyIterator(name)
+	if err != nil {
+		return nil, err
+	}
+	return tagKeyFileCounts(itr), nil
+}
+
+// tagKeyCardinalityByIterator counts the non-tombstoned series of each tag key
+// by merging the series of each tag value across the files.
+func (p IndexFiles) tagKeyCardinalityByIterator(name []byte) (map[string]uint64, error) {
+	m := make(map[string]uint64)
+	if p.measurementDeleted(name) {
+		return m, nil
+	}
+
+	kitr, err := p.tagKeyIterator(name)
+	if err != nil {
+		return nil, err
+	}
+	for k := nextTagKeyElem(kitr); k != nil; k = kitr.Next() {
+		if k.Deleted() {
+			continue
+		}
+
+		vitr, err := p.tagValueIterator(name, k.Key())
+		if err != nil {
+			return nil, err
+		}
+
+		var n uint64
+		for v := nextTagValueElem(vitr); v != nil; v = vitr.Next() {
+			if v.Deleted() {
+				continue
+			}
+
+			sitr := FilterUndeletedSeriesIterator(p.tagValueSeriesIterator(name, k.Key(), v.Value()))
+			for e := nextSeriesElem(sitr); e != nil; e = sitr.Next() {
+				n++
+			}
+			if err := SeriesIteratorErr(sitr); err != nil {
+				return nil, err
+			}
+		}
+		if n > 0 {
+			m[string(k.Key())] = n
+		}
+	}
+	return m, nil
+}
+
+// TagValueSeriesIterator returns an iterator that merges series across all files.
+func (p IndexFiles) TagValueSeriesIterator(name, key, value []byte) SeriesIteratorCloser {
+	return retainSeriesIterator(p, p.tagValueSeriesIterator(name, key, value))
+}
+
+// tagValueSeriesIterator returns a merged tag value series iterator which does
+// not retain the files.
+func (p IndexFiles) tagValueSeriesIterator(name, key, value []byte) SeriesIterator {
+	a := make([]SeriesIterator, 0, len(p))
+	for i := range p {
+		itr := p[i].TagValueSeriesIterator(name, key, value)
+		if itr != nil {
+			a = append(a, itr)
+		}
+	}
+	return MergeSeriesIterators(a...)
+}
+
+// TagValueSeriesIDSets returns the series id set of a tag value in each file.
+// The sets are in the same order as the files. Series ids are local to each
+// file so the sets cannot be unioned directly; combine the sets of each file
+// & pass the results to SeriesIDSetIterator to merge them.
+func (p IndexFiles) TagValueSeriesIDSets(name, key, value []byte) ([]*SeriesIDSet, error) {
+	a := make([]*SeriesIDSet, len(p))
+	for i, f := range p {
+		set, err := f.TagValueSeriesIDSet(name, key, value)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = set
+	}
+	return a, nil
+}
+
+// SeriesIDSetIterator returns an iterator that merges the series of a set of
+// ids from each file. The sets must be in the same order as the files & a nil
+// set is treated as empty. Series are merged with the same precedence as
+// TagValueSeriesIterator so a tombstone in a newer file takes effect. Returns
+// a nil iterator if every set is empty. Returns ErrSeriesBlockNotLoaded if any
+// file was opened with OpenMetadataOnly.
+func (p IndexFiles) SeriesIDSetIterator(sets []*SeriesIDSet) (SeriesIteratorCloser, error) {
+	if len(sets) != len(p) {
+		return nil, fmt.Errorf("series id set count mismatch: %d sets, %d files", len(sets), len(p))
+	} else if err := p.seriesBlocksLoaded(); err != nil {
+		return nil, err
+	}
+
+	a := make([]SeriesIterator, 0, len(p))
+	for i, f := range p {
+		if sets[i].Cardinality() > 0 {
+			a = append(a, f.SeriesIDSetIterator(sets[i]))
+		}
+	}
+	return retainSeriesIterator(p, MergeSeriesIterators(a...)), nil
+}
+
+// VerifyChecksums verifies the block checksums of every file in the set.
+// Returns the first error encountered. Files without checksums are skipped.
+func (p IndexFiles) VerifyChecksums() error {
+	for _, f := range p {
+		if err := f.VerifyChecksums(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactTo merges all index files and writes them to w.
+func (p IndexFiles) CompactTo(w io.Writer, m, k uint64) (n int64, err error) {
+	return p.CompactToContext(context.Background(), w, m, k)
+}
+
+// CompactToFile merges all index files and atomically writes them to path.
+//
+// The data is written to a temporary file alongside path which is synced
+// and then renamed over path. The parent directory is synced so the rename is
+// durable. The temporary file is removed if any step fails. Returns
+// *ErrIndexFileExists if path already exists and overwrite is false.
+func (p IndexFiles) CompactToFile(path string, m, k uint64, overwrite bool) (n int64, err error) {
+	return p.CompactToFileWithOptions(context.Background(), path, m, k, overwrite, CompactOptions{})
+}
+
+// CompactInto atomically writes the merged index files to a new file at path
+// like CompactToFileWithOptions & stamps generation & level into its trailer.
+// Returns *ErrIndexFileExists if path already exists.
+func (p IndexFiles) CompactInto(ctx context.Context, path string, m, k uint64, generation uint64, level int, opt CompactOptions) (n int64, err error) {
+	opt.Generation, opt.Level = generation, level
+	return p.CompactToFileWithOptions(ctx, path, m, k, false, opt)
+}
+
+// CompactToFileWithOptions atomically writes the merged index files to path
+// like CompactToFile using CompactToWithOptions.
+func (p IndexFiles) CompactToFileWithOptions(ctx context.Context, path string, m, k uint64, overwrite bool, opt CompactOptions) (n int64, err error) {
+	var info indexCompactInfo
+	n, _, err = p.compactToFile(ctx, path, m, k, overwrite, opt, &info)
+	return n, err
+}
+
+// CompactionResult summarizes a completed compaction.
+type CompactionResult struct {
+	Path     string        // path of the compacted file
+	Size     int64         // total file size
+	Duration time.Duration // time taken to write & sync the file
+
+	// Size of each block.
+	SeriesBlockSize      int64
+	TagsetBlockSize      int64
+	MeasurementBlockSize int64
+
+	// Number of elements written, including tombstones.
+	MeasurementN int
+	SeriesN      int
+	TagKeyN      int // summed across measurements
+	TagValueN    int // summed across tag keys
+
+	// Number of series written as tombstones, which are included in SeriesN.
+	SeriesTombstoneN int
+
+	// Number of measurements & series omitted by CompactOptions.DropTombstones.
+	DroppedMeasurementN int
+	DroppedSeriesN      int
+
+	// Number of series tombstones kept by CompactOptions.TombstoneRetention,
+	// which are included in SeriesTombstoneN.
+	RetainedTombstoneN int
+}
+
+// TombstoneRatio returns the fraction of the series written which are
+// tombstones, between zero & one. A file which is mostly tombstones suggests
+// tombstones are never dropped by the compaction policy.
+func (r *CompactionResult) TombstoneRatio() float64 {
+	if r.SeriesN == 0 {
+		return 0
+	}
+	return float64(r.SeriesTombstoneN) / float64(r.SeriesN)
+}
+
+// Compact atomically writes the merged index files to path like
+// CompactToFileWithOptions and returns a summary of the compaction. The counts
+// are accumulated as the elements are written. Returns *ErrIndexFileExists if
+// path already exists.
+func (p IndexFiles) Compact(ctx context.Context, path string, m, k uint64, opt CompactOptions) (*CompactionResult, error) {
+	start := time.Now()
+
+	var info indexCompactInfo
+	n, t, err := p.compactToFile(ctx, path, m, k, false, opt, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompactionResult{
+		Path:                 path,
+		Size:                 n,
+		Duration:             time.Since(start),
+		SeriesBlockSize:      t.SeriesBlock.Size,
+		TagsetBlockSize:      t.TagsetBlock.Size,
+		MeasurementBlockSize: t.MeasurementBlock.Size,
+		MeasurementN:         info.stats.measurementN,
+		SeriesN:              info.stats.seriesN,
+		SeriesTombstoneN:     info.stats.seriesTombstoneN,
+		TagKeyN:              info.stats.tagKeyN,
+		TagValueN:            info.stats.tagValueN,
+		DroppedMeasurementN:  info.stats.droppedMeasurementN,
+		DroppedSeriesN:       info.stats.droppedSeriesN,
+		RetainedTombstoneN:   info.stats.retainedTombstoneN,
+	}, nil
+}
+
+// ErrCompactVerify is returned by CompactAndReplace when the compacted file
+// does not match the elements written.
+type ErrCompactVerify struct {
+	Path     string
+	Field    string // "measurements" or "series"
+	Expected int
+	Actual   int
+}
+
+// Error returns the error message.
+func (e *ErrCompactVerify) Error() string {
+	return fmt.Sprintf("compacted index file has %d %s, expected %d: %s", e.Actual, e.Field, e.Expected, e.Path)
+}
+
+// CompactAndReplace compacts the index files to a new file at path like
+// Compact & then removes the source files. The sources are only removed once
+// the new file has been synced, reopened, its checksums verified & its
+// measurement & series counts match the elements written. If any step before
+// the removal fails, including ctx being cancelled, the new file is removed &
+// the sources are left intact.
+//
+// The source files are not closed. The caller must still close them, which
+// waits for outstanding references, however, their data remains readable
+// once removed. If removing a source fails then the remaining sources are
+// still removed & the first error is returned. The new file holds all of
+// the data so the sources which remain are redundant.
+func (p IndexFiles) CompactAndReplace(ctx context.Context, path string, m, k uint64, opt CompactOptions) (*CompactionResult, error) {
+	r, err := p.Compact(ctx, path, m, k, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for cancellation last so the sources are kept if the compaction
+	// is cancelled at any point before they are removed.
+	if err := r.verify(); err != nil {
+		os.Remove(path)
+		syncDir(filepath.Dir(path))
+		return nil, err
+	} else if err := ctx.Err(); err != nil {
+		os.Remove(path)
+		syncDir(filepath.Dir(path))
+		return nil, err
+	}
+
+	// Remove the sources & sync each directory so the removal is durable.
+	var firstErr error
+	dirs := make(map[string]struct{})
+	for _, f := range p {
+		if err := os.Remove(f.Path()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		dirs[filepath.Dir(f.Path())] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return r, nil
+}
+
+// verify reopens the compacted file & checks its checksums & counts.
+func (r *CompactionResult) verify() error {
+	f := NewIndexFile()
+	f.SetPath(r.Path)
+	if err := f.Open(); err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.VerifyChecksums(); err != nil {
+		return err
+	} else if n := int(f.MeasurementN()); n != r.MeasurementN {
+		return &ErrCompactVerify{Path: r.Path, Field: "measurements", Expected: r.MeasurementN, Actual: n}
+	} else if n := int(f.sblk.SeriesCount()); n != r.SeriesN {
+		return &ErrCompactVerify{Path: r.Path, Field: "series", Expected: r.SeriesN, Actual: n}
+	}
+	return nil
+}
+
+// compactToFile atomically writes the merged index files to path & returns
+// the trailer written. Counts of the elements written are left in info.stats.
+func (p IndexFiles) compactToFile(ctx context.Context, path string, m, k uint64, overwrite bool, opt CompactOptions, info *indexCompactInfo) (n int64, t IndexFileTrailer, err error) {
+	if !overwrite {
+		if _, err := os.Stat(path); err == nil {
+			return 0, t, &ErrIndexFileExists{Path: path}
+		} else if !os.IsNotExist(err) {
+			return 0, t, err
+		}
+	}
+
+	tmpPath := path + TempFileExt
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, t, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if n, t, err = p.compactTo(ctx, f, m, k, opt, info); err != nil {
+		return n, t, err
+	} else if err = f.Sync(); err != nil {
+		return n, t, err
+	} else if err = f.Close(); err != nil {
+		return n, t, err
+	} else if err = renameFile(tmpPath, path); err != nil {
+		return n, t, err
+	}
+	return n, t, syncDir(filepath.Dir(path))
+}
+
+// CompactToPreallocatedFile merges all index files and writes them to the empty
+// file f like CompactToWithOptions. Before writing, size bytes are
+// preallocated in f to reduce fragmentation. If size is zero then it is
+// estimated with EstimateSizeWithOptions. Preallocated space past the end of
+// the written data is released afterward. Filesystems which do not support
+// preallocation are written to normally.
+func (p IndexFiles) CompactToPreallocatedFile(ctx context.Context, f *os.File, size int64, m, k uint64, opt CompactOptions) (n int64, err error) {
+	if size == 0 {
+		if size, err = p.EstimateSizeWithOptions(m, k, opt); err != nil {
+			return 0, err
+		}
+	}
+
+	if size > 0 {
+		if err := fallocate(f, 0, size); err != nil {
+			return 0, err
+		}
+	}
+
+	if n, err = p.CompactToWithOptions(ctx, f, m, k, opt); err != nil {
+		return n, err
+	}
+
+	// Release any unused preallocated blocks.
+	if size > n {
+		if err := f.Truncate(n); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// CompactAndVerify compacts the index files to path using CompactToFile and
+// then reopens the new file and checks it against the input files using
+// VerifyCompaction. This is expensive and is intended for testing encoder
+// changes rather than production use. The file is left in place on a
+// verification failure so that it can be inspected.
+func (p IndexFiles) CompactAndVerify(path string, m, k uint64) (n int64, err error) {
+	if n, err = p.CompactToFile(path, m, k, false); err != nil {
+		return n, err
+	}
+
+	f := NewIndexFile()
+	f.SetPath(path)
+	if err := f.Open(); err != nil {
+		return n, err
+	}
+	defer f.Close()
+
+	return n, p.VerifyCompaction(f)
+}
+
+// MergeLogFileTo merges a log file into the index files & writes a single
+// index file to w. The log file takes precedence so it should be newer than
+// every file in p. Typically p only holds the newest index file of a level so
+// the output is proportional to that file & the new data rather than to the
+// whole index.
+//
+// Series IDs are offsets into the series block of the file containing them so
+// they cannot be copied between files. The log file is first compacted in
+// memory to a temporary index file. The merged series block is then written
+// and each series ID in the tagset & measurement blocks is remapped by
+// decoding the series key from the input file and looking up the key in the
+// hash index of the new series block.
+func (p IndexFiles) MergeLogFileTo(w io.Writer, lf *LogFile, m, k uint64, opt CompactOptions) (n int64, err error) {
+	var buf bytes.Buffer
+	if _, err := lf.CompactTo(&buf, m, k); err != nil {
+		return 0, err
+	}
+
+	var f IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	a := make(IndexFiles, 0, len(p)+1)
+	a = append(a, &f)
+	a = append(a, p...)
+	return a.CompactToWithOptions(context.Background(), w, m, k, opt)
+}
+
+// VerifyCompaction returns an error describing the first difference between
+// the merged contents of the index files and the compacted file f.
+//
+// Every measurement, tag key, tag value & series, including tombstones, is
+// compared using the same merge iterators that are used for compaction. The
+// series of each tag value are also compared to check the series ids.
+func (p IndexFiles) VerifyCompaction(f *IndexFile) error {
+	return p.compare(IndexFiles{f})
+}
+
+// Equal returns true if the merged contents of p & other are logically the
+// same. Otherwise a description of the first difference is returned, where
+// elements "in output" refer to other. Elements & their tombstone states are
+// compared as with VerifyCompaction so the physical layout of the files, such
+// as how elements are split between files or the codec used, is ignored.
+// Elements are streamed from both sets so memory use does not grow with the
+// size of the files. Sets containing a file opened with OpenMetadataOnly are
+// never equal since their series cannot be compared.
+func (p IndexFiles) Equal(other IndexFiles) (bool, string) {
+	if err := p.compare(other); err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+// compare returns an error describing the first difference between the merged
+// contents of p & out. Files opened without their series block cannot be
+// compared.
+func (p IndexFiles) compare(out IndexFiles) error {
+	if err := p.seriesBlocksLoaded(); err != nil {
+		return err
+	} else if err := out.seriesBlocksLoaded(); err != nil {
+		return err
+	}
+
+	// Compare series block.
+	if err := verifyCompactedSeries("series", p.seriesIterator(), out.seriesIterator(), true); err != nil {
+		return err
+	}
+
+	// Compare measurements and their tagsets.
+	mitr0, mitr1 := p.measurementIterator(), out.measurementIterator()
+	for {
+		m0, m1 := nextMeasurementElem(mitr0), nextMeasurementElem(mitr1)
+		if m0 == nil && m1 == nil {
+			break
+		} else if err := verifyCompactedElem("measurement", m0, m1); err != nil {
+			return err
+		}
+
+		if err := p.verifyCompactedTagset(out, copyBytes(m0.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyCompactedTagset compares the tag keys, values & series of a measurement.
+func (p IndexFiles) verifyCompactedTagset(out IndexFiles, name []byte) error {
+	kitr0, err := p.tagKeyIterator(name)
+	if err != nil {
+		return err
+	}
+	kitr1, err := out.tagKeyIterator(name)
+	if err != nil {
+		return err
+	}
+
+	for {
+		k0, k1 := nextTagKeyElem(kitr0), nextTagKeyElem(kitr1)
+		if k0 == nil && k1 == nil {
+			return nil
+		} else if err := verifyCompactedElem(fmt.Sprintf("tag key on %q", name), k0, k1); err != nil {
+			return err
+		}
+		key := copyBytes(k0.Key())
+
+		// Compare values for the key.
+		vitr0, vitr1 := k0.TagValueIterator(), k1.TagValueIterator()
+		for {
+			v0, v1 := nextTagValueElem(vitr0), nextTagValueElem(vitr1)
+			if v0 == nil && v1 == nil {
+				break
+			} else if err := verifyCompactedElem(fmt.Sprintf("tag value on %q, %q", name, key), v0, v1); err != nil {
+				return err
+			}
+
+			// Tombstone state is resolved from the series block, which is
+			// already compared, so only compare the series keys.
+			kind := fmt.Sprintf("series on %q, %q=%q", name, key, v0.Value())
+			if err := verifyCompactedSeries(kind, p.tagValueSeriesIterator(name, key, v0.Value()), out.tagValueSeriesIterator(name, key, v1.Value()), false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// verifyCompactedSeries compares two series iterators.
+func verifyCompactedSeries(kind string, itr0, itr1 SeriesIterator, checkDeleted bool) error {
+	for {
+		e0, e1 := nextSeriesElem(itr0), nextSeriesElem(itr1)
+
+		switch {
+		case e0 == nil && e1 == nil:
+			return nil
+		case e0 == nil:
+			return fmt.Errorf("unexpected %s in output: %s", kind, models.MakeKey(e1.Name(), e1.Tags()))
+		case e1 == nil:
+			return fmt.Errorf("%s missing from output: %s", kind, models.MakeKey(e0.Name(), e0.Tags()))
+		case !bytes.Equal(e0.Name(), e1.Name()) || models.CompareTags(e0.Tags(), e1.Tags()) != 0:
+			return fmt.Errorf("%s mismatch: expected %s, got %s", kind, models.MakeKey(e0.Name(), e0.Tags()), models.MakeKey(e1.Name(), e1.Tags()))
+		case checkDeleted && e0.Deleted() != e1.Deleted():
+			return fmt.Errorf("%s tombstone mismatch: %s: expected deleted=%v", kind, models.MakeKey(e0.Name(), e0.Tags()), e0.Deleted())
+		}
+	}
+}
+
+// compactedElem is implemented by the measurement, tag key & tag value elements.
+type compactedElem interface {
+	Deleted() bool
+}
+
+// verifyCompactedElem compares the identifier and tombstone state of two
+// elements. A nil element means that the iterator was exhausted.
+func verifyCompactedElem(kind string, e0, e1 compactedElem) error {
+	id := func(e compactedElem) []byte {
+		switch e := e.(type) {
+		case MeasurementElem:
+			return e.Name()
+		case TagKeyElem:
+			return e.Key()
+		case TagValueElem:
+			return e.Value()
+		}
+		return nil
+	}
+
+	switch {
+	case e0 == nil:
+		return fmt.Errorf("unexpected %s in output: %q", kind, id(e1))
+	case e1 == nil:
+		return fmt.Errorf("%s missing from output: %q", kind, id(e0))
+	case !bytes.Equal(id(e0), id(e1)):
+		return fmt.Errorf("%s mismatch: expected %q, got %q", kind, id(e0), id(e1))
+	case e0.Deleted() != e1.Deleted():
+		return fmt.Errorf("%s tombstone mismatch: %q: expected deleted=%v", kind, id(e0), e0.Deleted())
+	}
+	return nil
+}
+
+// nextMeasurementElem returns the next element or nil if itr is nil.
+func nextMeasurementElem(itr MeasurementIterator) MeasurementElem {
+	if itr == nil {
+		return nil
+	}
+	return itr.Next()
+}
+
+// nextSeriesElem returns the next element or nil if itr is nil.
+func nextSeriesElem(itr SeriesIterator) SeriesElem {
+	if itr == nil {
+		return nil
+	}
+	return itr.Next()
+}
+
+// nextTagKeyElem returns the next element or nil if itr is nil.
+func nextTagKeyElem(itr TagKeyIterator) TagKeyElem {
+	if itr == nil {
+		return nil
+	}
+	return itr.Next()
+}
+
+// nextTagValueElem returns the next element or nil if itr is nil.
+func nextTagValueElem(itr TagValueIterator) TagValueElem {
+	if itr == nil {
+		return nil
+	}
+	return itr.Next()
+}
+
+// CompactToContext merges all index files and writes them to w.
+//
+// The context is checked before the series block, before each tagset, and
+// before the measurement block. If it is cancelled then ctx.Err() is returned
+// along with the number of bytes written so far. The buffered writer is not
+// flushed after cancellation so a trailer is never written for a partial file.
+func (p IndexFiles) CompactToContext(ctx context.Context, w io.Writer, m, k uint64) (n int64, err error) {
+	return p.CompactToWithOptions(ctx, w, m, k, CompactOptions{})
+}
+
+// CompactToWithOptions merges all index files and writes them to w using
+// the settings in opt. Cancellation behaves the same as CompactToContext.
+func (p IndexFiles) CompactToWithOptions(ctx context.Context, w io.Writer, m, k uint64, opt CompactOptions) (n int64, err error) {
+	n, _, err = p.CompactToWithTrailer(ctx, w, m, k, opt)
+	return n, err
+}
+
+// CompactToWithTrailer merges all index files and writes them to w like
+// CompactToWithOptions. The trailer written to the file is also returned so
+// callers can report the size of each block.
+func (p IndexFiles) CompactToWithTrailer(ctx context.Context, w io.Writer, m, k uint64, opt CompactOptions) (n int64, t IndexFileTrailer, err error) {
+	var info indexCompactInfo
+	return p.compactTo(ctx, w, m, k, opt, &info)
+}
+
+// compactTo writes the merged index files to w using info to track the
+// shared data of the compaction. Counts of the elements written are left in
+// info.stats.
+func (p IndexFiles) compactTo(ctx context.Context, w io.Writer, m, k uint64, opt CompactOptions, info *indexCompactInfo) (n int64, t IndexFileTrailer, err error) {
+	t.Version = IndexFileVersion
+	t.Generation, t.Level = opt.Generation, opt.Level
+	if opt.Now.IsZero() {
+		opt.Now = time.Now()
+	}
+
+	// Wrap writer in buffered I/O. Flushed data is rate limited, if set.
+	bw := bufio.NewWriterSize(opt.limitWriter(ctx, w), opt.bufferSize())
+
+	// Setup context object to track shared data for this compaction.
+	info.ctx = ctx
+	info.opt = opt
+	info.tagSets = make(map[string]indexTagSetPos)
+
+	// Write magic number.
+	if err := writeTo(bw, []byte(FileSignature), &n); err != nil {
+		return n, t, err
+	}
+
+	// Checksum each block as it is written.
+	cw := newChecksumWriter(bw)
+
+	// Write combined series list.
+	if err := ctx.Err(); err != nil {
+		return n, t, err
+	} else if err := opt.writeBlockPaddingTo(bw, &n); err != nil {
+		return n, t, err
+	}
+	t.SeriesBlock.Offset = n
+	info.progress(CompactPhaseSeriesBlock, 0, n)
+	if err := p.writeSeriesBlockTo(cw, m, k, info, &n); err != nil {
+		return n, t, p.compactError(CompactPhaseSeriesBlock, nil, err)
+	}
+	t.SeriesBlock.Size = n - t.SeriesBlock.Offset
+	t.SeriesBlock.Checksum = cw.Sum()
+
+	// Flush buffer before re-mapping.
+	if err := bw.Flush(); err != nil {
+		return n, t, p.compactError(CompactPhaseSeriesBlock, nil, err)
+	}
+
+	// Open series block as memory-mapped data.
+	sblk, data, err := mapIndexFileSeriesBlock(w, t.SeriesBlock.Offset)
+	if data != nil {
+		defer mmap.Unmap(data)
+	}
+	if err != nil {
+		return n, t, p.compactError(CompactPhaseSeriesBlock, nil, err)
+	}
+	info.sblk = sblk
+
+	// Write tagset blocks in measurement order.
+	if err := opt.writeBlockPaddingTo(bw, &n); err != nil {
+		return n, t, p.compactError(CompactPhaseTagsets, nil, err)
+	}
+	t.TagsetBlock.Offset = n
+	if err := p.writeTagsetsTo(cw, info, &n); err != nil {
+		return n, t, p.compactError(CompactPhaseTagsets, nil, err)
+	}
+	t.TagsetBlock.Size = n - t.TagsetBlock.Offset
+	t.TagsetBlock.Checksum = cw.Sum()
+
+	// Write measurement block.
+	if err := ctx.Err(); err != nil {
+		return n, t, err
+	} else if err := opt.writeBlockPaddingTo(bw, &n); err != nil {
+		return n, t, p.compactError(CompactPhaseMeasurementBlock, nil, err)
+	}
+	t.MeasurementBlock.Offset = n
+	if err := p.writeMeasurementBlockTo(cw, info, &n); err != nil {
+		return n, t, p.compactError(CompactPhaseMeasurementBlock, nil, err)
+	}
+	t.MeasurementBlock.Size = n - t.MeasurementBlock.Offset
+	t.MeasurementBlock.Checksum = cw.Sum()
+
+	// Write tombstone block.
+	t.TombstoneBlock.Offset = n
+	if err := writeTo(cw, info.tombstones, &n); err != nil {
+		return n, t, p.compactError(CompactPhaseTrailer, nil, err)
+	}
+	t.TombstoneBlock.Size = n - t.TombstoneBlock.Offset
+	t.TombstoneBlock.Checksum = cw.Sum()
+
+	// Write trailer.
+	nn, err := t.WriteTo(bw)
+	n += nn
+	if err != nil {
+		return n, t, p.compactError(CompactPhaseTrailer, nil, err)
+	}
+	info.progress(CompactPhaseTrailer, 0, n)
+
+	// Flush file.
+	if err := bw.Flush(); err != nil {
+		return n, t, p.compactError(CompactPhaseTrailer, nil, err)
+	}
+
+	// Write the series offsets of the finished file, if requested.
+	if opt.SeriesOffsetTable != nil {
+		if err := sblk.writeOffsetTableTo(opt.SeriesOffsetTable); err != nil {
+			return n, t, err
+		}
+	}
+	info.checkTombstones()
+
+	return n, t, nil
+}
+
+// EstimateSize returns the size of the file that would be produced by
+// compacting the index files with CompactTo. No data is written, however,
+// every series, tagset & measurement is still iterated and the offset of
+// every series is held in memory so the cost is similar to a compaction.
+func (p IndexFiles) EstimateSize(m, k uint64) (n int64, err error) {
+	return p.EstimateSizeWithOptions(m, k, CompactOptions{})
+}
+
+// EstimateSizeWithOptions returns the estimated compaction size like
+// EstimateSize using the settings in opt. If opt.MaxSeriesOffsetMemory is set
+// then series offsets are spilled to a temporary file once their estimated
+// in-memory size exceeds it.
+func (p IndexFiles) EstimateSizeWithOptions(m, k uint64, opt CompactOptions) (n int64, err error) {
+	l, err := p.Layout(m, k, opt)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Size(), nil
+}
+
+func (p IndexFiles) writeSeriesBlockTo(w io.Writer, m, k uint64, info *indexCompactInfo, n *int64) error {
+	// Files opened without their series block cannot be compacted.
+	if err := p.seriesBlocksLoaded(); err != nil {
+		return err
+	}
+
+	// Estimate series cardinality.
+	sketch := hll.NewDefaultPlus()
+	for _, f := range p {
+		if err := f.MergeSeriesSketches(sketch, sketch); err != nil {
+			return err
+		}
+	}
+
+	// Size the bloom filter for the false positive rate, if set.
+	seriesN := sketch.Count()
+	if fpr := info.opt.BloomFalsePositiveRate; fpr >= 1 {
+		return fmt.Errorf("invalid bloom filter false positive rate: %v", fpr)
+	} else if fpr > 0 {
+		if seriesN == 0 {
+			seriesN = 1
+		}
+		m, k = bloom.Estimate(seriesN, fpr)
+	}
+
+	itr := p.seriesIterator()
+	enc := NewSeriesBlockEncoder(w, uint32(seriesN), m, k)
+	enc.Codec = info.opt.SeriesBlockCodec
+	enc.Order = info.opt.SeriesBlockOrder
+	enc.AssumeSorted = info.opt.AssumeSorted
+	if info.opt.StrictSeriesOrder {
+		enc.Strict = true
+	}
+	if err := enc.SetSketchPrecision(info.opt.SketchPrecision); err != nil {
+		return err
+	} else if err := enc.SetHash(info.opt.SeriesBlockHash); err != nil {
+		return err
+	}
+
+	// Record the deletion times & offsets of the series as they are written.
+	// A hash ordered block writes each series after it is encoded so the
+	// deletion times are held by key until then.
+	info.tombstones = info.tombstones[:0]
+	deletedAts := make(map[string]int64)
+	enc.OnWrite = func(key []byte, offset uint32) error {
+		if deletedAt, ok := deletedAts[string(key)]; ok {
+			info.tombstones = appendTombstoneEntry(info.tombstones, offset, deletedAt)
+			delete(deletedAts, string(key))
+		}
+		if info.seriesOffsets != nil {
+			return info.seriesOffsets.add(key, offset)
+		}
+		return nil
+	}
+
+	// Write all series. Series are grouped by measurement so the tombstone
+	// state & remapped name of the current measurement are cached.
+	remap := measurementRemapper{opt: &info.opt}
+	var seriesKey, name, remapped []byte
+	var nameDeleted, skip bool
+	timed := p.hasTombstoneTimes()
+	for e := nextSeriesElem(itr); e != nil; e = itr.Next() {
+		if !bytes.Equal(e.Name(), name) {
+			name = append(name[:0], e.Name()...)
+			if info.names.past(name) {
+				break
+			} else if skip = !info.names.contains(name); skip {
+				continue
+			}
+			nameDeleted = info.opt.DropTombstones && p.measurementDeleted(name)
+
+			var err error
+			if remapped, err = remap.remap(name); err != nil {
+				return p.compactError(CompactPhaseSeriesBlock, name, err)
+			}
+		} else if skip {
+			continue
+		}
+
+		// Carry the deletion time of tombstones into the new file.
+		var deletedAt int64
+		if e.Deleted() && timed {
+			deletedAt = p.seriesTombstoneTime(e.Name(), e.Tags(), nil)
+		}
+
+		if info.opt.DropTombstones && (e.Deleted() || nameDeleted) {
+			if nameDeleted || !info.opt.retainTombstone(deletedAt) {
+				info.stats.droppedSeriesN++
+				if info.opt.OnDrop != nil {
+					info.opt.OnDrop(name, e.Tags())
+				}
+				continue
+			} else if deletedAt == 0 {
+				deletedAt = info.opt.Now.UnixNano()
+			}
+			info.stats.retainedTombstoneN++
+		}
+
+		if deletedAt != 0 {
+			seriesKey = AppendSeriesKey(seriesKey[:0], remapped, e.Tags())
+			deletedAts[string(seriesKey)] = deletedAt
+		}
+		if err := enc.Encode(remapped, e.Tags(), e.Deleted()); err != nil {
+			return p.compactError(CompactPhaseSeriesBlock, name, err)
+		}
+		info.stats.seriesN++
+		if e.Deleted() {
+			info.stats.seriesTombstoneN++
+		}
+	}
+
+	// Abort if a source file failed partway through the series. The failing
+	// file was reading the series after the last measurement encoded.
+	if err := SeriesIteratorErr(itr); err != nil {
+		return p.compactError(CompactPhaseSeriesBlock, name, err)
+	}
+
+	// Close and flush block.
+	err := enc.Close()
+	*n += int64(enc.N())
+	if err != nil {
+		return err
+	}
+
+	// Series ids of a hash ordered block are not assigned in key order.
+	if enc.Order == SeriesBlockOrderHash {
+		sortTombstoneEntries(info.tombstones)
+	}
+	return nil
+}
+
+func (p IndexFiles) writeTagsetsTo(w io.Writer, info *indexCompactInfo, n *int64) error {
+	if workerN := info.opt.concurrency(); workerN > 1 {
+		return p.writeTagsetsConcurrentlyTo(w, workerN, info, n)
+	}
+
+	var measurementN int
+	mitr := p.compactMeasurementIterator(info)
+	if mitr == nil {
+		return nil
+	}
+	for m := mitr.Next(); m != nil; m = mitr.Next() {
+		if err := info.ctx.Err(); err != nil {
+			return err
+		}
+		if p.dropMeasurement(m, info) {
+			continue
+		}
+		if err := p.writeTagsetTo(w, m.Name(), info, n); err != nil {
+			return p.compactError(CompactPhaseTagsets, m.Name(), err)
+		}
+
+		measurementN++
+		info.progress(CompactPhaseTagsets, measurementN, *n)
+	}
+	return nil
+}
+
+// writeTagsetsConcurrentlyTo encodes the tagsets for batches of workerN
+// measurements in parallel and then writes them to w in measurement order.
+// The output is identical to writing the tagsets sequentially.
+func (p IndexFiles) writeTagsetsConcurrentlyTo(w io.Writer, workerN int, info *indexCompactInfo, n *int64) error {
+	mitr := p.compactMeasurementIterator(info)
+	if mitr == nil {
+		return nil
+	}
+
+	var measurementN int
+	names := make([][]byte, 0, workerN)
+	bufs := make([]bytes.Buffer, workerN)
+	poss := make([]indexTagSetPos, workerN)
+	errs := make([]error, workerN)
+	for {
+		if err := info.ctx.Err(); err != nil {
+			return err
+		}
+
+		// Read the next batch of measurement names.
+		names = names[:0]
+		for len(names) < workerN {
+			m := mitr.Next()
+			if m == nil {
+				break
+			} else if p.dropMeasurement(m, info) {
+				continue
+			}
+			names = append(names, copyBytes(m.Name()))
+		}
+		if len(names) == 0 {
+			return nil
+		}
+
+		// Encode each tagset into its own buffer.
+		var wg sync.WaitGroup
+		for i := range names {
+			bufs[i].Reset()
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				poss[i], errs[i] = p.encodeTagsetTo(&bufs[i], names[i], info)
+			}(i)
+		}
+		wg.Wait()
+
+		// Write tagsets in order and save their positions.
+		for i, name := range names {
+			if errs[i] != nil {
+				return p.compactError(CompactPhaseTagsets, name, errs[i])
+			}
+
+			offset := *n
+			if err := writeTo(w, bufs[i].Bytes(), n); err != nil {
+				return p.compactError(CompactPhaseTagsets, name, err)
+			}
+			pos := poss[i]
+			pos.offset, pos.size = offset, *n-offset
+			info.tagSets[string(name)] = pos
+			poss[i] = indexTagSetPos{}
+
+			measurementN++
+			info.progress(CompactPhaseTagsets, measurementN, *n)
+		}
+	}
+}
+
+// writeTagsetTo writes a single tagset to w and saves the tagset offset.
+func (p IndexFiles) writeTagsetTo(w io.Writer, name []byte, info *indexCompactInfo, n *int64) error {
+	offset := *n
+
+	// Encode tagset to writer.
+	pos, err := p.encodeTagsetTo(w, name, info)
+	*n += pos.size
+	if err != nil {
+		return err
+	}
+
+	// Save tagset offset, size & series ids to measurement.
+	pos.offset = offset
+	info.tagSets[string(name)] = pos
+
+	return nil
+}
+
+// encodeTagsetTo encodes a single tagset to w and returns its position with
+// the number of bytes written as the size, the sorted ids of every series in
+// the measurement & the number of keys & values encoded. The offset is not
+// set. It does not modify info so it is safe to call concurrently.
+func (p IndexFiles) encodeTagsetTo(w io.Writer, name []byte, info *indexCompactInfo) (indexTagSetPos, error) {
+	dropTombstones := info.opt.DropTombstones
+	remapped := info.opt.remapMeasurement(name)
+
+	// Resolve the offset of every series in the measurement once. The offsets
+	// are cached so each tag value containing the series reuses the lookup &
+	// the ids are saved for the measurement block.
+	cache := newSeriesOffsetCache(info.sblk)
+	mitr := p.filterDroppedSeriesIterator(p.measurementSeriesIterator(name), &info.opt)
+	var measurementSeriesIDs []uint32
+	for e := nextSeriesElem(mitr); e != nil; e = mitr.Next() {
+		seriesID := cache.add(remapped, e.Tags())
+		if seriesID == 0 {
+			return indexTagSetPos{}, newErrMissingSeriesID(e.Name(), e.Tags())
+		}
+		measurementSeriesIDs = append(measurementSeriesIDs, seriesID)
+	}
+	if err := SeriesIteratorErr(mitr); err != nil {
+		return indexTagSetPos{}, err
+	}
+	sort.Sort(uint32Slice(measurementSeriesIDs))
+
+	kitr, err := p.tagKeyIterator(name)
+	if err != nil {
+		return indexTagSetPos{}, err
+	}
+
+	var keyN, valueN int
+	enc := NewTagBlockEncoder(w)
+	for ke := nextTagKeyElem(kitr); ke != nil; ke = kitr.Next() {
+		if dropTombstones && ke.Deleted() {
+			continue
+		}
+
+		// Encode key. Keys are deferred until a live value is found when
+		// dropping tombstones.
+		keyEncoded := false
+		if !dropTombstones {
+			if err := enc.EncodeKey(ke.Key(), ke.Deleted()); err != nil {
+				return indexTagSetPos{size: enc.N()}, err
+			}
+			keyEncoded = true
+			keyN++
+		}
+
+		// Iterate over tag values.
+		vitr := ke.TagValueIterator()
+		for ve := nextTagValueElem(vitr); ve != nil; ve = vitr.Next() {
+			if dropTombstones && ve.Deleted() {
+				continue
+			}
+
+			// Merge all series together.
+			sitr := p.filterDroppedSeriesIterator(p.tagValueSeriesIterator(name, ke.Key(), ve.Value()), &info.opt)
+			var seriesIDs []uint32
+			for se := nextSeriesElem(sitr); se != nil; se = sitr.Next() {
+				seriesID := cache.offset(remapped, se.Tags())
+				if seriesID == 0 {
+					return indexTagSetPos{size: enc.N()}, newErrMissingSeriesID(se.Name(), se.Tags())
+				}
+				seriesIDs = append(seriesIDs, seriesID)
+			}
+			if err := SeriesIteratorErr(sitr); err != nil {
+				return indexTagSetPos{size: enc.N()}, err
+			}
+			sort.Sort(uint32Slice(seriesIDs))
+
+			if dropTombstones {
+				if len(seriesIDs) == 0 {
+					continue
+				} else if !keyEncoded {
+					if err := enc.EncodeKey(ke.Key(), false); err != nil {
+						return indexTagSetPos{size: enc.N()}, err
+					}
+					keyEncoded = true
+					keyN++
+				}
+			}
+
+			// Encode value.
+			if err := enc.EncodeValue(ve.Value(), ve.Deleted(), seriesIDs); err != nil {
+				return indexTagSetPos{size: enc.N()}, err
+			}
+			valueN++
+		}
+	}
+
+	// Flush data to writer.
+	err = enc.Close()
+	return indexTagSetPos{size: enc.N(), seriesIDs: measurementSeriesIDs, keyN: keyN, valueN: valueN}, err
+}
+
+func (p IndexFiles) writeMeasurementBlockTo(w io.Writer, info *indexCompactInfo, n *int64) error {
+	mw := NewMeasurementBlockWriter()
+	mw.SetIndex(info.opt.MeasurementBlockIndex)
+	if info.opt.NoMeasurementSketches {
+		mw.DisableSketches()
+	} else if err := mw.SetSketchPrecision(info.opt.SketchPrecision); err != nil {
+		return err
+	}
+
+	// Add measurement data & compute sketches.
+	var measurementN int
+	remap := measurementRemapper{opt: &info.opt}
+	if mitr := p.compactMeasurementIterator(info); mitr != nil {
+		for m := mitr.Next(); m != nil; m = mitr.Next() {
+			name := m.Name()
+			if p.dropMeasurement(m, info) {
+				info.stats.droppedMeasurementN++
+				continue
+			}
+			remapped, err := remap.remap(name)
+			if err != nil {
+				return p.compactError(CompactPhaseMeasurementBlock, name, err)
+			}
+
+			// Add measurement to writer. Series ids were resolved with the tagset.
+			pos := info.tagSets[string(name)]
+			mw.Add(remapped, m.Deleted(), pos.offset, pos.size, pos.seriesIDs)
+			delete(info.tagSets, string(name))
+
+			info.stats.measurementN++
+			info.stats.tagKeyN += pos.keyN
+			info.stats.tagValueN += pos.valueN
+
+			measurementN++
+			info.progress(CompactPhaseMeasurementBlock, measurementN, *n)
+		}
 	}
 
 	// Flush data to writer.
@@ -315,11 +2299,124 @@ func (p IndexFiles) writeMeasurementBlockTo(w io.Writer, info *indexCompactInfo,
 	return err
 }
 
+// compactMeasurementIterator returns a merged iterator over the measurements
+// in the range being compacted.
+func (p IndexFiles) compactMeasurementIterator(info *indexCompactInfo) MeasurementIterator {
+	itr := p.measurementIterator()
+	if itr == nil || info.names.all() {
+		return itr
+	}
+	return &measurementRangeIterator{itr: itr, rng: info.names}
+}
+
+// hasTombstoneTimes returns true if any file records series deletion times.
+func (p IndexFiles) hasTombstoneTimes() bool {
+	for _, f := range p {
+		if f.tombstones.len() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// seriesTombstoneTime returns the deletion time recorded for the most recent
+// state of the series, in unix nanoseconds. Returns zero if the series is live
+// or the time is unknown.
+func (p IndexFiles) seriesTombstoneTime(name []byte, tags models.Tags, buf []byte) int64 {
+	for _, f := range p {
+		if exists, deletedAt := f.seriesTombstoneTime(name, tags, buf); exists {
+			return deletedAt
+		}
+	}
+	return 0
+}
+
+// measurementDeleted returns true if the most recent state of the measurement
+// is deleted.
+func (p IndexFiles) measurementDeleted(name []byte) bool {
+	for _, f := range p {
+		if e := f.Measurement(name); e != nil {
+			return e.Deleted()
+		}
+	}
+	return false
+}
+
+// dropMeasurement returns true if the measurement is omitted from the
+// compaction because tombstones are dropped and it has no live or retained
+// series.
+func (p IndexFiles) dropMeasurement(m MeasurementElem, info *indexCompactInfo) bool {
+	if !info.opt.DropTombstones {
+		return false
+	} else if m.Deleted() {
+		return true
+	}
+	return nextSeriesElem(p.filterDroppedSeriesIterator(p.measurementSeriesIterator(m.Name()), &info.opt)) == nil
+}
+
+// filterDroppedSeriesIterator returns itr without the series tombstones that
+// are dropped by the compaction. Tombstones kept by TombstoneRetention are
+// still returned so they mask the series in older files.
+func (p IndexFiles) filterDroppedSeriesIterator(itr SeriesIterator, opt *CompactOptions) SeriesIterator {
+	if !opt.DropTombstones {
+		return itr
+	} else if opt.TombstoneRetention <= 0 {
+		return FilterUndeletedSeriesIterator(itr)
+	} else if itr == nil {
+		return nil
+	}
+	return &filterDroppedSeriesIterator{p: p, itr: itr, opt: opt}
+}
+
+// filterDroppedSeriesIterator returns live series & retained tombstones.
+type filterDroppedSeriesIterator struct {
+	p   IndexFiles
+	itr SeriesIterator
+	opt *CompactOptions
+}
+
+// Err returns the error from the underlying iterator.
+func (itr *filterDroppedSeriesIterator) Err() error { return SeriesIteratorErr(itr.itr) }
+
+// EstimatedCount returns the estimate of the underlying iterator, which
+// includes dropped tombstones.
+func (itr *filterDroppedSeriesIterator) EstimatedCount() (uint64, bool) {
+	return SeriesIteratorEstimatedCount(itr.itr)
+}
+
+func (itr *filterDroppedSeriesIterator) Next() SeriesElem {
+	for {
+		e := itr.itr.Next()
+		if e == nil {
+			return nil
+		} else if e.Deleted() && !itr.opt.retainTombstone(itr.p.seriesTombstoneTime(e.Name(), e.Tags(), nil)) {
+			continue
+		}
+		return e
+	}
+}
+
+// MemSize returns the approximate memory used by all files, in bytes.
+func (p IndexFiles) MemSize() int64 { return p.MemUsage().Total() }
+
+// MemUsage returns the approximate memory used by all files.
+func (p IndexFiles) MemUsage() MemUsage {
+	var u MemUsage
+	for _, f := range p {
+		fu := f.MemUsage()
+		u.Mapped += fu.Mapped
+		u.Heap += fu.Heap
+	}
+	return u
+}
+
 // Stat returns the max index file size and the total file size for all index files.
+// The size & modtime of each file are cached when it is opened so the files
+// are only stat'd again if the cache is cold.
 func (p IndexFiles) Stat() (*IndexFilesInfo, error) {
 	var info IndexFilesInfo
 	for _, f := range p {
-		fi, err := os.Stat(f.Path())
+		fi, err := f.stat()
 		if os.IsNotExist(err) {
 			continue
 		} else if err != nil {
@@ -334,29 +2431,735 @@ func (p IndexFiles) Stat() (*IndexFilesInfo, error) {
 		}
 
 		info.Size += fi.Size()
+
+		// Aggregate block sizes from the trailer read when the file was opened.
+		t := f.Trailer()
+		info.SeriesBlockSize += t.SeriesBlock.Size
+		info.TagsetBlockSize += t.TagsetBlock.Size
+		info.MeasurementBlockSize += t.MeasurementBlock.Size
 	}
 	return &info, nil
 }
 
+// NeedsCompaction returns true if the files reach any of the thresholds. The
+// file sizes & series counts are read from memory so no file is accessed.
+// Tombstoned series are counted per file so a series tombstoned in multiple
+// files is counted more than once.
+func (p IndexFiles) NeedsCompaction(thresholds CompactionThresholds) bool {
+	var maxSize, size int64
+	var seriesN, tombstoneN uint64
+	for _, f := range p {
+		if sz := f.Size(); sz > maxSize {
+			maxSize = sz
+		}
+		size += f.Size()
+		seriesN += uint64(f.sblk.seriesN)
+		tombstoneN += uint64(f.sblk.tombstoneN)
+	}
+	return thresholds.Reached(len(p), maxSize, size, seriesN, tombstoneN)
+}
+
+// CompactOptions represents optional settings used when compacting index files.
+// The zero value uses the default settings.
+type CompactOptions struct {
+	// Invoked as the compaction moves through each phase. Optional.
+	Progress ProgressFunc
+
+	// Size of the buffer wrapping the output writer, in bytes.
+	// Defaults to DefaultCompactBufferSize if zero or less.
+	BufferSize int
+
+	// Boundary, in bytes, that the series, tagset & measurement blocks start
+	// on, such as 4096 for direct I/O. Zero bytes are written before each
+	// block to pad it to the next multiple of the alignment. The padding is
+	// not part of any block or checksum & readers skip it using the block
+	// offsets in the trailer. The trailer is written directly after the
+	// measurement block. Blocks are not padded if this is one or less.
+	BlockAlignment int64
+
+	// Maximum number of measurement tagsets to encode concurrently. The number
+	// of workers is also limited by GOMAXPROCS. Tagsets are encoded on the
+	// calling goroutine if this is one or less. The output is byte-identical
+	// regardless of the concurrency.
+	MaxConcurrency int
+
+	// Approximate number of bytes of series offsets held in memory by
+	// EstimateSizeWithOptions before they are spilled to a temporary file.
+	// Offsets are always held in memory if this is zero or less.
+	MaxSeriesOffsetMemory int64
+
+	// Directory for temporary files, such as spilled series offsets. Defaults
+	// to os.TempDir() if blank. The directory must exist; it is checked before
+	// planning starts so a bad setting fails fast rather than when the first
+	// spill happens. Temporary output files written by CompactToFile are
+	// always created alongside the destination so they can be renamed.
+	TempDir string
+
+	// Codec used to write series keys in the series block.
+	// Defaults to SeriesBlockCodecNone.
+	SeriesBlockCodec SeriesBlockCodec
+
+	// Hash function used by the series block hash indexes.
+	// Defaults to SeriesBlockHashXXHash.
+	SeriesBlockHash SeriesBlockHash
+
+	// Order of the series in the series block. SeriesBlockOrderHash lays out
+	// the series of each hash index in slot order so point lookups read less
+	// of the block, at the cost of sorting series ids by key whenever the
+	// series of the file are iterated. Defaults to SeriesBlockOrderLexical.
+	SeriesBlockOrder SeriesBlockOrder
+
+	// Compares each series key with the previous one while encoding the
+	// series block so an out of order series, such as from a corrupt source
+	// file, fails the compaction with *ErrSeriesOrder. Off by default since
+	// the merged series already arrive in key order; without it a corrupt
+	// source is written into a corrupt series block, so enable it for files
+	// which have not passed VerifyChecksums or validation.
+	StrictSeriesOrder bool
+
+	// Trusts the merged series to arrive in key order & skips the series
+	// order check even if StrictSeriesOrder is set.
+	AssumeSorted bool
+
+	// Precision of the HLL+ series & measurement sketches, between 4 and 18.
+	// A sketch uses up to 2^p bytes and has a standard error of roughly
+	// 1.04/sqrt(2^p), so each step halves or doubles the size while changing
+	// the error by a factor of about 1.4. Defaults to hll.DefaultPrecision (16)
+	// if zero. The precision is stored with each sketch.
+	SketchPrecision uint8
+
+	// Omits series, measurements, tag keys & tag values whose most recent
+	// state is deleted rather than writing tombstones. Measurements & tag
+	// values without live series are also omitted. This is only safe when the
+	// files being compacted contain the complete history of the index.
+	// Otherwise a dropped tombstone would no longer mask the element in an
+	// older file.
+	DropTombstones bool
+
+	// Called for each series omitted by DropTombstones, if set, such as to
+	// record deletions in an audit log. It is called in series key order on
+	// the compacting goroutine & is not called unless DropTombstones is set.
+	// The name is the name before any RemapMeasurement. The name & tags must
+	// not be modified or retained after the call returns. Layout does not
+	// call it.
+	OnDrop func(name []byte, tags models.Tags)
+
+	// Keeps series tombstones deleted less than this long ago, if set, when
+	// DropTombstones is set, such as to give replicas a grace period to see
+	// the deletion. Older series tombstones are dropped. Tombstones without a
+	// recorded deletion time, such as those from files written before version
+	// 4, are kept & stamped with Now so they are dropped once the window has
+	// passed. Only series tombstones have a deletion time: series of deleted
+	// measurements, measurements, tag keys & tag values are dropped as usual.
+	TombstoneRetention time.Duration
+
+	// Time the age of tombstones is measured from for TombstoneRetention.
+	// Defaults to the time the compaction, or layout, starts if zero.
+	Now time.Time
+
+	// Generation & level stamped into the trailer so planners can read them
+	// with IndexFile.Generation & Level instead of parsing the filename. A
+	// zero generation leaves them unset & readers fall back to the filename.
+	// The level must be between 0 & 65535.
+	Generation uint64
+	Level      int
+
+	// Called once a compaction has been written, if set, when the fraction of
+	// the written series which are tombstones exceeds TombstoneThreshold. It
+	// is passed the number of tombstones & the number of series written. This
+	// lets operators notice files which keep accumulating tombstones. Layout
+	// does not call it.
+	OnTombstoneThreshold func(tombstoneN, seriesN int)
+
+	// Fraction of the written series, between zero & one, which may be
+	// tombstones before OnTombstoneThreshold is called. If zero, any
+	// tombstone exceeds the threshold.
+	TombstoneThreshold float64
+
+	// Target false positive rate of the series block bloom filter, between
+	// zero & one. If set, the filter is sized using the estimated series
+	// cardinality & the m & k passed to the compaction are ignored. Lower
+	// rates use more memory: each halving costs roughly 1.44 bits per series.
+	// The filter size & hash count are stored in the file.
+	BloomFalsePositiveRate float64
+
+	// Skips computing the measurement block sketches. The sketches are
+	// omitted from the file and readers which need them, such as
+	// MergeMeasurementsSketches, return ErrMeasurementSketchNotAvailable.
+	// Series block sketches are still written.
+	NoMeasurementSketches bool
+
+	// Index of the measurement names in the measurement block.
+	// Defaults to MeasurementBlockIndexHash.
+	MeasurementBlockIndex MeasurementBlockIndex
+
+	// Limits the rate data is written, in bytes per second, if set. The limit
+	// is applied to the data flushed from the write buffer so the burst of the
+	// limiter should be at least the buffer size. A limiter may be shared by
+	// concurrent compactions to limit their combined rate. Waiting for the
+	// limiter stops if the compaction is cancelled.
+	RateLimiter *limiter.Rate
+
+	// Receives the offset of every series in the compacted file, if set,
+	// such as a sidecar file for external structures joined on the same
+	// offsets. The table is written once the file has been written & holds
+	// an entry per series, including tombstones, in series key order: the series key, as read by
+	// ReadSeriesKey, followed by its offset as a big-endian uint32. Offsets
+	// are the series ids used throughout the file & are only valid for the
+	// file produced by this compaction. Any other compaction, even of the
+	// same files, may assign different offsets. The table has an entry for
+	// every series so it can be as large as the series block. If the
+	// compaction fails the table may be incomplete & must be discarded.
+	// Layout & CompactSplit do not support it.
+	SeriesOffsetTable io.Writer
+
+	// Renames measurements as they are compacted, if set. The series keys,
+	// tagsets & measurement block all use the returned name. Names must keep
+	// their order & distinct names must stay distinct, otherwise the
+	// compaction fails with *ErrMeasurementRemapOrder. The function may be
+	// called more than once per measurement & concurrently when
+	// MaxConcurrency is set. The returned slice must not be modified.
+	RemapMeasurement func(name []byte) []byte
+}
+
+// DefaultCompactBufferSize is the default size of the compaction write buffer.
+const DefaultCompactBufferSize = 4096
+
+// bufferSize returns the write buffer size, or the default if unset.
+func (opt *CompactOptions) bufferSize() int {
+	if opt.BufferSize <= 0 {
+		return DefaultCompactBufferSize
+	}
+	return opt.BufferSize
+}
+
+// writeBlockPaddingTo writes zeros to w to align offset n to the block
+// alignment. Updates n.
+func (opt *CompactOptions) writeBlockPaddingTo(w io.Writer, n *int64) error {
+	if opt.BlockAlignment <= 1 || *n%opt.BlockAlignment == 0 {
+		return nil
+	}
+	return writeTo(w, make([]byte, opt.BlockAlignment-*n%opt.BlockAlignment), n)
+}
+
+// retainTombstone returns true if a series tombstone deleted at deletedAt, in
+// unix nanoseconds, is within the retention window. Unknown times are kept.
+func (opt *CompactOptions) retainTombstone(deletedAt int64) bool {
+	if opt.TombstoneRetention <= 0 {
+		return false
+	} else if deletedAt == 0 {
+		return true
+	}
+	return opt.Now.UnixNano()-deletedAt < int64(opt.TombstoneRetention)
+}
+
+// tempDir returns the directory for temporary files, or the default if unset.
+func (opt *CompactOptions) tempDir() string {
+	if opt.TempDir == "" {
+		return os.TempDir()
+	}
+	return opt.TempDir
+}
+
+// checkTempDir returns an error if the temporary file directory is needed but
+// is not a directory.
+func (opt *CompactOptions) checkTempDir() error {
+	if opt.MaxSeriesOffsetMemory <= 0 {
+		return nil
+	}
+
+	dir := opt.tempDir()
+	if fi, err := os.Stat(dir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("compaction temp dir is not a directory: %s", dir)
+	}
+	return nil
+}
+
+// limitWriter wraps w with the rate limiter, if set.
+func (opt *CompactOptions) limitWriter(ctx context.Context, w io.Writer) io.Writer {
+	if opt.RateLimiter == nil {
+		return w
+	}
+	return limiter.NewWriter(ctx, w, opt.RateLimiter)
+}
+
+// remapMeasurement returns the remapped measurement name, if set.
+func (opt *CompactOptions) remapMeasurement(name []byte) []byte {
+	if opt.RemapMeasurement == nil {
+		return name
+	}
+	return opt.RemapMeasurement(name)
+}
+
+// measurementRemapper remaps measurement names in ascending order & verifies
+// that each remapped name sorts after the previous one.
+type measurementRemapper struct {
+	opt                *CompactOptions
+	prev, prevRemapped []byte
+	started            bool
+}
+
+// remap returns the remapped name for name.
+func (r *measurementRemapper) remap(name []byte) ([]byte, error) {
+	if r.opt.RemapMeasurement == nil {
+		return name, nil
+	}
+
+	remapped := r.opt.RemapMeasurement(name)
+	if r.started && bytes.Compare(remapped, r.prevRemapped) <= 0 {
+		return nil, &ErrMeasurementRemapOrder{
+			Prev:         copyBytes(r.prev),
+			PrevRemapped: copyBytes(r.prevRemapped),
+			Name:         copyBytes(name),
+			Remapped:     copyBytes(remapped),
+		}
+	}
+	r.prev = append(r.prev[:0], name...)
+	r.prevRemapped = append(r.prevRemapped[:0], remapped...)
+	r.started = true
+	return remapped, nil
+}
+
+// concurrency returns the number of tagset encoding workers.
+func (opt *CompactOptions) concurrency() int {
+	if n := runtime.GOMAXPROCS(0); n < opt.MaxConcurrency {
+		return n
+	}
+	return opt.MaxConcurrency
+}
+
+// ProgressFunc is a callback used to report the progress of a compaction.
+// It is called from the compacting goroutine so it should return quickly.
+type ProgressFunc func(p CompactProgress)
+
+// CompactProgress describes the state of a compaction in progress.
+type CompactProgress struct {
+	Phase        CompactPhase // current phase
+	MeasurementN int          // measurements processed in the current phase
+	BytesWritten int64        // total bytes written so far
+}
+
+// CompactPhase represents a stage of an index file compaction.
+type CompactPhase int
+
+// Compaction phases, in the order they are executed.
+const (
+	CompactPhaseSeriesBlock CompactPhase = iota + 1
+	CompactPhaseTagsets
+	CompactPhaseMeasurementBlock
+	CompactPhaseTrailer
+)
+
+// String returns the name of the phase.
+func (p CompactPhase) String() string {
+	switch p {
+	case CompactPhaseSeriesBlock:
+		return "SeriesBlock"
+	case CompactPhaseTagsets:
+		return "Tagsets"
+	case CompactPhaseMeasurementBlock:
+		return "MeasurementBlock"
+	case CompactPhaseTrailer:
+		return "Trailer"
+	default:
+		return fmt.Sprintf("CompactPhase(%d)", int(p))
+	}
+}
+
 type IndexFilesInfo struct {
 	MaxSize int64     // largest file size
 	Size    int64     // total file size
 	ModTime time.Time // last modified
+
+	// Total size of each block type across all files.
+	SeriesBlockSize      int64
+	TagsetBlockSize      int64
+	MeasurementBlockSize int64
+}
+
+// ErrIndexFileExists is returned by CompactToFile when the destination
+// path already exists and overwriting was not requested.
+type ErrIndexFileExists struct {
+	Path string
+}
+
+// Error returns the string representation of the error.
+func (e *ErrIndexFileExists) Error() string {
+	return fmt.Sprintf("index file already exists: %s", e.Path)
+}
+
+// ErrMissingSeriesID is returned by a compaction when a series referenced by a
+// measurement or tag value does not exist in the compacted series block. This
+// usually means that one of the source index files is corrupt.
+type ErrMissingSeriesID struct {
+	Name []byte
+	Tags models.Tags
+}
+
+// newErrMissingSeriesID returns a new error with a copy of name & tags.
+func newErrMissingSeriesID(name []byte, tags models.Tags) *ErrMissingSeriesID {
+	return &ErrMissingSeriesID{Name: copyBytes(name), Tags: tags.Clone()}
+}
+
+// Error returns the string representation of the error.
+func (e *ErrMissingSeriesID) Error() string {
+	return fmt.Sprintf("expected series id: %s %s", e.Name, e.Tags.String())
+}
+
+// CompactError is returned when a compaction fails. It records the phase &,
+// when known, the measurement being compacted along with the paths of the
+// source files containing it. Files without a path are omitted. Err is the
+// underlying error.
+type CompactError struct {
+	Phase CompactPhase
+	Name  []byte
+	Paths []string
+	Err   error
+}
+
+// compactError wraps err with the phase & measurement name. Errors which are
+// already wrapped are returned unchanged, as are context errors so that
+// cancellation can still be compared with ctx.Err().
+func (p IndexFiles) compactError(phase CompactPhase, name []byte, err error) error {
+	switch err.(type) {
+	case nil, *CompactError:
+		return err
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+
+	e := &CompactError{Phase: phase, Err: err}
+	if name != nil {
+		e.Name = copyBytes(name)
+		for _, f := range p {
+			if f.Path() != "" && f.Measurement(name) != nil {
+				e.Paths = append(e.Paths, f.Path())
+			}
+		}
+	}
+	return e
+}
+
+// Error returns the string representation of the error.
+func (e *CompactError) Error() string {
+	if e.Name == nil {
+		return fmt.Sprintf("compact %s: %s", e.Phase, e.Err)
+	} else if len(e.Paths) == 0 {
+		return fmt.Sprintf("compact %s: measurement %q: %s", e.Phase, e.Name, e.Err)
+	}
+	return fmt.Sprintf("compact %s: measurement %q in %s: %s", e.Phase, e.Name, strings.Join(e.Paths, ", "), e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *CompactError) Unwrap() error { return e.Err }
+
+// ErrMeasurementRemapOrder is returned by a compaction when
+// CompactOptions.RemapMeasurement maps a measurement to a name which does not
+// sort after the remapped name of the previous measurement.
+type ErrMeasurementRemapOrder struct {
+	Prev, PrevRemapped []byte
+	Name, Remapped     []byte
+}
+
+// Error returns the string representation of the error.
+func (e *ErrMeasurementRemapOrder) Error() string {
+	return fmt.Sprintf("measurement remap out of order: %q -> %q does not sort after %q -> %q", e.Name, e.Remapped, e.Prev, e.PrevRemapped)
 }
 
 // indexCompactInfo is a context object used for tracking position information
 // during the compaction of index files.
 type indexCompactInfo struct {
-	// Memory-mapped series block.
+	// Context used to cancel the compaction.
+	ctx context.Context
+
+	// Options passed in by the caller.
+	opt CompactOptions
+
+	// Series offset lookup. Usually the memory-mapped series block.
 	// Available after the series block has been written.
-	sblk *SeriesBlock
+	sblk seriesOffsetter
+
+	// Offsets of each encoded series, if recorded as the block is written.
+	seriesOffsets *seriesOffsetSet
 
 	// Tracks offset/size for each measurement's tagset.
 	tagSets map[string]indexTagSetPos
+
+	// Range of measurement names to compact. All measurements if unset.
+	names measurementRange
+
+	// Tombstone block entries for the series written.
+	tombstones []byte
+
+	// Counts of the elements written & dropped.
+	stats compactStats
+}
+
+// compactStats counts the elements written & dropped by a compaction.
+type compactStats struct {
+	seriesN, droppedSeriesN           int
+	seriesTombstoneN                  int
+	retainedTombstoneN                int
+	measurementN, droppedMeasurementN int
+	tagKeyN, tagValueN                int
+}
+
+// tombstoneRatio returns the fraction of the written series which are
+// tombstones.
+func (s *compactStats) tombstoneRatio() float64 {
+	if s.seriesN == 0 {
+		return 0
+	}
+	return float64(s.seriesTombstoneN) / float64(s.seriesN)
+}
+
+// checkTombstones calls the tombstone threshold callback, if set, when the
+// fraction of series written as tombstones exceeds the threshold.
+func (info *indexCompactInfo) checkTombstones() {
+	if info.opt.OnTombstoneThreshold == nil {
+		return
+	} else if info.stats.tombstoneRatio() <= info.opt.TombstoneThreshold {
+		return
+	}
+	info.opt.OnTombstoneThreshold(info.stats.seriesTombstoneN, info.stats.seriesN)
+}
+
+// progress reports the compaction's progress, if a callback is set.
+func (info *indexCompactInfo) progress(phase CompactPhase, measurementN int, n int64) {
+	if info.opt.Progress == nil {
+		return
+	}
+	info.opt.Progress(CompactProgress{Phase: phase, MeasurementN: measurementN, BytesWritten: n})
+}
+
+// seriesOffsetter looks up the offset of a series in a series block.
+type seriesOffsetter interface {
+	Offset(name []byte, tags models.Tags, buf []byte) (offset uint32, tombstoned bool)
+}
+
+// seriesOffsetMap is an in-memory lookup of series key to series block offset.
+type seriesOffsetMap map[string]uint32
+
+// Offset returns the offset of the series. Tombstones are not tracked.
+func (m seriesOffsetMap) Offset(name []byte, tags models.Tags, buf []byte) (offset uint32, tombstoned bool) {
+	return m[string(AppendSeriesKey(buf[:0], name, tags))], false
+}
+
+// seriesOffsetEntrySize is the estimated memory overhead of each series
+// offset held in memory, excluding the series key.
+const seriesOffsetEntrySize = 48
+
+// seriesOffsetIndexInterval is the number of spilled entries between each
+// key held in the sparse in-memory index.
+const seriesOffsetIndexInterval = 64
+
+// seriesOffsetSet records the offset of each series as it is encoded.
+//
+// Entries are held in memory until their estimated size exceeds the budget.
+// After that every entry is written to a temporary file in series key order
+// and only every seriesOffsetIndexInterval-th key is kept in memory. Lookups
+// binary search the sparse index and then scan the memory-mapped file.
+// Series must be added in sorted order and finish must be called before
+// any lookup.
+type seriesOffsetSet struct {
+	budget int64
+	dir    string
+
+	// In-memory offsets, used until the budget is exceeded.
+	mem     seriesOffsetMap
+	memSize int64
+
+	// Spill file & sparse index of keys to their position in the file.
+	file  *os.File
+	w     *bufio.Writer
+	n     int64
+	count int
+	index []seriesOffsetIndexEntry
+	data  []byte
+}
+
+// seriesOffsetIndexEntry is the position of a spilled series key.
+type seriesOffsetIndexEntry struct {
+	key []byte
+	pos int64
+}
+
+// newSeriesOffsetSet returns a new instance of seriesOffsetSet.
+// Entries are never spilled if budget is zero or less.
+func newSeriesOffsetSet(budget int64, dir string) *seriesOffsetSet {
+	return &seriesOffsetSet{
+		budget: budget,
+		dir:    dir,
+		mem:    make(seriesOffsetMap),
+	}
+}
+
+// spilled returns true if entries have been moved to the spill file.
+func (s *seriesOffsetSet) spilled() bool { return s.file != nil }
+
+// add records the offset of key. Keys must be added in sorted order.
+func (s *seriesOffsetSet) add(key []byte, offset uint32) error {
+	if s.spilled() {
+		return s.write(key, offset)
+	}
+
+	s.mem[string(key)] = offset
+	s.memSize += int64(len(key)) + seriesOffsetEntrySize
+	if s.budget > 0 && s.memSize > s.budget {
+		return s.spill()
+	}
+	return nil
+}
+
+// spill moves all in-memory entries to a temporary file.
+func (s *seriesOffsetSet) spill() error {
+	f, err := ioutil.TempFile(s.dir, "tsi1-series-offsets-")
+	if err != nil {
+		return err
+	}
+	s.file, s.w = f, bufio.NewWriter(f)
+
+	// Write existing entries in key order.
+	keys := make([][]byte, 0, len(s.mem))
+	for k := range s.mem {
+		keys = append(keys, []byte(k))
+	}
+	sort.Sort(seriesKeys(keys))
+
+	for _, k := range keys {
+		if err := s.write(k, s.mem[string(k)]); err != nil {
+			return err
+		}
+	}
+	s.mem, s.memSize = nil, 0
+	return nil
+}
+
+// write appends an entry to the spill file.
+func (s *seriesOffsetSet) write(key []byte, offset uint32) error {
+	if s.count%seriesOffsetIndexInterval == 0 {
+		s.index = append(s.index, seriesOffsetIndexEntry{key: copyBytes(key), pos: s.n})
+	}
+	s.count++
+
+	if err := writeTo(s.w, key, &s.n); err != nil {
+		return err
+	}
+	return writeUint32To(s.w, offset, &s.n)
+}
+
+// finish flushes & maps the spill file, if used, so it can be searched.
+func (s *seriesOffsetSet) finish() error {
+	if !s.spilled() || s.n == 0 {
+		return nil
+	}
+
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+
+	data, err := mmap.Map(s.file.Name())
+	if err != nil {
+		return err
+	}
+	s.data = data
+	return nil
+}
+
+// Offset returns the offset of the series. Tombstones are not tracked.
+func (s *seriesOffsetSet) Offset(name []byte, tags models.Tags, buf []byte) (offset uint32, tombstoned bool) {
+	key := AppendSeriesKey(buf[:0], name, tags)
+	if !s.spilled() {
+		return s.mem[string(key)], false
+	}
+
+	// Find the last indexed key that is less than or equal to the key.
+	i := sort.Search(len(s.index), func(i int) bool {
+		return CompareSeriesKeys(s.index[i].key, key) == 1
+	}) - 1
+	if i < 0 {
+		return 0, false
+	}
+
+	// Scan entries until the key is found or has been passed.
+	data := s.data[s.index[i].pos:]
+	for j := 0; j < seriesOffsetIndexInterval && len(data) > 0; j++ {
+		k := ReadSeriesKey(data)
+		data = data[len(k):]
+		v := binary.BigEndian.Uint32(data)
+		data = data[4:]
+
+		if cmp := CompareSeriesKeys(k, key); cmp == 0 {
+			return v, false
+		} else if cmp == 1 {
+			break
+		}
+	}
+	return 0, false
+}
+
+// Close unmaps & removes the spill file, if one exists.
+func (s *seriesOffsetSet) Close() error {
+	if s.data != nil {
+		mmap.Unmap(s.data)
+		s.data = nil
+	}
+	if s.file == nil {
+		return nil
+	}
+
+	s.file.Close()
+	err := os.Remove(s.file.Name())
+	s.file = nil
+	return err
 }
 
-// indexTagSetPos stores the offset/size of tagsets.
+// indexTagSetPos stores the offset/size of tagsets & the ids of the series
+// in the measurement.
 type indexTagSetPos struct {
-	offset int64
-	size   int64
+	offset    int64
+	size      int64
+	seriesIDs []uint32
+
+	// Number of tag keys & values encoded.
+	keyN, valueN int
+}
+
+// maxSeriesOffsetCacheN is the maximum number of series offsets cached for a
+// single measurement. Larger measurements look up the remaining series in the
+// series block each time.
+const maxSeriesOffsetCacheN = 1 << 16
+
+// seriesOffsetCache caches the offsets of a measurement's series by key.
+type seriesOffsetCache struct {
+	sblk    seriesOffsetter
+	offsets map[string]uint32
+	buf     []byte
+}
+
+func newSeriesOffsetCache(sblk seriesOffsetter) *seriesOffsetCache {
+	return &seriesOffsetCache{sblk: sblk, offsets: make(map[string]uint32)}
+}
+
+// add looks up the offset of a series & caches it, if the cache is not full.
+func (c *seriesOffsetCache) add(name []byte, tags models.Tags) uint32 {
+	offset, _ := c.sblk.Offset(name, tags, c.buf[:0])
+	if offset != 0 && len(c.offsets) < maxSeriesOffsetCacheN {
+		c.buf = AppendSeriesKey(c.buf[:0], name, tags)
+		c.offsets[string(c.buf)] = offset
+	}
+	return offset
+}
+
+// offset returns the cached offset of a series or looks it up if not cached.
+func (c *seriesOffsetCache) offset(name []byte, tags models.Tags) uint32 {
+	c.buf = AppendSeriesKey(c.buf[:0], name, tags)
+	if offset, ok := c.offsets[string(c.buf)]; ok {
+		return offset
+	}
+	offset, _ := c.sblk.Offset(name, tags, c.buf[:0])
+	return offset
 }
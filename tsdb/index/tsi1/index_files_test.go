@@ -2,9 +2,26 @@ package tsi1_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/pkg/bloom"
+	"github.com/influxdata/influxdb/pkg/estimator"
+	"github.com/influxdata/influxdb/pkg/estimator/hll"
+	"github.com/influxdata/influxdb/pkg/limiter"
 	"github.com/influxdata/influxdb/tsdb/index/tsi1"
 )
 
@@ -51,3 +68,3815 @@ func TestIndexFiles_WriteTo(t *testing.T) {
 		t.Fatalf("unexpected series count: %d", n)
 	}
 }
+
+// Ensure a compaction is aborted when its context is cancelled.
+func TestIndexFiles_CompactToContext_Cancel(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var buf bytes.Buffer
+	a := tsi1.IndexFiles{f0}
+	if _, err := a.CompactToContext(ctx, &buf, M, K); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	} else if buf.Len() != 0 {
+		t.Fatalf("unexpected data flushed: %d bytes", buf.Len())
+	}
+}
+
+// Ensure compaction writes are throttled by the rate limiter.
+func TestIndexFiles_CompactToWithOptions_RateLimiter(t *testing.T) {
+	f0, err := GenerateIndexFile(2, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0}
+
+	var exp bytes.Buffer
+	if _, err := a.CompactTo(&exp, M, K); err != nil {
+		t.Fatal(err)
+	}
+
+	// Allow the rest of the file to be written in roughly 200ms after an
+	// initial burst of a fifth of the file.
+	opt := tsi1.CompactOptions{RateLimiter: limiter.NewRate(exp.Len()*4, exp.Len()/5)}
+
+	var buf bytes.Buffer
+	start := time.Now()
+	if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt); err != nil {
+		t.Fatal(err)
+	} else if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("compaction not throttled: %s", d)
+	} else if !bytes.Equal(buf.Bytes(), exp.Bytes()) {
+		t.Fatal("unexpected data")
+	}
+
+	// Waiting for the limiter stops once the context is cancelled.
+	opt.RateLimiter = limiter.NewRate(1, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := a.CompactToWithOptions(ctx, &bytes.Buffer{}, M, K, opt); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the trailer written by a compaction is returned to the caller.
+func TestIndexFiles_CompactToWithTrailer(t *testing.T) {
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compact the log file.
+	var buf bytes.Buffer
+	n, trailer, err := lf.CompactToWithTrailer(&buf, M, K)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != int64(buf.Len()) {
+		t.Fatalf("unexpected n: %d", n)
+	} else if exp, err := tsi1.ReadIndexFileTrailer(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if trailer != exp {
+		t.Fatalf("unexpected log file trailer: %+v, expected %+v", trailer, exp)
+	}
+
+	// Compact the resulting index file.
+	f := tsi1.NewIndexFile()
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	var other bytes.Buffer
+	if _, trailer, err := (tsi1.IndexFiles{f}).CompactToWithTrailer(context.Background(), &other, M, K, tsi1.CompactOptions{}); err != nil {
+		t.Fatal(err)
+	} else if exp, err := tsi1.ReadIndexFileTrailer(other.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if trailer != exp {
+		t.Fatalf("unexpected index file trailer: %+v, expected %+v", trailer, exp)
+	} else if trailer.SeriesBlock.Size == 0 || trailer.TagsetBlock.Size == 0 || trailer.MeasurementBlock.Size == 0 {
+		t.Fatalf("expected block sizes: %+v", trailer)
+	}
+}
+
+// Ensure the progress callback is invoked for each phase and measurement.
+func TestIndexFiles_CompactToWithOptions_Progress(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a []tsi1.CompactProgress
+	opt := tsi1.CompactOptions{
+		Progress: func(p tsi1.CompactProgress) { a = append(a, p) },
+	}
+
+	var buf bytes.Buffer
+	files := tsi1.IndexFiles{f0}
+	n, err := files.CompactToWithOptions(context.Background(), &buf, M, K, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var phases []tsi1.CompactPhase
+	for _, p := range a {
+		phases = append(phases, p.Phase)
+	}
+	if exp := []tsi1.CompactPhase{
+		tsi1.CompactPhaseSeriesBlock,
+		tsi1.CompactPhaseTagsets, tsi1.CompactPhaseTagsets,
+		tsi1.CompactPhaseMeasurementBlock, tsi1.CompactPhaseMeasurementBlock,
+		tsi1.CompactPhaseTrailer,
+	}; !reflect.DeepEqual(phases, exp) {
+		t.Fatalf("unexpected phases: %v", phases)
+	} else if p := a[2]; p.MeasurementN != 2 {
+		t.Fatalf("unexpected measurement count: %d", p.MeasurementN)
+	} else if p := a[len(a)-1]; p.BytesWritten != n {
+		t.Fatalf("unexpected bytes written: %d, expected %d", p.BytesWritten, n)
+	}
+}
+
+// Ensure a compaction returns an error if a source file references a series
+// that is not in its series block.
+func TestIndexFiles_CompactTo_ErrMissingSeriesID(t *testing.T) {
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := lf.CompactTo(&buf, M, K); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// Decrement the series count in the series block trailer so that the
+	// last series is no longer returned by the series iterator.
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := trailer.SeriesBlock.Offset + trailer.SeriesBlock.Size
+	seriesN := data[end-8 : end-4]
+	binary.BigEndian.PutUint32(seriesN, binary.BigEndian.Uint32(seriesN)-1)
+
+	// Open the file from disk so the error includes its path.
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.tsi")
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	f := tsi1.NewIndexFile()
+	f.SetPath(path)
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var other bytes.Buffer
+	_, err = tsi1.IndexFiles{f}.CompactTo(&other, M, K)
+	e, ok := err.(*tsi1.CompactError)
+	if !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if e.Phase != tsi1.CompactPhaseTagsets || string(e.Name) != "cpu" || !reflect.DeepEqual(e.Paths, []string{path}) {
+		t.Fatalf("unexpected error context: %s", e)
+	} else if exp := fmt.Sprintf("compact Tagsets: measurement \"cpu\" in %s: expected series id: cpu [{region west}]", path); e.Error() != exp {
+		t.Fatalf("unexpected error: %s", e)
+	}
+
+	if err, ok := e.Unwrap().(*tsi1.ErrMissingSeriesID); !ok {
+		t.Fatalf("unexpected error: %#v", e.Err)
+	} else if string(err.Name) != "cpu" || err.Tags.GetString("region") != "west" {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure a write error is returned with the phase & measurement of the
+// compaction.
+func TestIndexFiles_CompactTo_CompactError(t *testing.T) {
+	a := tsi1.IndexFiles{MustGenerateIndexFile(4, 2, 2)}
+	errWrite := errors.New("write failed")
+
+	l, err := a.Layout(M, K, tsi1.CompactOptions{BufferSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	trailer := l.Trailer()
+
+	// Fail while writing the series block.
+	w := &failingWriter{n: trailer.SeriesBlock.Offset + 8, err: errWrite}
+	_, err = a.CompactToWithOptions(context.Background(), w, M, K, tsi1.CompactOptions{BufferSize: 1})
+	if e, ok := err.(*tsi1.CompactError); !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if e.Phase != tsi1.CompactPhaseSeriesBlock || string(e.Name) != "measurement0" || e.Unwrap() != errWrite {
+		t.Fatalf("unexpected error: %s", e)
+	}
+
+	// Fail while writing the first tagset.
+	wa := &failingWriterAt{n: trailer.TagsetBlock.Offset + 1, err: errWrite}
+	_, err = l.CompactTo(context.Background(), wa)
+	if e, ok := err.(*tsi1.CompactError); !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if e.Phase != tsi1.CompactPhaseTagsets || string(e.Name) != "measurement0" || e.Unwrap() != errWrite {
+		t.Fatalf("unexpected error: %s", e)
+	} else if exp := `compact Tagsets: measurement "measurement0": write failed`; e.Error() != exp {
+		t.Fatalf("unexpected error: %s", e)
+	}
+}
+
+// failingWriter returns err once n bytes have been written.
+type failingWriter struct {
+	n   int64
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.n {
+		n := int(w.n)
+		w.n = 0
+		return n, w.err
+	}
+	w.n -= int64(len(p))
+	return len(p), nil
+}
+
+// failingWriterAt returns err for writes which extend past n bytes.
+type failingWriterAt struct {
+	n   int64
+	err error
+}
+
+func (w *failingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > w.n {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+// Ensure the estimated compaction size matches the compacted size.
+func TestIndexFiles_EstimateSize(t *testing.T) {
+	f0, err := GenerateIndexFile(10, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("measurement0"), Tags: models.NewTags(map[string]string{"key0": "value100"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := tsi1.IndexFiles{f0, f1}
+	var buf bytes.Buffer
+	n, err := a.CompactTo(&buf, M, K)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sz, err := a.EstimateSize(M, K); err != nil {
+		t.Fatal(err)
+	} else if sz != n {
+		t.Fatalf("unexpected estimate: %d, expected %d", sz, n)
+	}
+}
+
+// Ensure the series count for a measurement excludes duplicates and tombstones.
+func TestIndexFiles_MeasurementSeriesN(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a newer file which duplicates one series and deletes another.
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "east"})); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		files tsi1.IndexFiles
+		name  string
+		exp   uint64
+	}{
+		{files: tsi1.IndexFiles{f0}, name: "cpu", exp: 2},
+		{files: tsi1.IndexFiles{f0}, name: "mem", exp: 1},
+		{files: tsi1.IndexFiles{f0}, name: "disk", exp: 0},
+		{files: tsi1.IndexFiles{f1}, name: "cpu", exp: 2},
+		{files: tsi1.IndexFiles{f1, f0}, name: "cpu", exp: 2},
+		{files: tsi1.IndexFiles{f1, f0}, name: "mem", exp: 1},
+	} {
+		if n, err := tt.files.MeasurementSeriesN([]byte(tt.name)); err != nil {
+			t.Fatal(err)
+		} else if n != tt.exp {
+			t.Errorf("%s: unexpected series count (%d files): %d, expected %d", tt.name, len(tt.files), n, tt.exp)
+		}
+	}
+}
+
+// Ensure the series APIs fail on a file opened without its series block
+// rather than miscounting its tombstones.
+func TestIndexFiles_MetadataOnly(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if _, err := (tsi1.IndexFiles{f0}).CompactToFile(path, M, K, false); err != nil {
+		t.Fatal(err)
+	}
+	f := tsi1.NewIndexFile()
+	if err := f.OpenMetadataOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The fully loaded file skips the tombstone.
+	if n, err := (tsi1.IndexFiles{f0}).MeasurementSeriesN([]byte("cpu")); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("unexpected series count: %d", n)
+	}
+
+	for _, a := range []tsi1.IndexFiles{{f}, {f, f0}, {f0, f}} {
+		if _, err := a.SeriesN(); err != tsi1.ErrSeriesBlockNotLoaded {
+			t.Fatalf("%d files: unexpected series count error: %v", len(a), err)
+		} else if _, err := a.MeasurementSeriesN([]byte("cpu")); err != tsi1.ErrSeriesBlockNotLoaded {
+			t.Fatalf("%d files: unexpected measurement series count error: %v", len(a), err)
+		} else if _, err := a.TagKeyCardinality([]byte("cpu")); err != tsi1.ErrSeriesBlockNotLoaded {
+			t.Fatalf("%d files: unexpected tag key cardinality error: %v", len(a), err)
+		} else if _, err := a.OverlapStats(); err != tsi1.ErrSeriesBlockNotLoaded {
+			t.Fatalf("%d files: unexpected overlap stats error: %v", len(a), err)
+		}
+
+		sets, err := a.TagValueSeriesIDSets([]byte("cpu"), []byte("region"), []byte("east"))
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := a.SeriesIDSetIterator(sets); err != tsi1.ErrSeriesBlockNotLoaded {
+			t.Fatalf("%d files: unexpected series id set iterator error: %v", len(a), err)
+		}
+	}
+
+	// Sets with a metadata only file are never equal.
+	if ok, reason := (tsi1.IndexFiles{f}).Equal(tsi1.IndexFiles{f0}); ok || reason != tsi1.ErrSeriesBlockNotLoaded.Error() {
+		t.Fatalf("unexpected equality: %v, %q", ok, reason)
+	} else if ok, reason := (tsi1.IndexFiles{f0}).Equal(tsi1.IndexFiles{f}); ok || reason != tsi1.ErrSeriesBlockNotLoaded.Error() {
+		t.Fatalf("unexpected equality: %v, %q", ok, reason)
+	}
+}
+
+// Ensure compacting with a larger write buffer produces the same output.
+func TestIndexFiles_CompactToWithOptions_BufferSize(t *testing.T) {
+	f0, err := GenerateIndexFile(10, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0}
+
+	var exp bytes.Buffer
+	if _, err := a.CompactTo(&exp, M, K); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	opt := tsi1.CompactOptions{BufferSize: 1 << 20}
+	if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt); err != nil {
+		t.Fatal(err)
+	} else if buf.Len() != exp.Len() {
+		t.Fatalf("unexpected size: %d, expected %d", buf.Len(), exp.Len())
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if n := f.MeasurementN(); n != 10 {
+		t.Fatalf("unexpected measurement count: %d", n)
+	} else if e := f.TagValueElem([]byte("measurement9"), []byte("key2"), []byte("value3")); e == nil {
+		t.Fatal("expected element")
+	}
+}
+
+// Ensure encoding tagsets concurrently produces identical output.
+func TestIndexFiles_CompactToWithOptions_MaxConcurrency(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	f0, err := GenerateIndexFile(10, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("measurement0"), Tags: models.NewTags(map[string]string{"key0": "value100"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0, f1}
+
+	var exp bytes.Buffer
+	if _, err := a.CompactTo(&exp, M, K); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrency := range []int{2, 3, 16} {
+		var buf bytes.Buffer
+		opt := tsi1.CompactOptions{MaxConcurrency: concurrency}
+		if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), exp.Bytes()) {
+			t.Fatalf("output mismatch with concurrency %d", concurrency)
+		}
+	}
+}
+
+// Ensure series shared by several tag values resolve to the same series in
+// each tag value & the measurement.
+func TestIndexFiles_CompactTo_SharedSeries(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "a"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "b"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "west", "host": "a"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "host": "a"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "b"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	var buf bytes.Buffer
+	if _, err := a.CompactTo(&buf, M, K); err != nil {
+		t.Fatal(err)
+	}
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if err := a.VerifyCompaction(&f); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		key, value string
+		exp        []string
+	}{
+		{"host", "a", []string{"cpu,host=a,region=east", "cpu,host=a,region=west"}},
+		{"host", "b", []string{"cpu,host=b,region=east"}},
+		{"region", "east", []string{"cpu,host=a,region=east", "cpu,host=b,region=east"}},
+		{"region", "west", []string{"cpu,host=a,region=west"}},
+	} {
+		var got []string
+		itr := f.TagValueSeriesIterator([]byte("cpu"), []byte(tt.key), []byte(tt.value))
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			got = append(got, string(models.MakeKey(e.Name(), e.Tags())))
+		}
+		if !reflect.DeepEqual(got, tt.exp) {
+			t.Fatalf("unexpected series for %s=%s: %v", tt.key, tt.value, got)
+		}
+	}
+
+	var n int
+	itr := f.MeasurementSeriesIterator([]byte("cpu"))
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("unexpected measurement series count: %d", n)
+	}
+}
+
+// Ensure live series iteration skips tombstoned series.
+func TestIndexFiles_LiveSeriesIterator(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "east"})); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	// Full iterator includes the tombstone.
+	var deletedN int
+	itr := a.SeriesIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		if e.Deleted() {
+			deletedN++
+		}
+	}
+	if deletedN != 1 {
+		t.Fatalf("unexpected deleted series count: %d", deletedN)
+	}
+
+	// Live iterator excludes it.
+	var keys []string
+	itr = a.LiveSeriesIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		keys = append(keys, string(e.Name())+","+e.Tags().GetString("region"))
+	}
+	if exp := []string{"cpu,west", "mem,east"}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("unexpected series: %v", keys)
+	}
+}
+
+// Ensure the diff of two sets returns added, deleted & un-tombstoned series and
+// skips unchanged series.
+func TestIndexFiles_SeriesDiff(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The base also has a tombstoned series & a series the newer set lacks.
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("gpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("net"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("gpu"), models.NewTags(map[string]string{"region": "east"})); err != nil {
+		t.Fatal(err)
+	}
+	b1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := tsi1.IndexFiles{b1, f0}
+
+	// The newer set adds a series, deletes a series & re-creates the
+	// tombstoned series.
+	lf, err = CreateLogFile([]Series{
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("gpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "west"})); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	diff := func(p, base tsi1.IndexFiles) []string {
+		itr := p.SeriesDiff(base)
+		if itr == nil {
+			return nil
+		}
+		defer itr.Close()
+
+		var keys []string
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			key := string(e.Name()) + "," + e.Tags().GetString("region")
+			if e.Deleted() {
+				key += " deleted"
+			}
+			keys = append(keys, key)
+		}
+		if err := tsi1.SeriesIteratorErr(itr); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	if keys, exp := diff(a, base), []string{"cpu,west deleted", "disk,east", "gpu,east"}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("unexpected series: %v", keys)
+	} else if keys := diff(a, a); keys != nil {
+		t.Fatalf("unexpected series for same set: %v", keys)
+	} else if keys, exp := diff(a, nil), []string{"cpu,east", "disk,east", "gpu,east", "mem,east"}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("unexpected series for empty base: %v", keys)
+	} else if keys, exp := diff(base, a), []string{"cpu,west", "gpu,east deleted", "net,east"}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("unexpected reverse series: %v", keys)
+	} else if itr := (tsi1.IndexFiles{}).SeriesDiff(a); itr != nil {
+		t.Fatal("expected nil iterator for empty set")
+	}
+}
+
+// Ensure the earliest file takes precedence when a series is live in one file
+// and tombstoned in another, regardless of which file holds the tombstone.
+func TestIndexFiles_TombstonePrecedence(t *testing.T) {
+	east := models.NewTags(map[string]string{"region": "east"})
+	west := models.NewTags(map[string]string{"region": "west"})
+
+	// The live file contains both series.
+	live, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: east},
+		{Name: []byte("cpu"), Tags: west},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tombstone file deletes the east series.
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: east},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("cpu"), east); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		files   tsi1.IndexFiles
+		deleted bool
+	}{
+		{name: "DeletedNewest", files: tsi1.IndexFiles{deleted, live}, deleted: true},
+		{name: "LiveNewest", files: tsi1.IndexFiles{live, deleted}, deleted: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			itr := tt.files.SeriesIterator()
+			defer itr.Close()
+			if e := itr.Next(); e == nil || e.Tags().GetString("region") != "east" {
+				t.Fatalf("unexpected elem: %v", e)
+			} else if e.Deleted() != tt.deleted {
+				t.Fatalf("unexpected deleted state: %v", e.Deleted())
+			} else if e := itr.Next(); e == nil || e.Tags().GetString("region") != "west" || e.Deleted() {
+				t.Fatalf("unexpected elem: %v", e)
+			} else if e := itr.Next(); e != nil {
+				t.Fatalf("expected nil elem: %v", e)
+			}
+
+			if tt.files.HasSeries([]byte("cpu"), east, nil) == tt.deleted {
+				t.Fatalf("unexpected HasSeries: %v", !tt.deleted)
+			}
+
+			// The compacted file keeps the state of the earliest file.
+			var buf bytes.Buffer
+			if _, err := tt.files.CompactTo(&buf, M, K); err != nil {
+				t.Fatal(err)
+			}
+			f := tsi1.NewIndexFile()
+			if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+				t.Fatal(err)
+			} else if exists, tombstoned := f.HasSeries([]byte("cpu"), east, nil); !exists || tombstoned != tt.deleted {
+				t.Fatalf("unexpected compacted series: exists=%v tombstoned=%v", exists, tombstoned)
+			}
+		})
+	}
+}
+
+// Ensure the series of each tag key are counted within & across files.
+func TestIndexFiles_TagKeyCardinality(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "a", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "b", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "c"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"host": "a"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counts are read from the tag values of a single file.
+	if m, err := (tsi1.IndexFiles{f0}).TagKeyCardinality([]byte("cpu")); err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]uint64{"host": 3, "region": 2}; !reflect.DeepEqual(m, exp) {
+		t.Fatalf("unexpected cardinality: %v", m)
+	}
+
+	// A newer file duplicates a series, adds a series & tombstones a series.
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "a", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "d", "region": "west"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "b", "region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("cpu"), models.NewTags(map[string]string{"host": "b", "region": "east"})); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := tsi1.IndexFiles{f1, f0}
+	if m, err := a.TagKeyCardinality([]byte("cpu")); err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]uint64{"host": 3, "region": 2}; !reflect.DeepEqual(m, exp) {
+		t.Fatalf("unexpected cardinality: %v", m)
+	}
+
+	if m, err := a.TagKeyCardinality([]byte("disk")); err != nil {
+		t.Fatal(err)
+	} else if len(m) != 0 {
+		t.Fatalf("unexpected cardinality: %v", m)
+	}
+}
+
+// Ensure tag keys are counted by the files containing them.
+func TestIndexFiles_TagKeyFileCounts(t *testing.T) {
+	f0 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "a", "region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"host": "a"})},
+	})
+	f1 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "b", "zone": "1"})},
+	})
+
+	// The newest file adds a key & tombstones the region key.
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "c", "rack": "2"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteTagKey([]byte("cpu"), []byte("region")); err != nil {
+		t.Fatal(err)
+	}
+	f2, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := tsi1.IndexFiles{f2, f1, f0}
+	if m, err := a.TagKeyFileCounts([]byte("cpu")); err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]int{"host": 3, "rack": 1, "zone": 1}; !reflect.DeepEqual(m, exp) {
+		t.Fatalf("unexpected counts: %v", m)
+	}
+
+	// Without the tombstone the region key is counted in its only file.
+	if m, err := a[1:].TagKeyFileCounts([]byte("cpu")); err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]int{"host": 2, "region": 1, "zone": 1}; !reflect.DeepEqual(m, exp) {
+		t.Fatalf("unexpected counts: %v", m)
+	}
+
+	if m, err := a.TagKeyFileCounts([]byte("disk")); err != nil {
+		t.Fatal(err)
+	} else if len(m) != 0 {
+		t.Fatalf("unexpected counts: %v", m)
+	}
+}
+
+// Ensure tag keys without live values are skipped by the live iterator.
+func TestIndexFiles_LiveTagKeyIterator(t *testing.T) {
+	f0 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "a", "region": "east", "zone": "1"})},
+	})
+	f1 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "b", "rack": "2"})},
+	})
+
+	// A newer file deletes the only value of the region key, one of the values
+	// of the host key & the rack key itself.
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "c"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []models.Tag{{Key: []byte("region"), Value: []byte("east")}, {Key: []byte("host"), Value: []byte("a")}} {
+		if err := lf.DeleteTagValue([]byte("cpu"), tag.Key, tag.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lf.DeleteTagKey([]byte("cpu"), []byte("rack")); err != nil {
+		t.Fatal(err)
+	}
+	f2, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The newest file only deletes the only value of the zone key.
+	lf, err = CreateLogFile(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteTagValue([]byte("cpu"), []byte("zone"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	f3, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func(a tsi1.IndexFiles, live bool) []string {
+		var itr tsi1.TagKeyIteratorCloser
+		var err error
+		if live {
+			itr, err = a.LiveTagKeyIterator([]byte("cpu"))
+		} else {
+			itr, err = a.TagKeyIterator([]byte("cpu"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		} else if itr == nil {
+			return nil
+		}
+		defer itr.Close()
+
+		var keys []string
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			keys = append(keys, string(e.Key()))
+		}
+		return keys
+	}
+
+	a := tsi1.IndexFiles{f2, f1, f0}
+	if v := keys(a, true); !reflect.DeepEqual(v, []string{"host", "zone"}) {
+		t.Fatalf("unexpected live keys: %v", v)
+	} else if v := keys(a, false); !reflect.DeepEqual(v, []string{"host", "rack", "region", "zone"}) {
+		t.Fatalf("unexpected keys: %v", v)
+	}
+
+	// Deleting the last live value of a key removes it.
+	if v := keys(tsi1.IndexFiles{f3, f2, f1, f0}, true); !reflect.DeepEqual(v, []string{"host"}) {
+		t.Fatalf("unexpected live keys: %v", v)
+	}
+
+	// Without the deletions every key has a live value.
+	if v := keys(a[1:], true); !reflect.DeepEqual(v, []string{"host", "rack", "region", "zone"}) {
+		t.Fatalf("unexpected live keys: %v", v)
+	}
+
+	// Only the host key has a live value in the newer file itself & a file
+	// with only deletions has no live keys.
+	if v := keys(tsi1.IndexFiles{f2}, true); !reflect.DeepEqual(v, []string{"host"}) {
+		t.Fatalf("unexpected live keys: %v", v)
+	} else if v := keys(tsi1.IndexFiles{f3}, true); v != nil {
+		t.Fatalf("unexpected live keys: %v", v)
+	}
+}
+
+// Ensure a set of index files can be opened & closed together.
+func TestOpenIndexFiles(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	data := MustCompactIndexFileData(t)
+	path0, path1 := filepath.Join(dir, tsi1.FormatIndexFileName(2, 1)), filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if err := ioutil.WriteFile(path0, data, 0666); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(path1, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := tsi1.OpenIndexFiles(path0, path1)
+	if err != nil {
+		t.Fatal(err)
+	} else if ids := a.IDs(); !reflect.DeepEqual(ids, []int{2, 1}) {
+		t.Fatalf("unexpected ids: %v", ids)
+	} else if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt file fails to open the set.
+	corrupt := filepath.Join(dir, tsi1.FormatIndexFileName(3, 1))
+	if err := ioutil.WriteFile(corrupt, []byte("bad"), 0666); err != nil {
+		t.Fatal(err)
+	} else if a, err := tsi1.OpenIndexFiles(path0, corrupt, path1); err != io.ErrShortBuffer {
+		t.Fatalf("unexpected error: %v", err)
+	} else if a != nil {
+		t.Fatalf("unexpected files: %v", a)
+	}
+}
+
+// Ensure a subset of files can be selected by id & is retained until released.
+func TestIndexFiles_Select(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	data := MustCompactIndexFileData(t)
+	var paths []string
+	for _, id := range []int{5, 4, 2, 1} {
+		path := filepath.Join(dir, tsi1.FormatIndexFileName(id, 1))
+		if err := ioutil.WriteFile(path, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	a, err := tsi1.OpenIndexFiles(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sel := a.Select(1, 3, 5)
+	if ids := sel.IDs(); !reflect.DeepEqual(ids, []int{5, 1}) {
+		t.Fatalf("unexpected selected ids: %v", ids)
+	}
+	rng := a.SelectRange(2, 4)
+	if ids := rng.IDs(); !reflect.DeepEqual(ids, []int{4, 2}) {
+		t.Fatalf("unexpected range ids: %v", ids)
+	}
+	if ids := a.SelectRange(6, 9).IDs(); len(ids) != 0 {
+		t.Fatalf("unexpected empty range ids: %v", ids)
+	}
+
+	// Closing the files blocks until every selection is released.
+	closed := make(chan error)
+	go func() { closed <- a.Close() }()
+	sel.Release()
+	select {
+	case err := <-closed:
+		t.Fatalf("files closed with range retained: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rng.Release()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for files to close")
+	}
+}
+
+// Ensure iterators retain their files until closed.
+func TestIndexFiles_IteratorRetain(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if err := ioutil.WriteFile(path, MustCompactIndexFileData(t), 0666); err != nil {
+		t.Fatal(err)
+	}
+	a, err := tsi1.OpenIndexFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	itr := a.MeasurementSeriesIterator([]byte("cpu"))
+	if e := itr.Next(); e == nil || string(e.Name()) != "cpu" {
+		t.Fatalf("unexpected series: %v", e)
+	}
+
+	// Closing the files blocks until the iterator is closed.
+	closed := make(chan error)
+	go func() { closed <- a.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("files closed with iterator open: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := itr.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := itr.Close(); err != nil {
+		t.Fatal(err)
+	} else if e := itr.Next(); e != nil {
+		t.Fatalf("unexpected series after close: %v", e)
+	}
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for files to close")
+	}
+}
+
+// Ensure stat reports block sizes for files that exist on disk.
+func TestIndexFiles_Stat(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	// Write an index file to disk and reopen it.
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if err := ioutil.WriteFile(path, MustCompactIndexFileData(t), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f0 := tsi1.NewIndexFile()
+	f0.SetPath(path)
+	if err := f0.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer f0.Close()
+
+	// In-memory files have no path and are skipped.
+	f1, err := GenerateIndexFile(2, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := tsi1.IndexFiles{f0, f1}.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trailer := f0.Trailer()
+	if info.Size != f0.Size() {
+		t.Fatalf("unexpected size: %d", info.Size)
+	} else if info.SeriesBlockSize != trailer.SeriesBlock.Size || info.SeriesBlockSize == 0 {
+		t.Fatalf("unexpected series block size: %d", info.SeriesBlockSize)
+	} else if info.TagsetBlockSize != trailer.TagsetBlock.Size || info.TagsetBlockSize == 0 {
+		t.Fatalf("unexpected tagset block size: %d", info.TagsetBlockSize)
+	} else if info.MeasurementBlockSize != trailer.MeasurementBlock.Size || info.MeasurementBlockSize == 0 {
+		t.Fatalf("unexpected measurement block size: %d", info.MeasurementBlockSize)
+	}
+
+	// The file info is cached when the file is opened.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	} else if other, err := (tsi1.IndexFiles{f0, f1}).Stat(); err != nil {
+		t.Fatal(err)
+	} else if other.Size != info.Size || !other.ModTime.Equal(info.ModTime) {
+		t.Fatalf("unexpected cached info: %+v", other)
+	}
+}
+
+// Ensure series can be counted exactly & approximately across files.
+func TestIndexFiles_SeriesN(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("mem"), models.NewTags(map[string]string{"region": "east"})); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		files tsi1.IndexFiles
+		exp   uint64
+	}{
+		{files: nil, exp: 0},
+		{files: tsi1.IndexFiles{f0}, exp: 3},
+		{files: tsi1.IndexFiles{f1, f0}, exp: 3},
+	} {
+		if n, err := tt.files.SeriesN(); err != nil {
+			t.Fatal(err)
+		} else if n != tt.exp {
+			t.Errorf("unexpected series count (%d files): %d, expected %d", len(tt.files), n, tt.exp)
+		}
+
+		// Small cardinalities are counted exactly by the sparse sketch.
+		if n, err := tt.files.ApproximateSeriesN(); err != nil {
+			t.Fatal(err)
+		} else if n != tt.exp {
+			t.Errorf("unexpected approximate series count (%d files): %d, expected %d", len(tt.files), n, tt.exp)
+		}
+	}
+}
+
+// Ensure merged series iterators estimate their remaining series as the sum of
+// the series left in each file.
+func TestIndexFiles_SeriesIterator_EstimatedCount(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"}), Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	// Duplicates & tombstones are counted.
+	itr := a.SeriesIterator()
+	defer itr.Close()
+	if n, ok := tsi1.SeriesIteratorEstimatedCount(itr); !ok || n != 5 {
+		t.Fatalf("unexpected estimate: %d/%v", n, ok)
+	}
+	itr.Next() // cpu,region=east
+	if n, ok := tsi1.SeriesIteratorEstimatedCount(itr); !ok || n != 4 {
+		t.Fatalf("unexpected estimate: %d/%v", n, ok)
+	}
+	itr.Next() // cpu,region=west from both files
+	if n, ok := tsi1.SeriesIteratorEstimatedCount(itr); !ok || n != 2 {
+		t.Fatalf("unexpected estimate: %d/%v", n, ok)
+	}
+	for itr.Next() != nil {
+	}
+	if n, ok := tsi1.SeriesIteratorEstimatedCount(itr); !ok || n != 0 {
+		t.Fatalf("unexpected estimate: %d/%v", n, ok)
+	}
+
+	if itr := a.MeasurementSeriesIterator([]byte("cpu")); itr == nil {
+		t.Fatal("expected iterator")
+	} else if n, ok := tsi1.SeriesIteratorEstimatedCount(itr); !ok || n != 3 {
+		t.Fatalf("unexpected measurement estimate: %d/%v", n, ok)
+	} else {
+		itr.Close()
+	}
+
+	if itr := a.TagValueSeriesIterator([]byte("cpu"), []byte("region"), []byte("west")); itr == nil {
+		t.Fatal("expected iterator")
+	} else if n, ok := tsi1.SeriesIteratorEstimatedCount(itr); !ok || n != 2 {
+		t.Fatalf("unexpected tag value estimate: %d/%v", n, ok)
+	} else {
+		itr.Close()
+	}
+
+	// Iterators without an estimate make the merge unable to estimate.
+	if _, ok := tsi1.SeriesIteratorEstimatedCount(tsi1.MergeSeriesIterators(f0.SeriesIterator(), &SeriesIterator{})); ok {
+		t.Fatal("expected no estimate")
+	}
+}
+
+// Ensure the overlap of series between files is counted.
+func TestIndexFiles_OverlapStats(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"}), Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("net"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := tsi1.IndexFiles{f2, f1, f0}.OverlapStats()
+	if err != nil {
+		t.Fatal(err)
+	} else if stats.SeriesN != 5 || stats.OverlapN != 2 {
+		t.Fatalf("unexpected counts: series=%d overlap=%d", stats.SeriesN, stats.OverlapN)
+	} else if !reflect.DeepEqual(stats.InputN, []uint64{2, 3, 3}) {
+		t.Fatalf("unexpected input counts: %v", stats.InputN)
+	} else if n := stats.Pair(0, 1); n != 1 {
+		t.Fatalf("unexpected overlap of files 0 & 1: %d", n)
+	} else if n := stats.Pair(2, 0); n != 1 {
+		t.Fatalf("unexpected overlap of files 0 & 2: %d", n)
+	} else if n := stats.Pair(1, 2); n != 2 {
+		t.Fatalf("unexpected overlap of files 1 & 2: %d", n)
+	} else if n := stats.Pair(1, 1); n != 3 {
+		t.Fatalf("unexpected series in file 1: %d", n)
+	} else if r := stats.OverlapRatio(); r != 0.4 {
+		t.Fatalf("unexpected overlap ratio: %v", r)
+	}
+
+	// No files have no overlap.
+	if stats, err := (tsi1.IndexFiles{}).OverlapStats(); err != nil {
+		t.Fatal(err)
+	} else if stats.SeriesN != 0 || stats.OverlapRatio() != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+// Ensure a compaction summarizes the elements written & dropped.
+func TestIndexFiles_Compact(t *testing.T) {
+	east := models.NewTags(map[string]string{"region": "east"})
+	west := models.NewTags(map[string]string{"region": "west"})
+
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: east},
+		{Name: []byte("cpu"), Tags: west},
+		{Name: []byte("mem"), Tags: east},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf, err := CreateLogFile(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("cpu"), west); err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("mem")); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		name string
+		opt  tsi1.CompactOptions
+		exp  tsi1.CompactionResult
+	}{
+		{
+			name: "Tombstones",
+			exp:  tsi1.CompactionResult{MeasurementN: 2, SeriesN: 3, SeriesTombstoneN: 1, TagKeyN: 2, TagValueN: 3},
+		},
+		{
+			name: "DropTombstones",
+			opt:  tsi1.CompactOptions{DropTombstones: true},
+			exp:  tsi1.CompactionResult{MeasurementN: 1, SeriesN: 1, TagKeyN: 1, TagValueN: 1, DroppedMeasurementN: 1, DroppedSeriesN: 2},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			res, err := a.Compact(context.Background(), path, M, K, tt.opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trailer, err := tsi1.ReadIndexFileTrailer(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.exp.Path = path
+			tt.exp.Size = int64(len(buf))
+			tt.exp.SeriesBlockSize = trailer.SeriesBlock.Size
+			tt.exp.TagsetBlockSize = trailer.TagsetBlock.Size
+			tt.exp.MeasurementBlockSize = trailer.MeasurementBlock.Size
+			if res.Duration <= 0 {
+				t.Fatalf("unexpected duration: %s", res.Duration)
+			}
+			tt.exp.Duration = res.Duration
+			if !reflect.DeepEqual(*res, tt.exp) {
+				t.Fatalf("unexpected result: %+v, expected %+v", *res, tt.exp)
+			}
+
+			if _, err := a.Compact(context.Background(), path, M, K, tt.opt); err == nil {
+				t.Fatal("expected error for existing file")
+			}
+		})
+	}
+}
+
+// Ensure source files are only removed once the compacted file is verified.
+func TestIndexFiles_CompactAndReplace(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for i, series := range [][]Series{
+		{{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})}},
+		{
+			{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+			{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+			{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"}), Deleted: true},
+		},
+	} {
+		path := filepath.Join(dir, tsi1.FormatIndexFileName(2-i, 1))
+		if _, err := (tsi1.IndexFiles{MustCreateIndexFile(series)}).CompactToFile(path, M, K, false); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	a, err := tsi1.OpenIndexFiles(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	dst := filepath.Join(dir, tsi1.FormatIndexFileName(3, 2))
+
+	// Cancel once the file has been written but before the sources are removed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opt := tsi1.CompactOptions{Progress: func(p tsi1.CompactProgress) {
+		if p.Phase == tsi1.CompactPhaseTrailer {
+			cancel()
+		}
+	}}
+	if _, err := a.CompactAndReplace(ctx, dst, M, K, opt); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	} else if exists(dst) || exists(dst+tsi1.TempFileExt) {
+		t.Fatal("expected compacted file to be removed")
+	} else if !exists(paths[0]) || !exists(paths[1]) {
+		t.Fatal("expected sources to be kept")
+	}
+
+	// An existing file is not replaced.
+	if _, err := a.CompactAndReplace(context.Background(), paths[0], M, K, tsi1.CompactOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(*tsi1.ErrIndexFileExists); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !exists(paths[0]) || !exists(paths[1]) {
+		t.Fatal("expected sources to be kept")
+	}
+
+	r, err := a.CompactAndReplace(context.Background(), dst, M, K, tsi1.CompactOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if r.MeasurementN != 2 || r.SeriesN != 4 || r.SeriesTombstoneN != 1 {
+		t.Fatalf("unexpected result: %+v", r)
+	} else if !exists(dst) || exists(paths[0]) || exists(paths[1]) {
+		t.Fatal("expected sources to be replaced")
+	}
+
+	// The removed sources remain readable until closed.
+	if a[1].Measurement([]byte("cpu")) == nil {
+		t.Fatal("expected measurement")
+	}
+
+	other, err := tsi1.OpenIndexFiles(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if n, err := other.CountMeasurements(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected measurement count: %d", n)
+	}
+}
+
+// Ensure the tombstone threshold callback is only called when the fraction of
+// tombstoned series exceeds the threshold.
+func TestIndexFiles_Compact_OnTombstoneThreshold(t *testing.T) {
+	f0 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "a"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "b"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "c"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "d"})},
+	})
+	f1 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "a"}), Deleted: true},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "b"}), Deleted: true},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "c"}), Deleted: true},
+	})
+	a := tsi1.IndexFiles{f1, f0}
+
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	for i, tt := range []struct {
+		threshold float64
+		called    bool
+	}{
+		{threshold: 0.5, called: true},
+		{threshold: 0.75, called: false},
+	} {
+		var tombstoneN, seriesN int
+		opt := tsi1.CompactOptions{
+			TombstoneThreshold: tt.threshold,
+			OnTombstoneThreshold: func(t, n int) {
+				tombstoneN, seriesN = t, n
+			},
+		}
+
+		res, err := a.Compact(context.Background(), filepath.Join(dir, fmt.Sprint(i)), M, K, opt)
+		if err != nil {
+			t.Fatal(err)
+		} else if res.TombstoneRatio() != 0.75 {
+			t.Fatalf("unexpected ratio: %v", res.TombstoneRatio())
+		} else if called := seriesN != 0; called != tt.called {
+			t.Fatalf("unexpected call (threshold=%v): %v", tt.threshold, called)
+		} else if called && (tombstoneN != 3 || seriesN != 4) {
+			t.Fatalf("unexpected counts: tombstones=%d, series=%d", tombstoneN, seriesN)
+		}
+	}
+}
+
+// Ensure index files can be compacted atomically to a path.
+func TestIndexFiles_CompactToFile(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	f0, err := GenerateIndexFile(2, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0}
+
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if n, err := a.CompactToFile(path, M, K, false); err != nil {
+		t.Fatal(err)
+	} else if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != n {
+		t.Fatalf("unexpected file size: %d, expected %d", fi.Size(), n)
+	} else if _, err := os.Stat(path + tsi1.TempFileExt); !os.IsNotExist(err) {
+		t.Fatalf("expected temporary file to be removed: %v", err)
+	}
+
+	// Writing to an existing path requires overwrite.
+	if _, err := a.CompactToFile(path, M, K, false); err == nil {
+		t.Fatal("expected error")
+	} else if e, ok := err.(*tsi1.ErrIndexFileExists); !ok || e.Path != path {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := a.CompactToFile(path, M, K, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The temporary file is removed if the compaction fails.
+	path = filepath.Join(dir, "missing", tsi1.FormatIndexFileName(2, 1))
+	if _, err := a.CompactToFile(path, M, K, false); err == nil {
+		t.Fatal("expected error")
+	} else if _, err := os.Stat(path + tsi1.TempFileExt); !os.IsNotExist(err) {
+		t.Fatalf("expected no temporary file: %v", err)
+	}
+}
+
+// Ensure the generation & level stamped by CompactInto are read back in
+// place of the filename.
+func TestIndexFiles_CompactInto(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	a := tsi1.IndexFiles{MustGenerateIndexFile(2, 2, 2)}
+	open := func(path string) *tsi1.IndexFile {
+		f := tsi1.NewIndexFile()
+		f.SetPath(path)
+		if err := f.Open(); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if _, err := a.CompactInto(context.Background(), path, M, K, 7, 3, tsi1.CompactOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	f := open(path)
+	defer f.Close()
+	if f.Generation() != 7 || f.Level() != 3 || f.ID() != 1 {
+		t.Fatalf("unexpected metadata: generation=%d, level=%d, id=%d", f.Generation(), f.Level(), f.ID())
+	} else if err := a.VerifyCompaction(f); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files without metadata fall back to the filename.
+	path = filepath.Join(dir, tsi1.FormatIndexFileName(2, 4))
+	if _, err := a.CompactToFile(path, M, K, false); err != nil {
+		t.Fatal(err)
+	}
+	f = open(path)
+	defer f.Close()
+	if f.Generation() != 2 || f.Level() != 4 {
+		t.Fatalf("unexpected metadata: generation=%d, level=%d", f.Generation(), f.Level())
+	}
+
+	// Levels must fit in the trailer.
+	path = filepath.Join(dir, tsi1.FormatIndexFileName(3, 1))
+	if _, err := a.CompactInto(context.Background(), path, M, K, 3, 1<<16, tsi1.CompactOptions{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure compacting to a preallocated file writes the same data and releases
+// unused space.
+func TestIndexFiles_CompactToPreallocatedFile(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	f0, err := GenerateIndexFile(2, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0}
+
+	var exp bytes.Buffer
+	if _, err := a.CompactTo(&exp, M, K); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int64{0, int64(exp.Len()) * 4} {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%d", size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if n, err := a.CompactToPreallocatedFile(context.Background(), f, size, M, K, tsi1.CompactOptions{}); err != nil {
+			t.Fatal(err)
+		} else if n != int64(exp.Len()) {
+			t.Fatalf("unexpected n: %d, expected %d", n, exp.Len())
+		} else if fi, err := f.Stat(); err != nil {
+			t.Fatal(err)
+		} else if fi.Size() != n {
+			t.Fatalf("unexpected file size: %d", fi.Size())
+		} else if buf, err := ioutil.ReadFile(f.Name()); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, exp.Bytes()) {
+			t.Fatalf("unexpected data with size %d", size)
+		}
+	}
+}
+
+// Ensure measurements can be iterated across files in both directions.
+func TestIndexFiles_ReverseMeasurementIterator(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("net"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("aaa"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("disk")); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	names := func(itr tsi1.MeasurementIteratorCloser) []string {
+		defer itr.Close()
+		var names []string
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			v := string(e.Name())
+			if e.Deleted() {
+				v += "(deleted)"
+			}
+			names = append(names, v)
+		}
+		return names
+	}
+
+	if got, exp := names(a.MeasurementIterator()), []string{"aaa", "cpu", "disk(deleted)", "mem", "net"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected ascending names: %v", got)
+	} else if got, exp := names(a.ReverseMeasurementIterator()), []string{"net", "mem", "disk(deleted)", "cpu", "aaa"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected descending names: %v", got)
+	}
+
+	// Empty sets return no measurements.
+	if itr := (tsi1.IndexFiles{}).ReverseMeasurementIterator(); itr != nil {
+		t.Fatalf("unexpected iterator: %#v", itr)
+	}
+}
+
+// Ensure measurement names can be paged in sorted order.
+func TestIndexFiles_MeasurementNamesFrom(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("net"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0, f1}
+
+	if names := a.MeasurementNamesN(2); !reflect.DeepEqual(names, [][]byte{[]byte("cpu"), []byte("disk")}) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := a.MeasurementNamesN(0); len(names) != 4 {
+		t.Fatalf("unexpected names: %q", names)
+	}
+
+	if names := a.MeasurementNamesFrom([]byte("disk"), 1); !reflect.DeepEqual(names, [][]byte{[]byte("mem")}) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := a.MeasurementNamesFrom([]byte("dog"), 10); !reflect.DeepEqual(names, [][]byte{[]byte("mem"), []byte("net")}) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := a.MeasurementNamesFrom([]byte("net"), 10); len(names) != 0 {
+		t.Fatalf("unexpected names: %q", names)
+	}
+
+	if names := (tsi1.IndexFiles{}).MeasurementNamesN(1); names != nil {
+		t.Fatalf("unexpected names: %q", names)
+	}
+}
+
+// Ensure measurement names with a prefix are merged across files.
+func TestIndexFiles_MeasurementNamesByPrefix(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu_load"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("cpu_idle"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	if names := a.MeasurementNamesByPrefix([]byte("cpu"), 0); !reflect.DeepEqual(names, [][]byte{[]byte("cpu"), []byte("cpu_idle"), []byte("cpu_load")}) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := a.MeasurementNamesByPrefix([]byte("cpu_"), 1); !reflect.DeepEqual(names, [][]byte{[]byte("cpu_idle")}) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := a.MeasurementNamesByPrefix([]byte("d"), 10); !reflect.DeepEqual(names, [][]byte{[]byte("disk")}) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := a.MeasurementNamesByPrefix([]byte("net"), 0); names != nil {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := (tsi1.IndexFiles{}).MeasurementNamesByPrefix([]byte("cpu"), 0); names != nil {
+		t.Fatalf("unexpected names: %q", names)
+	}
+}
+
+func TestIndexFiles_MeasurementNamesByFoldPrefix(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("CPU"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu_load"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("CPU"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("Cpu_Idle"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	if names := a.MeasurementNamesByFoldPrefix([]byte("cpu"), 0); !reflect.DeepEqual(names, [][]byte{[]byte("CPU"), []byte("Cpu_Idle"), []byte("cpu"), []byte("cpu_load")}) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := a.MeasurementNamesByFoldPrefix([]byte("CPU_"), 1); !reflect.DeepEqual(names, [][]byte{[]byte("Cpu_Idle")}) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := a.MeasurementNamesByFoldPrefix([]byte("net"), 0); names != nil {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := a.MeasurementNamesFold([]byte("cPu")); !reflect.DeepEqual(names, [][]byte{[]byte("CPU"), []byte("cpu")}) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := a.MeasurementNamesFold([]byte("DISK")); !reflect.DeepEqual(names, [][]byte{[]byte("disk")}) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if names := (tsi1.IndexFiles{}).MeasurementNamesFold([]byte("cpu")); names != nil {
+		t.Fatalf("unexpected names: %q", names)
+	}
+}
+
+// BenchmarkIndexFiles_MeasurementNamesByPrefix compares listing the names with
+// a prefix against filtering every name.
+func BenchmarkIndexFiles_MeasurementNamesByPrefix(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(1000, 1, 1), MustFindOrGenerateIndexFile(100, 1, 1)}
+	prefix := []byte("measurement12")
+
+	b.Run("Prefix", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if names := a.MeasurementNamesByPrefix(prefix, 0); len(names) != 11 {
+				b.Fatalf("unexpected names: %d", len(names))
+			}
+		}
+	})
+
+	b.Run("Filter", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var names [][]byte
+			for _, name := range a.MeasurementNames() {
+				if bytes.HasPrefix(name, prefix) {
+					names = append(names, name)
+				}
+			}
+			if len(names) != 11 {
+				b.Fatalf("unexpected names: %d", len(names))
+			}
+		}
+	})
+}
+
+// Ensure measurement names are appended from a shared buffer.
+func TestIndexFiles_AppendMeasurementNames(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0, f1}
+
+	names := a.AppendMeasurementNames([][]byte{[]byte("existing")})
+	if !reflect.DeepEqual(names, [][]byte{[]byte("existing"), []byte("cpu"), []byte("disk"), []byte("mem")}) {
+		t.Fatalf("unexpected names: %q", names)
+	}
+
+	// Appending to one name must not affect the next.
+	_ = append(names[1], 'X')
+	if string(names[2]) != "disk" {
+		t.Fatalf("unexpected name: %q", names[2])
+	}
+
+	if names := a.MeasurementNames(); !reflect.DeepEqual(names, [][]byte{[]byte("cpu"), []byte("disk"), []byte("mem")}) {
+		t.Fatalf("unexpected names: %q", names)
+	}
+}
+
+func BenchmarkIndexFiles_MeasurementNames(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(1000, 1, 1)}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		a.MeasurementNames()
+	}
+}
+
+// Ensure distinct measurement names are counted whether or not the files
+// overlap.
+func TestIndexFiles_CountMeasurements(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("net"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("gpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("cpu")); err != nil {
+		t.Fatal(err)
+	}
+	f2, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		files tsi1.IndexFiles
+		n     int
+	}{
+		{files: tsi1.IndexFiles{}, n: 0},
+		{files: tsi1.IndexFiles{f0}, n: 2},
+		{files: tsi1.IndexFiles{f1, f0}, n: 4},
+		{files: tsi1.IndexFiles{f2, f1, f0}, n: 5},
+		{files: tsi1.IndexFiles{f0, f0}, n: 2},
+	} {
+		if n, err := tt.files.CountMeasurements(); err != nil {
+			t.Fatal(err)
+		} else if n != tt.n {
+			t.Fatalf("%d: unexpected count: %d", i, n)
+		} else if n != len(tt.files.MeasurementNames()) {
+			t.Fatalf("%d: count does not match names: %d", i, n)
+		}
+	}
+}
+
+// BenchmarkIndexFiles_CountMeasurements compares counting measurements with
+// listing their names.
+func BenchmarkIndexFiles_CountMeasurements(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(10000, 1, 1)}
+
+	b.Run("Count", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if n, err := a.CountMeasurements(); err != nil {
+				b.Fatal(err)
+			} else if n != 10000 {
+				b.Fatalf("unexpected count: %d", n)
+			}
+		}
+	})
+
+	b.Run("Overlap", func(b *testing.B) {
+		a := tsi1.IndexFiles{a[0], a[0]}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if n, err := a.CountMeasurements(); err != nil {
+				b.Fatal(err)
+			} else if n != 10000 {
+				b.Fatalf("unexpected count: %d", n)
+			}
+		}
+	})
+
+	b.Run("Names", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if n := len(a.MeasurementNames()); n != 10000 {
+				b.Fatalf("unexpected count: %d", n)
+			}
+		}
+	})
+}
+
+// Ensure measurement existence is checked with precedence.
+func TestIndexFiles_HasMeasurement(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("cpu")); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	if a.HasMeasurement([]byte("cpu")) {
+		t.Fatal("expected deleted measurement")
+	} else if !a.HasMeasurement([]byte("mem")) {
+		t.Fatal("expected measurement")
+	} else if a.HasMeasurement([]byte("no_such_measurement")) {
+		t.Fatal("unexpected measurement")
+	} else if !(tsi1.IndexFiles{f0, f1}).HasMeasurement([]byte("cpu")) {
+		t.Fatal("expected measurement in newer file to take precedence")
+	}
+
+	if !a.AnyMeasurement() {
+		t.Fatal("expected a measurement")
+	} else if err := lf.DeleteMeasurement([]byte("mem")); err != nil {
+		t.Fatal(err)
+	} else if f1, err = CompactLogFile(lf); err != nil {
+		t.Fatal(err)
+	} else if (tsi1.IndexFiles{f1, f0}).AnyMeasurement() {
+		t.Fatal("expected every measurement to be deleted")
+	} else if (tsi1.IndexFiles{}).AnyMeasurement() {
+		t.Fatal("expected no measurements in empty set")
+	}
+}
+
+// Ensure the smallest & largest live measurement names are found with
+// precedence.
+func TestIndexFiles_FirstMeasurement(t *testing.T) {
+	f0 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("net"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	f1 := MustCreateIndexFile([]Series{
+		{Name: []byte("aaa"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("zzz"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+
+	lf, err := CreateLogFile(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"aaa", "cpu", "net", "zzz"} {
+		if err := lf.DeleteMeasurement([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f2, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compact the files with a trie indexed measurement block.
+	var buf bytes.Buffer
+	if _, err := (tsi1.IndexFiles{f2, f1, f0}).CompactToWithOptions(context.Background(), &buf, M, K, tsi1.CompactOptions{MeasurementBlockIndex: tsi1.MeasurementBlockIndexTrie}); err != nil {
+		t.Fatal(err)
+	}
+	var trie tsi1.IndexFile
+	if err := trie.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		a           tsi1.IndexFiles
+		first, last string
+	}{
+		{a: tsi1.IndexFiles{f0}, first: "cpu", last: "net"},
+		{a: tsi1.IndexFiles{f1, f0}, first: "aaa", last: "zzz"},
+		{a: tsi1.IndexFiles{f2, f1, f0}, first: "disk", last: "mem"},
+		{a: tsi1.IndexFiles{f1, f0, f2}, first: "aaa", last: "zzz"},
+		{a: tsi1.IndexFiles{&trie}, first: "disk", last: "mem"},
+		{a: tsi1.IndexFiles{f2}},
+		{a: tsi1.IndexFiles{}},
+	} {
+		if first, err := tt.a.FirstMeasurement(); err != nil {
+			t.Fatal(err)
+		} else if string(first) != tt.first || (tt.first == "" && first != nil) {
+			t.Fatalf("%d. unexpected first measurement: %q", i, first)
+		} else if last, err := tt.a.LastMeasurement(); err != nil {
+			t.Fatal(err)
+		} else if string(last) != tt.last || (tt.last == "" && last != nil) {
+			t.Fatalf("%d. unexpected last measurement: %q", i, last)
+		}
+	}
+}
+
+// BenchmarkIndexFiles_FirstLastMeasurement compares reading the extremes
+// of each measurement block with iterating the merged measurements.
+func BenchmarkIndexFiles_FirstLastMeasurement(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(1000, 1, 1), MustFindOrGenerateIndexFile(100, 1, 1)}
+
+	b.Run("FirstMeasurement", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if name, err := a.FirstMeasurement(); err != nil || name == nil {
+				b.Fatalf("unexpected first measurement: %q, err=%v", name, err)
+			}
+		}
+	})
+
+	b.Run("LastMeasurement", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if name, err := a.LastMeasurement(); err != nil || name == nil {
+				b.Fatalf("unexpected last measurement: %q, err=%v", name, err)
+			}
+		}
+	})
+
+	b.Run("Iterator", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var last []byte
+			itr := a.MeasurementIterator()
+			for e := itr.Next(); e != nil; e = itr.Next() {
+				if !e.Deleted() {
+					last = append(last[:0], e.Name()...)
+				}
+			}
+			itr.Close()
+			if last == nil {
+				b.Fatal("expected measurement")
+			}
+		}
+	})
+}
+
+// BenchmarkIndexFiles_HasSeriesBatch compares checking a batch of 10k series,
+// half of which exist, with a single batch lookup & with repeated HasSeries.
+func BenchmarkIndexFiles_HasSeriesBatch(b *testing.B) {
+	a := tsi1.IndexFiles{MustGenerateIndexFile(10, 2, 10), MustFindOrGenerateIndexFile(100, 2, 10)}
+
+	names := make([][]byte, 0, 10000)
+	tagsSlice := make([]models.Tags, 0, 10000)
+	for i := 50; i < 150; i++ {
+		name := []byte(fmt.Sprintf("measurement%d", i))
+		for j := 0; j < 100; j++ {
+			names = append(names, name)
+			tagsSlice = append(tagsSlice, models.NewTags(map[string]string{
+				"key0": fmt.Sprintf("value%d", j%10),
+				"key1": fmt.Sprintf("value%d", j/10),
+			}))
+		}
+	}
+
+	b.Run("HasSeriesBatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if v, err := a.HasSeriesBatch(names, tagsSlice); err != nil {
+				b.Fatal(err)
+			} else if !v[0] || v[len(v)-1] {
+				b.Fatal("unexpected existence")
+			}
+		}
+	})
+
+	b.Run("HasSeries", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			v := make([]bool, len(names))
+			for j := range names {
+				v[j] = a.HasSeries(names[j], tagsSlice[j], buf)
+			}
+			if !v[0] || v[len(v)-1] {
+				b.Fatal("unexpected existence")
+			}
+		}
+	})
+}
+
+// BenchmarkIndexFiles_HasMeasurement compares checking for a measurement with
+// its hash index & with a merged iterator.
+func BenchmarkIndexFiles_HasMeasurement(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(1000, 1, 1), MustFindOrGenerateIndexFile(100, 1, 1)}
+	name := []byte("measurement500")
+
+	b.Run("HasMeasurement", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if !a.HasMeasurement(name) {
+				b.Fatal("expected measurement")
+			}
+		}
+	})
+
+	b.Run("Iterator", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var found bool
+			itr := a.MeasurementIterator()
+			for e := itr.Next(); e != nil; e = itr.Next() {
+				if bytes.Equal(e.Name(), name) {
+					found = !e.Deleted()
+					break
+				}
+			}
+			itr.Close()
+			if !found {
+				b.Fatal("expected measurement")
+			}
+		}
+	})
+}
+
+func TestIndexFiles_TagKeyHasValue(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "a"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "host": "b"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteTagValue([]byte("cpu"), []byte("region"), []byte("west")); err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteTagKey([]byte("cpu"), []byte("host")); err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("mem")); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	for _, tt := range []struct {
+		name, key, value string
+		exp              bool
+	}{
+		{"cpu", "region", "east", true},
+		{"cpu", "region", "north", true},
+		{"cpu", "region", "west", false},
+		{"cpu", "region", "south", false},
+		{"cpu", "host", "a", false},
+		{"cpu", "no_such_key", "a", false},
+		{"mem", "region", "east", false},
+		{"disk", "region", "east", true},
+		{"no_such_measurement", "region", "east", false},
+	} {
+		if ok, err := a.TagKeyHasValue([]byte(tt.name), []byte(tt.key), []byte(tt.value)); err != nil {
+			t.Fatal(err)
+		} else if ok != tt.exp {
+			t.Errorf("%s %s=%s: unexpected result: %v", tt.name, tt.key, tt.value, ok)
+		}
+	}
+
+	// The older file alone still has the deleted values.
+	if ok, err := (tsi1.IndexFiles{f0}).TagKeyHasValue([]byte("cpu"), []byte("region"), []byte("west")); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected value")
+	}
+}
+
+// BenchmarkIndexFiles_TagKeyHasValue compares checking for a tag value with
+// the tag block hash indexes & with a tag value series iterator.
+func BenchmarkIndexFiles_TagKeyHasValue(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(10, 3, 10), MustFindOrGenerateIndexFile(100, 1, 1)}
+	name, key, value := []byte("measurement5"), []byte("key1"), []byte("value7")
+
+	b.Run("TagKeyHasValue", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if ok, err := a.TagKeyHasValue(name, key, value); err != nil {
+				b.Fatal(err)
+			} else if !ok {
+				b.Fatal("expected value")
+			}
+		}
+	})
+
+	b.Run("Iterator", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			itr := a.TagValueSeriesIterator(name, key, value)
+			found := itr != nil && itr.Next() != nil
+			if itr != nil {
+				itr.Close()
+			}
+			if !found {
+				b.Fatal("expected value")
+			}
+		}
+	})
+}
+
+// BenchmarkIndexFiles_AnyMeasurement compares checking for any measurement
+// with & without merging the files.
+func BenchmarkIndexFiles_AnyMeasurement(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(1000, 1, 1), MustFindOrGenerateIndexFile(100, 1, 1)}
+
+	b.Run("AnyMeasurement", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if !a.AnyMeasurement() {
+				b.Fatal("expected measurement")
+			}
+		}
+	})
+
+	b.Run("Iterator", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var found bool
+			itr := a.MeasurementIterator()
+			for e := itr.Next(); e != nil; e = itr.Next() {
+				if !e.Deleted() {
+					found = true
+					break
+				}
+			}
+			itr.Close()
+			if !found {
+				b.Fatal("expected measurement")
+			}
+		}
+	})
+}
+
+// Ensure tag pairs are merged & deduplicated across files.
+func TestIndexFiles_TagPairIterator(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "a"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "host": "a"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"path": "/"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north", "host": "a"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"path": "/tmp"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteTagValue([]byte("cpu"), []byte("region"), []byte("west")); err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("disk")); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pairs []string
+	itr := tsi1.IndexFiles{f1, f0}.TagPairIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		v := fmt.Sprintf("%s,%s=%s", e.Name, e.Key, e.Value)
+		if e.Deleted {
+			v += "(deleted)"
+		}
+		pairs = append(pairs, v)
+	}
+	if exp := []string{
+		"cpu,host=a",
+		"cpu,region=east",
+		"cpu,region=north",
+		"cpu,region=west(deleted)",
+		"disk,path=/(deleted)",
+		"mem,region=east",
+	}; !reflect.DeepEqual(pairs, exp) {
+		t.Fatalf("unexpected pairs: %v", pairs)
+	}
+
+	// Empty file sets return no pairs.
+	if e := (tsi1.IndexFiles{}).TagPairIterator().Next(); e != nil {
+		t.Fatalf("unexpected pair: %+v", e)
+	}
+}
+
+// Ensure tag values are merged across files without descending into series.
+func TestIndexFiles_TagValueIterator(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteTagValue([]byte("cpu"), []byte("region"), []byte("west")); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	itr, err := tsi1.IndexFiles{f1, f0}.TagValueIterator([]byte("cpu"), []byte("region"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var values []string
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		v := string(e.Value())
+		if e.Deleted() {
+			v += "(deleted)"
+		}
+		values = append(values, v)
+	}
+	if exp := []string{"east", "north", "west(deleted)"}; !reflect.DeepEqual(values, exp) {
+		t.Fatalf("unexpected values: %v", values)
+	}
+
+	// Missing keys return a nil iterator.
+	if itr, err := (tsi1.IndexFiles{f1, f0}).TagValueIterator([]byte("cpu"), []byte("host")); err != nil {
+		t.Fatal(err)
+	} else if itr != nil {
+		t.Fatal("expected nil iterator")
+	}
+}
+
+// Ensure merged value iteration resumes after a value across files with
+// overlapping values.
+func TestIndexFiles_TagValueIteratorFrom(t *testing.T) {
+	series := func(values ...string) []Series {
+		var a []Series
+		for _, v := range values {
+			a = append(a, Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": v})})
+		}
+		return a
+	}
+	f0 := MustCreateIndexFile(series("a", "c", "e", "g"))
+	f1 := MustCreateIndexFile(series("b", "c", "f", "g"))
+	p := tsi1.IndexFiles{f1, f0}
+
+	for _, tt := range []struct {
+		after string
+		exp   []string
+	}{
+		{after: "", exp: []string{"a", "b", "c", "e", "f", "g"}},
+		{after: "a", exp: []string{"b", "c", "e", "f", "g"}},
+		{after: "c", exp: []string{"e", "f", "g"}},
+		{after: "d", exp: []string{"e", "f", "g"}},
+		{after: "f", exp: []string{"g"}},
+		{after: "g", exp: nil},
+	} {
+		itr, err := p.TagValueIteratorFrom([]byte("cpu"), []byte("host"), []byte(tt.after))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var values []string
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			values = append(values, string(e.Value()))
+		}
+		itr.Close()
+		if !reflect.DeepEqual(values, tt.exp) {
+			t.Fatalf("unexpected values after %q: %v", tt.after, values)
+		}
+	}
+
+	// Missing keys return a nil iterator.
+	if itr, err := p.TagValueIteratorFrom([]byte("cpu"), []byte("region"), []byte("a")); err != nil {
+		t.Fatal(err)
+	} else if itr != nil {
+		t.Fatal("expected nil iterator")
+	}
+}
+
+// Ensure size estimation spills series offsets to disk with a tiny budget.
+func TestIndexFiles_EstimateSizeWithOptions_Spill(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	f0, err := GenerateIndexFile(10, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("measurement0"), Tags: models.NewTags(map[string]string{"key0": "value100"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := tsi1.IndexFiles{f0, f1}
+	var buf bytes.Buffer
+	n, err := a.CompactTo(&buf, M, K)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, budget := range []int64{1, 4096} {
+		opt := tsi1.CompactOptions{MaxSeriesOffsetMemory: budget, TempDir: dir}
+		if sz, err := a.EstimateSizeWithOptions(M, K, opt); err != nil {
+			t.Fatal(err)
+		} else if sz != n {
+			t.Fatalf("unexpected estimate (budget=%d): %d, expected %d", budget, sz, n)
+		}
+	}
+
+	// Spill files must be removed.
+	if fis, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(fis) != 0 {
+		t.Fatalf("unexpected temporary files: %d", len(fis))
+	}
+}
+
+// Ensure series offsets spill to the configured directory & a missing
+// directory fails before planning.
+func TestIndexFiles_Layout_TempDir(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	a := MustGenerateIndexFiles(t)
+	l, err := a.Layout(M, K, tsi1.CompactOptions{MaxSeriesOffsetMemory: 1, TempDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fis, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(fis) != 1 {
+		t.Fatalf("unexpected temporary files: %d", len(fis))
+	} else if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Layout(M, K, tsi1.CompactOptions{MaxSeriesOffsetMemory: 1, TempDir: filepath.Join(dir, "missing")}); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure series membership respects tombstones in newer files.
+func TestIndexFiles_HasSeries(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"}), Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	for i, tt := range []struct {
+		name   string
+		tags   map[string]string
+		exists bool
+	}{
+		{name: "cpu", tags: map[string]string{"region": "east"}, exists: true},
+		{name: "cpu", tags: map[string]string{"region": "west"}, exists: false},
+		{name: "mem", tags: map[string]string{"region": "east"}, exists: true},
+		{name: "mem", tags: map[string]string{"region": "west"}, exists: false},
+		{name: "disk", tags: nil, exists: false},
+	} {
+		if v := a.HasSeries([]byte(tt.name), models.NewTags(tt.tags), nil); v != tt.exists {
+			t.Fatalf("%d. unexpected existence: %v", i, v)
+		}
+	}
+}
+
+// Ensure a batch of series is checked the same as with single lookups.
+func TestIndexFiles_HasSeriesBatch(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"}), Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2 := MustGenerateIndexFile(3, 2, 3)
+
+	names := [][]byte{[]byte("cpu"), []byte("cpu"), []byte("mem"), []byte("mem"), []byte("disk"), []byte("measurement1"), []byte("measurement1"), []byte("cpu")}
+	tagsSlice := []models.Tags{
+		models.NewTags(map[string]string{"region": "east"}),
+		models.NewTags(map[string]string{"region": "west"}),
+		models.NewTags(map[string]string{"region": "east"}),
+		models.NewTags(map[string]string{"region": "west"}),
+		nil,
+		models.NewTags(map[string]string{"key0": "value2", "key1": "value0"}),
+		models.NewTags(map[string]string{"key0": "value3", "key1": "value0"}),
+		models.NewTags(map[string]string{"region": "east"}),
+	}
+
+	for _, a := range []tsi1.IndexFiles{{f2, f1, f0}, {f1, f0}, {f0}, {f2}, nil} {
+		v, err := a.HasSeriesBatch(names, tagsSlice)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(v) != len(names) {
+			t.Fatalf("unexpected result count: %d", len(v))
+		}
+		for i := range names {
+			if exp := a.HasSeries(names[i], tagsSlice[i], nil); v[i] != exp {
+				t.Fatalf("%d files: %d. unexpected existence: %v", len(a), i, v[i])
+			}
+		}
+	}
+
+	if v, err := (tsi1.IndexFiles{f1, f0}).HasSeriesBatch(names, tagsSlice); err != nil {
+		t.Fatal(err)
+	} else if exp := []bool{true, false, true, false, false, false, false, true}; !reflect.DeepEqual(v, exp) {
+		t.Fatalf("unexpected existence: %v", v)
+	}
+
+	if v, err := (tsi1.IndexFiles{f0}).HasSeriesBatch(nil, nil); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 0 {
+		t.Fatalf("unexpected existence: %v", v)
+	}
+
+	if _, err := (tsi1.IndexFiles{f0}).HasSeriesBatch(names, tagsSlice[1:]); err == nil || err.Error() != "series batch length mismatch: 8 names, 7 tag sets" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a batch cannot be checked against a file without its series block.
+func TestIndexFiles_HasSeriesBatch_MetadataOnly(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if _, err := (tsi1.IndexFiles{f0}).CompactToFile(path, M, K, false); err != nil {
+		t.Fatal(err)
+	}
+	f := tsi1.NewIndexFile()
+	if err := f.OpenMetadataOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	names := [][]byte{[]byte("cpu")}
+	tagsSlice := []models.Tags{models.NewTags(map[string]string{"region": "east"})}
+	for _, a := range []tsi1.IndexFiles{{f}, {f0, f}} {
+		if v, err := a.HasSeriesBatch(names, tagsSlice); err != tsi1.ErrSeriesBlockNotLoaded {
+			t.Fatalf("%d files: unexpected error: %v", len(a), err)
+		} else if v != nil {
+			t.Fatalf("%d files: unexpected existence: %v", len(a), v)
+		}
+	}
+}
+
+// Ensure index files can be compacted with a compressed series block.
+func TestIndexFiles_CompactToWithOptions_SeriesBlockCodec(t *testing.T) {
+	f0, err := GenerateIndexFile(10, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0}
+
+	opt := tsi1.CompactOptions{SeriesBlockCodec: tsi1.SeriesBlockCodecPrefix}
+	var buf bytes.Buffer
+	n, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt)
+	if err != nil {
+		t.Fatal(err)
+	} else if sz, err := a.EstimateSizeWithOptions(M, K, opt); err != nil {
+		t.Fatal(err)
+	} else if sz != n {
+		t.Fatalf("unexpected estimate: %d, expected %d", sz, n)
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if err := a.VerifyCompaction(&f); err != nil {
+		t.Fatal(err)
+	} else if f.Trailer().SeriesBlock.Size >= f0.Trailer().SeriesBlock.Size {
+		t.Fatalf("expected smaller series block: %d >= %d", f.Trailer().SeriesBlock.Size, f0.Trailer().SeriesBlock.Size)
+	}
+}
+
+// Ensure a series block ordered by hash holds the same series, ids &
+// tombstones as one in key order.
+func TestIndexFiles_CompactToWithOptions_SeriesBlockOrder(t *testing.T) {
+	f0, err := GenerateIndexFile(10, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deleted []Series
+	for _, name := range []string{"measurement1", "measurement5"} {
+		deleted = append(deleted, Series{
+			Name:    []byte(name),
+			Tags:    models.NewTags(map[string]string{"key0": "value1", "key1": "value2", "key2": "value3"}),
+			Deleted: true,
+		})
+	}
+	lf, err := CreateLogFile(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	opt := tsi1.CompactOptions{SeriesBlockOrder: tsi1.SeriesBlockOrderHash}
+	var buf bytes.Buffer
+	n, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt)
+	if err != nil {
+		t.Fatal(err)
+	} else if sz, err := a.EstimateSizeWithOptions(M, K, opt); err != nil {
+		t.Fatal(err)
+	} else if sz != n {
+		t.Fatalf("unexpected estimate: %d, expected %d", sz, n)
+	}
+
+	// A planned layout writes the same file.
+	l, err := a.Layout(M, K, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	w := &bufferAt{buf: make([]byte, l.Size())}
+	if _, err := l.CompactTo(context.Background(), w); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(w.buf, buf.Bytes()) {
+		t.Fatal("unexpected layout data")
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if err := a.VerifyCompaction(&f); err != nil {
+		t.Fatal(err)
+	}
+	sblk := buf.Bytes()[f.Trailer().SeriesBlock.Offset:][:f.Trailer().SeriesBlock.Size]
+	if order := tsi1.ReadSeriesBlockTrailer(sblk).Order; order != tsi1.SeriesBlockOrderHash {
+		t.Fatalf("unexpected order: %s", order)
+	}
+
+	// Deletion times are kept.
+	for _, s := range deleted {
+		exp, ok := f1.SeriesTombstoneTime(s.Name, s.Tags, nil)
+		if !ok {
+			t.Fatal("expected deletion time")
+		} else if ts, ok := f.SeriesTombstoneTime(s.Name, s.Tags, nil); !ok || !ts.Equal(exp) {
+			t.Fatalf("unexpected deletion time: %s, expected %s", ts, exp)
+		}
+	}
+
+	// Compacting the file in key order writes the same file as compacting
+	// the original files.
+	var exp, got bytes.Buffer
+	if _, err := a.CompactTo(&exp, M, K); err != nil {
+		t.Fatal(err)
+	} else if _, err := (tsi1.IndexFiles{&f}).CompactTo(&got, M, K); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(exp.Bytes(), got.Bytes()) {
+		t.Fatal("unexpected file")
+	} else if bytes.Equal(exp.Bytes(), buf.Bytes()) {
+		t.Fatal("expected series block ordered by hash")
+	}
+
+	// The series cannot be scanned in key order.
+	if _, err := tsi1.NewSeriesReader(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != tsi1.ErrHashOrderedSeriesBlock {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the series offset table matches the offsets of the compacted file.
+func TestIndexFiles_CompactToWithOptions_SeriesOffsetTable(t *testing.T) {
+	f0, err := GenerateIndexFile(3, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf, err := CreateLogFile(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("measurement1"), models.NewTags(map[string]string{"key0": "value0", "key1": "value0"})); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	for _, order := range []tsi1.SeriesBlockOrder{tsi1.SeriesBlockOrderLexical, tsi1.SeriesBlockOrderHash} {
+		for _, codec := range []tsi1.SeriesBlockCodec{tsi1.SeriesBlockCodecNone, tsi1.SeriesBlockCodecPrefix} {
+			var buf, table bytes.Buffer
+			opt := tsi1.CompactOptions{SeriesBlockCodec: codec, SeriesBlockOrder: order, SeriesOffsetTable: &table}
+			if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt); err != nil {
+				t.Fatal(err)
+			}
+
+			tr, err := tsi1.ReadIndexFileTrailer(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sblk tsi1.SeriesBlock
+			if err := sblk.UnmarshalBinary(buf.Bytes()[tr.SeriesBlock.Offset:][:tr.SeriesBlock.Size]); err != nil {
+				t.Fatal(err)
+			}
+
+			// Every series is in the table in key order with its offset.
+			var prev []byte
+			var n int
+			for data := table.Bytes(); len(data) > 0; n++ {
+				key := tsi1.ReadSeriesKey(data)
+				offset := binary.BigEndian.Uint32(data[len(key):])
+				data = data[len(key)+4:]
+
+				if prev != nil && tsi1.CompareSeriesKeys(prev, key) != -1 {
+					t.Fatalf("%s/%d: series out of order: %q", order, codec, key)
+				}
+				prev = key
+
+				name, tags, err := tsi1.DecodeSeriesKey(key)
+				if err != nil {
+					t.Fatal(err)
+				} else if exp, _ := sblk.Offset(name, tags, nil); exp != offset {
+					t.Fatalf("%s/%d: unexpected offset for %q: %d, expected %d", order, codec, key, offset, exp)
+				}
+			}
+			if exp := int(sblk.SeriesCount()); n != exp || n != 3*9 {
+				t.Fatalf("%s/%d: unexpected entry count: %d, expected %d", order, codec, n, exp)
+			}
+		}
+	}
+
+	// Split compactions would write a table per file.
+	opt := tsi1.CompactOptions{SeriesOffsetTable: ioutil.Discard}
+	if _, err := a.CompactSplit(context.Background(), func() string { return "" }, M, K, 1, opt); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure index files can be compacted with a trie indexed measurement block.
+func TestIndexFiles_CompactToWithOptions_MeasurementBlockIndex(t *testing.T) {
+	f0, err := GenerateIndexFile(20, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0}
+
+	opt := tsi1.CompactOptions{MeasurementBlockIndex: tsi1.MeasurementBlockIndexTrie}
+	var buf bytes.Buffer
+	n, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt)
+	if err != nil {
+		t.Fatal(err)
+	} else if sz, err := a.EstimateSizeWithOptions(M, K, opt); err != nil {
+		t.Fatal(err)
+	} else if sz != n {
+		t.Fatalf("unexpected estimate: %d, expected %d", sz, n)
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if err := a.VerifyCompaction(&f); err != nil {
+		t.Fatal(err)
+	} else if names := (tsi1.IndexFiles{&f}).MeasurementNamesByPrefix([]byte("measurement1"), 0); !reflect.DeepEqual(names, a.MeasurementNamesByPrefix([]byte("measurement1"), 0)) {
+		t.Fatalf("unexpected names: %q", names)
+	} else if f.Measurement([]byte("measurement7")) == nil {
+		t.Fatal("expected measurement")
+	} else if f.Measurement([]byte("measurement")) != nil {
+		t.Fatal("unexpected measurement")
+	}
+}
+
+// Ensure sketches written at a custom precision are read back & estimate
+// within the expected error.
+func TestIndexFiles_CompactToWithOptions_SketchPrecision(t *testing.T) {
+	f0, err := GenerateIndexFile(10, 2, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0}
+	exp, err := a.SeriesN()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []uint8{8, 10} {
+		opt := tsi1.CompactOptions{SketchPrecision: p}
+		var buf bytes.Buffer
+		n, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt)
+		if err != nil {
+			t.Fatal(err)
+		} else if sz, err := a.EstimateSizeWithOptions(M, K, opt); err != nil {
+			t.Fatal(err)
+		} else if sz != n {
+			t.Fatalf("unexpected estimate: %d, expected %d", sz, n)
+		}
+
+		var f tsi1.IndexFile
+		if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Allow three standard errors.
+		maxErr := 3 * 1.04 / math.Sqrt(float64(uint64(1)<<p))
+		for _, b := range []tsi1.IndexFiles{{&f}, {&f, f0}, {f0, &f}} {
+			if got, err := b.ApproximateSeriesN(); err != nil {
+				t.Fatal(err)
+			} else if e := math.Abs(float64(got)-float64(exp)) / float64(exp); e > maxErr {
+				t.Fatalf("unexpected estimate (p=%d): %d, expected %d", p, got, exp)
+			}
+		}
+
+		s, ts := hll.NewDefaultPlus(), hll.NewDefaultPlus()
+		if err := f.MergeMeasurementsSketches(s, ts); err != nil {
+			t.Fatal(err)
+		} else if s.Precision() != p || ts.Precision() != p {
+			t.Fatalf("unexpected precision: %d, %d", s.Precision(), ts.Precision())
+		}
+	}
+
+	if _, err := a.CompactToWithOptions(context.Background(), ioutil.Discard, M, K, tsi1.CompactOptions{SketchPrecision: 30}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure measurement sketches are built per file & merged across files.
+func TestIndexFiles_MeasurementSketch(t *testing.T) {
+	newSeries := func(name string, from, to int) []Series {
+		var a []Series
+		for i := from; i < to; i++ {
+			a = append(a, Series{Name: []byte(name), Tags: models.NewTags(map[string]string{"host": fmt.Sprintf("server%d", i)})})
+		}
+		return a
+	}
+
+	f0, err := CreateIndexFile(append(newSeries("cpu", 0, 2000), newSeries("mem", 0, 10)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write the newer file with prefix-compressed keys & a lower precision.
+	lf, err := CreateLogFile(newSeries("cpu", 1000, 3000))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("mem")); err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	opt := tsi1.CompactOptions{SeriesBlockCodec: tsi1.SeriesBlockCodecPrefix, SketchPrecision: 8}
+	if _, err := (tsi1.IndexFiles{tmp}).CompactToWithOptions(context.Background(), &buf, M, K, opt); err != nil {
+		t.Fatal(err)
+	}
+	var f1 tsi1.IndexFile
+	if err := f1.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Allow three standard errors.
+	maxErr := 3 * 1.04 / math.Sqrt(float64(uint64(1)<<8))
+	for _, tt := range []struct {
+		name string
+		s    func() (estimator.Sketch, error)
+		exp  uint64
+	}{
+		{"File", func() (estimator.Sketch, error) { return f0.MeasurementSketch([]byte("cpu")) }, 2000},
+		{"Prefix", func() (estimator.Sketch, error) { return f1.MeasurementSketch([]byte("cpu")) }, 2000},
+		{"Merged", func() (estimator.Sketch, error) { return tsi1.IndexFiles{&f1, f0}.MeasurementSketch([]byte("cpu")) }, 3000},
+	} {
+		s, err := tt.s()
+		if err != nil {
+			t.Fatal(err)
+		} else if got := s.Count(); math.Abs(float64(got)-float64(tt.exp))/float64(tt.exp) > maxErr {
+			t.Fatalf("%s: unexpected estimate: %d, expected %d", tt.name, got, tt.exp)
+		}
+	}
+
+	// Merged sketches use the lowest precision.
+	if s, err := (tsi1.IndexFiles{f0, &f1}).MeasurementSketch([]byte("cpu")); err != nil {
+		t.Fatal(err)
+	} else if p := s.(*hll.Plus).Precision(); p != 8 {
+		t.Fatalf("unexpected precision: %d", p)
+	}
+
+	// Files older than a measurement tombstone are skipped.
+	if s, err := (tsi1.IndexFiles{&f1, f0}).MeasurementSketch([]byte("mem")); err != nil {
+		t.Fatal(err)
+	} else if n := s.Count(); n != 0 {
+		t.Fatalf("unexpected deleted measurement estimate: %d", n)
+	} else if s, err := (tsi1.IndexFiles{f0}).MeasurementSketch([]byte("mem")); err != nil {
+		t.Fatal(err)
+	} else if n := s.Count(); n != 10 {
+		t.Fatalf("unexpected measurement estimate: %d", n)
+	}
+
+	// Missing measurements return a nil sketch.
+	if s, err := (tsi1.IndexFiles{&f1, f0}).MeasurementSketch([]byte("disk")); err != nil {
+		t.Fatal(err)
+	} else if s != nil {
+		t.Fatalf("unexpected sketch: %v", s)
+	}
+}
+
+// Ensure measurement sketches can be omitted from a compaction.
+func TestIndexFiles_CompactToWithOptions_NoMeasurementSketches(t *testing.T) {
+	f0, err := GenerateIndexFile(10, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0}
+
+	opt := tsi1.CompactOptions{NoMeasurementSketches: true}
+	var buf bytes.Buffer
+	n, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt)
+	if err != nil {
+		t.Fatal(err)
+	} else if sz, err := a.EstimateSizeWithOptions(M, K, opt); err != nil {
+		t.Fatal(err)
+	} else if sz != n {
+		t.Fatalf("unexpected estimate: %d, expected %d", sz, n)
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if err := a.VerifyCompaction(&f); err != nil {
+		t.Fatal(err)
+	}
+
+	// The trailer marks the sketches as absent.
+	mt := f.Trailer().MeasurementBlock
+	if tr, err := tsi1.ReadMeasurementBlockTrailer(buf.Bytes()[mt.Offset:][:mt.Size]); err != nil {
+		t.Fatal(err)
+	} else if tr.HasSketches() {
+		t.Fatal("expected no sketches")
+	}
+
+	// Readers return an explicit error while series sketches are unaffected.
+	if err := f.MergeMeasurementsSketches(hll.NewDefaultPlus(), hll.NewDefaultPlus()); err != tsi1.ErrMeasurementSketchNotAvailable {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n, err := (tsi1.IndexFiles{&f}).ApproximateSeriesN(); err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("expected series estimate")
+	}
+
+	// Files without sketches can be compacted again.
+	var other bytes.Buffer
+	if _, err := (tsi1.IndexFiles{&f}).CompactTo(&other, M, K); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure tombstoned elements are omitted when compacting with DropTombstones.
+func TestIndexFiles_CompactToWithOptions_DropTombstones(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"host": "a"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east", "host": "a"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east", "host": "a"}), Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("disk")); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	opt := tsi1.CompactOptions{DropTombstones: true}
+	var buf bytes.Buffer
+	n, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt)
+	if err != nil {
+		t.Fatal(err)
+	} else if sz, err := a.EstimateSizeWithOptions(M, K, opt); err != nil {
+		t.Fatal(err)
+	} else if sz != n {
+		t.Fatalf("unexpected estimate: %d, expected %d", sz, n)
+	} else if full, err := a.CompactTo(&bytes.Buffer{}, M, K); err != nil {
+		t.Fatal(err)
+	} else if n >= full {
+		t.Fatalf("expected smaller file: %d >= %d", n, full)
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the live series remains.
+	var keys []string
+	itr := f.SeriesIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		keys = append(keys, string(models.MakeKey(e.Name(), e.Tags())))
+	}
+	if exp := []string{"cpu,region=east"}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("unexpected series: %v", keys)
+	}
+	if exists, _ := f.HasSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "west"}), nil); exists {
+		t.Fatal("expected tombstoned series to be dropped")
+	} else if n := f.SeriesN(); n != 1 {
+		t.Fatalf("unexpected series count: %d", n)
+	}
+
+	// Measurements without live series are dropped.
+	var names []string
+	mitr := f.MeasurementIterator()
+	for e := mitr.Next(); e != nil; e = mitr.Next() {
+		names = append(names, string(e.Name()))
+	}
+	if exp := []string{"cpu"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected measurements: %v", names)
+	} else if e := f.Measurement([]byte("disk")); e != nil {
+		t.Fatalf("unexpected measurement: %s", e.Name())
+	}
+
+	// Tag values without live series are dropped.
+	var values []string
+	vitr := f.TagValueIterator([]byte("cpu"), []byte("region"))
+	for e := vitr.Next(); e != nil; e = vitr.Next() {
+		values = append(values, string(e.Value()))
+	}
+	if exp := []string{"east"}; !reflect.DeepEqual(values, exp) {
+		t.Fatalf("unexpected tag values: %v", values)
+	} else if sitr := f.TagValueSeriesIterator([]byte("cpu"), []byte("region"), []byte("west")); sitr != nil && sitr.Next() != nil {
+		t.Fatal("unexpected tag value series")
+	}
+}
+
+// Ensure series tombstones within the retention window are kept when dropping
+// tombstones & that deletion times are carried through compactions.
+func TestIndexFiles_CompactToWithOptions_TombstoneRetention(t *testing.T) {
+	east := models.NewTags(map[string]string{"region": "east"})
+	west := models.NewTags(map[string]string{"region": "west"})
+	f0 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: east},
+		{Name: []byte("cpu"), Tags: west},
+		{Name: []byte("disk"), Tags: east},
+	})
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: west, Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("disk")); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	deletedAt, ok := f1.SeriesTombstoneTime([]byte("cpu"), west, nil)
+	if !ok {
+		t.Fatal("expected deletion time")
+	}
+
+	compact := func(a tsi1.IndexFiles, opt tsi1.CompactOptions) *tsi1.IndexFile {
+		var buf bytes.Buffer
+		if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		// A planned layout writes the same file.
+		l, err := a.Layout(M, K, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		w := &bufferAt{buf: make([]byte, l.Size())}
+		if _, err := l.CompactTo(context.Background(), w); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(w.buf, buf.Bytes()) {
+			t.Fatal("unexpected layout data")
+		}
+
+		var f tsi1.IndexFile
+		if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		} else if err := f.VerifyChecksums(); err != nil {
+			t.Fatal(err)
+		}
+		return &f
+	}
+
+	// The deletion time is kept by a compaction which keeps tombstones.
+	f := compact(a, tsi1.CompactOptions{})
+	if ts, ok := f.SeriesTombstoneTime([]byte("cpu"), west, nil); !ok || !ts.Equal(deletedAt) {
+		t.Fatalf("unexpected deletion time: %s, expected %s", ts, deletedAt)
+	}
+
+	// The tombstone is kept within the window. The deleted measurement is
+	// still dropped.
+	opt := tsi1.CompactOptions{DropTombstones: true, TombstoneRetention: time.Hour, Now: deletedAt.Add(30 * time.Minute)}
+	f = compact(a, opt)
+	if exists, tombstoned := f.HasSeries([]byte("cpu"), west, nil); !exists || !tombstoned {
+		t.Fatalf("expected retained tombstone: exists=%v tombstoned=%v", exists, tombstoned)
+	} else if ts, ok := f.SeriesTombstoneTime([]byte("cpu"), west, nil); !ok || !ts.Equal(deletedAt) {
+		t.Fatalf("unexpected deletion time: %s, expected %s", ts, deletedAt)
+	} else if exists, _ := f.HasSeries([]byte("disk"), east, nil); exists {
+		t.Fatal("expected series of deleted measurement to be dropped")
+	}
+
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	if r, err := a.Compact(context.Background(), filepath.Join(dir, "index.tsi"), M, K, opt); err != nil {
+		t.Fatal(err)
+	} else if r.RetainedTombstoneN != 1 || r.SeriesTombstoneN != 1 || r.DroppedSeriesN != 1 {
+		t.Fatalf("unexpected counts: retained=%d tombstones=%d dropped=%d", r.RetainedTombstoneN, r.SeriesTombstoneN, r.DroppedSeriesN)
+	}
+
+	// The tombstone is dropped once the window has passed.
+	opt.Now = deletedAt.Add(time.Hour)
+	f = compact(a, opt)
+	if exists, _ := f.HasSeries([]byte("cpu"), west, nil); exists {
+		t.Fatal("expected tombstone to be dropped")
+	}
+
+	// Tombstones from files before version 4 have no deletion time. They are
+	// kept & stamped with the compaction time.
+	data := MustRewriteIndexFileTrailerV3(t, f1)
+	var old tsi1.IndexFile
+	if err := old.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	} else if _, ok := old.SeriesTombstoneTime([]byte("cpu"), west, nil); ok {
+		t.Fatal("unexpected deletion time in version 3 file")
+	}
+
+	now := deletedAt.Add(2 * time.Hour)
+	opt = tsi1.CompactOptions{DropTombstones: true, TombstoneRetention: time.Hour, Now: now}
+	f = compact(tsi1.IndexFiles{&old, f0}, opt)
+	if ts, ok := f.SeriesTombstoneTime([]byte("cpu"), west, nil); !ok || !ts.Equal(now) {
+		t.Fatalf("unexpected deletion time: %s, expected %s", ts, now)
+	}
+
+	opt.Now = now.Add(time.Hour)
+	f = compact(tsi1.IndexFiles{f, f0}, opt)
+	if exists, _ := f.HasSeries([]byte("cpu"), west, nil); exists {
+		t.Fatal("expected stamped tombstone to be dropped")
+	}
+}
+
+// MustRewriteIndexFileTrailerV3 returns the data of f with its trailer
+// replaced by the version 3 encoding, which ends after the level.
+func MustRewriteIndexFileTrailerV3(tb testing.TB, f *tsi1.IndexFile) []byte {
+	var buf bytes.Buffer
+	if _, err := (tsi1.IndexFiles{f}).CompactTo(&buf, M, K); err != nil {
+		tb.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	other := append([]byte{}, data[:len(data)-tsi1.IndexFileTrailerSize]...)
+	fields := data[len(data)-tsi1.IndexFileTrailerSize:]
+	fields = fields[:tsi1.IndexFileTrailerV3Size-tsi1.IndexFileTrailerChecksumSize-tsi1.IndexFileVersionSize]
+	other = append(other, fields...)
+	other = append(other, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(other[len(other)-4:], crc32.ChecksumIEEE(fields))
+	return append(other, 0, tsi1.IndexFileVersion3)
+}
+
+// Ensure the drop callback observes each series omitted by DropTombstones.
+func TestIndexFiles_CompactToWithOptions_OnDrop(t *testing.T) {
+	f0 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"host": "a"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east", "host": "a"})},
+	})
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east", "host": "a"}), Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("disk")); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	var dropped []string
+	onDrop := func(name []byte, tags models.Tags) {
+		dropped = append(dropped, string(models.MakeKey(name, tags)))
+	}
+
+	// The callback is only called when tombstones are dropped.
+	if _, err := a.CompactToWithOptions(context.Background(), &bytes.Buffer{}, M, K, tsi1.CompactOptions{OnDrop: onDrop}); err != nil {
+		t.Fatal(err)
+	} else if len(dropped) != 0 {
+		t.Fatalf("unexpected dropped series: %v", dropped)
+	}
+
+	if _, err := a.CompactToWithOptions(context.Background(), &bytes.Buffer{}, M, K, tsi1.CompactOptions{DropTombstones: true, OnDrop: onDrop}); err != nil {
+		t.Fatal(err)
+	} else if exp := []string{"cpu,region=west", "disk,host=a", "mem,host=a,region=east"}; !reflect.DeepEqual(dropped, exp) {
+		t.Fatalf("unexpected dropped series: %v", dropped)
+	}
+}
+
+// Ensure the bloom filter is sized for the requested false positive rate.
+func TestIndexFiles_CompactToWithOptions_BloomFalsePositiveRate(t *testing.T) {
+	f0, err := GenerateIndexFile(10, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f0}
+
+	compact := func(fpr float64) *tsi1.IndexFile {
+		var buf bytes.Buffer
+		if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, tsi1.CompactOptions{BloomFalsePositiveRate: fpr}); err != nil {
+			t.Fatal(err)
+		}
+		var f tsi1.IndexFile
+		if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		return &f
+	}
+
+	// The default uses the m & k passed to the compaction.
+	if f, exp := compact(0).Filter(), bloom.NewFilter(M, K); f.Len() != exp.Len() || f.K() != K {
+		t.Fatalf("unexpected default filter: len=%d, k=%d", f.Len(), f.K())
+	}
+
+	low, high := compact(0.001), compact(0.1)
+	if low.Filter().Len() <= high.Filter().Len() {
+		t.Fatalf("expected larger filter for lower rate: %d <= %d", low.Filter().Len(), high.Filter().Len())
+	}
+	for _, f := range []*tsi1.IndexFile{low, high} {
+		if err := a.VerifyCompaction(f); err != nil {
+			t.Fatal(err)
+		}
+
+		// Every series must be in the filter.
+		itr := f.SeriesIterator()
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			if !f.Filter().Contains(tsi1.AppendSeriesKey(nil, e.Name(), e.Tags())) {
+				t.Fatalf("series missing from filter: %s", models.MakeKey(e.Name(), e.Tags()))
+			}
+		}
+	}
+
+	if _, err := a.CompactToWithOptions(context.Background(), &bytes.Buffer{}, M, K, tsi1.CompactOptions{BloomFalsePositiveRate: 1}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func BenchmarkIndexFiles_CompactTo(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(10, 3, 10)}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var buf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if _, err := a.CompactTo(&buf, M, K); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIndexFiles_CompactTo_NoMeasurementSketches(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(10000, 1, 2)}
+	for _, v := range []bool{false, true} {
+		b.Run(fmt.Sprintf("%v", v), func(b *testing.B) {
+			b.ReportAllocs()
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, tsi1.CompactOptions{NoMeasurementSketches: v}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Ensure assuming the merged series are sorted writes the same file.
+func TestIndexFiles_CompactTo_AssumeSorted(t *testing.T) {
+	a := tsi1.IndexFiles{MustGenerateIndexFile(3, 2, 3), MustGenerateIndexFile(4, 2, 2)}
+
+	var exp bytes.Buffer
+	if _, err := a.CompactToWithOptions(context.Background(), &exp, M, K, tsi1.CompactOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []tsi1.CompactOptions{{AssumeSorted: true}, {StrictSeriesOrder: true}} {
+		var got bytes.Buffer
+		if _, err := a.CompactToWithOptions(context.Background(), &got, M, K, opt); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(exp.Bytes(), got.Bytes()) {
+			t.Fatalf("unexpected file: %+v", opt)
+		}
+	}
+}
+
+// Ensure blocks are padded to the block alignment & the padded file reads the
+// same as an unpadded file.
+func TestIndexFiles_CompactTo_BlockAlignment(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	a := tsi1.IndexFiles{MustGenerateIndexFile(3, 2, 3), MustGenerateIndexFile(4, 2, 2)}
+	var exp bytes.Buffer
+	if _, err := a.CompactTo(&exp, M, K); err != nil {
+		t.Fatal(err)
+	}
+
+	// An alignment of one or less does not pad.
+	for _, align := range []int64{-1, 0, 1} {
+		var buf bytes.Buffer
+		if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, tsi1.CompactOptions{BlockAlignment: align}); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), exp.Bytes()) {
+			t.Fatalf("%d: unexpected file", align)
+		}
+	}
+
+	for _, align := range []int64{7, 512, 4096} {
+		opt := tsi1.CompactOptions{BlockAlignment: align}
+		path := filepath.Join(dir, fmt.Sprintf("%d.tsi", align))
+		n, err := a.CompactToFileWithOptions(context.Background(), path, M, K, false, opt)
+		if err != nil {
+			t.Fatal(err)
+		} else if size, err := a.EstimateSizeWithOptions(M, K, opt); err != nil {
+			t.Fatal(err)
+		} else if size != n {
+			t.Fatalf("%d: unexpected estimated size: %d, expected %d", align, size, n)
+		}
+
+		f := tsi1.NewIndexFile()
+		f.SetPath(path)
+		if err := f.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		tr := f.Trailer()
+		for _, offset := range []int64{tr.SeriesBlock.Offset, tr.TagsetBlock.Offset, tr.MeasurementBlock.Offset} {
+			if offset%align != 0 {
+				t.Fatalf("%d: unaligned block offset: %d", align, offset)
+			}
+		}
+
+		if err := f.VerifyChecksums(); err != nil {
+			t.Fatal(err)
+		} else if got, exp := MeasurementBlockNames(f.MeasurementIterator()), MeasurementBlockNames(a.MeasurementIterator()); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("%d: unexpected measurements: %q", align, got)
+		} else if f.SeriesN() != 31 {
+			t.Fatalf("%d: unexpected series count: %d", align, f.SeriesN())
+		}
+
+		var seriesN int
+		itr := f.MeasurementSeriesIterator([]byte("measurement3"))
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			seriesN++
+		}
+		if seriesN != 4 {
+			t.Fatalf("%d: unexpected measurement series count: %d", align, seriesN)
+		}
+	}
+}
+
+// BenchmarkIndexFiles_CompactTo_AssumeSorted compares compacting 100k series
+// with & without comparing each series key to the previous one.
+func BenchmarkIndexFiles_CompactTo_AssumeSorted(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(100, 3, 10)}
+	for _, v := range []bool{false, true} {
+		b.Run(fmt.Sprintf("%v", v), func(b *testing.B) {
+			b.ReportAllocs()
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, tsi1.CompactOptions{AssumeSorted: v}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIndexFiles_CompactTo_BloomFalsePositiveRate(b *testing.B) {
+	a := tsi1.IndexFiles{MustFindOrGenerateIndexFile(100, 3, 7)}
+	for _, fpr := range []float64{0.1, 0.01, 0.001, 0.0001} {
+		b.Run(fmt.Sprintf("%g", fpr), func(b *testing.B) {
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, tsi1.CompactOptions{BloomFalsePositiveRate: fpr}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			// Measure the observed rate using series which do not exist.
+			var f tsi1.IndexFile
+			if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+				b.Fatal(err)
+			}
+			var fpN int
+			const n = 100000
+			for i := 0; i < n; i++ {
+				if f.Filter().Contains([]byte(fmt.Sprintf("missing%d", i))) {
+					fpN++
+				}
+			}
+			b.Logf("filter size=%d bytes, k=%d, observed fpr=%g", f.Filter().Len(), f.Filter().K(), float64(fpN)/n)
+		})
+	}
+}
+
+// Ensure a log file can be merged into an index file & series ids remapped.
+func TestIndexFiles_MergeLogFileTo(t *testing.T) {
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New series sort before existing series so their offsets shift.
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "abc"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"}), Deleted: true},
+		{Name: []byte("aaa"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := (tsi1.IndexFiles{f0}).MergeLogFileTo(&buf, lf.LogFile, M, K, tsi1.CompactOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify against the log file compacted on its own.
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := (tsi1.IndexFiles{f1, f0}).VerifyCompaction(&f); err != nil {
+		t.Fatal(err)
+	}
+
+	// Series ids in the tagsets must resolve to series in the new file.
+	for _, tt := range []struct {
+		name, value string
+		exp         []string
+	}{
+		{name: "cpu", value: "abc", exp: []string{"cpu,region=abc"}},
+		{name: "cpu", value: "east", exp: []string{"cpu,region=east"}},
+		{name: "cpu", value: "west", exp: []string{"cpu,region=west"}},
+		{name: "mem", value: "east", exp: []string{"mem,region=east"}},
+		{name: "aaa", value: "east", exp: []string{"aaa,region=east"}},
+	} {
+		var keys []string
+		itr := f.TagValueSeriesIterator([]byte(tt.name), []byte("region"), []byte(tt.value))
+		for e := nextSeries(itr); e != nil; e = itr.Next() {
+			keys = append(keys, string(models.MakeKey(e.Name(), e.Tags())))
+		}
+		if !reflect.DeepEqual(keys, tt.exp) {
+			t.Fatalf("%s=%s: unexpected series: %v", tt.name, tt.value, keys)
+		}
+	}
+
+	if exists, tombstoned := f.HasSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "west"}), nil); !exists || !tombstoned {
+		t.Fatalf("expected tombstoned series: exists=%v, tombstoned=%v", exists, tombstoned)
+	} else if n, err := (tsi1.IndexFiles{&f}).SeriesN(); err != nil {
+		t.Fatal(err)
+	} else if n != 4 {
+		t.Fatalf("unexpected series count: %d", n)
+	}
+}
+
+// nextSeries returns the next element or nil if itr is nil.
+func nextSeries(itr tsi1.SeriesIterator) tsi1.SeriesElem {
+	if itr == nil {
+		return nil
+	}
+	return itr.Next()
+}
+
+// Ensure a compaction can be verified against its inputs.
+func TestIndexFiles_CompactAndVerify(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	f0, err := GenerateIndexFile(4, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("measurement0"), Tags: models.NewTags(map[string]string{"key0": "value100"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("measurement1")); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if _, err := a.CompactAndVerify(path, M, K); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file which does not match its inputs is reported.
+	if err := a.VerifyCompaction(f0); err == nil {
+		t.Fatal("expected error")
+	} else if exp := `series mismatch: expected cpu,region=east, got measurement0,key0=value0,key1=value0`; err.Error() != exp {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := (tsi1.IndexFiles{f0}).VerifyCompaction(f1); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure file sets are compared by their merged contents.
+func TestIndexFiles_Equal(t *testing.T) {
+	east := models.NewTags(map[string]string{"region": "east"})
+	west := models.NewTags(map[string]string{"region": "west"})
+
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: east},
+		{Name: []byte("cpu"), Tags: west},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("mem"), Tags: east},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("cpu"), west); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	// A prefix-compressed compaction has a different layout but equal contents.
+	var buf bytes.Buffer
+	if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, tsi1.CompactOptions{SeriesBlockCodec: tsi1.SeriesBlockCodecPrefix}); err != nil {
+		t.Fatal(err)
+	}
+	f := tsi1.NewIndexFile()
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, diff := a.Equal(tsi1.IndexFiles{f}); !ok {
+		t.Fatalf("expected equal: %s", diff)
+	} else if ok, diff := (tsi1.IndexFiles{f}).Equal(a); !ok {
+		t.Fatalf("expected equal: %s", diff)
+	}
+
+	// The tombstone state of a series is compared.
+	if ok, diff := a.Equal(tsi1.IndexFiles{f0, f1}); ok {
+		t.Fatal("expected difference")
+	} else if exp := `series tombstone mismatch: cpu,region=west: expected deleted=true`; diff != exp {
+		t.Fatalf("unexpected diff: %s", diff)
+	}
+
+	// Missing elements are reported.
+	if ok, diff := (tsi1.IndexFiles{f0}).Equal(tsi1.IndexFiles{}); ok {
+		t.Fatal("expected difference")
+	} else if exp := `series missing from output: cpu,region=east`; diff != exp {
+		t.Fatalf("unexpected diff: %s", diff)
+	}
+}
+
+// Ensure measurements can be renamed during a compaction.
+func TestIndexFiles_CompactTo_RemapMeasurement(t *testing.T) {
+	east := models.NewTags(map[string]string{"region": "east"})
+	west := models.NewTags(map[string]string{"region": "west"})
+
+	f0, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: east},
+		{Name: []byte("cpu"), Tags: west, Deleted: true},
+		{Name: []byte("mem"), Tags: east},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := CreateIndexFile([]Series{
+		{Name: []byte("disk"), Tags: west},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	prefix := func(name []byte) []byte { return append([]byte("tenant1_"), name...) }
+	for _, concurrency := range []int{0, 4} {
+		var buf bytes.Buffer
+		opt := tsi1.CompactOptions{MaxConcurrency: concurrency, RemapMeasurement: prefix}
+		if _, err := a.CompactToWithOptions(context.Background(), &buf, M, K, opt); err != nil {
+			t.Fatal(err)
+		}
+		f := tsi1.NewIndexFile()
+		if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		} else if err := f.VerifyChecksums(); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		mitr := f.MeasurementIterator()
+		for e := mitr.Next(); e != nil; e = mitr.Next() {
+			names = append(names, string(e.Name()))
+		}
+		if exp := []string{"tenant1_cpu", "tenant1_disk", "tenant1_mem"}; !reflect.DeepEqual(names, exp) {
+			t.Fatalf("unexpected measurements: %v", names)
+		} else if f.Measurement([]byte("cpu")) != nil {
+			t.Fatal("expected old measurement name to be removed")
+		}
+
+		if exists, tombstoned := f.HasSeries([]byte("tenant1_cpu"), east, nil); !exists || tombstoned {
+			t.Fatalf("unexpected series state: exists=%v, tombstoned=%v", exists, tombstoned)
+		} else if exists, tombstoned := f.HasSeries([]byte("tenant1_cpu"), west, nil); !exists || !tombstoned {
+			t.Fatalf("unexpected series state: exists=%v, tombstoned=%v", exists, tombstoned)
+		} else if exists, _ := f.HasSeries([]byte("cpu"), east, nil); exists {
+			t.Fatal("expected old series key to be removed")
+		}
+
+		itr := f.TagValueSeriesIterator([]byte("tenant1_disk"), []byte("region"), []byte("west"))
+		if e := itr.Next(); e == nil || string(models.MakeKey(e.Name(), e.Tags())) != "tenant1_disk,region=west" {
+			t.Fatalf("unexpected series: %v", e)
+		} else if e := itr.Next(); e != nil {
+			t.Fatalf("expected eof, got: %s", models.MakeKey(e.Name(), e.Tags()))
+		}
+
+		if e := f.Measurement([]byte("tenant1_cpu")); e == nil || e.(*tsi1.MeasurementBlockElem).SeriesN() != 2 {
+			t.Fatalf("unexpected measurement: %v", e)
+		}
+	}
+}
+
+// Ensure a remap which does not preserve the measurement order fails.
+func TestIndexFiles_CompactTo_RemapMeasurement_ErrOrder(t *testing.T) {
+	f, err := CreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		fn   func(name []byte) []byte
+		exp  string
+	}{
+		{
+			name: "Reversed",
+			fn: func(name []byte) []byte {
+				if string(name) == "cpu" {
+					return []byte("z")
+				}
+				return []byte("a")
+			},
+			exp: `measurement remap out of order: "mem" -> "a" does not sort after "cpu" -> "z"`,
+		},
+		{
+			name: "Collision",
+			fn:   func(name []byte) []byte { return []byte("x") },
+			exp:  `measurement remap out of order: "mem" -> "x" does not sort after "cpu" -> "x"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := tsi1.CompactOptions{RemapMeasurement: tt.fn}
+			_, err := (tsi1.IndexFiles{f}).CompactToWithOptions(context.Background(), ioutil.Discard, M, K, opt)
+			if e, ok := err.(*tsi1.CompactError); !ok || e.Phase != tsi1.CompactPhaseSeriesBlock || string(e.Name) != "mem" {
+				t.Fatalf("unexpected error: %v", err)
+			} else if e, ok := e.Err.(*tsi1.ErrMeasurementRemapOrder); !ok {
+				t.Fatalf("unexpected error: %v", err)
+			} else if e.Error() != tt.exp {
+				t.Fatalf("unexpected error: %s", e)
+			}
+		})
+	}
+}
+
+// Ensure an empty set of files compacts to a valid, empty index file.
+func TestIndexFiles_CompactTo_Empty(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := (tsi1.IndexFiles{}).CompactTo(&buf, M, K); err != nil {
+		t.Fatal(err)
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if err := f.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	}
+
+	if itr := f.MeasurementIterator(); itr != nil && itr.Next() != nil {
+		t.Fatal("expected no measurements")
+	} else if itr := f.SeriesIterator(); itr != nil && itr.Next() != nil {
+		t.Fatal("expected no series")
+	} else if n := f.SeriesN(); n != 0 {
+		t.Fatalf("unexpected series count: %d", n)
+	} else if n := f.MeasurementN(); n != 0 {
+		t.Fatalf("unexpected measurement count: %d", n)
+	} else if itr := f.TagKeyIterator([]byte("cpu")); itr != nil {
+		t.Fatal("expected nil tag key iterator")
+	}
+
+	// The empty file can be compacted again.
+	a := tsi1.IndexFiles{&f}
+	if names := a.MeasurementNames(); len(names) != 0 {
+		t.Fatalf("unexpected names: %q", names)
+	} else if _, err := a.CompactTo(&bytes.Buffer{}, M, K); err != nil {
+		t.Fatal(err)
+	} else if n, err := a.EstimateSize(M, K); err != nil {
+		t.Fatal(err)
+	} else if n != int64(buf.Len()) {
+		t.Fatalf("unexpected estimate: %d", n)
+	}
+}
+
+// Ensure measurements without tags or series can be compacted.
+func TestIndexFiles_CompactTo_NoTagsOrSeries(t *testing.T) {
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu")},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteMeasurement([]byte("disk")); err != nil {
+		t.Fatal(err)
+	}
+	f0, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	if _, err := (tsi1.IndexFiles{f0}).CompactAndVerify(filepath.Join(dir, tsi1.FormatIndexFileName(1, 1)), M, K); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -243,6 +243,96 @@ func TestIndex_DropMeasurement(t *testing.T) {
 	})
 }
 
+// Ensure the series count excludes tombstoned series once the log file has
+// been compacted into an index file.
+func TestIndex_SeriesN(t *testing.T) {
+	idx := MustOpenIndex()
+	defer idx.Close()
+
+	if err := idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"})},
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := idx.DropSeries([]byte("cpu,region=west")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compact the log file into an index file.
+	idx.MaxLogFileSize = 1
+	if err := idx.CheckLogFile(); err != nil {
+		t.Fatal(err)
+	}
+	idx.Wait()
+
+	fs := idx.RetainFileSet()
+	n := 0
+	for _, f := range fs.Files() {
+		if _, ok := f.(*tsi1.IndexFile); ok {
+			n++
+		}
+	}
+	fs.Release()
+	if n != 1 {
+		t.Fatalf("unexpected index file count: %d", n)
+	} else if n := idx.SeriesN(); n != 2 {
+		t.Fatalf("unexpected series count: %d", n)
+	}
+}
+
+// Ensure index files compacted from log files are opened with the index's
+// load mode & respond the same in each mode.
+func TestIndex_IndexFileLoadMode(t *testing.T) {
+	for _, mode := range []tsi1.IndexFileLoadMode{tsi1.IndexFileLoadMmap, tsi1.IndexFileLoadHeap} {
+		t.Run("mode="+mode.String(), func(t *testing.T) {
+			idx := NewIndex()
+			idx.IndexFileLoadMode = mode
+			idx.MaxLogFileSize = 1 // compact after every series
+			if err := idx.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer idx.Close()
+
+			if err := idx.CreateSeriesSliceIfNotExists([]Series{
+				{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+				{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+				{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			idx.Wait()
+
+			idx.Run(t, func(t *testing.T) {
+				fs := idx.RetainFileSet()
+				defer fs.Release()
+
+				files := fs.IndexFiles()
+				if len(files) == 0 {
+					t.Fatal("expected index files")
+				}
+				for _, f := range files {
+					if f.LoadMode() != mode {
+						t.Fatalf("unexpected load mode: %s", f.LoadMode())
+					}
+				}
+
+				var names []string
+				if err := idx.ForEachMeasurementName(func(name []byte) error {
+					names = append(names, string(name))
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				} else if !reflect.DeepEqual(names, []string{"cpu", "mem"}) {
+					t.Fatalf("unexpected names: %#v", names)
+				} else if n := idx.SeriesN(); n != 3 {
+					t.Fatalf("unexpected series count: %d", n)
+				}
+			})
+		})
+	}
+}
+
 // Index is a test wrapper for tsi1.Index.
 type Index struct {
 	*tsi1.Index
@@ -276,9 +366,9 @@ func (idx *Index) Reopen() error {
 		return err
 	}
 
-	path := idx.Path
+	path, mode := idx.Path, idx.IndexFileLoadMode
 	idx.Index = tsi1.NewIndex()
-	idx.Path = path
+	idx.Path, idx.IndexFileLoadMode = path, mode
 	if err := idx.Open(); err != nil {
 		return err
 	}
@@ -0,0 +1,251 @@
+package tsi1
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// ErrIndexFileLayoutMismatch is returned when a block is written with a
+// different size than was planned by the layout.
+var ErrIndexFileLayoutMismatch = errors.New("index file layout mismatch")
+
+// IndexFileLayout is the planned layout of a compaction of a set of index
+// files. It allows the blocks of the compacted file to be written out of order
+// to known offsets, such as into the parts of a multipart upload.
+//
+// Planning encodes the whole file once without writing it & records the
+// offset of every series so the tagset & measurement blocks can be encoded
+// without reading back the series block. The files must not change until the
+// layout is closed.
+type IndexFileLayout struct {
+	p       IndexFiles
+	m, k    uint64
+	opt     CompactOptions
+	trailer IndexFileTrailer
+	size    int64
+	offsets *seriesOffsetSet
+	names   measurementRange
+
+	// Checksum of the planned series block.
+	seriesSum uint32
+
+	// Tombstone block recorded while planning the series block.
+	tombstones []byte
+}
+
+// Layout plans the compaction of the files using the settings in opt. The
+// returned layout must be closed to release the series offsets.
+func (p IndexFiles) Layout(m, k uint64, opt CompactOptions) (*IndexFileLayout, error) {
+	return p.layout(m, k, opt, measurementRange{})
+}
+
+// layout plans the compaction of the measurements in names.
+func (p IndexFiles) layout(m, k uint64, opt CompactOptions, names measurementRange) (*IndexFileLayout, error) {
+	if err := opt.checkTempDir(); err != nil {
+		return nil, err
+	}
+
+	l := &IndexFileLayout{p: p, m: m, k: k, opt: opt, names: names}
+	l.opt.Progress = nil
+	l.opt.OnDrop = nil
+	l.opt.OnTombstoneThreshold = nil
+	l.opt.SeriesOffsetTable = nil
+	if l.opt.Now.IsZero() {
+		l.opt.Now = time.Now()
+	}
+
+	var info indexCompactInfo
+	info.ctx = context.Background()
+	info.opt = l.opt
+	info.names = names
+	info.tagSets = make(map[string]indexTagSetPos)
+	info.seriesOffsets = newSeriesOffsetSet(opt.MaxSeriesOffsetMemory, opt.tempDir())
+	l.offsets = info.seriesOffsets
+
+	t := &l.trailer
+	t.Version = IndexFileVersion
+	t.Generation, t.Level = opt.Generation, opt.Level
+	n := int64(len(FileSignature))
+
+	// Count series block & record the offsets of each series.
+	l.opt.writeBlockPaddingTo(ioutil.Discard, &n)
+	t.SeriesBlock.Offset = n
+	cw := newChecksumWriter(ioutil.Discard)
+	if err := p.writeSeriesBlockTo(cw, m, k, &info, &n); err != nil {
+		l.Close()
+		return nil, err
+	}
+	t.SeriesBlock.Size = n - t.SeriesBlock.Offset
+	l.seriesSum = cw.Sum()
+	if err := info.seriesOffsets.finish(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	info.sblk = info.seriesOffsets
+
+	// Count tagset & measurement blocks.
+	l.opt.writeBlockPaddingTo(ioutil.Discard, &n)
+	t.TagsetBlock.Offset = n
+	if err := p.writeTagsetsTo(ioutil.Discard, &info, &n); err != nil {
+		l.Close()
+		return nil, err
+	}
+	t.TagsetBlock.Size = n - t.TagsetBlock.Offset
+
+	l.opt.writeBlockPaddingTo(ioutil.Discard, &n)
+	t.MeasurementBlock.Offset = n
+	if err := p.writeMeasurementBlockTo(ioutil.Discard, &info, &n); err != nil {
+		l.Close()
+		return nil, err
+	}
+	t.MeasurementBlock.Size = n - t.MeasurementBlock.Offset
+
+	// The tombstone block is the same for every write of the series block.
+	l.tombstones = info.tombstones
+	t.TombstoneBlock.Offset = n
+	t.TombstoneBlock.Size = int64(len(l.tombstones))
+	t.TombstoneBlock.Checksum = crc32.ChecksumIEEE(l.tombstones)
+	n += t.TombstoneBlock.Size
+
+	// Count trailer.
+	l.size = n + IndexFileTrailerSize
+	return l, nil
+}
+
+// Trailer returns the planned offset & size of each block. Checksums are only
+// known once the blocks are written, except for the tombstone block.
+func (l *IndexFileLayout) Trailer() IndexFileTrailer { return l.trailer }
+
+// Size returns the total size of the compacted file, in bytes.
+func (l *IndexFileLayout) Size() int64 { return l.size }
+
+// CompactTo writes the compacted file to w at the planned offsets. The series
+// block is written concurrently with the tagset & measurement blocks. The
+// signature & trailer are written once the blocks are complete. Returns the
+// trailer written to the file.
+//
+// The progress, drop & tombstone threshold callbacks in the options are not
+// called.
+func (l *IndexFileLayout) CompactTo(ctx context.Context, w io.WriterAt) (IndexFileTrailer, error) {
+	t := l.trailer
+
+	var wg sync.WaitGroup
+	var errs [2]error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		t.SeriesBlock.Checksum, errs[0] = l.writeSeriesBlockAt(ctx, w)
+	}()
+	go func() {
+		defer wg.Done()
+		t.TagsetBlock.Checksum, t.MeasurementBlock.Checksum, errs[1] = l.writeMeasurementBlocksAt(ctx, w)
+	}()
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return t, err
+		}
+	}
+
+	return t, l.writeTrailerAt(w, t)
+}
+
+// writeTrailerAt writes the signature, the padding before the series block,
+// the tombstone block & trailer t.
+func (l *IndexFileLayout) writeTrailerAt(w io.WriterAt, t IndexFileTrailer) error {
+	n := int64(len(FileSignature))
+	if _, err := w.WriteAt([]byte(FileSignature), 0); err != nil {
+		return err
+	} else if err := l.opt.writeBlockPaddingTo(&offsetWriter{w: w, off: n}, &n); err != nil {
+		return err
+	} else if _, err := w.WriteAt(l.tombstones, t.TombstoneBlock.Offset); err != nil {
+		return err
+	} else if _, err := t.WriteTo(&offsetWriter{w: w, off: l.size - IndexFileTrailerSize}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeSeriesBlockAt writes the series block & returns its checksum.
+func (l *IndexFileLayout) writeSeriesBlockAt(ctx context.Context, w io.WriterAt) (uint32, error) {
+	var info indexCompactInfo
+	info.ctx = ctx
+	info.opt = l.opt
+	info.names = l.names
+
+	n := l.trailer.SeriesBlock.Offset
+	bw := bufio.NewWriterSize(l.opt.limitWriter(ctx, &offsetWriter{w: w, off: n}), l.opt.bufferSize())
+	cw := newChecksumWriter(bw)
+	if err := l.p.writeSeriesBlockTo(cw, l.m, l.k, &info, &n); err != nil {
+		return 0, l.p.compactError(CompactPhaseSeriesBlock, nil, err)
+	} else if err := l.opt.writeBlockPaddingTo(bw, &n); err != nil {
+		return 0, l.p.compactError(CompactPhaseSeriesBlock, nil, err)
+	} else if n != l.trailer.TagsetBlock.Offset {
+		return 0, ErrIndexFileLayoutMismatch
+	}
+
+	sum := cw.Sum()
+	if sum != l.seriesSum {
+		return 0, ErrIndexFileLayoutMismatch
+	}
+	return sum, l.p.compactError(CompactPhaseSeriesBlock, nil, bw.Flush())
+}
+
+// writeMeasurementBlocksAt writes the tagset & measurement blocks using the
+// planned series offsets & returns their checksums.
+func (l *IndexFileLayout) writeMeasurementBlocksAt(ctx context.Context, w io.WriterAt) (tagsetSum, measurementSum uint32, err error) {
+	var info indexCompactInfo
+	info.ctx = ctx
+	info.opt = l.opt
+	info.names = l.names
+	info.tagSets = make(map[string]indexTagSetPos)
+	info.sblk = l.offsets
+
+	n := l.trailer.TagsetBlock.Offset
+	bw := bufio.NewWriterSize(l.opt.limitWriter(ctx, &offsetWriter{w: w, off: n}), l.opt.bufferSize())
+	cw := newChecksumWriter(bw)
+	if err := l.p.writeTagsetsTo(cw, &info, &n); err != nil {
+		return 0, 0, l.p.compactError(CompactPhaseTagsets, nil, err)
+	} else if err := l.opt.writeBlockPaddingTo(bw, &n); err != nil {
+		return 0, 0, l.p.compactError(CompactPhaseTagsets, nil, err)
+	} else if n != l.trailer.MeasurementBlock.Offset {
+		return 0, 0, ErrIndexFileLayoutMismatch
+	}
+	tagsetSum = cw.Sum()
+
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	} else if err := l.p.writeMeasurementBlockTo(cw, &info, &n); err != nil {
+		return 0, 0, l.p.compactError(CompactPhaseMeasurementBlock, nil, err)
+	} else if n != l.trailer.TombstoneBlock.Offset {
+		return 0, 0, ErrIndexFileLayoutMismatch
+	}
+	measurementSum = cw.Sum()
+
+	return tagsetSum, measurementSum, l.p.compactError(CompactPhaseMeasurementBlock, nil, bw.Flush())
+}
+
+// Close releases the series offsets held by the layout.
+func (l *IndexFileLayout) Close() error {
+	return l.offsets.Close()
+}
+
+// offsetWriter writes sequentially to an io.WriterAt starting at an offset.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+// Write writes p at the current offset & advances the offset.
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.w.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
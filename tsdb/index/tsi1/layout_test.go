@@ -0,0 +1,98 @@
+package tsi1_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure a planned layout writes the same file as a sequential compaction.
+func TestIndexFiles_Layout(t *testing.T) {
+	f0, err := GenerateIndexFile(4, 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := GenerateIndexFile(2, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tsi1.IndexFiles{f1, f0}
+
+	var exp bytes.Buffer
+	if _, err := a.CompactTo(&exp, M, K); err != nil {
+		t.Fatal(err)
+	}
+	expTrailer, err := tsi1.ReadIndexFileTrailer(exp.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := a.Layout(M, K, tsi1.CompactOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if l.Size() != int64(exp.Len()) {
+		t.Fatalf("unexpected size: %d, expected %d", l.Size(), exp.Len())
+	}
+	planned := l.Trailer()
+	if planned.SeriesBlock.Offset != expTrailer.SeriesBlock.Offset || planned.SeriesBlock.Size != expTrailer.SeriesBlock.Size {
+		t.Fatalf("unexpected series block layout: %+v", planned.SeriesBlock)
+	} else if planned.TagsetBlock.Offset != expTrailer.TagsetBlock.Offset || planned.TagsetBlock.Size != expTrailer.TagsetBlock.Size {
+		t.Fatalf("unexpected tagset block layout: %+v", planned.TagsetBlock)
+	} else if planned.MeasurementBlock.Offset != expTrailer.MeasurementBlock.Offset || planned.MeasurementBlock.Size != expTrailer.MeasurementBlock.Size {
+		t.Fatalf("unexpected measurement block layout: %+v", planned.MeasurementBlock)
+	}
+
+	w := &bufferAt{buf: make([]byte, l.Size())}
+	if trailer, err := l.CompactTo(context.Background(), w); err != nil {
+		t.Fatal(err)
+	} else if trailer != expTrailer {
+		t.Fatalf("unexpected trailer: %+v, expected %+v", trailer, expTrailer)
+	} else if !bytes.Equal(w.buf, exp.Bytes()) {
+		t.Fatal("unexpected data")
+	}
+}
+
+// Ensure a planned layout pads blocks the same as a sequential compaction.
+func TestIndexFiles_Layout_BlockAlignment(t *testing.T) {
+	a := tsi1.IndexFiles{MustGenerateIndexFile(2, 3, 4), MustGenerateIndexFile(4, 3, 3)}
+	opt := tsi1.CompactOptions{BlockAlignment: 512}
+
+	var exp bytes.Buffer
+	if _, err := a.CompactToWithOptions(context.Background(), &exp, M, K, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := a.Layout(M, K, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Fill the buffer so unwritten padding does not match.
+	w := &bufferAt{buf: bytes.Repeat([]byte{0xff}, int(l.Size()))}
+	if l.Size() != int64(exp.Len()) {
+		t.Fatalf("unexpected size: %d, expected %d", l.Size(), exp.Len())
+	} else if _, err := l.CompactTo(context.Background(), w); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(w.buf, exp.Bytes()) {
+		t.Fatal("unexpected data")
+	}
+}
+
+// bufferAt is a fixed-size in-memory io.WriterAt.
+type bufferAt struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return copy(b.buf[off:], p), nil
+}
@@ -33,6 +33,10 @@ const (
 	LogEntryMeasurementTombstoneFlag = 0x02
 	LogEntryTagKeyTombstoneFlag      = 0x04
 	LogEntryTagValueTombstoneFlag    = 0x08
+
+	// Set on series tombstones which are followed by their deletion time.
+	// Entries written before the flag existed have no time.
+	LogEntryTimeFlag = 0x10
 )
 
 // LogFile represents an on-disk write-ahead log file.
@@ -182,10 +186,16 @@ func (f *LogFile) Level() int { return 0 }
 func (f *LogFile) Filter() *bloom.Filter { return nil }
 
 // Retain adds a reference count to the file.
-func (f *LogFile) Retain() { f.wg.Add(1) }
+func (f *LogFile) Retain() {
+	f.wg.Add(1)
+	trackRetain(f)
+}
 
 // Release removes a reference count from the file.
-func (f *LogFile) Release() { f.wg.Done() }
+func (f *LogFile) Release() {
+	trackRelease(f)
+	f.wg.Done()
+}
 
 // Stat returns size and last modification time of the file.
 func (f *LogFile) Stat() (int64, time.Time) {
@@ -465,7 +475,7 @@ func (f *LogFile) DeleteSeries(name []byte, tags models.Tags) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	e := LogEntry{Flag: LogEntrySeriesTombstoneFlag, Name: name, Tags: tags}
+	e := LogEntry{Flag: LogEntrySeriesTombstoneFlag | LogEntryTimeFlag, Name: name, Tags: tags, Time: time.Now().UnixNano()}
 	if err := f.appendEntry(&e); err != nil {
 		return err
 	}
@@ -639,6 +649,10 @@ func (f *LogFile) execSeriesEntry(e *LogEntry) {
 	// Generate key & series, if not exists.
 	key := AppendSeriesKey(nil, e.Name, e.Tags)
 	serie := mm.createSeriesIfNotExists(key, e.Name, e.Tags, deleted)
+	serie.deletedAt = 0
+	if deleted {
+		serie.deletedAt = e.Time
+	}
 
 	// Save tags.
 	for _, t := range e.Tags {
@@ -757,6 +771,14 @@ func (f *LogFile) MeasurementSeriesIterator(name []byte) SeriesIterator {
 
 // CompactTo compacts the log file and writes it to w.
 func (f *LogFile) CompactTo(w io.Writer, m, k uint64) (n int64, err error) {
+	n, _, err = f.CompactToWithTrailer(w, m, k)
+	return n, err
+}
+
+// CompactToWithTrailer compacts the log file and writes it to w like
+// CompactTo. The trailer written to the file is also returned so callers can
+// report the size of each block.
+func (f *LogFile) CompactToWithTrailer(w io.Writer, m, k uint64) (n int64, t IndexFileTrailer, err error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
@@ -764,60 +786,76 @@ func (f *LogFile) CompactTo(w io.Writer, m, k uint64) (n int64, err error) {
 	bw := bufio.NewWriter(w)
 
 	// Setup compaction offset tracking data.
-	var t IndexFileTrailer
+	t.Version = IndexFileVersion
 	info := newLogFileCompactInfo()
 
 	// Write magic number.
 	if err := writeTo(bw, []byte(FileSignature), &n); err != nil {
-		return n, err
+		return n, t, err
 	}
 
 	// Retreve measurement names in order.
 	names := f.measurementNames()
 
+	// Checksum each block as it is written.
+	cw := newChecksumWriter(bw)
+
 	// Write series list.
 	t.SeriesBlock.Offset = n
-	if err := f.writeSeriesBlockTo(bw, names, m, k, info, &n); err != nil {
-		return n, err
+	if err := f.writeSeriesBlockTo(cw, names, m, k, info, &n); err != nil {
+		return n, t, err
 	}
 	t.SeriesBlock.Size = n - t.SeriesBlock.Offset
+	t.SeriesBlock.Checksum = cw.Sum()
 
 	// Flush buffer & mmap series block.
 	if err := bw.Flush(); err != nil {
-		return n, err
+		return n, t, err
 	}
 
 	// Update series offsets.
 	// NOTE: Pass the raw writer so we can mmap.
 	if err := f.updateSeriesOffsets(w, names, info); err != nil {
-		return n, err
+		return n, t, err
 	}
 
 	// Write tagset blocks in measurement order.
-	if err := f.writeTagsetsTo(bw, names, info, &n); err != nil {
-		return n, err
+	t.TagsetBlock.Offset = n
+	if err := f.writeTagsetsTo(cw, names, info, &n); err != nil {
+		return n, t, err
 	}
+	t.TagsetBlock.Size = n - t.TagsetBlock.Offset
+	t.TagsetBlock.Checksum = cw.Sum()
 
 	// Write measurement block.
 	t.MeasurementBlock.Offset = n
-	if err := f.writeMeasurementBlockTo(bw, names, info, &n); err != nil {
-		return n, err
+	if err := f.writeMeasurementBlockTo(cw, names, info, &n); err != nil {
+		return n, t, err
 	}
 	t.MeasurementBlock.Size = n - t.MeasurementBlock.Offset
+	t.MeasurementBlock.Checksum = cw.Sum()
+
+	// Write tombstone block.
+	t.TombstoneBlock.Offset = n
+	if err := writeTo(cw, info.tombstones, &n); err != nil {
+		return n, t, err
+	}
+	t.TombstoneBlock.Size = n - t.TombstoneBlock.Offset
+	t.TombstoneBlock.Checksum = cw.Sum()
 
 	// Write trailer.
 	nn, err := t.WriteTo(bw)
 	n += nn
 	if err != nil {
-		return n, err
+		return n, t, err
 	}
 
 	// Flush buffer.
 	if err := bw.Flush(); err != nil {
-		return n, err
+		return n, t, err
 	}
 
-	return n, nil
+	return n, t, nil
 }
 
 func (f *LogFile) writeSeriesBlockTo(w io.Writer, names []string, m, k uint64, info *logFileCompactInfo, n *int64) error {
@@ -846,6 +884,11 @@ func (f *LogFile) writeSeriesBlockTo(w io.Writer, names []string, m, k uint64, i
 			if err := enc.Encode(serie.name, serie.tags, serie.deleted); err != nil {
 				return err
 			}
+
+			// Record the deletion time of tombstones, if known.
+			if serie.deleted && serie.deletedAt != 0 {
+				info.tombstones = appendTombstoneEntry(info.tombstones, uint32(enc.Offset()), serie.deletedAt)
+			}
 		}
 	}
 
@@ -861,7 +904,7 @@ func (f *LogFile) writeSeriesBlockTo(w io.Writer, names []string, m, k uint64, i
 
 func (f *LogFile) updateSeriesOffsets(w io.Writer, names []string, info *logFileCompactInfo) error {
 	// Open series block.
-	sblk, data, err := mapIndexFileSeriesBlock(w)
+	sblk, data, err := mapIndexFileSeriesBlock(w, int64(len(FileSignature)))
 	if data != nil {
 		defer mmap.Unmap(data)
 	}
@@ -923,16 +966,21 @@ func (f *LogFile) writeTagsetTo(w io.Writer, name string, info *logFileCompactIn
 			continue
 		}
 
-		// Lookup compaction info.
+		// Lookup compaction info. This may not exist if the key only
+		// contains tombstoned values with no series in this file.
 		tagSetInfo := mmInfo.tagSet[k]
-		assert(tagSetInfo != nil, "tag set info not found")
 
-		// Add each value.
-		for v, value := range tag.tagValues {
-			tagValueInfo := tagSetInfo.tagValues[v]
-			sort.Sort(uint32Slice(tagValueInfo.seriesIDs))
+		// Add each value in sorted order.
+		for _, value := range tag.sortedTagValues() {
+			var seriesIDs []uint32
+			if tagSetInfo != nil {
+				if tagValueInfo := tagSetInfo.tagValues[string(value.name)]; tagValueInfo != nil {
+					seriesIDs = tagValueInfo.seriesIDs
+					sort.Sort(uint32Slice(seriesIDs))
+				}
+			}
 
-			if err := enc.EncodeValue(value.name, value.deleted, tagValueInfo.seriesIDs); err != nil {
+			if err := enc.EncodeValue(value.name, value.deleted, seriesIDs); err != nil {
 				return err
 			}
 		}
@@ -976,6 +1024,9 @@ func (f *LogFile) writeMeasurementBlockTo(w io.Writer, names []string, info *log
 // logFileCompactInfo is a context object to track compaction position info.
 type logFileCompactInfo struct {
 	mms map[string]*logFileMeasurementCompactInfo
+
+	// Tombstone block entries for the series written.
+	tombstones []byte
 }
 
 // newLogFileCompactInfo returns a new instance of logFileCompactInfo.
@@ -1038,10 +1089,10 @@ func (f *LogFile) MergeSeriesSketches(sketch, tsketch estimator.Sketch) error {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	if err := sketch.Merge(f.sSketch); err != nil {
+	if err := mergeSketch(sketch, f.sSketch); err != nil {
 		return err
 	}
-	return tsketch.Merge(f.sTSketch)
+	return mergeSketch(tsketch, f.sTSketch)
 }
 
 // MergeMeasurementsSketches merges the measurement sketches belonging to this
@@ -1052,10 +1103,10 @@ func (f *LogFile) MergeMeasurementsSketches(sketch, tsketch estimator.Sketch) er
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	if err := sketch.Merge(f.mSketch); err != nil {
+	if err := mergeSketch(sketch, f.mSketch); err != nil {
 		return err
 	}
-	return tsketch.Merge(f.mTSketch)
+	return mergeSketch(tsketch, f.mTSketch)
 }
 
 // LogEntry represents a single log entry in the write-ahead log.
@@ -1063,7 +1114,8 @@ type LogEntry struct {
 	Flag     byte        // flag
 	Name     []byte      // measurement name
 	Tags     models.Tags // tagset
-	Checksum uint32      // checksum of flag/name/tags.
+	Time     int64       // deletion time in unix nanoseconds, if LogEntryTimeFlag is set.
+	Checksum uint32      // checksum of flag/name/tags/time.
 	Size     int         // total size of record, in bytes.
 }
 
@@ -1128,6 +1180,15 @@ func (e *LogEntry) UnmarshalBinary(data []byte) error {
 	}
 	e.Tags = tags
 
+	// Parse deletion time.
+	e.Time = 0
+	if e.Flag&LogEntryTimeFlag != 0 {
+		if len(data) < 8 {
+			return io.ErrShortBuffer
+		}
+		e.Time, data = int64(binary.BigEndian.Uint64(data[:8])), data[8:]
+	}
+
 	// Compute checksum.
 	chk := crc32.ChecksumIEEE(orig[:start-len(data)])
 
@@ -1181,6 +1242,12 @@ func appendLogEntry(dst []byte, e *LogEntry) []byte {
 		dst = append(dst, t.Value...)
 	}
 
+	// Append deletion time.
+	if e.Flag&LogEntryTimeFlag != 0 {
+		binary.BigEndian.PutUint64(buf[:8], uint64(e.Time))
+		dst = append(dst, buf[:8]...)
+	}
+
 	// Calculate checksum.
 	e.Checksum = crc32.ChecksumIEEE(dst[start:])
 
@@ -1192,9 +1259,10 @@ func appendLogEntry(dst []byte, e *LogEntry) []byte {
 }
 
 type logSerie struct {
-	name    []byte
-	tags    models.Tags
-	deleted bool
+	name      []byte
+	tags      models.Tags
+	deleted   bool
+	deletedAt int64 // unix nanoseconds, zero if not deleted or unknown
 }
 
 func (s *logSerie) String() string {
@@ -1311,6 +1379,16 @@ func (tk *logTagKey) TagValueIterator() TagValueIterator {
 	return newLogTagValueIterator(a)
 }
 
+// sortedTagValues returns a list of the key's values sorted by name.
+func (tk *logTagKey) sortedTagValues() []logTagValue {
+	a := make([]logTagValue, 0, len(tk.tagValues))
+	for _, v := range tk.tagValues {
+		a = append(a, v)
+	}
+	sort.Sort(logTagValueSlice(a))
+	return a
+}
+
 func (tk *logTagKey) createTagValueIfNotExists(value []byte) logTagValue {
 	tv, ok := tk.tagValues[string(value)]
 	if !ok {
@@ -1403,6 +1481,11 @@ func newLogSeriesIterator(m map[string]*logSerie) *logSeriesIterator {
 	return &itr
 }
 
+// EstimatedCount returns the number of series left, which is exact.
+func (itr *logSeriesIterator) EstimatedCount() (uint64, bool) {
+	return uint64(len(itr.series)), true
+}
+
 // Next returns the next element in the iterator.
 func (itr *logSeriesIterator) Next() (e SeriesElem) {
 	if len(itr.series) == 0 {
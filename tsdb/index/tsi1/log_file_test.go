@@ -147,6 +147,55 @@ func TestLogFile_DeleteMeasurement(t *testing.T) {
 	}
 }
 
+// Ensure the deletion time of a series is replayed & written when compacted.
+func TestLogFile_DeleteSeries_Time(t *testing.T) {
+	f := MustOpenLogFile()
+	defer f.Close()
+
+	east := models.NewTags(map[string]string{"region": "east"})
+	west := models.NewTags(map[string]string{"region": "west"})
+	if err := f.AddSeries([]byte("cpu"), east); err != nil {
+		t.Fatal(err)
+	} else if err := f.AddSeries([]byte("cpu"), west); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	if err := f.DeleteSeries([]byte("cpu"), west); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	// The time is read back from the entry when the log is replayed.
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := CompactLogFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ts, ok := idx.SeriesTombstoneTime([]byte("cpu"), west, nil); !ok {
+		t.Fatal("expected deletion time")
+	} else if ts.Before(before) || ts.After(after) {
+		t.Fatalf("unexpected deletion time: %s, expected between %s & %s", ts, before, after)
+	} else if _, ok := idx.SeriesTombstoneTime([]byte("cpu"), east, nil); ok {
+		t.Fatal("unexpected deletion time for live series")
+	} else if _, ok := idx.SeriesTombstoneTime([]byte("mem"), east, nil); ok {
+		t.Fatal("unexpected deletion time for missing series")
+	}
+
+	// Adding the series again clears the time.
+	if err := f.AddSeries([]byte("cpu"), west); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := CompactLogFile(f); err != nil {
+		t.Fatal(err)
+	} else if _, ok := idx.SeriesTombstoneTime([]byte("cpu"), west, nil); ok {
+		t.Fatal("unexpected deletion time for re-added series")
+	}
+}
+
 // LogFile is a test wrapper for tsi1.LogFile.
 type LogFile struct {
 	*tsi1.LogFile
@@ -190,12 +239,18 @@ func (f *LogFile) Reopen() error {
 }
 
 // CreateLogFile creates a new temporary log file and adds a list of series.
+// Series marked as deleted are added & then tombstoned.
 func CreateLogFile(series []Series) (*LogFile, error) {
 	f := MustOpenLogFile()
 	for _, serie := range series {
 		if err := f.AddSeries(serie.Name, serie.Tags); err != nil {
 			return nil, err
 		}
+		if serie.Deleted {
+			if err := f.DeleteSeries(serie.Name, serie.Tags); err != nil {
+				return nil, err
+			}
+		}
 	}
 	return f, nil
 }
@@ -15,6 +15,11 @@ import (
 // MeasurementBlockVersion is the version of the measurement block.
 const MeasurementBlockVersion = 1
 
+// MeasurementBlockTrieVersion is the version of measurement blocks indexed by
+// a trie, see MeasurementBlockIndexTrie. The index section holds the trie
+// instead of the hash index & the layout is otherwise unchanged.
+const MeasurementBlockTrieVersion = 2
+
 // Measurement flag constants.
 const (
 	MeasurementTombstoneFlag = 0x01
@@ -42,18 +47,26 @@ const (
 var (
 	ErrUnsupportedMeasurementBlockVersion = errors.New("unsupported measurement block version")
 	ErrMeasurementBlockSizeMismatch       = errors.New("measurement block size mismatch")
+	ErrMeasurementSketchNotAvailable      = errors.New("measurement sketch not available")
+	ErrInvalidMeasurementBlock            = errors.New("invalid measurement block")
 )
 
 // MeasurementBlock represents a collection of all measurements in an index.
 type MeasurementBlock struct {
 	data     []byte
 	hashData []byte
+	trie     *measurementTrie // set instead of hashData for trie blocks
 
 	// Series block sketch and tombstone sketch for cardinality estimation.
 	// While we have exact counts for the block, these sketches allow us to
 	// estimate cardinality across multiple blocks (which might contain
 	// duplicate series).
 	sketch, tSketch estimator.Sketch
+	sketchSize      int64 // encoded size of both sketches
+
+	// Offset of the last element in data, found while validating the block.
+	// Zero if the block is empty.
+	lastOffset int
 
 	version int // block version
 }
@@ -64,6 +77,18 @@ func (blk *MeasurementBlock) Version() int { return blk.version }
 
 // Elem returns an element for a measurement.
 func (blk *MeasurementBlock) Elem(name []byte) (e MeasurementBlockElem, ok bool) {
+	if blk.trie != nil {
+		offset, ok := blk.trie.search(name, false)
+		if !ok {
+			return MeasurementBlockElem{}, false
+		}
+		e.UnmarshalBinary(blk.data[offset:])
+		if !bytes.Equal(e.name, name) {
+			return MeasurementBlockElem{}, false
+		}
+		return e, true
+	}
+
 	n := int64(binary.BigEndian.Uint64(blk.hashData[:MeasurementNSize]))
 	hash := rhh.HashKey(name)
 	pos := hash % n
@@ -106,41 +131,174 @@ func (blk *MeasurementBlock) Elem(name []byte) (e MeasurementBlockElem, ok bool)
 
 // UnmarshalBinary unpacks data into the block. Block is not copied so data
 // should be retained and unchanged after being passed into this function.
+//
+// Every section, element & hash index offset is bounds checked so a corrupt
+// block returns ErrInvalidMeasurementBlock rather than panicking when it is
+// read. The tag block & series data of each element are not checked.
 func (blk *MeasurementBlock) UnmarshalBinary(data []byte) error {
 	// Read trailer.
 	t, err := ReadMeasurementBlockTrailer(data)
 	if err != nil {
 		return err
 	}
+	body := data[:len(data)-MeasurementTrailerSize]
+	blk.version = t.Version
 
 	// Save data section.
-	blk.data = data[t.Data.Offset:]
-	blk.data = blk.data[:t.Data.Size]
+	var ok bool
+	if blk.data, ok = blockSection(body, t.Data.Offset, t.Data.Size); !ok || len(blk.data) < MeasurementFillSize {
+		return ErrInvalidMeasurementBlock
+	}
 
-	// Save hash index block.
-	blk.hashData = data[t.HashIndex.Offset:]
-	blk.hashData = blk.hashData[:t.HashIndex.Size]
+	// Save hash index block or trie.
+	index, ok := blockSection(body, t.HashIndex.Offset, t.HashIndex.Size)
+	if !ok {
+		return ErrInvalidMeasurementBlock
+	} else if t.Version == MeasurementBlockTrieVersion {
+		blk.hashData, blk.trie = nil, &measurementTrie{data: index}
+	} else if !validHashIndex(index) {
+		return ErrInvalidMeasurementBlock
+	} else {
+		blk.hashData, blk.trie = index, nil
+	}
+	if err := blk.validate(); err != nil {
+		return err
+	}
+
+	// Sketches are optional. Blocks written without them have empty sketch
+	// sections.
+	if !t.HasSketches() {
+		blk.sketch, blk.tSketch, blk.sketchSize = nil, nil, 0
+		return nil
+	}
 
 	// Initialise sketches. We're currently using HLL+.
+	sketchData, ok := blockSection(body, t.Sketch.Offset, t.Sketch.Size)
+	if !ok {
+		return ErrInvalidMeasurementBlock
+	}
+	tSketchData, ok := blockSection(body, t.TSketch.Offset, t.TSketch.Size)
+	if !ok {
+		return ErrInvalidMeasurementBlock
+	}
+
 	var s, ts = hll.NewDefaultPlus(), hll.NewDefaultPlus()
-	if err := s.UnmarshalBinary(data[t.Sketch.Offset:][:t.Sketch.Size]); err != nil {
+	if err := s.UnmarshalBinary(sketchData); err != nil {
 		return err
 	}
 	blk.sketch = s
 
-	if err := ts.UnmarshalBinary(data[t.TSketch.Offset:][:t.TSketch.Size]); err != nil {
+	if err := ts.UnmarshalBinary(tSketchData); err != nil {
 		return err
 	}
 	blk.tSketch = ts
+	blk.sketchSize = t.Sketch.Size + t.TSketch.Size
 
 	return nil
 }
 
+// validate decodes every element & checks that each hash index offset is
+// empty or the offset of an element, or that each trie reference is valid.
+func (blk *MeasurementBlock) validate() error {
+	var offsets []uint64
+	var e MeasurementBlockElem
+	for offset := MeasurementFillSize; offset < len(blk.data); offset += e.size {
+		if err := e.UnmarshalBinary(blk.data[offset:]); err != nil {
+			return err
+		}
+		offsets = append(offsets, uint64(offset))
+	}
+	blk.lastOffset = 0
+	if len(offsets) > 0 {
+		blk.lastOffset = int(offsets[len(offsets)-1])
+	}
+
+	if blk.trie != nil {
+		if !blk.trie.validate(offsets) {
+			return ErrInvalidMeasurementBlock
+		}
+		return nil
+	}
+
+	for buf := blk.hashData[MeasurementNSize:]; len(buf) > 0; buf = buf[MeasurementOffsetSize:] {
+		offset := binary.BigEndian.Uint64(buf)
+		if offset == 0 {
+			continue
+		}
+		i := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= offset })
+		if i == len(offsets) || offsets[i] != offset {
+			return ErrInvalidMeasurementBlock
+		}
+	}
+	return nil
+}
+
 // Iterator returns an iterator over all measurements.
 func (blk *MeasurementBlock) Iterator() MeasurementIterator {
 	return &blockMeasurementIterator{data: blk.data[MeasurementFillSize:]}
 }
 
+// PrefixIterator returns an iterator over the measurements whose names begin
+// with prefix. A trie indexed block seeks to the first match. Otherwise the
+// block does not index the position of its elements so the elements before
+// the prefix are still scanned, however, they are not returned & iteration
+// stops at the first name past the prefix.
+func (blk *MeasurementBlock) PrefixIterator(prefix []byte) MeasurementIterator {
+	if blk.trie != nil {
+		offset, ok := blk.trie.search(prefix, true)
+		if !ok {
+			return &prefixMeasurementIterator{prefix: prefix}
+		}
+		return &prefixMeasurementIterator{itr: blockMeasurementIterator{data: blk.data[offset:]}, prefix: prefix}
+	}
+
+	data := blk.data[MeasurementFillSize:]
+	var e MeasurementBlockElem
+	for len(data) > 0 {
+		e.UnmarshalBinary(data)
+		if bytes.Compare(e.name, prefix) >= 0 {
+			break
+		}
+		data = data[e.size:]
+	}
+	return &prefixMeasurementIterator{itr: blockMeasurementIterator{data: data}, prefix: prefix}
+}
+
+// maxFoldPrefixVariants is the most cases of a prefix that FoldPrefixIterator
+// seeks to in a trie indexed block.
+const maxFoldPrefixVariants = 16
+
+// FoldPrefixIterator returns an iterator over the measurements whose names
+// begin with prefix, ignoring ASCII case. See FilterFoldMeasurementIterator
+// for how names are folded.
+//
+// A trie indexed block seeks to each case of the prefix. Only the cases of the
+// leading letters are sought if the prefix has too many cases & the names
+// below them are filtered. Otherwise the block is scanned up to the uppercase
+// prefix, which sorts before every other case.
+func (blk *MeasurementBlock) FoldPrefixIterator(prefix []byte) MeasurementIterator {
+	if blk.trie != nil {
+		variants := foldASCIIVariants(prefix, maxFoldPrefixVariants)
+		a := make([]MeasurementIterator, 0, len(variants))
+		for _, v := range variants {
+			a = append(a, blk.PrefixIterator(v))
+		}
+		return FilterFoldMeasurementIterator(MergeMeasurementIterators(a...), prefix, true)
+	}
+
+	upper := upperASCII(prefix)
+	data := blk.data[MeasurementFillSize:]
+	var e MeasurementBlockElem
+	for len(data) > 0 {
+		e.UnmarshalBinary(data)
+		if bytes.Compare(e.name, upper) >= 0 {
+			break
+		}
+		data = data[e.size:]
+	}
+	return FilterFoldMeasurementIterator(&blockMeasurementIterator{data: data}, prefix, true)
+}
+
 // seriesIDIterator returns an iterator for all series ids in a measurement.
 func (blk *MeasurementBlock) seriesIDIterator(name []byte) seriesIDIterator {
 	// Find measurement element.
@@ -151,6 +309,76 @@ func (blk *MeasurementBlock) seriesIDIterator(name []byte) seriesIDIterator {
 	return &rawSeriesIDIterator{n: e.series.n, data: e.series.data}
 }
 
+// first returns the element with the smallest name. Returns false if the block
+// is empty.
+func (blk *MeasurementBlock) first() (e MeasurementBlockElem, ok bool) {
+	if blk.lastOffset == 0 {
+		return e, false
+	}
+	e.UnmarshalBinary(blk.data[MeasurementFillSize:])
+	return e, true
+}
+
+// last returns the element with the largest name without scanning the block.
+// Returns false if the block is empty.
+func (blk *MeasurementBlock) last() (e MeasurementBlockElem, ok bool) {
+	if blk.lastOffset == 0 {
+		return e, false
+	}
+	e.UnmarshalBinary(blk.data[blk.lastOffset:])
+	return e, true
+}
+
+// nameRange returns the first & last measurement names and the number of
+// measurements in the block. Every element is decoded but nothing is
+// allocated.
+func (blk *MeasurementBlock) nameRange() (min, max []byte, n int) {
+	var e MeasurementBlockElem
+	for offset := MeasurementFillSize; offset < len(blk.data); offset += e.size {
+		e.UnmarshalBinary(blk.data[offset:])
+		if n == 0 {
+			min = e.name
+		}
+		max = e.name
+		n++
+	}
+	return min, max, n
+}
+
+// ReverseIterator returns an iterator over all measurements in descending
+// order. The offset of each measurement is read up front, which uses 8 bytes
+// of memory per measurement, and elements are decoded as they are iterated.
+func (blk *MeasurementBlock) ReverseIterator() MeasurementIterator {
+	var offsets []int
+	var e MeasurementBlockElem
+	for offset := MeasurementFillSize; offset < len(blk.data); offset += e.size {
+		e.UnmarshalBinary(blk.data[offset:])
+		offsets = append(offsets, offset)
+	}
+	return &reverseBlockMeasurementIterator{data: blk.data, offsets: offsets}
+}
+
+// reverseBlockMeasurementIterator iterates over the measurements in a block in
+// descending order.
+type reverseBlockMeasurementIterator struct {
+	elem    MeasurementBlockElem
+	data    []byte
+	offsets []int
+}
+
+// Next returns the previous measurement. Returns nil when iterator is complete.
+func (itr *reverseBlockMeasurementIterator) Next() MeasurementElem {
+	if len(itr.offsets) == 0 {
+		return nil
+	}
+
+	// Unmarshal the last remaining element.
+	offset := itr.offsets[len(itr.offsets)-1]
+	itr.offsets = itr.offsets[:len(itr.offsets)-1]
+	itr.elem.UnmarshalBinary(itr.data[offset:])
+	return &itr.elem
+}
+
 // blockMeasurementIterator iterates over a list measurements in a block.
 type blockMeasurementIterator struct {
 	elem MeasurementBlockElem
@@ -173,6 +401,25 @@ func (itr *blockMeasurementIterator) Next() MeasurementElem {
 	return &itr.elem
 }
 
+// prefixMeasurementIterator iterates over measurements in a block until a
+// name does not begin with the prefix.
+type prefixMeasurementIterator struct {
+	itr    blockMeasurementIterator
+	prefix []byte
+}
+
+// Next returns the next measurement. Returns nil when iterator is complete.
+func (itr *prefixMeasurementIterator) Next() MeasurementElem {
+	e := itr.itr.Next()
+	if e == nil {
+		return nil
+	} else if !bytes.HasPrefix(e.Name(), itr.prefix) {
+		itr.itr.data = nil
+		return nil
+	}
+	return e
+}
+
 // rawSeriesIterator iterates over a list of raw series data.
 type rawSeriesIDIterator struct {
 	prev uint32
@@ -188,12 +435,18 @@ func (itr *rawSeriesIDIterator) next() uint32 {
 
 	delta, n := binary.Uvarint(itr.data)
 	itr.data = itr.data[n:]
+	if itr.n > 0 {
+		itr.n--
+	}
 
 	seriesID := itr.prev + uint32(delta)
 	itr.prev = seriesID
 	return seriesID
 }
 
+// remaining returns the number of ids left.
+func (itr *rawSeriesIDIterator) remaining() uint64 { return uint64(itr.n) }
+
 // MeasurementBlockTrailer represents meta data at the end of a MeasurementBlock.
 type MeasurementBlockTrailer struct {
 	Version int // Encoding version
@@ -223,13 +476,25 @@ type MeasurementBlockTrailer struct {
 	}
 }
 
+// heapSize returns the approximate size of the structures decoded from the
+// block data, which are the sketches.
+func (blk *MeasurementBlock) heapSize() int64 { return blk.sketchSize }
+
+// HasSketches returns true if the block contains measurement sketches.
+func (t *MeasurementBlockTrailer) HasSketches() bool {
+	return t.Sketch.Size != 0 || t.TSketch.Size != 0
+}
+
 // ReadMeasurementBlockTrailer returns the block trailer from data.
 func ReadMeasurementBlockTrailer(data []byte) (MeasurementBlockTrailer, error) {
 	var t MeasurementBlockTrailer
+	if len(data) < MeasurementTrailerSize {
+		return t, io.ErrShortBuffer
+	}
 
 	// Read version (which is located in the last two bytes of the trailer).
 	t.Version = int(binary.BigEndian.Uint16(data[len(data)-2:]))
-	if t.Version != MeasurementBlockVersion {
+	if t.Version != MeasurementBlockVersion && t.Version != MeasurementBlockTrieVersion {
 		return t, ErrUnsupportedIndexFileVersion
 	}
 
@@ -285,8 +550,13 @@ func (t *MeasurementBlockTrailer) WriteTo(w io.Writer) (n int64, err error) {
 		return n, err
 	}
 
-	// Write measurement block version.
-	if err := writeUint16To(w, MeasurementBlockVersion, &n); err != nil {
+	// Write measurement block version. Trailers without a version are written
+	// as MeasurementBlockVersion.
+	version := t.Version
+	if version == 0 {
+		version = MeasurementBlockVersion
+	}
+	if err := writeUint16To(w, uint16(version), &n); err != nil {
 		return n, err
 	}
 
@@ -362,21 +632,31 @@ func (e *MeasurementBlockElem) Size() int { return e.size }
 func (e *MeasurementBlockElem) UnmarshalBinary(data []byte) error {
 	start := len(data)
 
-	// Parse flag data.
+	// Parse flag data & tag block offset.
+	if len(data) < 17 {
+		return ErrInvalidMeasurementBlock
+	}
 	e.flag, data = data[0], data[1:]
-
-	// Parse tag block offset.
 	e.tagBlock.offset, data = int64(binary.BigEndian.Uint64(data)), data[8:]
 	e.tagBlock.size, data = int64(binary.BigEndian.Uint64(data)), data[8:]
 
 	// Parse name.
 	sz, n := binary.Uvarint(data)
+	if n <= 0 || sz > uint64(len(data)-n) {
+		return ErrInvalidMeasurementBlock
+	}
 	e.name, data = data[n:n+int(sz)], data[n+int(sz):]
 
 	// Parse series data.
 	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return ErrInvalidMeasurementBlock
+	}
 	e.series.n, data = uint32(v), data[n:]
 	sz, n = binary.Uvarint(data)
+	if n <= 0 || sz > uint64(len(data)-n) {
+		return ErrInvalidMeasurementBlock
+	}
 	data = data[n:]
 	e.series.data, data = data[:sz], data[sz:]
 
@@ -393,6 +673,9 @@ type MeasurementBlockWriter struct {
 
 	// Measurement sketch and tombstoned measurement sketch.
 	sketch, tSketch estimator.Sketch
+	noSketches      bool
+
+	index MeasurementBlockIndex
 }
 
 // NewMeasurementBlockWriter returns a new MeasurementBlockWriter.
@@ -404,6 +687,34 @@ func NewMeasurementBlockWriter() *MeasurementBlockWriter {
 	}
 }
 
+// SetSketchPrecision sets the precision of the measurement sketches. This
+// must be called before any measurements are added. See
+// CompactOptions.SketchPrecision for the accuracy & size tradeoff.
+func (mw *MeasurementBlockWriter) SetSketchPrecision(p uint8) error {
+	if len(mw.mms) > 0 {
+		return errors.New("cannot set sketch precision after measurements are added")
+	}
+
+	sketch, tSketch, err := newSketches(p)
+	if err != nil {
+		return err
+	}
+	mw.sketch, mw.tSketch = sketch, tSketch
+	return nil
+}
+
+// DisableSketches omits the measurement sketches from the block. The sketch
+// sections of the trailer are left empty.
+func (mw *MeasurementBlockWriter) DisableSketches() {
+	mw.sketch, mw.tSketch = nil, nil
+	mw.noSketches = true
+}
+
+// SetIndex sets how measurement names are indexed in the block.
+func (mw *MeasurementBlockWriter) SetIndex(index MeasurementBlockIndex) {
+	mw.index = index
+}
+
 // Add adds a measurement with series and tag set offset/size.
 func (mw *MeasurementBlockWriter) Add(name []byte, deleted bool, offset, size int64, seriesIDs []uint32) {
 	mm := mw.mms[string(name)]
@@ -413,7 +724,9 @@ func (mw *MeasurementBlockWriter) Add(name []byte, deleted bool, offset, size in
 	mm.seriesIDs = seriesIDs
 	mw.mms[string(name)] = mm
 
-	if deleted {
+	if mw.noSketches {
+		return
+	} else if deleted {
 		mw.tSketch.Add(name)
 	} else {
 		mw.sketch.Add(name)
@@ -424,10 +737,10 @@ func (mw *MeasurementBlockWriter) Add(name []byte, deleted bool, offset, size in
 func (mw *MeasurementBlockWriter) WriteTo(w io.Writer) (n int64, err error) {
 	var t MeasurementBlockTrailer
 
-	// The sketches must be set before calling WriteTo.
-	if mw.sketch == nil {
+	// The sketches must be set before calling WriteTo, unless disabled.
+	if !mw.noSketches && mw.sketch == nil {
 		return 0, errors.New("measurement sketch not set")
-	} else if mw.tSketch == nil {
+	} else if !mw.noSketches && mw.tSketch == nil {
 		return 0, errors.New("measurement tombstone sketch not set")
 	}
 
@@ -460,21 +773,58 @@ func (mw *MeasurementBlockWriter) WriteTo(w io.Writer) (n int64, err error) {
 	}
 	t.Data.Size = n - t.Data.Offset
 
+	if mw.index == MeasurementBlockIndexTrie {
+		if err := mw.writeTrieTo(w, names, &t, &n); err != nil {
+			return n, err
+		}
+	} else if err := mw.writeHashIndexTo(w, names, &t, &n); err != nil {
+		return n, err
+	}
+
+	// Write the sketches out.
+	t.Sketch.Offset = n
+	if !mw.noSketches {
+		if err := writeSketchTo(w, mw.sketch, &n); err != nil {
+			return n, err
+		}
+	}
+	t.Sketch.Size = n - t.Sketch.Offset
+
+	t.TSketch.Offset = n
+	if !mw.noSketches {
+		if err := writeSketchTo(w, mw.tSketch, &n); err != nil {
+			return n, err
+		}
+	}
+	t.TSketch.Size = n - t.TSketch.Offset
+
+	// Write trailer.
+	nn, err := t.WriteTo(w)
+	n += nn
+	if err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+// writeHashIndexTo writes a hash index of the sorted names to w.
+func (mw *MeasurementBlockWriter) writeHashIndexTo(w io.Writer, names []string, t *MeasurementBlockTrailer, n *int64) error {
 	// Build key hash map
 	m := rhh.NewHashMap(rhh.Options{
 		Capacity:   int64(len(names)),
 		LoadFactor: LoadFactor,
 	})
-	for name := range mw.mms {
+	for _, name := range names {
 		mm := mw.mms[name]
 		m.Put([]byte(name), &mm)
 	}
 
-	t.HashIndex.Offset = n
+	t.HashIndex.Offset = *n
 
 	// Encode hash map length.
-	if err := writeUint64To(w, uint64(m.Cap()), &n); err != nil {
-		return n, err
+	if err := writeUint64To(w, uint64(m.Cap()), n); err != nil {
+		return err
 	}
 
 	// Encode hash map offset entries.
@@ -486,33 +836,29 @@ func (mw *MeasurementBlockWriter) WriteTo(w io.Writer) (n int64, err error) {
 			offset = mm.offset
 		}
 
-		if err := writeUint64To(w, uint64(offset), &n); err != nil {
-			return n, err
+		if err := writeUint64To(w, uint64(offset), n); err != nil {
+			return err
 		}
 	}
-	t.HashIndex.Size = n - t.HashIndex.Offset
+	t.HashIndex.Size = *n - t.HashIndex.Offset
+	return nil
+}
 
-	// Write the sketches out.
-	t.Sketch.Offset = n
-	if err := writeSketchTo(w, mw.sketch, &n); err != nil {
-		return n, err
+// writeTrieTo writes a trie of the sorted names to w & sets the trailer
+// version.
+func (mw *MeasurementBlockWriter) writeTrieTo(w io.Writer, names []string, t *MeasurementBlockTrailer, n *int64) error {
+	offsets := make([]int64, len(names))
+	for i, name := range names {
+		offsets[i] = mw.mms[name].offset
 	}
-	t.Sketch.Size = n - t.Sketch.Offset
 
-	t.TSketch.Offset = n
-	if err := writeSketchTo(w, mw.tSketch, &n); err != nil {
-		return n, err
-	}
-	t.TSketch.Size = n - t.TSketch.Offset
-
-	// Write trailer.
-	nn, err := t.WriteTo(w)
-	n += nn
-	if err != nil {
-		return n, err
+	t.Version = MeasurementBlockTrieVersion
+	t.HashIndex.Offset = *n
+	if err := writeTo(w, appendMeasurementTrie(nil, names, offsets), n); err != nil {
+		return err
 	}
-
-	return n, nil
+	t.HashIndex.Size = *n - t.HashIndex.Offset
+	return nil
 }
 
 // writeMeasurementTo encodes a single measurement entry into w.
@@ -581,6 +927,52 @@ func writeSketchTo(w io.Writer, s estimator.Sketch, n *int64) error {
 	return err
 }
 
+// mergeSketch merges src into dst. HLL+ sketches of different precisions are
+// merged at the lower of the two precisions, reducing dst in place if needed.
+func mergeSketch(dst, src estimator.Sketch) error {
+	d, ok := dst.(*hll.Plus)
+	if !ok {
+		return dst.Merge(src)
+	}
+	s, ok := src.(*hll.Plus)
+	if !ok || s.Precision() == d.Precision() {
+		return dst.Merge(src)
+	}
+
+	if s.Precision() < d.Precision() {
+		other, err := d.Reduce(s.Precision())
+		if err != nil {
+			return err
+		}
+		*d = *other
+		return d.Merge(s)
+	}
+
+	other, err := s.Reduce(d.Precision())
+	if err != nil {
+		return err
+	}
+	return d.Merge(other)
+}
+
+// newSketches returns a sketch and tombstone sketch with precision p.
+// The default precision is used if p is zero.
+func newSketches(p uint8) (s, t estimator.Sketch, err error) {
+	if p == 0 {
+		return hll.NewDefaultPlus(), hll.NewDefaultPlus(), nil
+	}
+
+	sketch, err := hll.NewPlus(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	tSketch, err := hll.NewPlus(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sketch, tSketch, nil
+}
+
 type measurement struct {
 	deleted  bool
 	tagBlock struct {
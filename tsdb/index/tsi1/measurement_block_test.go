@@ -160,6 +160,283 @@ func TestMeasurementBlockWriter(t *testing.T) {
 	}
 }
 
+// Ensure a block can iterate over the measurements with a prefix.
+func TestMeasurementBlock_PrefixIterator(t *testing.T) {
+	for _, index := range []tsi1.MeasurementBlockIndex{tsi1.MeasurementBlockIndexHash, tsi1.MeasurementBlockIndexTrie} {
+		blk := MustCreateMeasurementBlock(t, []string{"cpu", "cpu_load", "cpuz", "disk", "mem", "cp"}, index)
+
+		for _, tt := range []struct {
+			prefix string
+			exp    []string
+		}{
+			{"cpu", []string{"cpu", "cpu_load", "cpuz"}},
+			{"cpu_", []string{"cpu_load"}},
+			{"c", []string{"cp", "cpu", "cpu_load", "cpuz"}},
+			{"mem", []string{"mem"}},
+			{"n", nil},
+			{"a", nil},
+			{"", []string{"cp", "cpu", "cpu_load", "cpuz", "disk", "mem"}},
+		} {
+			var names []string
+			itr := blk.PrefixIterator([]byte(tt.prefix))
+			for e := itr.Next(); e != nil; e = itr.Next() {
+				names = append(names, string(e.Name()))
+			}
+			if !reflect.DeepEqual(names, tt.exp) {
+				t.Fatalf("%d: unexpected names for %q: %v", index, tt.prefix, names)
+			} else if itr.Next() != nil {
+				t.Fatalf("%d: expected iterator for %q to stay complete", index, tt.prefix)
+			}
+		}
+	}
+}
+
+// Ensure a block can iterate over the measurements with a prefix ignoring
+// ASCII case.
+func TestMeasurementBlock_FoldPrefixIterator(t *testing.T) {
+	names := []string{"CPU", "CPU_Load", "Cpu", "Mem", "cPU_idle", "cafÉ", "café", "cpu", "cpu_load", "cpuz", "cq", "disk", "diskIO", "mem"}
+	for _, index := range []tsi1.MeasurementBlockIndex{tsi1.MeasurementBlockIndexHash, tsi1.MeasurementBlockIndexTrie} {
+		blk := MustCreateMeasurementBlock(t, names, index)
+
+		for _, tt := range []struct {
+			prefix string
+			exp    []string
+		}{
+			{"cpu", []string{"CPU", "CPU_Load", "Cpu", "cPU_idle", "cpu", "cpu_load", "cpuz"}},
+			{"CPU_", []string{"CPU_Load", "cPU_idle", "cpu_load"}},
+			{"cpu_load", []string{"CPU_Load", "cpu_load"}},
+			{"DISKio", []string{"diskIO"}},
+			{"CAFÉ", []string{"cafÉ"}},
+			{"café", []string{"café"}},
+			{"MEM", []string{"Mem", "mem"}},
+			{"n", nil},
+			{"", names},
+		} {
+			itr := blk.FoldPrefixIterator([]byte(tt.prefix))
+			if a := MeasurementBlockNames(itr); !reflect.DeepEqual(a, tt.exp) {
+				t.Fatalf("%d: unexpected names for %q: %q", index, tt.prefix, a)
+			} else if itr.Next() != nil {
+				t.Fatalf("%d: expected iterator for %q to stay complete", index, tt.prefix)
+			}
+		}
+	}
+}
+
+// Ensure a trie indexed block returns the same elements & prefixes as a hash
+// indexed block.
+func TestMeasurementBlock_Trie(t *testing.T) {
+	names := []string{"", "a", "ab", "abc", "abd", "b", "cpu", "cpu_load", "cpu_load_1", "cpu_load_2", "cpuz", "disk", "mem", "mem\xff"}
+	for i := 0; i < 300; i++ {
+		names = append(names, fmt.Sprintf("app.server%d.host%03d", i%3, i))
+	}
+	hash := MustCreateMeasurementBlock(t, names, tsi1.MeasurementBlockIndexHash)
+	trie := MustCreateMeasurementBlock(t, names, tsi1.MeasurementBlockIndexTrie)
+
+	if v := hash.Version(); v != tsi1.MeasurementBlockVersion {
+		t.Fatalf("unexpected hash block version: %d", v)
+	} else if v := trie.Version(); v != tsi1.MeasurementBlockTrieVersion {
+		t.Fatalf("unexpected trie block version: %d", v)
+	}
+
+	// Look up every name & every prefix of every name, which includes names
+	// & prefixes which do not exist.
+	for _, name := range names {
+		for i := 0; i <= len(name)+1; i++ {
+			key := name
+			if i <= len(name) {
+				key = name[:i]
+			} else {
+				key += "x"
+			}
+
+			e0, ok0 := hash.Elem([]byte(key))
+			e1, ok1 := trie.Elem([]byte(key))
+			if ok0 != ok1 || string(e0.Name()) != string(e1.Name()) || e0.TagBlockOffset() != e1.TagBlockOffset() {
+				t.Fatalf("unexpected element for %q: %q/%v", key, e1.Name(), ok1)
+			}
+
+			if a, b := MeasurementBlockNames(hash.PrefixIterator([]byte(key))), MeasurementBlockNames(trie.PrefixIterator([]byte(key))); !reflect.DeepEqual(a, b) {
+				t.Fatalf("unexpected names for prefix %q: %q", key, b)
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(MeasurementBlockNames(hash.Iterator()), MeasurementBlockNames(trie.Iterator())) {
+		t.Fatal("unexpected names")
+	}
+
+	// Empty & single measurement blocks are also indexed.
+	for _, names := range [][]string{nil, {"cpu"}} {
+		blk := MustCreateMeasurementBlock(t, names, tsi1.MeasurementBlockIndexTrie)
+		if _, ok := blk.Elem([]byte("cpu")); ok != (len(names) == 1) {
+			t.Fatalf("unexpected element in %v", names)
+		} else if _, ok := blk.Elem([]byte("cp")); ok {
+			t.Fatalf("unexpected element in %v", names)
+		} else if a := MeasurementBlockNames(blk.PrefixIterator([]byte("c"))); len(a) != len(names) {
+			t.Fatalf("unexpected prefix names in %v: %q", names, a)
+		}
+	}
+}
+
+// Ensure a trie index is smaller than a hash index for names with long shared
+// prefixes.
+func TestMeasurementBlock_Trie_Size(t *testing.T) {
+	names := make([]string, 10000)
+	for i := range names {
+		names[i] = fmt.Sprintf("telegraf.datacenter-%d.rack-%02d.host-%05d.cpu", i/1000, i/100%10, i)
+	}
+
+	var sizes [2]int64
+	for i, index := range []tsi1.MeasurementBlockIndex{tsi1.MeasurementBlockIndexHash, tsi1.MeasurementBlockIndexTrie} {
+		mw := tsi1.NewMeasurementBlockWriter()
+		mw.DisableSketches()
+		mw.SetIndex(index)
+		for _, name := range names {
+			mw.Add([]byte(name), false, 0, 0, nil)
+		}
+
+		var buf bytes.Buffer
+		if _, err := mw.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		tr, err := tsi1.ReadMeasurementBlockTrailer(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = tr.HashIndex.Size
+	}
+
+	t.Logf("index size: hash=%d trie=%d", sizes[0], sizes[1])
+	if sizes[1] >= sizes[0] {
+		t.Fatalf("expected trie to be smaller: hash=%d trie=%d", sizes[0], sizes[1])
+	}
+}
+
+// Ensure a corrupt trie returns an error rather than panicking & that lookups
+// on a decoded block do not panic.
+func TestMeasurementBlock_Trie_Malformed(t *testing.T) {
+	names := []string{"cpu", "cpu_load", "cpuz", "disk", "mem", "mem_free", "net"}
+	mw := tsi1.NewMeasurementBlockWriter()
+	mw.DisableSketches()
+	mw.SetIndex(tsi1.MeasurementBlockIndexTrie)
+	for i, name := range names {
+		mw.Add([]byte(name), false, int64(i), 1, []uint32{uint32(i + 1)})
+	}
+	var buf bytes.Buffer
+	if _, err := mw.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	tr, err := tsi1.ReadMeasurementBlockTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := tr.HashIndex.Offset; i < tr.HashIndex.Offset+tr.HashIndex.Size; i++ {
+		for _, v := range []byte{0x00, 0x01, 0x02, 0x7F, 0x80, 0xFF} {
+			other := append([]byte(nil), data...)
+			other[i] = v
+
+			var blk tsi1.MeasurementBlock
+			if err := blk.UnmarshalBinary(other); err != nil {
+				continue
+			}
+			for _, name := range names {
+				blk.Elem([]byte(name))
+				MeasurementBlockNames(blk.PrefixIterator([]byte(name[:1])))
+			}
+		}
+	}
+}
+
+// BenchmarkMeasurementBlock_PrefixIterator compares seeking to a prefix with
+// a trie against scanning a hash indexed block.
+func BenchmarkMeasurementBlock_PrefixIterator(b *testing.B) {
+	names := make([]string, 100000)
+	for i := range names {
+		names[i] = fmt.Sprintf("telegraf.datacenter-%d.rack-%02d.host-%05d.cpu", i/10000, i/1000%10, i)
+	}
+	prefix := []byte("telegraf.datacenter-7.rack-03.")
+
+	for _, tt := range []struct {
+		name  string
+		index tsi1.MeasurementBlockIndex
+	}{
+		{"Hash", tsi1.MeasurementBlockIndexHash},
+		{"Trie", tsi1.MeasurementBlockIndexTrie},
+	} {
+		blk := MustCreateMeasurementBlock(b, names, tt.index)
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var n int
+				itr := blk.PrefixIterator(prefix)
+				for e := itr.Next(); e != nil; e = itr.Next() {
+					n++
+				}
+				if n != 1000 {
+					b.Fatalf("unexpected count: %d", n)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMeasurementBlock_Elem compares looking up a name with each index.
+func BenchmarkMeasurementBlock_Elem(b *testing.B) {
+	names := make([]string, 100000)
+	for i := range names {
+		names[i] = fmt.Sprintf("telegraf.datacenter-%d.rack-%02d.host-%05d.cpu", i/10000, i/1000%10, i)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		index tsi1.MeasurementBlockIndex
+	}{
+		{"Hash", tsi1.MeasurementBlockIndexHash},
+		{"Trie", tsi1.MeasurementBlockIndexTrie},
+	} {
+		blk := MustCreateMeasurementBlock(b, names, tt.index)
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, ok := blk.Elem([]byte(names[i%len(names)])); !ok {
+					b.Fatal("expected element")
+				}
+			}
+		})
+	}
+}
+
+// MustCreateMeasurementBlock returns a block of the names, each with a single
+// series, indexed with index.
+func MustCreateMeasurementBlock(tb testing.TB, names []string, index tsi1.MeasurementBlockIndex) *tsi1.MeasurementBlock {
+	mw := tsi1.NewMeasurementBlockWriter()
+	mw.SetIndex(index)
+	for i, name := range names {
+		mw.Add([]byte(name), false, int64(i), 1, []uint32{uint32(i + 1)})
+	}
+
+	var buf bytes.Buffer
+	if _, err := mw.WriteTo(&buf); err != nil {
+		tb.Fatal(err)
+	}
+	var blk tsi1.MeasurementBlock
+	if err := blk.UnmarshalBinary(buf.Bytes()); err != nil {
+		tb.Fatal(err)
+	}
+	return &blk
+}
+
+// MeasurementBlockNames returns the names of the iterator.
+func MeasurementBlockNames(itr tsi1.MeasurementIterator) []string {
+	var names []string
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		names = append(names, string(e.Name()))
+	}
+	return names
+}
+
 type Measurements []Measurement
 
 type Measurement struct {
@@ -0,0 +1,306 @@
+package tsi1
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// MeasurementBlockIndex specifies how measurement names are indexed in a
+// measurement block.
+//
+// The index is recorded in the block version so readers look up measurements
+// in any block regardless of the index that was used to write it.
+type MeasurementBlockIndex int
+
+const (
+	// Names are positioned in a robin hood hash index. This is the default.
+	MeasurementBlockIndexHash MeasurementBlockIndex = iota
+
+	// Names are indexed by a radix trie storing only the positions & bytes
+	// where names diverge. Names sharing long prefixes use a fraction of the
+	// space of the hash index & PrefixIterator seeks to the first match
+	// instead of scanning the block. Blocks are written with
+	// MeasurementBlockTrieVersion so older releases cannot read them.
+	MeasurementBlockIndexTrie
+)
+
+// Measurement trie field size constants.
+const (
+	// 1 byte offset for the trie to ensure non-zero node offsets.
+	MeasurementTrieFillSize = 1
+
+	// Reference to the root node, or zero if the block is empty.
+	MeasurementTrieRootSize = 8
+)
+
+// measurementTrie is a radix trie over the names of a measurement block.
+//
+// Nodes are written with children before their parents & the root reference
+// is stored in the last 8 bytes. Each node stores the number of leading bytes
+// shared by every name below it, the offset of the first element below it,
+// delta-encoded against the parent node, and its children sorted by the byte
+// following the shared bytes:
+//
+//	depth <uvarint>
+//	base <uvarint>
+//	child count << 1 | terminal <uvarint>
+//	child... (byte + reference <uvarint>)
+//
+// The terminal bit is set if the first element's name ends at the node. A
+// reference to a single element is its offset relative to the node's base,
+// shifted left with the low bit set. A reference to a child node is its
+// distance before the node, shifted left. Names are not stored in the trie so
+// a lookup decodes the element it finds to confirm the name. Elements are
+// sorted so the elements below a node are contiguous & the base is the
+// smallest name below the node.
+type measurementTrie struct {
+	data []byte
+}
+
+// root returns the root reference.
+func (t *measurementTrie) root() uint64 {
+	return binary.BigEndian.Uint64(t.data[len(t.data)-MeasurementTrieRootSize:])
+}
+
+// search returns the offset of the only element which may be named key. If
+// prefix is true then the offset of the first element which may begin with
+// key is returned instead. The caller must check the name of the element.
+func (t *measurementTrie) search(key []byte, prefix bool) (offset int64, ok bool) {
+	ref := t.root()
+	if ref == 0 {
+		return 0, false
+	} else if ref&1 == 1 {
+		return int64(ref >> 1), true
+	}
+
+	pos, base := int64(ref>>1), int64(0)
+	for {
+		var node measurementTrieNode
+		node.unmarshal(t.data[pos:], base)
+		base = node.base
+
+		if len(key) <= node.depth {
+			if prefix || (len(key) == node.depth && node.terminal) {
+				return base, true
+			}
+			return 0, false
+		}
+
+		ref, ok := node.child(key[node.depth])
+		if !ok {
+			return 0, false
+		} else if ref&1 == 1 {
+			return base + int64(ref>>1), true
+		}
+		pos -= int64(ref >> 1)
+	}
+}
+
+// validate checks that every reference of the trie is within the trie & that
+// every element offset is in offsets, the sorted offsets of the elements.
+func (t *measurementTrie) validate(offsets []uint64) bool {
+	if len(t.data) < MeasurementTrieFillSize+MeasurementTrieRootSize {
+		return false
+	}
+	end := int64(len(t.data) - MeasurementTrieRootSize)
+
+	isElem := func(offset int64) bool {
+		i := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= uint64(offset) })
+		return offset > 0 && i < len(offsets) && offsets[i] == uint64(offset)
+	}
+
+	ref := t.root()
+	if ref == 0 {
+		return len(offsets) == 0
+	} else if ref&1 == 1 {
+		return ref>>1 < 1<<62 && isElem(int64(ref>>1))
+	} else if ref>>1 < MeasurementTrieFillSize || ref>>1 >= uint64(end) {
+		return false
+	}
+
+	// Child nodes are before their parents so every walk terminates, however,
+	// nodes may be shared by a corrupt trie so the number of visits is
+	// limited to the number of bytes.
+	type visit struct {
+		pos, base int64
+		depth     int
+	}
+	stack := []visit{{pos: int64(ref >> 1), depth: -1}}
+	for visitN := int64(0); len(stack) > 0; visitN++ {
+		if visitN > end {
+			return false
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		var node measurementTrieNode
+		if !node.unmarshal(t.data[v.pos:end], v.base) || node.depth <= v.depth || !isElem(node.base) {
+			return false
+		}
+
+		for buf := node.children; len(buf) > 0; {
+			ref, n := binary.Uvarint(buf[1:])
+			if n <= 0 {
+				return false
+			}
+			buf = buf[1+n:]
+
+			if ref&1 == 1 {
+				if ref>>1 >= 1<<62 || !isElem(node.base+int64(ref>>1)) {
+					return false
+				}
+			} else if ref>>1 == 0 || ref>>1 > uint64(v.pos-MeasurementTrieFillSize) {
+				return false
+			} else {
+				stack = append(stack, visit{pos: v.pos - int64(ref>>1), base: node.base, depth: node.depth})
+			}
+		}
+	}
+	return true
+}
+
+// measurementTrieNode is a decoded trie node.
+type measurementTrieNode struct {
+	depth    int
+	base     int64
+	terminal bool
+	children []byte
+}
+
+// unmarshal decodes the node at the start of data with a parent base. Returns
+// false if the node is not within data.
+func (node *measurementTrieNode) unmarshal(data []byte, base int64) bool {
+	depth, n := binary.Uvarint(data)
+	if n <= 0 || depth >= 1<<31 {
+		return false
+	}
+	data = data[n:]
+
+	delta, n := binary.Uvarint(data)
+	if n <= 0 || delta >= 1<<62 {
+		return false
+	}
+	data = data[n:]
+
+	v, n := binary.Uvarint(data)
+	if n <= 0 || v>>1 > uint64(len(data)-n) {
+		return false
+	}
+	data = data[n:]
+
+	node.depth, node.base, node.terminal = int(depth), base+int64(delta), v&1 == 1
+
+	// Find the end of the children, which are at least 2 bytes each.
+	childN, i := int(v>>1), 0
+	for ; childN > 0; childN-- {
+		if i+1 >= len(data) {
+			return false
+		}
+		_, n := binary.Uvarint(data[i+1:])
+		if n <= 0 {
+			return false
+		}
+		i += 1 + n
+	}
+	node.children = data[:i]
+	return true
+}
+
+// child returns the reference of the child for b.
+func (node *measurementTrieNode) child(b byte) (uint64, bool) {
+	for buf := node.children; len(buf) > 0; {
+		ref, n := binary.Uvarint(buf[1:])
+		if buf[0] == b {
+			return ref, true
+		} else if buf[0] > b {
+			return 0, false
+		}
+		buf = buf[1+n:]
+	}
+	return 0, false
+}
+
+// appendMeasurementTrie appends a trie over names, which must be sorted &
+// distinct, to dst. The offset of the element for each name is in offsets.
+func appendMeasurementTrie(dst []byte, names []string, offsets []int64) []byte {
+	start := len(dst)
+	dst = append(dst, 0)
+
+	var root uint64
+	if len(names) > 0 {
+		var pos int64
+		var leaf bool
+		dst, pos, leaf = appendMeasurementTrieNode(dst, start, names, offsets, 0)
+		if leaf {
+			root = uint64(pos)<<1 | 1
+		} else {
+			root = uint64(pos) << 1
+		}
+	}
+
+	var buf [MeasurementTrieRootSize]byte
+	binary.BigEndian.PutUint64(buf[:], root)
+	return append(dst, buf[:]...)
+}
+
+// appendMeasurementTrieNode appends the nodes for names below a node with a
+// parent base. A single name is not written & its element offset is returned
+// with leaf set. Otherwise the position of the node within the trie is
+// returned.
+func appendMeasurementTrieNode(dst []byte, start int, names []string, offsets []int64, parentBase int64) (_ []byte, pos int64, leaf bool) {
+	if len(names) == 1 {
+		return dst, offsets[0], true
+	}
+
+	// Names are sorted so the shared bytes of the first & last are shared by all.
+	first, last := names[0], names[len(names)-1]
+	depth := 0
+	for depth < len(first) && depth < len(last) && first[depth] == last[depth] {
+		depth++
+	}
+	base := offsets[0]
+
+	i, terminal := 0, len(first) == depth
+	if terminal {
+		i++
+	}
+
+	// Write children first so their positions are known.
+	type child struct {
+		b    byte
+		pos  int64
+		leaf bool
+	}
+	var children []child
+	for i < len(names) {
+		b := names[i][depth]
+		j := i + 1
+		for j < len(names) && names[j][depth] == b {
+			j++
+		}
+
+		c := child{b: b}
+		dst, c.pos, c.leaf = appendMeasurementTrieNode(dst, start, names[i:j], offsets[i:j], base)
+		children = append(children, c)
+		i = j
+	}
+
+	pos = int64(len(dst) - start)
+	dst = appendUvarint(dst, uint64(depth))
+	dst = appendUvarint(dst, uint64(base-parentBase))
+	v := uint64(len(children)) << 1
+	if terminal {
+		v |= 1
+	}
+	dst = appendUvarint(dst, v)
+
+	for _, c := range children {
+		dst = append(dst, c.b)
+		if c.leaf {
+			dst = appendUvarint(dst, uint64(c.pos-base)<<1|1)
+		} else {
+			dst = appendUvarint(dst, uint64(pos-c.pos)<<1)
+		}
+	}
+	return dst, pos, false
+}
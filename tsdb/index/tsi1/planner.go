@@ -0,0 +1,167 @@
+package tsi1
+
+// CompactionPlanner decides which index files to compact together.
+type CompactionPlanner interface {
+	// PlanCompaction returns groups of indices into files. Each group should
+	// be compacted into a single file. Indices within a group are contiguous
+	// & in the same order as files so the precedence of newer files is kept.
+	PlanCompaction(files IndexFiles) [][]int
+}
+
+// Default settings used by SizeTieredCompactionPlanner.
+const (
+	DefaultCompactionSizeRatio = 2.0
+	DefaultCompactionMinFiles  = 2
+	DefaultCompactionMaxFiles  = 8
+)
+
+// SizeTieredCompactionPlanner groups adjacent files of a similar size. A group
+// is only planned if the size of its largest file is within SizeRatio of its
+// smallest file. The zero value uses the default settings.
+type SizeTieredCompactionPlanner struct {
+	// Maximum ratio of the largest to the smallest file in a group.
+	// Defaults to DefaultCompactionSizeRatio if less than one.
+	SizeRatio float64
+
+	// Minimum & maximum number of files in a group.
+	// Defaults to DefaultCompactionMinFiles & DefaultCompactionMaxFiles if
+	// less than two.
+	MinFiles int
+	MaxFiles int
+}
+
+// PlanCompaction groups files using the size of each file's data.
+func (p *SizeTieredCompactionPlanner) PlanCompaction(files IndexFiles) [][]int {
+	sizes := make([]int64, len(files))
+	for i, f := range files {
+		sizes[i] = f.Size()
+	}
+	return p.PlanSizes(sizes)
+}
+
+// PlanSizes groups files by their sizes, such as those reported by Stat.
+//
+// Files are scanned in order and each group is extended with the next file
+// until the size ratio or maximum group size is exceeded. Groups smaller than
+// the minimum are not planned and scanning resumes at the following file.
+func (p *SizeTieredCompactionPlanner) PlanSizes(sizes []int64) [][]int {
+	ratio, minN, maxN := p.sizeRatio(), p.minFiles(), p.maxFiles()
+
+	var groups [][]int
+	for i := 0; i < len(sizes); {
+		lo, hi := sizes[i], sizes[i]
+		j := i + 1
+		for ; j < len(sizes) && j-i < maxN; j++ {
+			l, h := lo, hi
+			if sizes[j] < l {
+				l = sizes[j]
+			}
+			if sizes[j] > h {
+				h = sizes[j]
+			}
+			if float64(h) > ratio*float64(l) {
+				break
+			}
+			lo, hi = l, h
+		}
+
+		if j-i < minN {
+			i++
+			continue
+		}
+
+		group := make([]int, 0, j-i)
+		for ; i < j; i++ {
+			group = append(group, i)
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func (p *SizeTieredCompactionPlanner) sizeRatio() float64 {
+	if p.SizeRatio < 1 {
+		return DefaultCompactionSizeRatio
+	}
+	return p.SizeRatio
+}
+
+func (p *SizeTieredCompactionPlanner) minFiles() int {
+	if p.MinFiles < 2 {
+		return DefaultCompactionMinFiles
+	}
+	return p.MinFiles
+}
+
+func (p *SizeTieredCompactionPlanner) maxFiles() int {
+	if p.MaxFiles < 2 {
+		return DefaultCompactionMaxFiles
+	} else if p.MaxFiles < p.minFiles() {
+		return p.minFiles()
+	}
+	return p.MaxFiles
+}
+
+// Default settings used by CompactionThresholds.
+const (
+	DefaultCompactionThresholdMaxFiles       = 8
+	DefaultCompactionThresholdSizeRatio      = 0.5
+	DefaultCompactionThresholdTombstoneRatio = 0.25
+)
+
+// CompactionThresholds determines when a set of index files is worth
+// compacting. A set needs compaction once any threshold is reached. The zero
+// value uses the default settings.
+type CompactionThresholds struct {
+	// Number of files at which a set is compacted.
+	// Defaults to DefaultCompactionThresholdMaxFiles if less than two.
+	MaxFiles int
+
+	// Ratio of the largest file size to the total size at or below which a
+	// set of two or more files is compacted. A low ratio means no single file
+	// holds most of the data so merging the files is cheap relative to the
+	// files it removes. Defaults to DefaultCompactionThresholdSizeRatio if not
+	// between zero & one.
+	SizeRatio float64
+
+	// Ratio of tombstoned series to all series at or above which a set is
+	// compacted so the tombstones can be dropped. Defaults to
+	// DefaultCompactionThresholdTombstoneRatio if not greater than zero.
+	TombstoneRatio float64
+}
+
+// Reached returns true if a set of fileN files with the given total & largest
+// file sizes, such as those reported by Stat, and series counts reaches any of
+// the thresholds. seriesN is the number of live series & tombstoneN the number
+// of tombstoned series across all files.
+func (t CompactionThresholds) Reached(fileN int, maxSize, size int64, seriesN, tombstoneN uint64) bool {
+	if fileN >= t.maxFiles() {
+		return true
+	} else if fileN >= 2 && size > 0 && float64(maxSize)/float64(size) <= t.sizeRatio() {
+		return true
+	} else if total := seriesN + tombstoneN; total > 0 && float64(tombstoneN)/float64(total) >= t.tombstoneRatio() {
+		return true
+	}
+	return false
+}
+
+func (t CompactionThresholds) maxFiles() int {
+	if t.MaxFiles < 2 {
+		return DefaultCompactionThresholdMaxFiles
+	}
+	return t.MaxFiles
+}
+
+func (t CompactionThresholds) sizeRatio() float64 {
+	if t.SizeRatio <= 0 || t.SizeRatio > 1 {
+		return DefaultCompactionThresholdSizeRatio
+	}
+	return t.SizeRatio
+}
+
+func (t CompactionThresholds) tombstoneRatio() float64 {
+	if t.TombstoneRatio <= 0 {
+		return DefaultCompactionThresholdTombstoneRatio
+	}
+	return t.TombstoneRatio
+}
@@ -0,0 +1,131 @@
+package tsi1_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure files of a similar size are grouped together.
+func TestSizeTieredCompactionPlanner_PlanSizes(t *testing.T) {
+	for i, tt := range []struct {
+		planner tsi1.SizeTieredCompactionPlanner
+		sizes   []int64
+		exp     [][]int
+	}{
+		// Nothing to compact.
+		{sizes: nil, exp: nil},
+		{sizes: []int64{100}, exp: nil},
+
+		// Similar sizes are grouped & large files are left alone.
+		{sizes: []int64{10, 12, 15, 1000}, exp: [][]int{{0, 1, 2}}},
+		{sizes: []int64{1000, 10, 12}, exp: [][]int{{1, 2}}},
+		{sizes: []int64{10, 100, 1000}, exp: nil},
+
+		// Separate tiers form separate groups.
+		{sizes: []int64{10, 11, 100, 110, 120}, exp: [][]int{{0, 1}, {2, 3, 4}}},
+
+		// Ratio is measured against the whole group, not the previous file.
+		{sizes: []int64{10, 15, 22}, exp: [][]int{{0, 1}}},
+		{planner: tsi1.SizeTieredCompactionPlanner{SizeRatio: 3}, sizes: []int64{10, 15, 22}, exp: [][]int{{0, 1, 2}}},
+
+		// Group sizes are limited.
+		{planner: tsi1.SizeTieredCompactionPlanner{MaxFiles: 2}, sizes: []int64{10, 10, 10, 10, 10}, exp: [][]int{{0, 1}, {2, 3}}},
+		{planner: tsi1.SizeTieredCompactionPlanner{MinFiles: 3}, sizes: []int64{10, 10, 100, 100, 100}, exp: [][]int{{2, 3, 4}}},
+	} {
+		if groups := tt.planner.PlanSizes(tt.sizes); !reflect.DeepEqual(groups, tt.exp) {
+			t.Errorf("%d. unexpected groups: %v", i, groups)
+		}
+	}
+}
+
+// Ensure index files are planned using their data size.
+func TestSizeTieredCompactionPlanner_PlanCompaction(t *testing.T) {
+	var files tsi1.IndexFiles
+	for _, n := range []int{1, 1, 1000} {
+		f, err := GenerateIndexFile(n, 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	var planner tsi1.CompactionPlanner = &tsi1.SizeTieredCompactionPlanner{}
+	if groups := planner.PlanCompaction(files); !reflect.DeepEqual(groups, [][]int{{0, 1}}) {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+}
+
+// Ensure compaction is needed once any threshold is reached.
+func TestCompactionThresholds_Reached(t *testing.T) {
+	for i, tt := range []struct {
+		thresholds         tsi1.CompactionThresholds
+		fileN              int
+		maxSize, size      int64
+		seriesN, tombstone uint64
+		exp                bool
+	}{
+		// Nothing to compact.
+		{fileN: 0, exp: false},
+		{fileN: 1, maxSize: 100, size: 100, seriesN: 10, exp: false},
+
+		// File count.
+		{fileN: 7, maxSize: 700, size: 1000, exp: false},
+		{fileN: 8, maxSize: 700, size: 1000, exp: true},
+		{thresholds: tsi1.CompactionThresholds{MaxFiles: 3}, fileN: 3, maxSize: 900, size: 1000, exp: true},
+
+		// Size ratio is inclusive & ignored for a single file.
+		{fileN: 2, maxSize: 51, size: 100, exp: false},
+		{fileN: 2, maxSize: 50, size: 100, exp: true},
+		{thresholds: tsi1.CompactionThresholds{SizeRatio: 0.9}, fileN: 2, maxSize: 90, size: 100, exp: true},
+		{thresholds: tsi1.CompactionThresholds{SizeRatio: 0.1}, fileN: 1, maxSize: 100, size: 100, exp: false},
+
+		// Tombstone ratio is inclusive & applies to a single file.
+		{fileN: 1, maxSize: 100, size: 100, seriesN: 76, tombstone: 24, exp: false},
+		{fileN: 1, maxSize: 100, size: 100, seriesN: 75, tombstone: 25, exp: true},
+		{thresholds: tsi1.CompactionThresholds{TombstoneRatio: 0.5}, fileN: 1, maxSize: 100, size: 100, seriesN: 75, tombstone: 25, exp: false},
+	} {
+		if v := tt.thresholds.Reached(tt.fileN, tt.maxSize, tt.size, tt.seriesN, tt.tombstone); v != tt.exp {
+			t.Errorf("%d. unexpected result: %v", i, v)
+		}
+	}
+}
+
+// Ensure index files need compaction based on their sizes & tombstones.
+func TestIndexFiles_NeedsCompaction(t *testing.T) {
+	small, err := GenerateIndexFile(1, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := GenerateIndexFile(100, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if (tsi1.IndexFiles{large}).NeedsCompaction(tsi1.CompactionThresholds{}) {
+		t.Fatal("expected single file to not need compaction")
+	} else if (tsi1.IndexFiles{small, large}).NeedsCompaction(tsi1.CompactionThresholds{}) {
+		t.Fatal("expected dominant file to not need compaction")
+	} else if !(tsi1.IndexFiles{large, large}).NeedsCompaction(tsi1.CompactionThresholds{}) {
+		t.Fatal("expected similar files to need compaction")
+	}
+
+	// A file with mostly tombstoned series needs compaction.
+	lf, err := CreateLogFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "east"})); err != nil {
+		t.Fatal(err)
+	}
+	f, err := CompactLogFile(lf)
+	if err != nil {
+		t.Fatal(err)
+	} else if !(tsi1.IndexFiles{f}).NeedsCompaction(tsi1.CompactionThresholds{}) {
+		t.Fatal("expected tombstoned file to need compaction")
+	}
+}
@@ -0,0 +1,79 @@
+package tsi1
+
+import (
+	"io"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// TombstoneSet lists the deletions applied by RebuildIndexFile on top of the
+// recovered series.
+type TombstoneSet struct {
+	Series       []SeriesTombstone
+	Measurements [][]byte
+	TagKeys      []TagTombstone // Value is ignored
+	TagValues    []TagTombstone
+}
+
+// SeriesTombstone is the deletion of a single series. A zero DeletedAt means
+// the time of the deletion is unknown.
+type SeriesTombstone struct {
+	Name      []byte
+	Tags      models.Tags
+	DeletedAt time.Time
+}
+
+// TagTombstone is the deletion of a tag key or tag value of a measurement.
+type TagTombstone struct {
+	Name  []byte
+	Key   []byte
+	Value []byte
+}
+
+// RebuildIndexFile writes a new index file to w from recovery inputs, such as
+// when an index file is corrupt but the series it held can still be listed from
+// the series data. Every series from the iterator is added, or tombstoned if
+// the element is deleted, then the tombstones are applied. The blocks are
+// built in memory & written the same way a log file is compacted, so w must be
+// a *bytes.Buffer or *os.File, and m & k set the bloom filter of the series
+// block. Returns the number of bytes written.
+//
+// Series tombstones with a DeletedAt time are recorded in the tombstone block
+// so they are retained by compactions with a TombstoneRetention. A deleted
+// measurement drops all of its series, including those tombstoned.
+func RebuildIndexFile(series SeriesIterator, tombstones TombstoneSet, w io.Writer, m, k uint64) (n int64, err error) {
+	f := NewLogFile("")
+	for e := nextSeriesElem(series); e != nil; e = series.Next() {
+		le := LogEntry{Name: []byte(string(e.Name())), Tags: e.Tags().Clone()}
+		if e.Deleted() {
+			le.Flag = LogEntrySeriesTombstoneFlag
+		}
+		f.execEntry(&le)
+	}
+	if err := SeriesIteratorErr(series); err != nil {
+		return 0, err
+	}
+
+	// Apply tombstones from the finest to the coarsest so a deleted tag key or
+	// measurement is not recreated by a finer tombstone.
+	for _, t := range tombstones.Series {
+		e := LogEntry{Flag: LogEntrySeriesTombstoneFlag, Name: t.Name, Tags: t.Tags}
+		if !t.DeletedAt.IsZero() {
+			e.Flag |= LogEntryTimeFlag
+			e.Time = t.DeletedAt.UnixNano()
+		}
+		f.execEntry(&e)
+	}
+	for _, t := range tombstones.TagValues {
+		f.execEntry(&LogEntry{Flag: LogEntryTagValueTombstoneFlag, Name: t.Name, Tags: models.Tags{{Key: t.Key, Value: t.Value}}})
+	}
+	for _, t := range tombstones.TagKeys {
+		f.execEntry(&LogEntry{Flag: LogEntryTagKeyTombstoneFlag, Name: t.Name, Tags: models.Tags{{Key: t.Key}}})
+	}
+	for _, name := range tombstones.Measurements {
+		f.execEntry(&LogEntry{Flag: LogEntryMeasurementTombstoneFlag, Name: name})
+	}
+
+	return f.CompactTo(w, m, k)
+}
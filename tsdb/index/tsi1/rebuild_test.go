@@ -0,0 +1,126 @@
+package tsi1_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure a corrupt index file can be rebuilt from its series & tombstones.
+func TestRebuildIndexFile(t *testing.T) {
+	series := []Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"host": "a", "region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"}), Deleted: true},
+	}
+
+	// Build the original file with a series, tag value & tag key tombstone.
+	lf, err := CreateLogFile(series)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteTagValue([]byte("cpu"), []byte("region"), []byte("west")); err != nil {
+		t.Fatal(err)
+	} else if err := lf.DeleteTagKey([]byte("disk"), []byte("host")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := lf.CompactTo(&buf, M, K); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	var orig tsi1.IndexFile
+	if err := orig.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	deletedAt, ok := orig.SeriesTombstoneTime(series[3].Name, series[3].Tags, nil)
+	if !ok {
+		t.Fatal("expected tombstone time")
+	}
+
+	// Corrupt the series block. The file fails to open or to verify.
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[trailer.SeriesBlock.Offset+trailer.SeriesBlock.Size/2] ^= 0xFF
+	var bad tsi1.IndexFile
+	if err := bad.UnmarshalBinary(corrupt); err == nil && bad.VerifyChecksums() == nil {
+		t.Fatal("expected corrupt file")
+	}
+
+	// Rebuild from the raw series & the tombstones.
+	itr := &SeriesIterator{}
+	for _, s := range series {
+		itr.Elems = append(itr.Elems, SeriesElem{name: s.Name, tags: s.Tags})
+	}
+	tombstones := tsi1.TombstoneSet{
+		Series:    []tsi1.SeriesTombstone{{Name: series[3].Name, Tags: series[3].Tags, DeletedAt: deletedAt}},
+		TagKeys:   []tsi1.TagTombstone{{Name: []byte("disk"), Key: []byte("host")}},
+		TagValues: []tsi1.TagTombstone{{Name: []byte("cpu"), Key: []byte("region"), Value: []byte("west")}},
+	}
+
+	var rebuilt bytes.Buffer
+	if n, err := tsi1.RebuildIndexFile(itr, tombstones, &rebuilt, M, K); err != nil {
+		t.Fatal(err)
+	} else if n != int64(rebuilt.Len()) {
+		t.Fatalf("unexpected bytes written: %d", n)
+	} else if !bytes.Equal(rebuilt.Bytes(), data) {
+		t.Fatal("rebuilt file does not match original")
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(rebuilt.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if err := f.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	} else if exists, tombstoned := f.HasSeries(series[3].Name, series[3].Tags, nil); !exists || !tombstoned {
+		t.Fatalf("unexpected series state: exists=%v, tombstoned=%v", exists, tombstoned)
+	} else if v, ok := f.SeriesTombstoneTime(series[3].Name, series[3].Tags, nil); !ok || !v.Equal(deletedAt) {
+		t.Fatalf("unexpected tombstone time: %v", v)
+	}
+}
+
+// Ensure deleted elements & measurement tombstones are applied on rebuild.
+func TestRebuildIndexFile_Deletes(t *testing.T) {
+	itr := &SeriesIterator{Elems: []SeriesElem{
+		{name: []byte("cpu"), tags: models.NewTags(map[string]string{"region": "east"})},
+		{name: []byte("cpu"), tags: models.NewTags(map[string]string{"region": "west"}), deleted: true},
+		{name: []byte("mem"), tags: models.NewTags(map[string]string{"region": "east"})},
+	}}
+
+	var buf bytes.Buffer
+	if _, err := tsi1.RebuildIndexFile(itr, tsi1.TombstoneSet{Measurements: [][]byte{[]byte("mem")}}, &buf, M, K); err != nil {
+		t.Fatal(err)
+	}
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if exists, tombstoned := f.HasSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "east"}), nil); !exists || tombstoned {
+		t.Fatalf("unexpected series state: exists=%v, tombstoned=%v", exists, tombstoned)
+	} else if exists, tombstoned := f.HasSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "west"}), nil); !exists || !tombstoned {
+		t.Fatalf("unexpected series state: exists=%v, tombstoned=%v", exists, tombstoned)
+	} else if _, ok := f.SeriesTombstoneTime([]byte("cpu"), models.NewTags(map[string]string{"region": "west"}), nil); ok {
+		t.Fatal("expected unknown tombstone time")
+	} else if exists, _ := f.HasSeries([]byte("mem"), models.NewTags(map[string]string{"region": "east"}), nil); exists {
+		t.Fatal("expected no series")
+	} else if e := f.Measurement([]byte("mem")); e == nil || !e.Deleted() {
+		t.Fatal("expected deleted measurement")
+	}
+
+	// Iterator errors are returned before anything is written.
+	failure := errors.New("marker")
+	fitr := &FailingSeriesIterator{Failure: failure}
+	buf.Reset()
+	if _, err := tsi1.RebuildIndexFile(fitr, tsi1.TombstoneSet{}, &buf, M, K); err != failure {
+		t.Fatalf("unexpected error: %v", err)
+	} else if buf.Len() != 0 {
+		t.Fatalf("unexpected bytes written: %d", buf.Len())
+	}
+}
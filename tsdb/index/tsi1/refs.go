@@ -0,0 +1,15 @@
+// +build !tsi1debug
+
+package tsi1
+
+// trackRetain records the caller retaining f. It only records references when
+// built with the tsi1debug tag.
+func trackRetain(f File) {}
+
+// trackRelease removes the most recently recorded reference to f.
+func trackRelease(f File) {}
+
+// ReferenceLeaks returns the files with outstanding references along with the
+// stacks which retained them. It always returns nil unless built with the
+// tsi1debug tag.
+func ReferenceLeaks() []ReferenceLeak { return nil }
@@ -0,0 +1,75 @@
+// +build tsi1debug
+
+package tsi1
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// refs holds the stacks retaining each file with outstanding references.
+var refs = struct {
+	mu    sync.Mutex
+	files map[File][]string
+}{files: make(map[File][]string)}
+
+// trackRetain records the caller retaining f.
+func trackRetain(f File) {
+	stack := callerStack(3)
+
+	refs.mu.Lock()
+	refs.files[f] = append(refs.files[f], stack)
+	refs.mu.Unlock()
+}
+
+// trackRelease removes the most recently recorded reference to f.
+func trackRelease(f File) {
+	refs.mu.Lock()
+	defer refs.mu.Unlock()
+
+	if a := refs.files[f]; len(a) > 1 {
+		refs.files[f] = a[:len(a)-1]
+	} else {
+		delete(refs.files, f)
+	}
+}
+
+// ReferenceLeaks returns the files with outstanding references along with the
+// stacks which retained them, sorted by path.
+func ReferenceLeaks() []ReferenceLeak {
+	refs.mu.Lock()
+	defer refs.mu.Unlock()
+
+	a := make([]ReferenceLeak, 0, len(refs.files))
+	for f, stacks := range refs.files {
+		a = append(a, ReferenceLeak{Path: f.Path(), Stacks: append([]string(nil), stacks...)})
+	}
+	sort.Sort(referenceLeaks(a))
+	return a
+}
+
+// callerStack returns a formatted stack trace, skipping skip frames.
+func callerStack(skip int) string {
+	var pcs [32]uintptr
+	n := runtime.Callers(skip, pcs[:])
+
+	var buf bytes.Buffer
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&buf, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return buf.String()
+}
+
+type referenceLeaks []ReferenceLeak
+
+func (a referenceLeaks) Len() int           { return len(a) }
+func (a referenceLeaks) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a referenceLeaks) Less(i, j int) bool { return a[i].Path < a[j].Path }
@@ -0,0 +1,40 @@
+// +build tsi1debug
+
+package tsi1_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure outstanding references are reported with their acquiring stacks.
+func TestReferenceLeaks(t *testing.T) {
+	f := tsi1.NewIndexFile()
+	f.SetPath("leak.tsi")
+
+	leaks := func() []tsi1.ReferenceLeak {
+		var a []tsi1.ReferenceLeak
+		for _, leak := range tsi1.ReferenceLeaks() {
+			if leak.Path == f.Path() {
+				a = append(a, leak)
+			}
+		}
+		return a
+	}
+
+	f.Retain()
+	tsi1.IndexFiles{f}.Retain()
+	f.Release()
+	if a := leaks(); len(a) != 1 || len(a[0].Stacks) != 1 {
+		t.Fatalf("unexpected leaks: %#v", a)
+	} else if !strings.Contains(a[0].Stacks[0], "TestReferenceLeaks") {
+		t.Fatalf("unexpected stack: %s", a[0].Stacks[0])
+	}
+
+	f.Release()
+	if a := leaks(); len(a) != 0 {
+		t.Fatalf("unexpected leaks: %#v", a)
+	}
+}
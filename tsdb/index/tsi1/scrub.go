@@ -0,0 +1,191 @@
+package tsi1
+
+import (
+	"context"
+	"hash/crc32"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/pkg/limiter"
+	"github.com/uber-go/zap"
+)
+
+// ScrubChunkSize is the maximum number of bytes checksummed between checks
+// for cancellation & waits for the rate limiter.
+const ScrubChunkSize = 64 * 1024
+
+// Scrub statistic names.
+const (
+	statScrubRuns       = "scrubRuns"
+	statScrubFiles      = "scrubFiles"
+	statScrubBytes      = "scrubBytes"
+	statScrubMismatches = "scrubMismatches"
+	statScrubErrors     = "scrubErrors"
+)
+
+// ScrubStatistics holds the counters of the background scrubber.
+type ScrubStatistics struct {
+	Runs       int64 // completed passes over the index files
+	Files      int64 // files scrubbed without a mismatch
+	Bytes      int64 // bytes checksummed
+	Mismatches int64 // files with a block checksum mismatch
+	Errors     int64 // files which could not be scrubbed
+}
+
+// Scrub reads every block of the file, recomputes its checksum and compares
+// it to the checksum stored in the trailer. It is the same check as
+// VerifyChecksums but is intended for a low-priority background goroutine:
+// the blocks are read in chunks of ScrubChunkSize and ctx is checked between
+// chunks. Returns *ErrChecksumMismatch for the first block that differs.
+// Unverified files always return nil.
+//
+// The file is immutable so no locks are held. The caller must hold a
+// reference to the file until Scrub returns.
+func (f *IndexFile) Scrub(ctx context.Context) error {
+	_, err := f.scrub(ctx, nil)
+	return err
+}
+
+// ScrubWithRateLimiter scrubs the file like Scrub but waits for a token from
+// r for each byte read. A limiter may be shared by the scrubbers of several
+// indexes to limit their combined rate.
+func (f *IndexFile) ScrubWithRateLimiter(ctx context.Context, r *limiter.Rate) error {
+	_, err := f.scrub(ctx, r)
+	return err
+}
+
+// scrub scrubs the file & returns the number of bytes checksummed.
+func (f *IndexFile) scrub(ctx context.Context, r *limiter.Rate) (n int64, err error) {
+	blks, err := f.checksummedBlocks()
+	if err != nil {
+		return 0, err
+	}
+
+	// Limit the chunks to the burst so a single wait is never too long.
+	chunkSize := ScrubChunkSize
+	if r != nil && r.Burst() > 0 && r.Burst() < chunkSize {
+		chunkSize = r.Burst()
+	}
+
+	for _, blk := range blks {
+		var checksum uint32
+		for data := blk.data; len(data) > 0; {
+			chunk := data
+			if len(chunk) > chunkSize {
+				chunk = chunk[:chunkSize]
+			}
+
+			if r != nil {
+				if err := r.WaitN(ctx, len(chunk)); err != nil {
+					return n, err
+				}
+			} else if err := ctx.Err(); err != nil {
+				return n, err
+			}
+
+			checksum = crc32.Update(checksum, crc32.IEEETable, chunk)
+			n += int64(len(chunk))
+			data = data[len(chunk):]
+		}
+
+		if checksum != blk.checksum {
+			return n, &ErrChecksumMismatch{Path: f.path, Block: blk.name, Expected: blk.checksum, Actual: checksum}
+		}
+	}
+	return n, nil
+}
+
+// Scrub scrubs every index file in the index once. Scrubbing continues after
+// a checksum mismatch so every corrupt file is logged & counted. Returns the
+// first error, or ctx.Err() if ctx is done before every file is scrubbed.
+//
+// The file set is retained while scrubbing so compactions & queries are not
+// blocked. Files compacted during the scrub are scrubbed before they are
+// removed.
+func (i *Index) Scrub(ctx context.Context) error {
+	fs := i.RetainFileSet()
+	defer fs.Release()
+
+	var firstErr error
+	for _, f := range fs.IndexFiles() {
+		n, err := f.scrub(ctx, i.ScrubRateLimiter)
+		atomic.AddInt64(&i.scrubStats.Bytes, n)
+
+		if err == nil {
+			atomic.AddInt64(&i.scrubStats.Files, 1)
+			continue
+		} else if err == ctx.Err() {
+			return err
+		}
+
+		if _, ok := err.(*ErrChecksumMismatch); ok {
+			atomic.AddInt64(&i.scrubStats.Mismatches, 1)
+		} else {
+			atomic.AddInt64(&i.scrubStats.Errors, 1)
+		}
+		i.logger.Error("index file scrub failed", zap.String("path", f.Path()), zap.Error(err))
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	atomic.AddInt64(&i.scrubStats.Runs, 1)
+	return firstErr
+}
+
+// runScrubber scrubs the index every interval until the index is closed.
+func (i *Index) runScrubber(interval time.Duration) {
+	defer i.scrubWG.Done()
+
+	// Stop scrubbing, including waits for the rate limiter, if the index is
+	// closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-i.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.closing:
+			return
+		case <-ticker.C:
+			i.Scrub(ctx)
+		}
+	}
+}
+
+// ScrubStatistics returns a copy of the scrubber counters.
+func (i *Index) ScrubStatistics() ScrubStatistics {
+	return ScrubStatistics{
+		Runs:       atomic.LoadInt64(&i.scrubStats.Runs),
+		Files:      atomic.LoadInt64(&i.scrubStats.Files),
+		Bytes:      atomic.LoadInt64(&i.scrubStats.Bytes),
+		Mismatches: atomic.LoadInt64(&i.scrubStats.Mismatches),
+		Errors:     atomic.LoadInt64(&i.scrubStats.Errors),
+	}
+}
+
+// Statistics returns statistics for periodic monitoring.
+func (i *Index) Statistics(tags map[string]string) []models.Statistic {
+	stats := i.ScrubStatistics()
+	return []models.Statistic{{
+		Name: "tsi1_scrub",
+		Tags: models.StatisticTags{"path": i.Path}.Merge(tags),
+		Values: map[string]interface{}{
+			statScrubRuns:       stats.Runs,
+			statScrubFiles:      stats.Files,
+			statScrubBytes:      stats.Bytes,
+			statScrubMismatches: stats.Mismatches,
+			statScrubErrors:     stats.Errors,
+		},
+	}}
+}
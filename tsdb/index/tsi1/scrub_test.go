@@ -0,0 +1,132 @@
+package tsi1_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/pkg/limiter"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure scrubbing an index file detects block checksum mismatches.
+func TestIndexFile_Scrub(t *testing.T) {
+	data := MustCompactIndexFileData(t)
+
+	var f tsi1.IndexFile
+	if err := f.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	} else if err := f.Scrub(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := f.ScrubWithRateLimiter(context.Background(), limiter.NewRate(1<<30, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cancelled scrub returns the context error.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := f.Scrub(ctx); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Corrupt the flag of the first measurement.
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[trailer.MeasurementBlock.Offset] ^= 0xFF
+
+	var other tsi1.IndexFile
+	if err := other.UnmarshalBinary(corrupt); err != nil {
+		t.Fatal(err)
+	} else if err, ok := other.Scrub(context.Background()).(*tsi1.ErrChecksumMismatch); !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if err.Block != "measurement" {
+		t.Fatalf("unexpected block: %s", err.Block)
+	}
+}
+
+// Ensure the index scrubs every index file in the background & counts
+// mismatches.
+func TestIndex_Scrub(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	// Write a valid file & a file with a bad tagset checksum.
+	data := MustCompactIndexFileData(t)
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer.TagsetBlock.Checksum++
+
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-tsi1.IndexFileTrailerSize])
+	if _, err := trailer.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	m := tsi1.NewManifest()
+	for i, data := range [][]byte{data, buf.Bytes()} {
+		name := tsi1.FormatIndexFileName(i+1, 1)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		m.Files = append(m.Files, name)
+	}
+	if err := tsi1.WriteManifestFile(filepath.Join(dir, tsi1.ManifestFileName), m); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := tsi1.NewIndex()
+	idx.Path = dir
+	idx.CompactionEnabled = false
+	idx.ScrubInterval = 10 * time.Millisecond
+	idx.ScrubRateLimiter = limiter.NewRate(1<<30, 1024)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// Scrubbing continues after a mismatch.
+	if err, ok := idx.Scrub(context.Background()).(*tsi1.ErrChecksumMismatch); !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if err.Block != "tagset" {
+		t.Fatalf("unexpected block: %s", err.Block)
+	}
+
+	// Wait for the background scrubber to complete a pass.
+	timeout := time.After(5 * time.Second)
+	for idx.ScrubStatistics().Runs < 2 {
+		select {
+		case <-timeout:
+			t.Fatal("timeout waiting for scrub")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// Closing the index stops the scrubber.
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := idx.ScrubStatistics()
+	if stats.Files != stats.Runs || stats.Mismatches != stats.Runs || stats.Errors != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	} else if stats.Bytes == 0 {
+		t.Fatal("expected bytes scrubbed")
+	}
+
+	if a := idx.Statistics(map[string]string{"id": "1"}); len(a) != 1 {
+		t.Fatalf("unexpected statistics: %v", a)
+	} else if a[0].Tags["id"] != "1" || a[0].Tags["path"] != dir {
+		t.Fatalf("unexpected tags: %v", a[0].Tags)
+	} else if a[0].Values["scrubMismatches"].(int64) < 2 {
+		t.Fatalf("unexpected values: %v", a[0].Values)
+	}
+}
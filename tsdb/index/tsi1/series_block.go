@@ -1,6 +1,7 @@
 package tsi1
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
@@ -21,10 +22,52 @@ import (
 // ErrSeriesOverflow is returned when too many series are added to a series writer.
 var ErrSeriesOverflow = errors.New("series overflow")
 
+// ErrSeriesPrefixElem is returned when unmarshaling a prefix-compressed
+// series element outside of its series block.
+var ErrSeriesPrefixElem = errors.New("prefix-compressed series element")
+
+// ErrSeriesKeyTruncated is returned when decoding a series key which is
+// shorter than its encoded length.
+var ErrSeriesKeyTruncated = errors.New("series key truncated")
+
+// ErrInvalidSeriesBlock is returned when the trailer or a section of a series
+// block is not within the block.
+var ErrInvalidSeriesBlock = errors.New("invalid series block")
+
+// ErrUnsupportedSeriesBlockCodec is returned when the series block trailer
+// records a codec which is not supported by this package.
+var ErrUnsupportedSeriesBlockCodec = errors.New("unsupported series block codec")
+
+// ErrHashOrderedSeriesBlock is returned by SeriesReader for series blocks
+// written with SeriesBlockOrderHash, which cannot be scanned in key order.
+var ErrHashOrderedSeriesBlock = errors.New("series block is ordered by hash")
+
+// ErrInvalidSeriesKey is returned when a series key's fields do not match its
+// encoded length.
+var ErrInvalidSeriesKey = errors.New("invalid series key")
+
+// ErrSeriesOrder is returned by a strict SeriesBlockEncoder when a series key
+// does not sort after the previously encoded key. The block is not written
+// past the previous series so an out-of-order source fails the compaction
+// rather than producing a block whose hash indexes & merges are silently
+// wrong.
+type ErrSeriesOrder struct {
+	Prev, Key []byte
+}
+
+// Error returns the string representation of the error.
+func (e *ErrSeriesOrder) Error() string {
+	if bytes.Equal(e.Prev, e.Key) {
+		return fmt.Sprintf("series already encoded: %q", e.Key)
+	}
+	return fmt.Sprintf("series out of order: prev=%q, new=%q", e.Prev, e.Key)
+}
+
 // Series list field size constants.
 const (
 	// Series list trailer field sizes.
 	SeriesBlockTrailerSize = 0 +
+		1 + // series key codec
 		4 + 4 + // series data offset/size
 		4 + 4 + 4 + // series index offset/size/capacity
 		8 + 4 + 4 + // bloom filter false positive rate, offset/size
@@ -33,6 +76,9 @@ const (
 		4 + 4 + // series count and tombstone count
 		0
 
+	// Size of the series list trailer before version 5, which has no codec.
+	SeriesBlockTrailerV4Size = SeriesBlockTrailerSize - 1
+
 	// Other field sizes
 	SeriesCountSize = 4
 	SeriesIDSize    = 4
@@ -46,12 +92,123 @@ const (
 	// Marks the following bytes as a hash index.
 	// These bytes should be skipped by an iterator.
 	SeriesHashIndexFlag = 0x02
+
+	// Marks the series key as prefix-compressed against a restart element.
+	SeriesPrefixFlag = 0x04
+
+	// Marks a hash index as positioning keys with SeriesBlockHashFNV.
+	// Only set together with SeriesHashIndexFlag.
+	SeriesHashIndexFNVFlag = 0x08
 )
 
+// SeriesBlockCodec specifies how series keys are written to a series block.
+//
+// The codec is recorded in the series block trailer since version 5. Each
+// prefix-compressed element is also flagged, as restart elements are written
+// in full, so readers decode blocks from earlier versions too.
+type SeriesBlockCodec int
+
+const (
+	// Series keys are written in full. This is the default.
+	SeriesBlockCodecNone SeriesBlockCodec = iota
+
+	// Series keys are front-coded against the most recent restart element.
+	// A full key is written every SeriesBlockRestartInterval series so a
+	// single series can be decoded from its own element and its restart
+	// element without decoding the rest of the block.
+	SeriesBlockCodecPrefix
+)
+
+// String returns the name of the codec.
+func (c SeriesBlockCodec) String() string {
+	switch c {
+	case SeriesBlockCodecNone:
+		return "none"
+	case SeriesBlockCodecPrefix:
+		return "prefix"
+	default:
+		return fmt.Sprintf("SeriesBlockCodec(%d)", int(c))
+	}
+}
+
+// valid returns true if the codec is supported by this package.
+func (c SeriesBlockCodec) valid() bool {
+	return c == SeriesBlockCodecNone || c == SeriesBlockCodecPrefix
+}
+
+// SeriesBlockOrder specifies the order of the series elements in a series
+// block.
+//
+// The order is recorded in the series block trailer by setting the high bit of
+// the codec, so readers which predate it reject hash ordered blocks as having
+// an unsupported codec rather than scanning them as if they were sorted.
+type SeriesBlockOrder int
+
+const (
+	// Series are written in lexical key order. This is the default.
+	SeriesBlockOrderLexical SeriesBlockOrder = iota
+
+	// The series of each hash index are written in the order of their hash
+	// index slots, so probing for a key reads series elements which are next
+	// to each other. The hash indexes still cover consecutive key ranges but
+	// series ids no longer sort by key, so the series iterators sort the ids
+	// of each list by key when they are read.
+	SeriesBlockOrderHash
+)
+
+// seriesBlockHashOrderFlag is set on the codec in the series block trailer
+// when the series are written with SeriesBlockOrderHash.
+const seriesBlockHashOrderFlag = 0x80
+
+// String returns the name of the order.
+func (o SeriesBlockOrder) String() string {
+	switch o {
+	case SeriesBlockOrderLexical:
+		return "lexical"
+	case SeriesBlockOrderHash:
+		return "hash"
+	default:
+		return fmt.Sprintf("SeriesBlockOrder(%d)", int(o))
+	}
+}
+
+// SeriesBlockHash specifies the hash function used to position series keys in
+// the hash indexes of a series block.
+//
+// The hash is recorded in the flag of each hash index so readers look up
+// series in any block regardless of the hash that was used to write it.
+type SeriesBlockHash int
+
+const (
+	// Keys are hashed with xxhash. This is the default.
+	SeriesBlockHashXXHash SeriesBlockHash = iota
+
+	// Keys are hashed with 64-bit FNV-1a. This is an escape hatch for key
+	// sets which cluster under xxhash.
+	SeriesBlockHashFNV
+)
+
+// hashFunc returns the hash function & the hash index flag for h.
+func (h SeriesBlockHash) hashFunc() (func([]byte) int64, byte) {
+	if h == SeriesBlockHashFNV {
+		return rhh.HashKeyFNV, SeriesHashIndexFlag | SeriesHashIndexFNVFlag
+	}
+	return rhh.HashKey, SeriesHashIndexFlag
+}
+
+// SeriesBlockRestartInterval is the number of series between full keys when
+// using SeriesBlockCodecPrefix.
+const SeriesBlockRestartInterval = 16
+
 // MaxSeriesBlockHashSize is the maximum number of series in a single hash.
 const MaxSeriesBlockHashSize = (65536 * LoadFactor) / 100
 
 // SeriesBlock represents the section of the index that holds series data.
+//
+// The id of a series is its offset in the block. With SeriesBlockOrderLexical
+// sorting series ids also sorts series by key, so the measurement & tag value
+// series lists return series in key order as the merge iterators require.
+// With SeriesBlockOrderHash the ids of each list are sorted by key on read.
 type SeriesBlock struct {
 	data []byte
 
@@ -63,6 +220,10 @@ type SeriesBlock struct {
 	seriesN    int32
 	tombstoneN int32
 
+	// Codec used to write the series keys & the order of the series.
+	codec SeriesBlockCodec
+	order SeriesBlockOrder
+
 	// Bloom filter used for fast series existence check.
 	filter *bloom.Filter
 
@@ -71,8 +232,17 @@ type SeriesBlock struct {
 	// estimate cardinality across multiple blocks (which might contain
 	// duplicate series).
 	sketch, tsketch estimator.Sketch
+	sketchSize      int64 // encoded size of both sketches
 }
 
+// Codec returns the codec used to write the series keys. Blocks from files
+// before version 5 always return SeriesBlockCodecNone since the codec was not
+// recorded, though their keys may still be prefix-compressed.
+func (blk *SeriesBlock) Codec() SeriesBlockCodec { return blk.codec }
+
+// Order returns the order the series were written in.
+func (blk *SeriesBlock) Order() SeriesBlockOrder { return blk.order }
+
 // HasSeries returns flags indicating if the series exists and if it is tombstoned.
 func (blk *SeriesBlock) HasSeries(name []byte, tags models.Tags, buf []byte) (exists, tombstoned bool) {
 	offset, tombstoned := blk.Offset(name, tags, buf)
@@ -87,7 +257,7 @@ func (blk *SeriesBlock) Series(name []byte, tags models.Tags) SeriesElem {
 	}
 
 	var e SeriesBlockElem
-	e.UnmarshalBinary(blk.data[offset:])
+	e.unmarshalAt(blk.data, offset)
 	return &e
 }
 
@@ -100,7 +270,6 @@ func (blk *SeriesBlock) Offset(name []byte, tags models.Tags, buf []byte) (offse
 
 	// Compute series key.
 	buf = AppendSeriesKey(buf[:0], name, tags)
-	bufN := uint32(len(buf))
 
 	// Quickly check the bloom filter.
 	// If the key doesn't exist then we know for sure that it doesn't exist.
@@ -109,6 +278,23 @@ func (blk *SeriesBlock) Offset(name []byte, tags models.Tags, buf []byte) (offse
 	if !blk.filter.Contains(buf) {
 		return 0, false
 	}
+	return blk.keyOffset(buf)
+}
+
+// mayContainHash returns false if the series key with the bloom filter hash h
+// is definitely not in the block. Otherwise the key must be checked with
+// keyOffset.
+func (blk *SeriesBlock) mayContainHash(h bloom.Hash) bool {
+	return len(blk.seriesIndexes) != 0 && blk.filter.ContainsHash(h)
+}
+
+// keyOffset returns the byte offset of the encoded series key within the
+// block using the hash index. The bloom filter is not checked.
+func (blk *SeriesBlock) keyOffset(buf []byte) (offset uint32, tombstoned bool) {
+	if len(blk.seriesIndexes) == 0 {
+		return 0, false
+	}
+	bufN := uint32(len(buf))
 
 	// Find the correct partition.
 	// Use previous index unless an exact match on the min value.
@@ -122,11 +308,12 @@ func (blk *SeriesBlock) Offset(name []byte, tags models.Tags, buf []byte) (offse
 
 	// Search within partition.
 	n := int64(seriesIndex.capacity)
-	hash := rhh.HashKey(buf)
+	hash := seriesIndex.hash(buf)
 	pos := hash % n
 
 	// Track current distance
 	var d int64
+	var keyBuf []byte
 	for {
 		// Find offset of series.
 		offset := binary.BigEndian.Uint32(seriesIndex.data[pos*SeriesIDSize:])
@@ -135,13 +322,19 @@ func (blk *SeriesBlock) Offset(name []byte, tags models.Tags, buf []byte) (offse
 		}
 
 		// Evaluate encoded value matches expected.
-		key := ReadSeriesKey(blk.data[offset+1 : offset+1+bufN])
+		var key []byte
+		if blk.data[offset]&SeriesPrefixFlag == 0 {
+			key = ReadSeriesKey(blk.data[offset+1 : offset+1+bufN])
+		} else {
+			_, key, _ = readSeriesBlockElem(blk.data, offset, keyBuf[:0])
+			keyBuf = key
+		}
 		if bytes.Equal(buf, key) {
 			return offset, (blk.data[offset] & SeriesTombstoneFlag) != 0
 		}
 
 		// Check if we've exceeded the probe distance.
-		max := rhh.Dist(rhh.HashKey(key), pos, n)
+		max := rhh.Dist(seriesIndex.hash(key), pos, n)
 		if d > max {
 			return 0, false
 		}
@@ -161,8 +354,11 @@ func (blk *SeriesBlock) SeriesCount() uint32 {
 	return uint32(blk.seriesN + blk.tombstoneN)
 }
 
-// SeriesIterator returns an iterator over all the series.
+// SeriesIterator returns an iterator over all the series in key order.
 func (blk *SeriesBlock) SeriesIterator() SeriesIterator {
+	if blk.order == SeriesBlockOrderHash {
+		return &seriesBlockHashIterator{n: blk.SeriesCount(), sblk: blk}
+	}
 	return &seriesBlockIterator{
 		n:      blk.SeriesCount(),
 		offset: 1,
@@ -174,35 +370,76 @@ func (blk *SeriesBlock) SeriesIterator() SeriesIterator {
 //
 // If data is an mmap then it should stay open until the series list is no
 // longer used because data access is performed directly from the byte slice.
+//
+// The trailer, sections & hash index entries are bounds checked so a corrupt
+// header returns ErrInvalidSeriesBlock rather than panicking. Series elements
+// are decoded lazily & are not checked.
+//
+// The block must use the trailer of the current index file version.
 func (blk *SeriesBlock) UnmarshalBinary(data []byte) error {
-	t := ReadSeriesBlockTrailer(data)
+	return blk.unmarshalBinary(data, IndexFileVersion)
+}
+
+// unmarshalBinary unpacks data into the series list from an index file of
+// the given version.
+func (blk *SeriesBlock) unmarshalBinary(data []byte, version int) error {
+	size := seriesBlockTrailerSize(version)
+	if len(data) < size {
+		return io.ErrShortBuffer
+	}
+	t := readSeriesBlockTrailer(data, version)
+	if !t.Codec.valid() {
+		return ErrUnsupportedSeriesBlockCodec
+	}
+	body := data[:len(data)-size]
 
 	// Save entire block.
 	blk.data = data
 
 	// Slice series data.
-	blk.seriesData = data[t.Series.Data.Offset:]
-	blk.seriesData = blk.seriesData[:t.Series.Data.Size]
+	var ok bool
+	if blk.seriesData, ok = blockSection(body, int64(t.Series.Data.Offset), int64(t.Series.Data.Size)); !ok {
+		return ErrInvalidSeriesBlock
+	}
 
-	// Read in all index partitions.
-	buf := data[t.Series.Index.Offset:]
-	buf = buf[:t.Series.Index.Size]
+	// Read in all index partitions. Each entry is at least 16 bytes.
+	buf, ok := blockSection(body, int64(t.Series.Index.Offset), int64(t.Series.Index.Size))
+	if !ok || t.Series.Index.N < 0 || int64(t.Series.Index.N) > int64(len(buf)/16) {
+		return ErrInvalidSeriesBlock
+	}
 	blk.seriesIndexes = make([]seriesBlockIndex, t.Series.Index.N)
 	for i := range blk.seriesIndexes {
 		idx := &blk.seriesIndexes[i]
+		if len(buf) < 16 {
+			return ErrInvalidSeriesBlock
+		}
 
 		// Read data block.
 		var offset, size uint32
 		offset, buf = binary.BigEndian.Uint32(buf[:4]), buf[4:]
 		size, buf = binary.BigEndian.Uint32(buf[:4]), buf[4:]
-		idx.data = blk.data[offset : offset+size]
+		if idx.data, ok = blockSection(body, int64(offset), int64(size)); !ok {
+			return ErrInvalidSeriesBlock
+		}
+
+		// Read the hash from the flag preceding the index capacity & data.
+		idx.hash = rhh.HashKey
+		if offset >= 5 && blk.data[offset-5]&SeriesHashIndexFNVFlag != 0 {
+			idx.hash = rhh.HashKeyFNV
+		}
 
 		// Read block capacity.
 		idx.capacity, buf = int32(binary.BigEndian.Uint32(buf[:4])), buf[4:]
+		if idx.capacity <= 0 || int64(idx.capacity)*SeriesIDSize != int64(size) {
+			return ErrInvalidSeriesBlock
+		}
 
 		// Read min key.
 		var n uint32
 		n, buf = binary.BigEndian.Uint32(buf[:4]), buf[4:]
+		if uint64(n) > uint64(len(buf)) {
+			return ErrInvalidSeriesBlock
+		}
 		idx.min, buf = buf[:n], buf[n:]
 	}
 	if len(buf) != 0 {
@@ -210,26 +447,41 @@ func (blk *SeriesBlock) UnmarshalBinary(data []byte) error {
 	}
 
 	// Initialize bloom filter.
-	filter, err := bloom.NewFilterBuffer(data[t.Bloom.Offset:][:t.Bloom.Size], t.Bloom.K)
+	filterData, ok := blockSection(body, int64(t.Bloom.Offset), int64(t.Bloom.Size))
+	if !ok {
+		return ErrInvalidSeriesBlock
+	}
+	filter, err := bloom.NewFilterBuffer(filterData, t.Bloom.K)
 	if err != nil {
 		return err
 	}
 	blk.filter = filter
 
 	// Initialise sketches. We're currently using HLL+.
+	sketchData, ok := blockSection(body, int64(t.Sketch.Offset), int64(t.Sketch.Size))
+	if !ok {
+		return ErrInvalidSeriesBlock
+	}
+	tSketchData, ok := blockSection(body, int64(t.TSketch.Offset), int64(t.TSketch.Size))
+	if !ok {
+		return ErrInvalidSeriesBlock
+	}
+
 	var s, ts = hll.NewDefaultPlus(), hll.NewDefaultPlus()
-	if err := s.UnmarshalBinary(data[t.Sketch.Offset:][:t.Sketch.Size]); err != nil {
+	if err := s.UnmarshalBinary(sketchData); err != nil {
 		return err
 	}
 	blk.sketch = s
 
-	if err := ts.UnmarshalBinary(data[t.TSketch.Offset:][:t.TSketch.Size]); err != nil {
+	if err := ts.UnmarshalBinary(tSketchData); err != nil {
 		return err
 	}
 	blk.tsketch = ts
+	blk.sketchSize = int64(t.Sketch.Size) + int64(t.TSketch.Size)
 
 	// Set the series and tombstone counts
 	blk.seriesN, blk.tombstoneN = t.SeriesN, t.TombstoneN
+	blk.codec, blk.order = t.Codec, t.Order
 
 	return nil
 }
@@ -239,6 +491,7 @@ type seriesBlockIndex struct {
 	data     []byte
 	min      []byte
 	capacity int32
+	hash     func([]byte) int64
 }
 
 // seriesBlockIterator is an iterator over a series ids in a series list.
@@ -249,6 +502,12 @@ type seriesBlockIterator struct {
 	e      SeriesBlockElem // buffer
 }
 
+// EstimatedCount returns the number of series left in the block, which is
+// exact.
+func (itr *seriesBlockIterator) EstimatedCount() (uint64, bool) {
+	return uint64(itr.n - itr.i), true
+}
+
 // Next returns the next series element.
 func (itr *seriesBlockIterator) Next() SeriesElem {
 	for {
@@ -272,7 +531,7 @@ func (itr *seriesBlockIterator) Next() SeriesElem {
 		}
 
 		// Read next element.
-		itr.e.UnmarshalBinary(itr.sblk.data[itr.offset:])
+		itr.e.unmarshalAt(itr.sblk.data, itr.offset)
 
 		// Move iterator and offset forward.
 		itr.i++
@@ -282,6 +541,109 @@ func (itr *seriesBlockIterator) Next() SeriesElem {
 	}
 }
 
+// elemOffset returns the offset of the element last returned by Next.
+func (itr *seriesBlockIterator) elemOffset() uint32 {
+	return itr.offset - uint32(itr.e.size)
+}
+
+// seriesBlockHashIterator iterates over the series of a block written with
+// SeriesBlockOrderHash in key order. The hash indexes cover consecutive key
+// ranges so the series of each index are sorted in turn.
+type seriesBlockHashIterator struct {
+	i, n uint32
+	sblk *SeriesBlock
+
+	// Offsets of the current index's series in key order & the next index.
+	offsets []uint32
+	index   int
+
+	// Offset of the current element.
+	offset uint32
+	e      SeriesBlockElem // buffer
+}
+
+// EstimatedCount returns the number of series left in the block, which is
+// exact.
+func (itr *seriesBlockHashIterator) EstimatedCount() (uint64, bool) {
+	return uint64(itr.n - itr.i), true
+}
+
+// Next returns the next series element.
+func (itr *seriesBlockHashIterator) Next() SeriesElem {
+	for len(itr.offsets) == 0 {
+		if itr.index == len(itr.sblk.seriesIndexes) {
+			return nil
+		}
+
+		// Read the offsets of the next index's series from its slots.
+		idx := &itr.sblk.seriesIndexes[itr.index]
+		a := make([]uint32, 0, idx.capacity)
+		for i := int32(0); i < idx.capacity; i++ {
+			if offset := binary.BigEndian.Uint32(idx.data[i*SeriesIDSize:]); offset != 0 {
+				a = append(a, offset)
+			}
+		}
+		itr.offsets = itr.sblk.sortOffsetsByKey(a)
+		itr.index++
+	}
+
+	itr.offset, itr.offsets = itr.offsets[0], itr.offsets[1:]
+	itr.e.unmarshalAt(itr.sblk.data, itr.offset)
+	itr.i++
+	return &itr.e
+}
+
+// elemOffset returns the offset of the element last returned by Next.
+func (itr *seriesBlockHashIterator) elemOffset() uint32 { return itr.offset }
+
+// sortOffsetsByKey sorts the series offsets in a by the key of each series.
+func (blk *SeriesBlock) sortOffsetsByKey(a []uint32) []uint32 {
+	keys := make([][]byte, len(a))
+	for i, offset := range a {
+		_, key, _ := readSeriesBlockElem(blk.data, offset, nil)
+		keys[i] = key
+	}
+	sort.Sort(seriesOffsetsByKey{offsets: a, keys: keys})
+	return a
+}
+
+// seriesOffsetsByKey sorts series offsets by their keys.
+type seriesOffsetsByKey struct {
+	offsets []uint32
+	keys    [][]byte
+}
+
+func (a seriesOffsetsByKey) Len() int { return len(a.offsets) }
+func (a seriesOffsetsByKey) Swap(i, j int) {
+	a.offsets[i], a.offsets[j] = a.offsets[j], a.offsets[i]
+	a.keys[i], a.keys[j] = a.keys[j], a.keys[i]
+}
+func (a seriesOffsetsByKey) Less(i, j int) bool {
+	return CompareSeriesKeys(a.keys[i], a.keys[j]) == -1
+}
+
+// writeOffsetTableTo writes the key & offset of every series to w in series
+// key order. See CompactOptions.SeriesOffsetTable for the format.
+func (blk *SeriesBlock) writeOffsetTableTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	itr := blk.SeriesIterator().(interface {
+		SeriesIterator
+		elemOffset() uint32
+	})
+
+	var n int64
+	var key []byte
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		key = AppendSeriesKey(key[:0], e.Name(), e.Tags())
+		if err := writeTo(bw, key, &n); err != nil {
+			return err
+		} else if err := writeUint32To(bw, itr.elemOffset(), &n); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
 // seriesDecodeIterator decodes a series id iterator into unmarshaled elements.
 type seriesDecodeIterator struct {
 	itr  seriesIDIterator
@@ -289,11 +651,28 @@ type seriesDecodeIterator struct {
 	e    SeriesBlockElem // buffer
 }
 
-// newSeriesDecodeIterator returns a new instance of seriesDecodeIterator.
+// newSeriesDecodeIterator returns a new instance of seriesDecodeIterator. The
+// ids of a block written with SeriesBlockOrderHash are read & sorted by key
+// first so the series are returned in key order.
 func newSeriesDecodeIterator(sblk *SeriesBlock, itr seriesIDIterator) *seriesDecodeIterator {
+	if sblk.order == SeriesBlockOrderHash {
+		var a []uint32
+		for id := itr.next(); id != 0; id = itr.next() {
+			a = append(a, id)
+		}
+		itr = &seriesIDSetIterator{a: sblk.sortOffsetsByKey(a)}
+	}
 	return &seriesDecodeIterator{sblk: sblk, itr: itr}
 }
 
+// EstimatedCount returns the number of series ids left, if known.
+func (itr *seriesDecodeIterator) EstimatedCount() (uint64, bool) {
+	if itr, ok := itr.itr.(seriesIDCounter); ok {
+		return itr.remaining(), true
+	}
+	return 0, false
+}
+
 // Next returns the next series element.
 func (itr *seriesDecodeIterator) Next() SeriesElem {
 	// Read next series id.
@@ -303,7 +682,7 @@ func (itr *seriesDecodeIterator) Next() SeriesElem {
 	}
 
 	// Read next element.
-	itr.e.UnmarshalBinary(itr.sblk.data[id:])
+	itr.e.unmarshalAt(itr.sblk.data, id)
 	return &itr.e
 }
 
@@ -313,6 +692,9 @@ type SeriesBlockElem struct {
 	name []byte
 	tags models.Tags
 	size int
+
+	// Buffer for rebuilding prefix-compressed keys.
+	buf []byte
 }
 
 // Deleted returns true if the tombstone flag is set.
@@ -329,11 +711,35 @@ func (e *SeriesBlockElem) Tags() models.Tags { return e.tags }
 func (e *SeriesBlockElem) Expr() influxql.Expr { return nil }
 
 // UnmarshalBinary unmarshals data into e.
+//
+// Prefix-compressed elements cannot be decoded without the rest of the series
+// block so ErrSeriesPrefixElem is returned for them.
 func (e *SeriesBlockElem) UnmarshalBinary(data []byte) error {
-	start := len(data)
+	if data[0]&SeriesPrefixFlag != 0 {
+		return ErrSeriesPrefixElem
+	}
+
+	key := ReadSeriesKey(data[1:])
+	e.unmarshalKey(data[0], key, 1+len(key))
+	return nil
+}
+
+// unmarshalAt unmarshals the element at offset within the series block data.
+func (e *SeriesBlockElem) unmarshalAt(data []byte, offset uint32) {
+	flag, key, size := readSeriesBlockElem(data, offset, e.buf[:0])
+	if flag&SeriesPrefixFlag != 0 {
+		e.buf = key
+	}
+	e.unmarshalKey(flag, key, size)
+}
+
+// unmarshalKey sets the element's fields from its flag, key & encoded size.
+// The name & tags reference the key data.
+func (e *SeriesBlockElem) unmarshalKey(flag byte, key []byte, size int) {
+	data := key
 
 	// Parse flag data.
-	e.flag, data = data[0], data[1:]
+	e.flag = flag
 
 	// Parse total size.
 	_, szN := binary.Uvarint(data)
@@ -361,9 +767,44 @@ func (e *SeriesBlockElem) UnmarshalBinary(data []byte) error {
 	}
 
 	// Save length of elem.
-	e.size = start - len(data)
+	e.size = size
+}
 
-	return nil
+// readSeriesBlockElem returns the flag, series key & encoded size of the
+// element at offset within the series block data.
+//
+// Uncompressed keys reference data. Prefix-compressed keys are rebuilt from
+// the key of their restart element and are appended to buf.
+func readSeriesBlockElem(data []byte, offset uint32, buf []byte) (flag byte, key []byte, size int) {
+	flag = data[offset]
+	if flag&SeriesPrefixFlag == 0 {
+		key = ReadSeriesKey(data[offset+1:])
+		return flag, key, 1 + len(key)
+	}
+
+	// Read distance to restart element, shared prefix size & suffix.
+	p := data[offset+1:]
+	delta, n := binary.Uvarint(p)
+	p = p[n:]
+	shared, n := binary.Uvarint(p)
+	p = p[n:]
+	suffixN, n := binary.Uvarint(p)
+	p = p[n:]
+	suffix := p[:suffixN]
+	size = len(data[offset:]) - len(p) + int(suffixN)
+
+	// Read the restart key without its total size.
+	restart := ReadSeriesKey(data[offset-uint32(delta)+1:])
+	_, n = binary.Uvarint(restart)
+	prefix := restart[n:][:shared]
+
+	// Rebuild key.
+	var tmp [binary.MaxVarintLen64]byte
+	i := binary.PutUvarint(tmp[:], shared+suffixN)
+	key = append(buf, tmp[:i]...)
+	key = append(key, prefix...)
+	key = append(key, suffix...)
+	return flag, key, size
 }
 
 // AppendSeriesElem serializes flag/name/tags to dst and returns the new buffer.
@@ -394,9 +835,12 @@ func AppendSeriesKey(dst []byte, name []byte, tags models.Tags) []byte {
 	// Variable encode length.
 	totalSz := binary.PutUvarint(buf, uint64(size))
 
-	// If caller doesn't provide a buffer then pre-allocate an exact one.
-	if dst == nil {
-		dst = make([]byte, 0, size+totalSz)
+	// Grow the buffer once if it cannot hold the key so appending never
+	// reallocates. A buffer with enough capacity is reused without allocating.
+	if cap(dst)-len(dst) < size+totalSz {
+		other := make([]byte, len(dst), len(dst)+size+totalSz)
+		copy(other, dst)
+		dst = other
 	}
 
 	// Append total length.
@@ -435,6 +879,65 @@ func ReadSeriesKey(data []byte) []byte {
 	return data[:int(sz)+n]
 }
 
+// DecodeSeriesKey decodes the name & tags of the series key encoded by
+// AppendSeriesKey at the beginning of data. Any data after the key is ignored.
+// The returned name & tags refer to data so they are only valid while data is.
+func DecodeSeriesKey(data []byte) (name []byte, tags models.Tags, err error) {
+	// Read total size.
+	sz, i := binary.Uvarint(data)
+	if i <= 0 {
+		return nil, nil, ErrSeriesKeyTruncated
+	} else if uint64(len(data)-i) < sz {
+		return nil, nil, ErrSeriesKeyTruncated
+	}
+	data = data[i : i+int(sz)]
+
+	// Read name.
+	if name, data, err = decodeSeriesKeyField(data); err != nil {
+		return nil, nil, err
+	}
+
+	// Read tag count.
+	tagN, i := binary.Uvarint(data)
+	if i <= 0 {
+		return nil, nil, ErrInvalidSeriesKey
+	} else if tagN > uint64(len(data)-i)/4 {
+		return nil, nil, ErrInvalidSeriesKey
+	}
+	data = data[i:]
+
+	// Read tags.
+	if tagN > 0 {
+		tags = make(models.Tags, tagN)
+	}
+	for i := range tags {
+		if tags[i].Key, data, err = decodeSeriesKeyField(data); err != nil {
+			return nil, nil, err
+		} else if tags[i].Value, data, err = decodeSeriesKeyField(data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Ensure the fields fill the encoded length.
+	if len(data) != 0 {
+		return nil, nil, ErrInvalidSeriesKey
+	}
+	return name, tags, nil
+}
+
+// decodeSeriesKeyField reads a length-prefixed field of a series key & returns
+// the field & the remaining data.
+func decodeSeriesKeyField(data []byte) (field, remaining []byte, err error) {
+	if len(data) < 2 {
+		return nil, nil, ErrInvalidSeriesKey
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data)-2 < n {
+		return nil, nil, ErrInvalidSeriesKey
+	}
+	return data[2 : 2+n], data[2+n:], nil
+}
+
 func CompareSeriesKeys(a, b []byte) int {
 	// Handle 'nil' keys.
 	if len(a) == 0 && len(b) == 0 {
@@ -533,20 +1036,75 @@ type SeriesBlockEncoder struct {
 	// Bloom filter to check for series existance.
 	filter *bloom.Filter
 
+	// Offset of the most recently encoded series.
+	offset int64
+
+	// Current restart element, if using prefix compression.
+	restart struct {
+		offset int64
+		body   []byte
+		n      int
+	}
+	prefixBuf []byte
+
+	// Codec used to write series keys. Must be set before encoding series.
+	Codec SeriesBlockCodec
+
+	// Order of the series elements. Must be set before encoding series.
+	Order SeriesBlockOrder
+
+	// Called with the key & offset of each series once its element has been
+	// written, in key order, if set. With SeriesBlockOrderHash the series of
+	// a hash index are only written when the index is flushed so Offset
+	// cannot be used. The key is only valid during the call.
+	OnWrite func(key []byte, offset uint32) error
+
+	// Elements of the current hash index waiting to be written in hash order
+	// & the end of each element.
+	pending     []byte
+	pendingEnds []int
+
+	// Checks that each series sorts after the previous series & returns
+	// *ErrSeriesOrder if it does not. Out of order or duplicate series are
+	// otherwise written without an error & produce a block whose lookups are
+	// wrong. Defaults to off, as the merge iterators already return series
+	// in order, except in this package's tests.
+	Strict bool
+
+	// Skips the order check even if Strict is set, such as when the caller
+	// guarantees the series arrive sorted.
+	AssumeSorted bool
+
+	// Flag written before each hash index. Set by SetHash.
+	indexFlag byte
+
+	// Initial capacity of each hash index, sized from the expected series.
+	capacity int64
+
 	// Series sketch and tombstoned series sketch. These must be
 	// set before calling WriteTo.
 	sketch, tSketch estimator.Sketch
 }
 
+// strictSeriesOrder is the default of SeriesBlockEncoder.Strict. The tests
+// set it so every encoder they create checks the series order.
+var strictSeriesOrder = false
+
 // NewSeriesBlockEncoder returns a new instance of SeriesBlockEncoder.
+// The hash index is sized for n series & grows if more are encoded, so n only
+// needs to be an estimate.
 func NewSeriesBlockEncoder(w io.Writer, n uint32, m, k uint64) *SeriesBlockEncoder {
+	capacity := seriesBlockHashCapacity(n)
 	return &SeriesBlockEncoder{
 		w: w,
 
 		offsets: rhh.NewHashMap(rhh.Options{
-			Capacity:   MaxSeriesBlockHashSize,
+			Capacity:   capacity,
 			LoadFactor: LoadFactor,
 		}),
+		indexFlag: SeriesHashIndexFlag,
+		capacity:  capacity,
+		Strict:    strictSeriesOrder,
 
 		filter: bloom.NewFilter(m, k),
 
@@ -558,8 +1116,47 @@ func NewSeriesBlockEncoder(w io.Writer, n uint32, m, k uint64) *SeriesBlockEncod
 // N returns the number of bytes written.
 func (enc *SeriesBlockEncoder) N() int64 { return enc.n }
 
+// Offset returns the offset of the most recently encoded series. It is not
+// set with SeriesBlockOrderHash; use OnWrite instead.
+func (enc *SeriesBlockEncoder) Offset() int64 { return enc.offset }
+
+// SetSketchPrecision sets the precision of the series sketches. This must be
+// called before any series are encoded. See CompactOptions.SketchPrecision
+// for the accuracy & size tradeoff.
+func (enc *SeriesBlockEncoder) SetSketchPrecision(p uint8) error {
+	if enc.n > 0 {
+		return errors.New("cannot set sketch precision after series are encoded")
+	}
+
+	sketch, tSketch, err := newSketches(p)
+	if err != nil {
+		return err
+	}
+	enc.sketch, enc.tSketch = sketch, tSketch
+	return nil
+}
+
+// SetHash sets the hash function used by the hash indexes. This must be
+// called before any series are encoded.
+func (enc *SeriesBlockEncoder) SetHash(h SeriesBlockHash) error {
+	if enc.n > 0 {
+		return errors.New("cannot set series block hash after series are encoded")
+	}
+
+	hash, flag := h.hashFunc()
+	enc.offsets = rhh.NewHashMap(rhh.Options{
+		Capacity:   enc.capacity,
+		LoadFactor: LoadFactor,
+		Hash:       hash,
+	})
+	enc.indexFlag = flag
+	return nil
+}
+
 // Encode writes a series to the underlying writer.
 // The series must be lexicographical sorted after the previous encoded series.
+// Returns *ErrSeriesOrder if it is not & Strict is set, unless AssumeSorted
+// is also set.
 func (enc *SeriesBlockEncoder) Encode(name []byte, tags models.Tags, deleted bool) error {
 	// An initial empty byte must be written.
 	if err := enc.ensureHeaderWritten(); err != nil {
@@ -570,14 +1167,15 @@ func (enc *SeriesBlockEncoder) Encode(name []byte, tags models.Tags, deleted boo
 	buf := AppendSeriesElem(enc.buf[0][:0], encodeSerieFlag(deleted), name, tags)
 
 	// Verify series is after previous series.
-	if enc.buf[1] != nil {
+	if enc.buf[1] != nil && enc.Strict && !enc.AssumeSorted {
 		// Skip the first byte since it is the flag. Remaining bytes are key.
 		key0, key1 := buf[1:], enc.buf[1][1:]
 
-		if cmp := CompareSeriesKeys(key0, key1); cmp == -1 {
-			return fmt.Errorf("series out of order: prev=%q, new=%q", enc.buf[1], buf)
-		} else if cmp == 0 {
-			return fmt.Errorf("series already encoded: %s", buf)
+		if CompareSeriesKeys(key0, key1) != 1 {
+			return &ErrSeriesOrder{
+				Prev: append([]byte(nil), key1...),
+				Key:  append([]byte(nil), key0...),
+			}
 		}
 	}
 
@@ -589,15 +1187,30 @@ func (enc *SeriesBlockEncoder) Encode(name []byte, tags models.Tags, deleted boo
 	// Swap double buffer.
 	enc.buf[0], enc.buf[1] = enc.buf[1], buf
 
-	// Write encoded series to writer.
-	offset := enc.n
-	if err := writeTo(enc.w, buf, &enc.n); err != nil {
-		return err
-	}
+	if enc.Order == SeriesBlockOrderHash {
+		// Defer writing until the index is flushed. The position of the
+		// element is saved until its offset is known.
+		enc.offsets.Put(buf[1:], uint32(len(enc.pendingEnds)))
+		enc.pending = append(enc.pending, buf...)
+		enc.pendingEnds = append(enc.pendingEnds, len(enc.pending))
+	} else {
+		// Write encoded series to writer.
+		offset := enc.n
+		if err := enc.writeElem(buf); err != nil {
+			return err
+		}
+		enc.offset = offset
 
-	// Save offset to generate index later.
-	// Key is copied by the RHH map.
-	enc.offsets.Put(buf[1:], uint32(offset))
+		// Save offset to generate index later.
+		// Key is copied by the RHH map.
+		enc.offsets.Put(buf[1:], uint32(offset))
+
+		if enc.OnWrite != nil {
+			if err := enc.OnWrite(buf[1:], uint32(offset)); err != nil {
+				return err
+			}
+		}
+	}
 
 	// Update bloom filter.
 	enc.filter.Insert(buf[1:])
@@ -614,6 +1227,38 @@ func (enc *SeriesBlockEncoder) Encode(name []byte, tags models.Tags, deleted boo
 	return nil
 }
 
+// writeElem writes a series element using the encoder's codec.
+func (enc *SeriesBlockEncoder) writeElem(elem []byte) error {
+	if enc.Codec != SeriesBlockCodecPrefix {
+		return writeTo(enc.w, elem, &enc.n)
+	}
+
+	// Strip flag & total size from the key.
+	key := elem[1:]
+	_, n := binary.Uvarint(key)
+	body := key[n:]
+
+	// Periodically write a full key which later keys are compressed against.
+	if enc.restart.offset == 0 || enc.restart.n >= SeriesBlockRestartInterval {
+		enc.restart.offset = enc.n
+		enc.restart.body = append(enc.restart.body[:0], body...)
+		enc.restart.n = 1
+		return writeTo(enc.w, elem, &enc.n)
+	}
+	enc.restart.n++
+
+	// Write flag, distance to restart element, shared prefix size & suffix.
+	shared := commonPrefixLen(enc.restart.body, body)
+	buf := append(enc.prefixBuf[:0], elem[0]|SeriesPrefixFlag)
+	buf = appendUvarint(buf, uint64(enc.n-enc.restart.offset))
+	buf = appendUvarint(buf, uint64(shared))
+	buf = appendUvarint(buf, uint64(len(body)-shared))
+	buf = append(buf, body[shared:]...)
+	enc.prefixBuf = buf
+
+	return writeTo(enc.w, buf, &enc.n)
+}
+
 // Close writes the index and trailer.
 // This should be called at the end once all series have been encoded.
 func (enc *SeriesBlockEncoder) Close() error {
@@ -626,6 +1271,15 @@ func (enc *SeriesBlockEncoder) Close() error {
 		return err
 	}
 
+	// Record the codec the keys were written with. Keys are written in full
+	// for any codec other than SeriesBlockCodecPrefix.
+	if enc.Codec == SeriesBlockCodecPrefix {
+		enc.trailer.Codec = SeriesBlockCodecPrefix
+	}
+	if enc.Order == SeriesBlockOrderHash {
+		enc.trailer.Order = SeriesBlockOrderHash
+	}
+
 	// Write dictionary-encoded series list.
 	enc.trailer.Series.Data.Offset = 1
 	enc.trailer.Series.Data.Size = int32(enc.n) - enc.trailer.Series.Data.Offset
@@ -721,7 +1375,7 @@ func (enc *SeriesBlockEncoder) checkFlushIndex(min []byte) error {
 
 	// Flush index values.
 	if err := enc.flushIndex(); err != nil {
-		return nil
+		return err
 	}
 
 	// Reset index and save minimum series key.
@@ -732,14 +1386,32 @@ func (enc *SeriesBlockEncoder) checkFlushIndex(min []byte) error {
 	return nil
 }
 
+// seriesBlockHashCapacity returns the hash index capacity for n series at the
+// load factor. Indexes never hold more than MaxSeriesBlockHashSize series.
+func seriesBlockHashCapacity(n uint32) int64 {
+	if n >= MaxSeriesBlockHashSize {
+		return MaxSeriesBlockHashSize
+	}
+	return (int64(n) * 100) / LoadFactor
+}
+
 // flushIndex flushes the hash index segment.
 func (enc *SeriesBlockEncoder) flushIndex() error {
 	if enc.offsets.Len() == 0 {
 		return nil
 	}
 
+	// Write the series of a hash ordered block ahead of their index.
+	var slots []uint32
+	if enc.Order == SeriesBlockOrderHash {
+		var err error
+		if slots, err = enc.writePending(); err != nil {
+			return err
+		}
+	}
+
 	// Write index segment flag.
-	if err := writeUint8To(enc.w, SeriesHashIndexFlag, &enc.n); err != nil {
+	if err := writeUint8To(enc.w, enc.indexFlag, &enc.n); err != nil {
 		return err
 	}
 	// Write index capacity.
@@ -756,8 +1428,13 @@ func (enc *SeriesBlockEncoder) flushIndex() error {
 
 	// Encode hash map offset entries.
 	for i := int64(0); i < enc.offsets.Cap(); i++ {
-		_, v := enc.offsets.Elem(i)
-		seriesOffset, _ := v.(uint32)
+		var seriesOffset uint32
+		if slots != nil {
+			seriesOffset = slots[i]
+		} else {
+			_, v := enc.offsets.Elem(i)
+			seriesOffset, _ = v.(uint32)
+		}
 
 		if err := writeUint32To(enc.w, uint32(seriesOffset), &enc.n); err != nil {
 			return err
@@ -786,6 +1463,44 @@ func (enc *SeriesBlockEncoder) flushIndex() error {
 	return nil
 }
 
+// writePending writes the pending elements of the current hash index in the
+// order of their slots & returns the offset held by each slot. OnWrite is then
+// called for each element in the order it was encoded, which is key order.
+func (enc *SeriesBlockEncoder) writePending() ([]uint32, error) {
+	slots := make([]uint32, enc.offsets.Cap())
+	offsets := make([]uint32, len(enc.pendingEnds))
+	for i := range slots {
+		_, v := enc.offsets.Elem(int64(i))
+		j, ok := v.(uint32)
+		if !ok {
+			continue
+		}
+
+		var start int
+		if j > 0 {
+			start = enc.pendingEnds[j-1]
+		}
+		offsets[j] = uint32(enc.n)
+		if err := enc.writeElem(enc.pending[start:enc.pendingEnds[j]]); err != nil {
+			return nil, err
+		}
+		slots[i] = offsets[j]
+	}
+
+	if enc.OnWrite != nil {
+		var start int
+		for j, end := range enc.pendingEnds {
+			if err := enc.OnWrite(enc.pending[start+1:end], offsets[j]); err != nil {
+				return nil, err
+			}
+			start = end
+		}
+	}
+
+	enc.pending, enc.pendingEnds = enc.pending[:0], enc.pendingEnds[:0]
+	return slots, nil
+}
+
 // seriesBlockIndexEncodeInfo stores offset information for seriesBlockIndex structures.
 type seriesBlockIndexEncodeInfo struct {
 	offset   uint32
@@ -794,12 +1509,62 @@ type seriesBlockIndexEncodeInfo struct {
 	min      []byte
 }
 
-// ReadSeriesBlockTrailer returns the series list trailer from data.
+// seriesBlockIndexHeapSize is the approximate size of a decoded series index.
+const seriesBlockIndexHeapSize = 64
+
+// heapSize returns the approximate size of the structures decoded from the
+// block data, which are the series indexes & sketches.
+func (blk *SeriesBlock) heapSize() int64 {
+	return int64(len(blk.seriesIndexes))*seriesBlockIndexHeapSize + blk.sketchSize
+}
+
+// seriesBlockTrailerSize returns the size of the series list trailer in an
+// index file of the given version.
+func seriesBlockTrailerSize(version int) int {
+	if version < IndexFileVersion5 {
+		return SeriesBlockTrailerV4Size
+	}
+	return SeriesBlockTrailerSize
+}
+
+// ReadSeriesBlockTrailer returns the series list trailer of the current
+// version from data.
 func ReadSeriesBlockTrailer(data []byte) SeriesBlockTrailer {
+	return readSeriesBlockTrailer(data, IndexFileVersion)
+}
+
+// readSeriesBlockTrailerAt reads the series list trailer of the index file in
+// r, which has the trailer t. Returns ErrInvalidSeriesBlock if the series block
+// is too small to hold the trailer.
+func readSeriesBlockTrailerAt(r io.ReaderAt, t *IndexFileTrailer) (SeriesBlockTrailer, error) {
+	size := int64(seriesBlockTrailerSize(t.Version))
+	if t.SeriesBlock.Size < size {
+		return SeriesBlockTrailer{}, ErrInvalidSeriesBlock
+	}
+
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, t.SeriesBlock.Offset+t.SeriesBlock.Size-size); err != nil {
+		return SeriesBlockTrailer{}, err
+	}
+	return readSeriesBlockTrailer(buf, t.Version), nil
+}
+
+// readSeriesBlockTrailer returns the series list trailer from data, which is
+// from an index file of the given version.
+func readSeriesBlockTrailer(data []byte, version int) SeriesBlockTrailer {
 	var t SeriesBlockTrailer
 
 	// Slice trailer data.
-	buf := data[len(data)-SeriesBlockTrailerSize:]
+	buf := data[len(data)-seriesBlockTrailerSize(version):]
+
+	// Read series key codec & order.
+	if version >= IndexFileVersion5 {
+		t.Codec = SeriesBlockCodec(buf[0] &^ seriesBlockHashOrderFlag)
+		if buf[0]&seriesBlockHashOrderFlag != 0 {
+			t.Order = SeriesBlockOrderHash
+		}
+		buf = buf[1:]
+	}
 
 	// Read series data info.
 	t.Series.Data.Offset, buf = int32(binary.BigEndian.Uint32(buf[0:4])), buf[4:]
@@ -832,6 +1597,12 @@ func ReadSeriesBlockTrailer(data []byte) SeriesBlockTrailer {
 
 // SeriesBlockTrailer represents meta data written to the end of the series list.
 type SeriesBlockTrailer struct {
+	// Codec used to write the series keys. Not recorded before version 5.
+	Codec SeriesBlockCodec
+
+	// Order of the series, recorded with the codec.
+	Order SeriesBlockOrder
+
 	Series struct {
 		Data struct {
 			Offset int32
@@ -868,6 +1639,14 @@ type SeriesBlockTrailer struct {
 }
 
 func (t SeriesBlockTrailer) WriteTo(w io.Writer) (n int64, err error) {
+	codec := uint8(t.Codec)
+	if t.Order == SeriesBlockOrderHash {
+		codec |= seriesBlockHashOrderFlag
+	}
+	if err := writeUint8To(w, codec, &n); err != nil {
+		return n, err
+	}
+
 	if err := writeUint32To(w, uint32(t.Series.Data.Offset), &n); err != nil {
 		return n, err
 	} else if err := writeUint32To(w, uint32(t.Series.Data.Size), &n); err != nil {
@@ -943,24 +1722,28 @@ func (a series) Less(i, j int) bool {
 	return models.CompareTags(a[i].tags, a[j].tags) == -1
 }
 
-// mapIndexFileSeriesBlock maps a writer to a series block.
+// mapIndexFileSeriesBlock maps a writer to a series block which starts at
+// offset & runs to the end of the written data.
 // Returns the series block and the mmap byte slice (if mmap is used).
 // The memory-mapped slice MUST be unmapped by the caller.
-func mapIndexFileSeriesBlock(w io.Writer) (*SeriesBlock, []byte, error) {
+func mapIndexFileSeriesBlock(w io.Writer, offset int64) (*SeriesBlock, []byte, error) {
 	switch w := w.(type) {
 	case *bytes.Buffer:
-		return mapIndexFileSeriesBlockBuffer(w)
+		return mapIndexFileSeriesBlockBuffer(w, offset)
 	case *os.File:
-		return mapIndexFileSeriesBlockFile(w)
+		return mapIndexFileSeriesBlockFile(w, offset)
 	default:
 		return nil, nil, fmt.Errorf("invalid tsi1 writer type: %T", w)
 	}
 }
 
 // mapIndexFileSeriesBlockBuffer maps a buffer to a series block.
-func mapIndexFileSeriesBlockBuffer(buf *bytes.Buffer) (*SeriesBlock, []byte, error) {
+func mapIndexFileSeriesBlockBuffer(buf *bytes.Buffer, offset int64) (*SeriesBlock, []byte, error) {
 	data := buf.Bytes()
-	data = data[len(FileSignature):] // Skip file signature.
+	if offset > int64(len(data)) {
+		return nil, nil, io.ErrShortBuffer
+	}
+	data = data[offset:] // Skip file signature & padding.
 
 	var sblk SeriesBlock
 	if err := sblk.UnmarshalBinary(data); err != nil {
@@ -970,13 +1753,17 @@ func mapIndexFileSeriesBlockBuffer(buf *bytes.Buffer) (*SeriesBlock, []byte, err
 }
 
 // mapIndexFileSeriesBlockFile memory-maps a file to a series block.
-func mapIndexFileSeriesBlockFile(f *os.File) (*SeriesBlock, []byte, error) {
+func mapIndexFileSeriesBlockFile(f *os.File, offset int64) (*SeriesBlock, []byte, error) {
 	// Open a read-only memory map of the existing data.
 	data, err := mmap.Map(f.Name())
 	if err != nil {
 		return nil, nil, err
 	}
-	sblk_data := data[len(FileSignature):] // Skip file signature.
+	if offset > int64(len(data)) {
+		mmap.Unmap(data)
+		return nil, nil, io.ErrShortBuffer
+	}
+	sblk_data := data[offset:] // Skip file signature & padding.
 
 	// Unmarshal block on top of mmap.
 	var sblk SeriesBlock
@@ -0,0 +1,4 @@
+package tsi1
+
+// Check the series order in every encoder created by the tests.
+func init() { strictSeriesOrder = true }
@@ -3,9 +3,11 @@ package tsi1_test
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"testing"
 
 	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/pkg/rhh"
 	"github.com/influxdata/influxdb/tsdb/index/tsi1"
 )
 
@@ -51,30 +53,530 @@ func TestSeriesBlock_Series(t *testing.T) {
 	}
 }
 
+// Ensure the hash index is sized from the expected number of series & grows
+// when more series are encoded.
+func TestSeriesBlockEncoder_HashCapacity(t *testing.T) {
+	if _, n, err := CreateSeriesBlockWithCodec([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	}, tsi1.SeriesBlockCodecNone); err != nil {
+		t.Fatal(err)
+	} else if n > 1024 {
+		t.Fatalf("unexpected block size: %d", n)
+	}
+
+	var series []Series
+	for i := 0; i < 1000; i++ {
+		series = append(series, Series{
+			Name: []byte("cpu"),
+			Tags: models.NewTags(map[string]string{"host": fmt.Sprintf("server-%04d", i)}),
+		})
+	}
+
+	var buf bytes.Buffer
+	enc := tsi1.NewSeriesBlockEncoder(&buf, 1, M, K)
+	for _, s := range series {
+		if err := enc.Encode(s.Name, s.Tags, s.Deleted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var blk tsi1.SeriesBlock
+	if err := blk.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range series {
+		if e := blk.Series(s.Name, s.Tags); e == nil {
+			t.Fatalf("series does not exist: i=%d", i)
+		}
+	}
+}
+
+// Ensure a prefix-compressed series block can be read.
+func TestSeriesBlock_Series_PrefixCodec(t *testing.T) {
+	var series []Series
+	for i := 0; i < 100; i++ {
+		series = append(series, Series{
+			Name:    []byte("cpu"),
+			Tags:    models.NewTags(map[string]string{"host": fmt.Sprintf("server%03d", i), "region": "east"}),
+			Deleted: i%7 == 0,
+		})
+	}
+
+	blk, n, err := CreateSeriesBlockWithCodec(series, tsi1.SeriesBlockCodecPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, uncompressedN, err := CreateSeriesBlockWithCodec(series, tsi1.SeriesBlockCodecNone)
+	if err != nil {
+		t.Fatal(err)
+	} else if n >= uncompressedN {
+		t.Fatalf("expected smaller block: %d >= %d", n, uncompressedN)
+	} else if blk.Codec() != tsi1.SeriesBlockCodecPrefix || uncompressed.Codec() != tsi1.SeriesBlockCodecNone {
+		t.Fatalf("unexpected codecs: %s/%s", blk.Codec(), uncompressed.Codec())
+	}
+
+	// Verify all series can be looked up.
+	for i, s := range series {
+		if e := blk.Series(s.Name, s.Tags); e == nil {
+			t.Fatalf("series does not exist: i=%d", i)
+		} else if !bytes.Equal(e.Name(), s.Name) || models.CompareTags(e.Tags(), s.Tags) != 0 {
+			t.Fatalf("series element does not match: i=%d, %s (%s) != %s (%s)", i, e.Name(), e.Tags().String(), s.Name, s.Tags.String())
+		} else if e.Deleted() != s.Deleted {
+			t.Fatalf("unexpected deleted: i=%d", i)
+		}
+
+		if exists, tombstoned := blk.HasSeries(s.Name, s.Tags, nil); !exists || tombstoned != s.Deleted {
+			t.Fatalf("unexpected existence: i=%d, exists=%v, tombstoned=%v", i, exists, tombstoned)
+		}
+	}
+
+	// Verify iteration returns series in order.
+	itr := blk.SeriesIterator()
+	for i, s := range series {
+		if e := itr.Next(); e == nil {
+			t.Fatalf("expected series: i=%d", i)
+		} else if models.CompareTags(e.Tags(), s.Tags) != 0 {
+			t.Fatalf("unexpected series: i=%d, %s", i, e.Tags().String())
+		}
+	}
+	if e := itr.Next(); e != nil {
+		t.Fatalf("expected eof, got: %s", e.Tags().String())
+	}
+
+	// Verify non-existent series doesn't exist.
+	if e := blk.Series([]byte("cpu"), models.NewTags(map[string]string{"host": "server100", "region": "east"})); e != nil {
+		t.Fatalf("series should not exist: %#v", e)
+	}
+}
+
+// Ensure a series block with a codec this version cannot decode is rejected.
+func TestSeriesBlock_UnmarshalBinary_ErrUnsupportedSeriesBlockCodec(t *testing.T) {
+	var buf bytes.Buffer
+	enc := tsi1.NewSeriesBlockEncoder(&buf, 1, M, K)
+	enc.Codec = tsi1.SeriesBlockCodecPrefix
+	if err := enc.Encode([]byte("cpu"), models.NewTags(map[string]string{"region": "east"}), false); err != nil {
+		t.Fatal(err)
+	} else if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	if st := tsi1.ReadSeriesBlockTrailer(data); st.Codec != tsi1.SeriesBlockCodecPrefix {
+		t.Fatalf("unexpected codec: %s", st.Codec)
+	}
+
+	data[len(data)-tsi1.SeriesBlockTrailerSize] = 0xFF
+	var blk tsi1.SeriesBlock
+	if err := blk.UnmarshalBinary(data); err != tsi1.ErrUnsupportedSeriesBlockCodec {
+		t.Fatalf("unexpected error: %v", err)
+	} else if s := tsi1.SeriesBlockCodec(0xFF).String(); s != "SeriesBlockCodec(255)" {
+		t.Fatalf("unexpected name: %s", s)
+	}
+}
+
+// Ensure the encoder rejects series which do not sort after the previous one.
+func TestSeriesBlockEncoder_Encode_ErrSeriesOrder(t *testing.T) {
+	east := models.NewTags(map[string]string{"region": "east"})
+	west := models.NewTags(map[string]string{"region": "west"})
+
+	for _, codec := range []tsi1.SeriesBlockCodec{tsi1.SeriesBlockCodecNone, tsi1.SeriesBlockCodecPrefix} {
+		for _, tags := range []models.Tags{east, west} {
+			enc := tsi1.NewSeriesBlockEncoder(&bytes.Buffer{}, 2, M, K)
+			enc.Codec = codec
+			enc.Strict = true
+			if err := enc.Encode([]byte("cpu"), west, false); err != nil {
+				t.Fatal(err)
+			}
+
+			err := enc.Encode([]byte("cpu"), tags, false)
+			if e, ok := err.(*tsi1.ErrSeriesOrder); !ok {
+				t.Fatalf("unexpected error: %v", err)
+			} else if !bytes.Equal(e.Prev, tsi1.AppendSeriesKey(nil, []byte("cpu"), west)) {
+				t.Fatalf("unexpected previous key: %x", e.Prev)
+			} else if !bytes.Equal(e.Key, tsi1.AppendSeriesKey(nil, []byte("cpu"), tags)) {
+				t.Fatalf("unexpected key: %x", e.Key)
+			}
+		}
+	}
+}
+
+// Ensure the encoder does not compare series unless it is strict & does not
+// assume they are sorted.
+func TestSeriesBlockEncoder_Encode_AssumeSorted(t *testing.T) {
+	for _, tt := range []struct {
+		strict, assumeSorted bool
+	}{
+		{strict: false, assumeSorted: false},
+		{strict: true, assumeSorted: true},
+	} {
+		var buf bytes.Buffer
+		enc := tsi1.NewSeriesBlockEncoder(&buf, 2, M, K)
+		enc.Strict, enc.AssumeSorted = tt.strict, tt.assumeSorted
+		if err := enc.Encode([]byte("mem"), nil, false); err != nil {
+			t.Fatal(err)
+		} else if err := enc.Encode([]byte("cpu"), nil, false); err != nil {
+			t.Fatalf("strict=%v, assumeSorted=%v: unexpected error: %v", tt.strict, tt.assumeSorted, err)
+		} else if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure series keys can be decoded after being encoded.
+func TestDecodeSeriesKey(t *testing.T) {
+	rand := rand.New(rand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		name := []byte(fmt.Sprintf("m%d", rand.Intn(100)))
+		m := make(map[string]string)
+		for j, n := 0, rand.Intn(5); j < n; j++ {
+			m[fmt.Sprintf("k%d", rand.Intn(10))] = fmt.Sprintf("v%d", rand.Intn(1000))
+		}
+		tags := models.NewTags(m)
+
+		// Append trailing data, which is ignored.
+		key := tsi1.AppendSeriesKey(nil, name, tags)
+		buf := append(append([]byte{}, key...), 0xFF)
+
+		if gotName, gotTags, err := tsi1.DecodeSeriesKey(buf); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		} else if !bytes.Equal(gotName, name) {
+			t.Fatalf("unexpected name: i=%d, %s", i, gotName)
+		} else if !gotTags.Equal(tags) {
+			t.Fatalf("unexpected tags: i=%d, %s", i, gotTags.String())
+		}
+
+		// Every truncation of the key fails.
+		for n := 0; n < len(key); n++ {
+			if _, _, err := tsi1.DecodeSeriesKey(key[:n]); err != tsi1.ErrSeriesKeyTruncated {
+				t.Fatalf("unexpected error: i=%d, n=%d, %v", i, n, err)
+			}
+		}
+	}
+}
+
+// Ensure appending a series key reuses a buffer with enough capacity & grows
+// a smaller buffer with a single allocation.
+func TestAppendSeriesKey_Allocs(t *testing.T) {
+	name, tags := []byte("cpu"), seriesKeyBenchmarkTags(8)
+	exp := tsi1.AppendSeriesKey(nil, name, tags)
+
+	buf := make([]byte, 0, len(exp))
+	if n := testing.AllocsPerRun(100, func() {
+		buf = tsi1.AppendSeriesKey(buf[:0], name, tags)
+	}); n != 0 {
+		t.Fatalf("unexpected allocs: %v", n)
+	} else if !bytes.Equal(buf, exp) {
+		t.Fatalf("unexpected key: %x", buf)
+	}
+
+	prefix := []byte("prefix")
+	if n := testing.AllocsPerRun(100, func() {
+		buf = tsi1.AppendSeriesKey(prefix[:len(prefix):len(prefix)], name, tags)
+	}); n != 1 {
+		t.Fatalf("unexpected allocs: %v", n)
+	} else if !bytes.Equal(buf, append(append([]byte{}, prefix...), exp...)) {
+		t.Fatalf("unexpected key: %x", buf)
+	}
+}
+
+// BenchmarkAppendSeriesKey measures encoding series keys into a reused buffer.
+func BenchmarkAppendSeriesKey(b *testing.B) {
+	for _, n := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("tags=%d", n), func(b *testing.B) {
+			name, tags := []byte("cpu"), seriesKeyBenchmarkTags(n)
+			var buf []byte
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buf = tsi1.AppendSeriesKey(buf[:0], name, tags)
+			}
+		})
+	}
+}
+
+// seriesKeyBenchmarkTags returns n tags of a typical size.
+func seriesKeyBenchmarkTags(n int) models.Tags {
+	m := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		m[fmt.Sprintf("tagkey%d", i)] = fmt.Sprintf("tagvalue%04d", i)
+	}
+	return models.NewTags(m)
+}
+
+// Ensure a series key with inconsistent lengths returns an error.
+func TestDecodeSeriesKey_Invalid(t *testing.T) {
+	key := tsi1.AppendSeriesKey(nil, []byte("cpu"), models.NewTags(map[string]string{"region": "east"}))
+
+	// Overstate the length of the name.
+	buf := append([]byte{}, key...)
+	buf[2] = 0xFF
+	if _, _, err := tsi1.DecodeSeriesKey(buf); err != tsi1.ErrInvalidSeriesKey {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Overstate the tag count.
+	buf = append([]byte{}, key...)
+	buf[1+2+3] = 2
+	if _, _, err := tsi1.DecodeSeriesKey(buf); err != tsi1.ErrInvalidSeriesKey {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure series can be looked up in blocks written with each hash.
+func TestSeriesBlock_Series_Hash(t *testing.T) {
+	var series []Series
+	for i := 0; i < 1000; i++ {
+		series = append(series, Series{
+			Name:    []byte("cpu"),
+			Tags:    models.NewTags(map[string]string{"host": fmt.Sprintf("server%04d", i)}),
+			Deleted: i%7 == 0,
+		})
+	}
+
+	for _, hash := range []tsi1.SeriesBlockHash{tsi1.SeriesBlockHashXXHash, tsi1.SeriesBlockHashFNV} {
+		for _, codec := range []tsi1.SeriesBlockCodec{tsi1.SeriesBlockCodecNone, tsi1.SeriesBlockCodecPrefix} {
+			blk, _, err := CreateSeriesBlockWithCodecHash(series, codec, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, s := range series {
+				if exists, tombstoned := blk.HasSeries(s.Name, s.Tags, nil); !exists || tombstoned != s.Deleted {
+					t.Fatalf("unexpected existence: hash=%d, codec=%d, i=%d, exists=%v, tombstoned=%v", hash, codec, i, exists, tombstoned)
+				}
+			}
+			if exists, _ := blk.HasSeries([]byte("cpu"), models.NewTags(map[string]string{"host": "server1000"}), nil); exists {
+				t.Fatalf("series should not exist: hash=%d, codec=%d", hash, codec)
+			}
+		}
+	}
+}
+
+// Ensure a block ordered by hash is looked up & iterated the same as a block in
+// key order, across several hash indexes.
+func TestSeriesBlock_Series_Order(t *testing.T) {
+	var series []Series
+	for i := 0; i < tsi1.MaxSeriesBlockHashSize+1000; i++ {
+		series = append(series, Series{
+			Name:    []byte("cpu"),
+			Tags:    models.NewTags(map[string]string{"host": fmt.Sprintf("server%05d", i)}),
+			Deleted: i%7 == 0,
+		})
+	}
+
+	for _, codec := range []tsi1.SeriesBlockCodec{tsi1.SeriesBlockCodecNone, tsi1.SeriesBlockCodecPrefix} {
+		blk, _, err := CreateSeriesBlockWithOrder(series, codec, tsi1.SeriesBlockHashXXHash, tsi1.SeriesBlockOrderHash)
+		if err != nil {
+			t.Fatal(err)
+		} else if blk.Order() != tsi1.SeriesBlockOrderHash || blk.Codec() != codec {
+			t.Fatalf("unexpected order/codec: %s/%s", blk.Order(), blk.Codec())
+		}
+
+		// Series are found & their offsets are not in key order.
+		var prev uint32
+		var sorted = true
+		for i, s := range series {
+			offset, tombstoned := blk.Offset(s.Name, s.Tags, nil)
+			if offset == 0 || tombstoned != s.Deleted {
+				t.Fatalf("codec=%s, i=%d: unexpected offset: %d, tombstoned=%v", codec, i, offset, tombstoned)
+			} else if offset < prev {
+				sorted = false
+			}
+			prev = offset
+		}
+		if sorted {
+			t.Fatalf("codec=%s: expected series out of key order", codec)
+		} else if exists, _ := blk.HasSeries([]byte("cpu"), models.NewTags(map[string]string{"host": "server99999"}), nil); exists {
+			t.Fatalf("codec=%s: series should not exist", codec)
+		}
+
+		// Series are iterated in key order.
+		itr := blk.SeriesIterator()
+		if n, ok := tsi1.SeriesIteratorEstimatedCount(itr); !ok || n != uint64(len(series)) {
+			t.Fatalf("codec=%s: unexpected estimated count: %d", codec, n)
+		}
+		var i int
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			if i >= len(series) {
+				t.Fatalf("codec=%s: unexpected series: %s %s", codec, e.Name(), e.Tags())
+			} else if s := series[i]; !bytes.Equal(e.Name(), s.Name) || models.CompareTags(e.Tags(), s.Tags) != 0 || e.Deleted() != s.Deleted {
+				t.Fatalf("codec=%s, i=%d: unexpected series: %s %s", codec, i, e.Name(), e.Tags())
+			}
+			i++
+		}
+		if i != len(series) {
+			t.Fatalf("codec=%s: unexpected series count: %d", codec, i)
+		}
+	}
+
+	// The order is recorded in the trailer with the codec.
+	var buf bytes.Buffer
+	enc := tsi1.NewSeriesBlockEncoder(&buf, 1, M, K)
+	enc.Codec, enc.Order = tsi1.SeriesBlockCodecPrefix, tsi1.SeriesBlockOrderHash
+	if err := enc.Encode([]byte("cpu"), nil, false); err != nil {
+		t.Fatal(err)
+	} else if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	} else if tr := tsi1.ReadSeriesBlockTrailer(buf.Bytes()); tr.Order != tsi1.SeriesBlockOrderHash || tr.Codec != tsi1.SeriesBlockCodecPrefix {
+		t.Fatalf("unexpected trailer order/codec: %s/%s", tr.Order, tr.Codec)
+	} else if codec := buf.Bytes()[buf.Len()-tsi1.SeriesBlockTrailerSize]; codec != 0x80|byte(tsi1.SeriesBlockCodecPrefix) {
+		t.Fatalf("unexpected trailer codec byte: %#x", codec)
+	}
+}
+
+// BenchmarkSeriesBlock_HasSeries_Hash measures lookups of series whose keys
+// share the low 12 bits of their xxhash so they cluster in the hash index.
+// FNV spreads the same keys evenly.
+func BenchmarkSeriesBlock_HasSeries_Hash(b *testing.B) {
+	var series []Series
+	for i := 0; len(series) < 1000; i++ {
+		s := Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": fmt.Sprintf("server%08d", i)})}
+		if rhh.HashKey(tsi1.AppendSeriesKey(nil, s.Name, s.Tags))&0xFFF == 0 {
+			series = append(series, s)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		hash tsi1.SeriesBlockHash
+	}{
+		{"XXHash", tsi1.SeriesBlockHashXXHash},
+		{"FNV", tsi1.SeriesBlockHashFNV},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			blk, _, err := CreateSeriesBlockWithCodecHash(series, tsi1.SeriesBlockCodecNone, tt.hash)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var buf []byte
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s := series[i%len(series)]
+				if exists, _ := blk.HasSeries(s.Name, s.Tags, buf); !exists {
+					b.Fatal("expected series")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSeriesBlock_HasSeries_Random measures point lookups of series in a
+// random order, which probe the hash index & then the series data, in blocks
+// written in each order.
+func BenchmarkSeriesBlock_HasSeries_Random(b *testing.B) {
+	for _, order := range []tsi1.SeriesBlockOrder{tsi1.SeriesBlockOrderLexical, tsi1.SeriesBlockOrderHash} {
+		for _, n := range []int{1000, 100000, 1000000} {
+			b.Run(fmt.Sprintf("%s/N=%d", order, n), func(b *testing.B) {
+				series := make([]Series, n)
+				for i := range series {
+					series[i] = Series{
+						Name: []byte("cpu"),
+						Tags: models.NewTags(map[string]string{"host": fmt.Sprintf("server%08d", i)}),
+					}
+				}
+				blk, _, err := CreateSeriesBlockWithOrder(series, tsi1.SeriesBlockCodecNone, tsi1.SeriesBlockHashXXHash, order)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				rand := rand.New(rand.NewSource(0))
+				perm := rand.Perm(n)
+
+				var buf []byte
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					s := series[perm[i%n]]
+					if exists, _ := blk.HasSeries(s.Name, s.Tags, buf); !exists {
+						b.Fatal("expected series")
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkSeriesBlock_SeriesIterator compares iterating every series of a
+// block in each order, which sorts the series of each hash index by key for
+// blocks ordered by hash.
+func BenchmarkSeriesBlock_SeriesIterator(b *testing.B) {
+	series := make([]Series, 100000)
+	for i := range series {
+		series[i] = Series{
+			Name: []byte("cpu"),
+			Tags: models.NewTags(map[string]string{"host": fmt.Sprintf("server%08d", i)}),
+		}
+	}
+
+	for _, order := range []tsi1.SeriesBlockOrder{tsi1.SeriesBlockOrderLexical, tsi1.SeriesBlockOrderHash} {
+		b.Run(order.String(), func(b *testing.B) {
+			blk, _, err := CreateSeriesBlockWithOrder(series, tsi1.SeriesBlockCodecNone, tsi1.SeriesBlockHashXXHash, order)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				itr := blk.SeriesIterator()
+				for e := itr.Next(); e != nil; e = itr.Next() {
+				}
+			}
+		})
+	}
+}
+
 // CreateSeriesBlock returns an in-memory SeriesBlock with a list of series.
 func CreateSeriesBlock(a []Series) (*tsi1.SeriesBlock, error) {
+	blk, _, err := CreateSeriesBlockWithCodec(a, tsi1.SeriesBlockCodecNone)
+	return blk, err
+}
+
+// CreateSeriesBlockWithCodec returns an in-memory SeriesBlock with a list of
+// series encoded with codec & the size of the encoded block.
+func CreateSeriesBlockWithCodec(a []Series, codec tsi1.SeriesBlockCodec) (*tsi1.SeriesBlock, int, error) {
+	return CreateSeriesBlockWithCodecHash(a, codec, tsi1.SeriesBlockHashXXHash)
+}
+
+// CreateSeriesBlockWithCodecHash returns an in-memory SeriesBlock with a list
+// of series encoded with codec & hash and the size of the encoded block.
+func CreateSeriesBlockWithCodecHash(a []Series, codec tsi1.SeriesBlockCodec, hash tsi1.SeriesBlockHash) (*tsi1.SeriesBlock, int, error) {
+	return CreateSeriesBlockWithOrder(a, codec, hash, tsi1.SeriesBlockOrderLexical)
+}
+
+// CreateSeriesBlockWithOrder returns an in-memory SeriesBlock with a list of
+// series encoded with codec, hash & order and the size of the encoded block.
+func CreateSeriesBlockWithOrder(a []Series, codec tsi1.SeriesBlockCodec, hash tsi1.SeriesBlockHash, order tsi1.SeriesBlockOrder) (*tsi1.SeriesBlock, int, error) {
 	var buf bytes.Buffer
 
 	// Create writer and sketches. Add series.
 	enc := tsi1.NewSeriesBlockEncoder(&buf, uint32(len(a)), M, K)
+	enc.Codec, enc.Order = codec, order
+	if err := enc.SetHash(hash); err != nil {
+		return nil, 0, err
+	}
 	for i, s := range a {
 		if err := enc.Encode(s.Name, s.Tags, s.Deleted); err != nil {
-			return nil, fmt.Errorf("SeriesBlockWriter.Add(): i=%d, err=%s", i, err)
+			return nil, 0, fmt.Errorf("SeriesBlockWriter.Add(): i=%d, err=%s", i, err)
 		}
 	}
 
 	// Close and flush.
 	if err := enc.Close(); err != nil {
-		return nil, fmt.Errorf("SeriesBlockWriter.WriteTo(): %s", err)
+		return nil, 0, fmt.Errorf("SeriesBlockWriter.WriteTo(): %s", err)
 	}
 
 	// Unpack bytes into series block.
 	var blk tsi1.SeriesBlock
 	if err := blk.UnmarshalBinary(buf.Bytes()); err != nil {
-		return nil, fmt.Errorf("SeriesBlock.UnmarshalBinary(): %s", err)
+		return nil, 0, fmt.Errorf("SeriesBlock.UnmarshalBinary(): %s", err)
 	}
 
-	return &blk, nil
+	return &blk, buf.Len(), nil
 }
 
 // MustCreateSeriesBlock calls CreateSeriesBlock(). Panic on error.
@@ -0,0 +1,165 @@
+package tsi1
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// ErrInvalidSeriesIDData is returned when the series ids of a tag value cannot
+// be decoded.
+var ErrInvalidSeriesIDData = errors.New("invalid series id data")
+
+// SeriesIDSet is an immutable, sorted set of series ids within a single index
+// file. Set operations merge the sorted ids in linear time without decoding
+// the series.
+//
+// Series ids are offsets into the series block of the file they were read
+// from so sets from different files cannot be combined. Use
+// IndexFiles.SeriesIDSetIterator to merge the results from each file.
+type SeriesIDSet struct {
+	a []uint32
+}
+
+// NewSeriesIDSet returns a set containing ids. The ids do not need to be
+// sorted or unique.
+func NewSeriesIDSet(ids ...uint32) *SeriesIDSet {
+	a := make([]uint32, len(ids))
+	copy(a, ids)
+	sort.Sort(uint32Slice(a))
+
+	// Remove duplicates in place.
+	if len(a) > 1 {
+		n := 1
+		for _, id := range a[1:] {
+			if id != a[n-1] {
+				a[n] = id
+				n++
+			}
+		}
+		a = a[:n]
+	}
+	return &SeriesIDSet{a: a}
+}
+
+// Cardinality returns the number of ids in the set.
+func (s *SeriesIDSet) Cardinality() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.a)
+}
+
+// Contains returns true if id is in the set.
+func (s *SeriesIDSet) Contains(id uint32) bool {
+	if s == nil {
+		return false
+	}
+	i := sort.Search(len(s.a), func(i int) bool { return s.a[i] >= id })
+	return i < len(s.a) && s.a[i] == id
+}
+
+// Slice returns the ids in ascending order. The slice must not be modified.
+func (s *SeriesIDSet) Slice() []uint32 {
+	if s == nil {
+		return nil
+	}
+	return s.a
+}
+
+// And returns the intersection of s and other.
+func (s *SeriesIDSet) And(other *SeriesIDSet) *SeriesIDSet {
+	a, b := s.Slice(), other.Slice()
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	c := make([]uint32, 0, n)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		if a[i] < b[j] {
+			i++
+		} else if a[i] > b[j] {
+			j++
+		} else {
+			c = append(c, a[i])
+			i, j = i+1, j+1
+		}
+	}
+	return &SeriesIDSet{a: c}
+}
+
+// Or returns the union of s and other.
+func (s *SeriesIDSet) Or(other *SeriesIDSet) *SeriesIDSet {
+	a, b := s.Slice(), other.Slice()
+	c := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] < b[j] {
+			c, i = append(c, a[i]), i+1
+		} else if a[i] > b[j] {
+			c, j = append(c, b[j]), j+1
+		} else {
+			c = append(c, a[i])
+			i, j = i+1, j+1
+		}
+	}
+	c = append(c, a[i:]...)
+	c = append(c, b[j:]...)
+	return &SeriesIDSet{a: c}
+}
+
+// AndNot returns the ids in s which are not in other.
+func (s *SeriesIDSet) AndNot(other *SeriesIDSet) *SeriesIDSet {
+	a, b := s.Slice(), other.Slice()
+	c := make([]uint32, 0, len(a))
+	j := 0
+	for _, id := range a {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+		if j < len(b) && b[j] == id {
+			continue
+		}
+		c = append(c, id)
+	}
+	return &SeriesIDSet{a: c}
+}
+
+// decodeSeriesIDSet decodes n delta-encoded series ids from data.
+func decodeSeriesIDSet(n uint32, data []byte) (*SeriesIDSet, error) {
+	a := make([]uint32, 0, n)
+	var prev uint32
+	for len(data) > 0 {
+		delta, sz := binary.Uvarint(data)
+		if sz <= 0 || (delta == 0 && len(a) > 0) {
+			return nil, ErrInvalidSeriesIDData
+		}
+		data = data[sz:]
+
+		prev += uint32(delta)
+		a = append(a, prev)
+	}
+	if uint32(len(a)) != n {
+		return nil, ErrInvalidSeriesIDData
+	}
+	return &SeriesIDSet{a: a}, nil
+}
+
+// seriesIDSetIterator iterates over the ids in a set.
+type seriesIDSetIterator struct {
+	a []uint32
+}
+
+// remaining returns the number of ids left.
+func (itr *seriesIDSetIterator) remaining() uint64 { return uint64(len(itr.a)) }
+
+// next returns the next id or zero when the set is exhausted.
+func (itr *seriesIDSetIterator) next() uint32 {
+	if len(itr.a) == 0 {
+		return 0
+	}
+	id := itr.a[0]
+	itr.a = itr.a[1:]
+	return id
+}
@@ -0,0 +1,200 @@
+package tsi1_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure set operations return sorted, unique ids.
+func TestSeriesIDSet(t *testing.T) {
+	a := tsi1.NewSeriesIDSet(5, 1, 3, 3, 9)
+	b := tsi1.NewSeriesIDSet(3, 4, 9, 10)
+
+	if got, exp := a.Slice(), []uint32{1, 3, 5, 9}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected ids: %v", got)
+	} else if a.Cardinality() != 4 {
+		t.Fatalf("unexpected cardinality: %d", a.Cardinality())
+	} else if !a.Contains(5) || a.Contains(4) || a.Contains(10) {
+		t.Fatal("unexpected containment")
+	}
+
+	if got, exp := a.And(b).Slice(), []uint32{3, 9}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected and: %v", got)
+	} else if got, exp := a.Or(b).Slice(), []uint32{1, 3, 4, 5, 9, 10}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected or: %v", got)
+	} else if got, exp := a.AndNot(b).Slice(), []uint32{1, 5}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected and not: %v", got)
+	}
+
+	// A nil set is empty.
+	var empty *tsi1.SeriesIDSet
+	if empty.Cardinality() != 0 || empty.Contains(1) {
+		t.Fatal("expected empty set")
+	} else if got := a.And(empty).Cardinality(); got != 0 {
+		t.Fatalf("unexpected and cardinality: %d", got)
+	} else if got := empty.Or(a).Slice(); !reflect.DeepEqual(got, a.Slice()) {
+		t.Fatalf("unexpected or: %v", got)
+	}
+}
+
+// Ensure the set of a tag value contains the same series as its iterator.
+func TestIndexFile_TagValueSeriesIDSet(t *testing.T) {
+	f := MustFindOrGenerateIndexFile(1, 3, 4)
+
+	set, err := f.TagValueSeriesIDSet([]byte("measurement0"), []byte("key1"), []byte("value2"))
+	if err != nil {
+		t.Fatal(err)
+	} else if set.Cardinality() != 16 {
+		t.Fatalf("unexpected cardinality: %d", set.Cardinality())
+	}
+
+	var exp, got []string
+	itr := f.TagValueSeriesIterator([]byte("measurement0"), []byte("key1"), []byte("value2"))
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		exp = append(exp, string(models.MakeKey(e.Name(), e.Tags())))
+	}
+	itr = f.SeriesIDSetIterator(set)
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		got = append(got, string(models.MakeKey(e.Name(), e.Tags())))
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected series: %v", got)
+	}
+
+	// Missing elements return an empty set.
+	if set, err := f.TagValueSeriesIDSet([]byte("measurement0"), []byte("key1"), []byte("no_such_value")); err != nil {
+		t.Fatal(err)
+	} else if set.Cardinality() != 0 {
+		t.Fatalf("unexpected cardinality: %d", set.Cardinality())
+	} else if set, err := f.TagValueSeriesIDSet([]byte("no_such_measurement"), []byte("key1"), []byte("value2")); err != nil {
+		t.Fatal(err)
+	} else if set.Cardinality() != 0 {
+		t.Fatalf("unexpected cardinality: %d", set.Cardinality())
+	}
+}
+
+// Ensure sets combined in each file merge across files with precedence.
+func TestIndexFiles_SeriesIDSetIterator(t *testing.T) {
+	f0 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "a"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "b"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "host": "a"})},
+	})
+	f1 := MustCreateIndexFile([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "a"}), Deleted: true},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east", "host": "c"})},
+	})
+	p := tsi1.IndexFiles{f1, f0}
+
+	east, err := p.TagValueSeriesIDSets([]byte("cpu"), []byte("region"), []byte("east"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostA, err := p.TagValueSeriesIDSets([]byte("cpu"), []byte("host"), []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Intersect region=east AND host=a within each file.
+	sets := make([]*tsi1.SeriesIDSet, len(p))
+	for i := range p {
+		sets[i] = east[i].And(hostA[i])
+	}
+
+	itr, err := p.SeriesIDSetIterator(sets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer itr.Close()
+
+	if e := itr.Next(); e == nil || string(models.MakeKey(e.Name(), e.Tags())) != "cpu,host=a,region=east" || !e.Deleted() {
+		t.Fatalf("unexpected series: %v", e)
+	} else if e := itr.Next(); e != nil {
+		t.Fatalf("expected eof, got: %s", models.MakeKey(e.Name(), e.Tags()))
+	}
+
+	if _, err := p.SeriesIDSetIterator(sets[:1]); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// BenchmarkIndexFile_TagValueIntersection compares intersecting two tag
+// values using series id sets & merging series iterators.
+func BenchmarkIndexFile_TagValueIntersection(b *testing.B) {
+	f := MustFindOrGenerateIndexFile(1, 4, 10)
+	name := []byte("measurement0")
+
+	b.Run("SeriesIDSet", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s0, err := f.TagValueSeriesIDSet(name, []byte("key0"), []byte("value1"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			s1, err := f.TagValueSeriesIDSet(name, []byte("key1"), []byte("value2"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n := s0.And(s1).Cardinality(); n != 100 {
+				b.Fatalf("unexpected cardinality: %d", n)
+			}
+		}
+	})
+
+	b.Run("SeriesIterator", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			itr := tsi1.IntersectSeriesIterators(
+				f.TagValueSeriesIterator(name, []byte("key0"), []byte("value1")),
+				f.TagValueSeriesIterator(name, []byte("key1"), []byte("value2")),
+			)
+			var n int
+			for e := itr.Next(); e != nil; e = itr.Next() {
+				n++
+			}
+			if n != 100 {
+				b.Fatalf("unexpected cardinality: %d", n)
+			}
+		}
+	})
+}
+
+// BenchmarkIndexFile_TagValueUnion compares unioning two tag values using
+// series id sets & merging series iterators.
+func BenchmarkIndexFile_TagValueUnion(b *testing.B) {
+	f := MustFindOrGenerateIndexFile(1, 4, 10)
+	name := []byte("measurement0")
+
+	b.Run("SeriesIDSet", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s0, err := f.TagValueSeriesIDSet(name, []byte("key0"), []byte("value1"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			s1, err := f.TagValueSeriesIDSet(name, []byte("key1"), []byte("value2"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n := s0.Or(s1).Cardinality(); n != 1900 {
+				b.Fatalf("unexpected cardinality: %d", n)
+			}
+		}
+	})
+
+	b.Run("SeriesIterator", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			itr := tsi1.UnionSeriesIterators(
+				f.TagValueSeriesIterator(name, []byte("key0"), []byte("value1")),
+				f.TagValueSeriesIterator(name, []byte("key1"), []byte("value2")),
+			)
+			var n int
+			for e := itr.Next(); e != nil; e = itr.Next() {
+				n++
+			}
+			if n != 1900 {
+				b.Fatalf("unexpected cardinality: %d", n)
+			}
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package tsi1
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// SeriesReader scans the series block of an index file sequentially using
+// buffered reads instead of mapping the file. Memory use is bounded by the
+// read buffer & the largest series key rather than the size of the block.
+//
+// SeriesReader is scan-only: series are returned once in key order and
+// cannot be looked up. It is intended for tools such as exports & backups
+// which read every series once. Use IndexFile for random access & for blocks
+// written with SeriesBlockOrderHash, which are not stored in key order.
+type SeriesReader struct {
+	f    *os.File // set by OpenSeriesReader
+	path string
+
+	r        *bufio.Reader
+	h        hash.Hash32
+	checksum uint32 // expected series block checksum, if checksummed
+	verify   bool
+	codec    SeriesBlockCodec
+
+	i, n   uint32 // series read & total series
+	offset uint32 // offset of the next element within the series block
+	end    uint32 // end of the series data within the series block
+
+	// Body of the most recent full key, used to rebuild prefix-compressed
+	// keys.
+	restart struct {
+		offset uint32
+		body   []byte
+	}
+
+	buf []byte
+	e   SeriesBlockElem
+	err error
+}
+
+// OpenSeriesReader opens the index file at path for a sequential scan of its
+// series. The reader must be closed to release the file.
+func OpenSeriesReader(path string) (*SeriesReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r, err := newSeriesReader(f, fi.Size(), path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.f = f
+	return r, nil
+}
+
+// NewSeriesReader returns a reader over the series of the index file in ra,
+// which is size bytes long. The trailer & series block trailer are read
+// first and the series are then read in order from the series block.
+func NewSeriesReader(ra io.ReaderAt, size int64) (*SeriesReader, error) {
+	return newSeriesReader(ra, size, "")
+}
+
+func newSeriesReader(ra io.ReaderAt, size int64, path string) (*SeriesReader, error) {
+	t, err := readIndexFileTrailerFrom(ra, size)
+	if err != nil {
+		return nil, err
+	} else if err := t.validate(path, size); err != nil {
+		return nil, err
+	}
+
+	// Read the series block trailer for the series count, data size & codec.
+	st, err := readSeriesBlockTrailerAt(ra, &t)
+	if err == ErrInvalidSeriesBlock {
+		return nil, ErrInvalidIndexFile
+	} else if err != nil {
+		return nil, err
+	} else if !st.Codec.valid() {
+		return nil, ErrUnsupportedSeriesBlockCodec
+	} else if st.Order != SeriesBlockOrderLexical {
+		return nil, ErrHashOrderedSeriesBlock
+	} else if st.Series.Data.Offset != 1 || st.Series.Data.Size < 0 || int64(st.Series.Data.Offset)+int64(st.Series.Data.Size) > t.SeriesBlock.Size {
+		return nil, ErrInvalidIndexFile
+	}
+
+	r := &SeriesReader{
+		path:     path,
+		h:        crc32.NewIEEE(),
+		checksum: t.SeriesBlock.Checksum,
+		verify:   t.Checksummed(),
+		n:        uint32(st.SeriesN + st.TombstoneN),
+		end:      uint32(st.Series.Data.Offset + st.Series.Data.Size),
+		codec:    st.Codec,
+	}
+
+	// Checksum the block as it is read. The header byte is skipped so the
+	// offset of the first element is one.
+	sr := io.NewSectionReader(ra, t.SeriesBlock.Offset, t.SeriesBlock.Size)
+	r.r = bufio.NewReader(io.TeeReader(sr, r.h))
+	if _, err := r.r.Discard(1); err != nil {
+		return nil, err
+	}
+	r.offset = 1
+	return r, nil
+}
+
+// SeriesN returns the total number of series in the block, including
+// tombstoned series.
+func (r *SeriesReader) SeriesN() int { return int(r.n) }
+
+// Codec returns the codec used to write the series keys. See SeriesBlock.Codec.
+func (r *SeriesReader) Codec() SeriesBlockCodec { return r.codec }
+
+// Next returns the next series in key order or nil once all series have been
+// read. The element is only valid until the next call to Next.
+//
+// Once the last series is read the rest of the series block is read & the
+// block is verified against its checksum if the file has checksums.
+func (r *SeriesReader) Next() (SeriesElem, error) {
+	if r.err != nil {
+		return nil, r.err
+	} else if r.i == r.n {
+		if r.r != nil {
+			r.err = r.finish()
+			r.r = nil
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, nil
+	}
+
+	e, err := r.next()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.err = err
+		return nil, err
+	}
+	return e, nil
+}
+
+// next reads the next series element, skipping hash indexes.
+func (r *SeriesReader) next() (SeriesElem, error) {
+	for {
+		if r.offset >= r.end {
+			return nil, ErrInvalidIndexFile
+		}
+
+		start := r.offset
+		flag, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip hash index partitions.
+		if flag&SeriesHashIndexFlag != 0 {
+			var buf [4]byte
+			if err := r.readFull(buf[:]); err != nil {
+				return nil, err
+			}
+			n := int64(binary.BigEndian.Uint32(buf[:])) * SeriesIDSize
+			if n > int64(r.end-r.offset) {
+				return nil, ErrInvalidIndexFile
+			} else if _, err := r.r.Discard(int(n)); err != nil {
+				return nil, err
+			}
+			r.offset += uint32(n)
+			continue
+		}
+
+		var key []byte
+		if flag&SeriesPrefixFlag == 0 {
+			key, err = r.readFullKey(start)
+		} else {
+			key, err = r.readPrefixKey(start)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		r.e.unmarshalKey(flag, key, int(r.offset-start))
+		r.i++
+		return &r.e, nil
+	}
+}
+
+// readFullKey reads an uncompressed series key & records it as the restart
+// key for later prefix-compressed keys.
+func (r *SeriesReader) readFullKey(start uint32) ([]byte, error) {
+	sz, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	} else if sz > uint64(r.end-r.offset) {
+		return nil, ErrInvalidIndexFile
+	}
+
+	r.buf = appendUvarint(r.buf[:0], sz)
+	n := len(r.buf)
+	r.buf = growBytes(r.buf, n+int(sz))
+	if err := r.readFull(r.buf[n:]); err != nil {
+		return nil, err
+	}
+
+	r.restart.offset = start
+	r.restart.body = append(r.restart.body[:0], r.buf[n:]...)
+	return r.buf, nil
+}
+
+// readPrefixKey reads a prefix-compressed series key & rebuilds it from the
+// restart key.
+func (r *SeriesReader) readPrefixKey(start uint32) ([]byte, error) {
+	var v [3]uint64 // distance to restart element, shared prefix size & suffix size
+	for i := range v {
+		var err error
+		if v[i], err = r.readUvarint(); err != nil {
+			return nil, err
+		}
+	}
+	delta, shared, suffixN := v[0], v[1], v[2]
+
+	// Keys must be compressed against the most recent full key.
+	if r.restart.offset == 0 || delta != uint64(start-r.restart.offset) ||
+		shared > uint64(len(r.restart.body)) || suffixN > uint64(r.end-r.offset) {
+		return nil, ErrInvalidIndexFile
+	}
+
+	r.buf = appendUvarint(r.buf[:0], shared+suffixN)
+	r.buf = append(r.buf, r.restart.body[:shared]...)
+	n := len(r.buf)
+	r.buf = growBytes(r.buf, n+int(suffixN))
+	if err := r.readFull(r.buf[n:]); err != nil {
+		return nil, err
+	}
+	return r.buf, nil
+}
+
+// finish reads the rest of the series block & verifies its checksum.
+func (r *SeriesReader) finish() error {
+	if _, err := io.Copy(ioutil.Discard, r.r); err != nil {
+		return err
+	}
+	if r.verify {
+		if checksum := r.h.Sum32(); checksum != r.checksum {
+			return &ErrChecksumMismatch{Path: r.path, Block: "series", Expected: r.checksum, Actual: checksum}
+		}
+	}
+	return nil
+}
+
+// Close closes the file opened by OpenSeriesReader. It is a no-op for readers
+// returned by NewSeriesReader.
+func (r *SeriesReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func (r *SeriesReader) readByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.offset++
+	}
+	return b, err
+}
+
+func (r *SeriesReader) readFull(p []byte) error {
+	n, err := io.ReadFull(r.r, p)
+	r.offset += uint32(n)
+	return err
+}
+
+func (r *SeriesReader) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(byteReaderFunc(r.readByte))
+}
+
+// byteReaderFunc adapts a function to an io.ByteReader.
+type byteReaderFunc func() (byte, error)
+
+func (fn byteReaderFunc) ReadByte() (byte, error) { return fn() }
+
+// growBytes returns b resized to n bytes, reallocating only if the capacity
+// is too small.
+func growBytes(b []byte, n int) []byte {
+	if cap(b) < n {
+		other := make([]byte, n)
+		copy(other, b)
+		return other
+	}
+	return b[:n]
+}
@@ -0,0 +1,119 @@
+package tsi1_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+)
+
+// Ensure the series reader returns the same series as the series iterator of
+// the mapped file for each codec.
+func TestSeriesReader(t *testing.T) {
+	f0 := MustGenerateIndexFile(2, 3, 4)
+	f1 := MustCreateIndexFile([]Series{
+		{Name: []byte("measurement0"), Tags: models.NewTags(map[string]string{"key0": "value0", "key1": "value0", "key2": "value0"}), Deleted: true},
+	})
+
+	for _, codec := range []tsi1.SeriesBlockCodec{tsi1.SeriesBlockCodecNone, tsi1.SeriesBlockCodecPrefix} {
+		var buf bytes.Buffer
+		if _, err := (tsi1.IndexFiles{f1, f0}).CompactToWithOptions(context.Background(), &buf, M, K, tsi1.CompactOptions{SeriesBlockCodec: codec}); err != nil {
+			t.Fatal(err)
+		}
+
+		var f tsi1.IndexFile
+		if err := f.UnmarshalBinary(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		var exp []string
+		itr := f.SeriesIterator()
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			exp = append(exp, seriesReaderKey(e))
+		}
+
+		r, err := tsi1.NewSeriesReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		} else if r.SeriesN() != len(exp) {
+			t.Fatalf("unexpected series count: %d", r.SeriesN())
+		} else if r.Codec() != codec {
+			t.Fatalf("unexpected codec: %s", r.Codec())
+		}
+
+		var got []string
+		for {
+			e, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			} else if e == nil {
+				break
+			}
+			got = append(got, seriesReaderKey(e))
+		}
+		if len(got) != 128 || !reflect.DeepEqual(got, exp) {
+			t.Fatalf("%d. unexpected series: %v", codec, got)
+		} else if got[0] != "measurement0,key0=value0,key1=value0,key2=value0 deleted" {
+			t.Fatalf("%d. unexpected first series: %s", codec, got[0])
+		}
+
+		if e, err := r.Next(); e != nil || err != nil {
+			t.Fatalf("unexpected eof: %v %v", e, err)
+		} else if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure a corrupt series block fails its checksum once it has been read.
+func TestSeriesReader_ChecksumMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := (tsi1.IndexFiles{MustGenerateIndexFile(1, 2, 2)}).CompactTo(&buf, M, K); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	trailer, err := tsi1.ReadIndexFileTrailer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the end of the tombstone sketch so the keys still decode.
+	data[trailer.SeriesBlock.Offset+trailer.SeriesBlock.Size-tsi1.SeriesBlockTrailerSize-1] ^= 0xFF
+
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, tsi1.FormatIndexFileName(1, 1))
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := tsi1.OpenSeriesReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for {
+		e, err := r.Next()
+		if e != nil {
+			continue
+		} else if err, ok := err.(*tsi1.ErrChecksumMismatch); !ok || err.Path != path || err.Block != "series" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		break
+	}
+}
+
+// seriesReaderKey returns the key of e & whether it is deleted.
+func seriesReaderKey(e tsi1.SeriesElem) string {
+	key := string(models.MakeKey(e.Name(), e.Tags()))
+	if e.Deleted() {
+		key += " deleted"
+	}
+	return key
+}
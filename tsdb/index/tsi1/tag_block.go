@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 
 	"github.com/influxdata/influxdb/pkg/rhh"
 )
@@ -38,6 +39,7 @@ const (
 var (
 	ErrUnsupportedTagBlockVersion = errors.New("unsupported tag block version")
 	ErrTagBlockSizeMismatch       = errors.New("tag block size mismatch")
+	ErrInvalidTagBlock            = errors.New("invalid tag block")
 )
 
 // TagBlock represents tag key/value block for a single measurement.
@@ -57,6 +59,10 @@ func (blk *TagBlock) Version() int { return blk.version }
 
 // UnmarshalBinary unpacks data into the tag block. Tag block is not copied so data
 // should be retained and unchanged after being passed into this function.
+//
+// The trailer, sections & key hash index are bounds checked so a corrupt
+// header returns an error rather than panicking. Keys & values are decoded
+// lazily & are not checked.
 func (blk *TagBlock) UnmarshalBinary(data []byte) error {
 	// Read trailer.
 	t, err := ReadTagBlockTrailer(data)
@@ -68,18 +74,23 @@ func (blk *TagBlock) UnmarshalBinary(data []byte) error {
 	if int64(len(data)) != t.Size {
 		return ErrTagBlockSizeMismatch
 	}
+	body := data[:len(data)-TagBlockTrailerSize]
 
 	// Save data section.
-	blk.valueData = data[t.ValueData.Offset:]
-	blk.valueData = blk.valueData[:t.ValueData.Size]
+	var ok bool
+	if blk.valueData, ok = blockSection(body, t.ValueData.Offset, t.ValueData.Size); !ok {
+		return ErrInvalidTagBlock
+	}
 
 	// Save key data section.
-	blk.keyData = data[t.KeyData.Offset:]
-	blk.keyData = blk.keyData[:t.KeyData.Size]
+	if blk.keyData, ok = blockSection(body, t.KeyData.Offset, t.KeyData.Size); !ok {
+		return ErrInvalidTagBlock
+	}
 
 	// Save hash index block.
-	blk.hashData = data[t.HashIndex.Offset:]
-	blk.hashData = blk.hashData[:t.HashIndex.Size]
+	if blk.hashData, ok = blockSection(body, t.HashIndex.Offset, t.HashIndex.Size); !ok || !validHashIndex(blk.hashData) {
+		return ErrInvalidTagBlock
+	}
 
 	// Save entire block.
 	blk.data = data
@@ -135,6 +146,19 @@ func (blk *TagBlock) TagValueElem(key, value []byte) TagValueElem {
 		return nil
 	}
 
+	offset := blk.tagValueOffset(kelem, value)
+	if offset == 0 {
+		return nil
+	}
+
+	var e TagBlockValueElem
+	e.unmarshal(blk.data[offset:])
+	return &e
+}
+
+// tagValueOffset returns the offset of value within the block using the
+// key's hash index. Returns zero if the value does not exist.
+func (blk *TagBlock) tagValueOffset(kelem *TagBlockKeyElem, value []byte) uint64 {
 	// Slice hash index data.
 	hashData := kelem.hashIndex.buf
 
@@ -148,7 +172,7 @@ func (blk *TagBlock) TagValueElem(key, value []byte) TagValueElem {
 		// Find offset of tag value.
 		offset := binary.BigEndian.Uint64(hashData[TagValueNSize+(pos*TagValueOffsetSize):])
 		if offset == 0 {
-			return nil
+			return 0
 		}
 
 		// Parse into element.
@@ -157,13 +181,13 @@ func (blk *TagBlock) TagValueElem(key, value []byte) TagValueElem {
 
 		// Return if values match.
 		if bytes.Equal(e.value, value) {
-			return &e
+			return offset
 		}
 
 		// Check if we've exceeded the probe distance.
 		max := rhh.Dist(rhh.HashKey(e.value), pos, valueN)
 		if d > max {
-			return nil
+			return 0
 		}
 
 		// Move position forward.
@@ -171,11 +195,58 @@ func (blk *TagBlock) TagValueElem(key, value []byte) TagValueElem {
 		d++
 
 		if d > valueN {
-			return nil
+			return 0
 		}
 	}
 }
 
+// TagValueIteratorFrom returns an iterator over the values of key which sort
+// after the value after, such as to resume a paginated listing. Returns nil
+// if the key does not exist.
+//
+// If after exists in the block then the iterator is positioned past it using
+// the hash index. Otherwise the offsets in the hash index are sorted, which
+// puts them in value order, & binary searched so only O(log n) values are
+// decoded.
+func (blk *TagBlock) TagValueIteratorFrom(key, after []byte) TagValueIterator {
+	kelem, _ := blk.TagKeyElem(key).(*TagBlockKeyElem)
+	if kelem == nil {
+		return nil
+	} else if len(after) == 0 {
+		return kelem.TagValueIterator()
+	}
+	end := kelem.data.offset + kelem.data.size
+
+	// Resume directly after an existing value.
+	if offset := blk.tagValueOffset(kelem, after); offset != 0 {
+		var e TagBlockValueElem
+		e.unmarshal(blk.data[offset:])
+		return &tagBlockValueIterator{data: blk.data[offset+uint64(e.size) : end]}
+	}
+
+	// Read the offset of every value from the hash index.
+	hashData := kelem.hashIndex.buf
+	valueN := binary.BigEndian.Uint64(hashData[:TagValueNSize])
+	offsets := make([]uint64, 0, valueN)
+	for pos := uint64(0); pos < valueN; pos++ {
+		if offset := binary.BigEndian.Uint64(hashData[TagValueNSize+(pos*TagValueOffsetSize):]); offset != 0 {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Sort(uint64Slice(offsets))
+
+	// Find the first value after the resume point.
+	var e TagBlockValueElem
+	i := sort.Search(len(offsets), func(i int) bool {
+		e.unmarshal(blk.data[offsets[i]:])
+		return bytes.Compare(e.value, after) > 0
+	})
+	if i == len(offsets) {
+		return &tagBlockValueIterator{}
+	}
+	return &tagBlockValueIterator{data: blk.data[offsets[i]:end]}
+}
+
 // TagKeyIterator returns an iterator over all the keys in the block.
 func (blk *TagBlock) TagKeyIterator() TagKeyIterator {
 	return &tagBlockKeyIterator{
@@ -428,7 +499,7 @@ func (t *TagBlockTrailer) WriteTo(w io.Writer) (n int64, err error) {
 	// Write total size & encoding version.
 	if err := writeUint64To(w, uint64(t.Size), &n); err != nil {
 		return n, err
-	} else if err := writeUint16To(w, IndexFileVersion, &n); err != nil {
+	} else if err := writeUint16To(w, TagBlockVersion, &n); err != nil {
 		return n, err
 	}
 
@@ -438,6 +509,9 @@ func (t *TagBlockTrailer) WriteTo(w io.Writer) (n int64, err error) {
 // ReadTagBlockTrailer returns the tag block trailer from data.
 func ReadTagBlockTrailer(data []byte) (TagBlockTrailer, error) {
 	var t TagBlockTrailer
+	if len(data) < TagBlockTrailerSize {
+		return t, io.ErrShortBuffer
+	}
 
 	// Read version.
 	t.Version = int(binary.BigEndian.Uint16(data[len(data)-2:]))
@@ -75,6 +75,57 @@ func TestTagBlockWriter(t *testing.T) {
 	}
 }
 
+// Ensure value iteration can resume after values inside & outside the block.
+func TestTagBlock_TagValueIteratorFrom(t *testing.T) {
+	var buf bytes.Buffer
+	enc := tsi1.NewTagBlockEncoder(&buf)
+	if err := enc.EncodeKey([]byte("host"), false); err != nil {
+		t.Fatal(err)
+	}
+	var all []string
+	for i := 0; i < 100; i += 2 {
+		v := fmt.Sprintf("server%03d", i)
+		if err := enc.EncodeValue([]byte(v), false, []uint32{uint32(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, v)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var blk tsi1.TagBlock
+	if err := blk.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		after string
+		exp   []string
+	}{
+		{after: "", exp: all},
+		{after: "a", exp: all},
+		{after: "server000", exp: all[1:]},
+		{after: "server041", exp: all[21:]},
+		{after: "server042", exp: all[22:]},
+		{after: "server098", exp: nil},
+		{after: "z", exp: nil},
+	} {
+		var values []string
+		itr := blk.TagValueIteratorFrom([]byte("host"), []byte(tt.after))
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			values = append(values, string(e.Value()))
+		}
+		if !reflect.DeepEqual(values, tt.exp) {
+			t.Fatalf("unexpected values after %q: %v", tt.after, values)
+		}
+	}
+
+	if itr := blk.TagValueIteratorFrom([]byte("region"), nil); itr != nil {
+		t.Fatal("expected nil iterator")
+	}
+}
+
 var benchmarkTagBlock10x1000 *tsi1.TagBlock
 var benchmarkTagBlock100x1000 *tsi1.TagBlock
 var benchmarkTagBlock1000x1000 *tsi1.TagBlock
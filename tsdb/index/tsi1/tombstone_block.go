@@ -0,0 +1,66 @@
+package tsi1
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Tombstone block field size constants.
+const (
+	TombstoneBlockTimeSize  = 8
+	TombstoneBlockEntrySize = SeriesIDSize + TombstoneBlockTimeSize
+)
+
+// tombstoneBlock holds the deletion time of series tombstones in an index
+// file. Each entry is a series id, which is the offset of the series in the
+// series block, followed by the deletion time in nanoseconds since the epoch.
+// Both are big-endian & entries are sorted by series id so a time is found by
+// binary search. Tombstones without a recorded time have no entry.
+type tombstoneBlock []byte
+
+// len returns the number of entries in the block.
+func (blk tombstoneBlock) len() int { return len(blk) / TombstoneBlockEntrySize }
+
+// time returns the deletion time of the series with the given id. Returns zero
+// if the time was not recorded.
+func (blk tombstoneBlock) time(id uint32) int64 {
+	n := blk.len()
+	i := sort.Search(n, func(i int) bool { return blk.id(i) >= id })
+	if i >= n || blk.id(i) != id {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(blk[i*TombstoneBlockEntrySize+SeriesIDSize:]))
+}
+
+// id returns the series id of the i-th entry.
+func (blk tombstoneBlock) id(i int) uint32 {
+	return binary.BigEndian.Uint32(blk[i*TombstoneBlockEntrySize:])
+}
+
+// appendTombstoneEntry appends the deletion time of a series to a tombstone
+// block. Entries must be appended in series id order.
+func appendTombstoneEntry(dst []byte, id uint32, deletedAt int64) []byte {
+	var buf [TombstoneBlockEntrySize]byte
+	binary.BigEndian.PutUint32(buf[:SeriesIDSize], id)
+	binary.BigEndian.PutUint64(buf[SeriesIDSize:], uint64(deletedAt))
+	return append(dst, buf[:]...)
+}
+
+// sortTombstoneEntries sorts the entries of a tombstone block by series id,
+// for series blocks whose ids are not assigned in key order.
+func sortTombstoneEntries(blk []byte) { sort.Sort(tombstoneEntries(blk)) }
+
+// tombstoneEntries sorts tombstone block entries by series id.
+type tombstoneEntries []byte
+
+func (a tombstoneEntries) Len() int { return len(a) / TombstoneBlockEntrySize }
+func (a tombstoneEntries) Less(i, j int) bool {
+	return tombstoneBlock(a).id(i) < tombstoneBlock(a).id(j)
+}
+func (a tombstoneEntries) Swap(i, j int) {
+	var tmp [TombstoneBlockEntrySize]byte
+	x, y := a[i*TombstoneBlockEntrySize:][:TombstoneBlockEntrySize], a[j*TombstoneBlockEntrySize:][:TombstoneBlockEntrySize]
+	copy(tmp[:], x)
+	copy(x, y)
+	copy(y, tmp[:])
+}
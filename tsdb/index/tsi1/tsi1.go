@@ -5,8 +5,13 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"os"
+	"regexp"
+	"regexp/syntax"
+	"sync"
 
 	"github.com/influxdata/influxdb/influxql"
 	"github.com/influxdata/influxdb/models"
@@ -34,6 +39,13 @@ type MeasurementIterator interface {
 	Next() MeasurementElem
 }
 
+// MeasurementIteratorCloser represents a measurement iterator which holds resources, such as
+// references to files, until it is closed.
+type MeasurementIteratorCloser interface {
+	MeasurementIterator
+	io.Closer
+}
+
 // MergeMeasurementIterators returns an iterator that merges a set of iterators.
 // Iterators that are first in the list take precendence and a deletion by those
 // early iterators will invalidate elements by later iterators.
@@ -49,17 +61,42 @@ func MergeMeasurementIterators(itrs ...MeasurementIterator) MeasurementIterator
 	}
 }
 
+// MergeReverseMeasurementIterators returns an iterator that merges a set of
+// iterators which are sorted in descending order. Precedence is the same as
+// MergeMeasurementIterators.
+func MergeReverseMeasurementIterators(itrs ...MeasurementIterator) MeasurementIterator {
+	if len(itrs) == 0 {
+		return nil
+	}
+
+	return &measurementMergeIterator{
+		e:       make(measurementMergeElem, 0, len(itrs)),
+		buf:     make([]MeasurementElem, len(itrs)),
+		itrs:    itrs,
+		reverse: true,
+	}
+}
+
 type measurementMergeIterator struct {
 	e    measurementMergeElem
 	buf  []MeasurementElem
 	itrs []MeasurementIterator
+
+	// If true, merges iterators in descending order.
+	reverse bool
 }
 
-// Next returns the element with the next lowest name across the iterators.
+// Next returns the element with the next lowest name across the iterators, or
+// the next highest name if the iterator is reversed.
 //
 // If multiple iterators contain the same name then the first is returned
 // and the remaining ones are skipped.
 func (itr *measurementMergeIterator) Next() MeasurementElem {
+	next := -1
+	if itr.reverse {
+		next = 1
+	}
+
 	// Find next lowest name amongst the buffers.
 	var name []byte
 	for i, buf := range itr.buf {
@@ -72,8 +109,8 @@ func (itr *measurementMergeIterator) Next() MeasurementElem {
 			}
 		}
 
-		// Find next lowest name.
-		if name == nil || bytes.Compare(itr.buf[i].Name(), name) == -1 {
+		// Find next lowest (or highest, if reversed) name.
+		if name == nil || bytes.Compare(itr.buf[i].Name(), name) == next {
 			name = itr.buf[i].Name()
 		}
 	}
@@ -92,7 +129,9 @@ func (itr *measurementMergeIterator) Next() MeasurementElem {
 		itr.e = append(itr.e, buf)
 		itr.buf[i] = nil
 	}
-	return itr.e
+
+	// Return a pointer so the slice header is not allocated on each call.
+	return &itr.e
 }
 
 // measurementMergeElem represents a merged measurement element.
@@ -139,6 +178,201 @@ func (itr *filterUndeletedMeasurementIterator) Next() MeasurementElem {
 	}
 }
 
+// regexMeasurementIterator returns all measurements which match an expression.
+type regexMeasurementIterator struct {
+	itr    MeasurementIterator
+	re     *regexp.Regexp
+	prefix []byte // literal prefix of an anchored expression
+}
+
+// FilterRegexMeasurementIterator returns an iterator which only returns
+// measurements with names matching re. Matching is unanchored, the same as the
+// query engine, so an expression must begin with ^ to only match at the start
+// of the name. The underlying iterator must return elements in sorted order.
+//
+// If re is anchored to the start of the name and begins with a literal prefix
+// then iteration stops as soon as names sort after the prefix.
+func FilterRegexMeasurementIterator(itr MeasurementIterator, re *regexp.Regexp) MeasurementIterator {
+	if itr == nil {
+		return nil
+	}
+	return &regexMeasurementIterator{itr: itr, re: re, prefix: anchoredRegexPrefix(re)}
+}
+
+// Next returns the next matching measurement.
+func (itr *regexMeasurementIterator) Next() MeasurementElem {
+	for {
+		e := itr.itr.Next()
+		if e == nil {
+			return nil
+		}
+
+		// All remaining names are past the anchored prefix so none can match.
+		if len(itr.prefix) > 0 && !bytes.HasPrefix(e.Name(), itr.prefix) {
+			if bytes.Compare(e.Name(), itr.prefix) == 1 {
+				return nil
+			}
+			continue
+		}
+
+		if itr.re.Match(e.Name()) {
+			return e
+		}
+	}
+}
+
+// anchoredRegexPrefix returns the literal prefix of re if re is anchored to the
+// beginning of the text. Returns nil if re is unanchored, has no literal prefix,
+// or the prefix is case-insensitive.
+func anchoredRegexPrefix(re *regexp.Regexp) []byte {
+	expr, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	expr = expr.Simplify()
+
+	if expr.Op != syntax.OpConcat || len(expr.Sub) < 2 || expr.Sub[0].Op != syntax.OpBeginText {
+		return nil
+	}
+
+	var prefix []byte
+	for _, sub := range expr.Sub[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		prefix = append(prefix, string(sub.Rune)...)
+	}
+	return prefix
+}
+
+// foldMeasurementIterator returns the measurements whose names equal or begin
+// with a name, ignoring ASCII case.
+type foldMeasurementIterator struct {
+	itr    MeasurementIterator
+	name   []byte
+	lower  []byte // name with ASCII letters lowercased
+	prefix bool
+}
+
+// FilterFoldMeasurementIterator returns an iterator which only returns
+// measurements with names equal to name, or beginning with name if prefix is
+// true, ignoring case. The underlying iterator must return elements in sorted
+// order & iteration stops as soon as names sort after every case of name.
+//
+// Only the ASCII letters A-Z & a-z are folded. Every other byte, including
+// each byte of a multi-byte UTF-8 rune, must match exactly so "CAFÉ" does not
+// match "café". This is not the same as the (?i) flag of a regular expression,
+// which applies Unicode simple case folding where, for example, "k" also
+// matches the Kelvin sign. Use FilterRegexMeasurementIterator for full Unicode
+// folding.
+func FilterFoldMeasurementIterator(itr MeasurementIterator, name []byte, prefix bool) MeasurementIterator {
+	if itr == nil {
+		return nil
+	}
+	return &foldMeasurementIterator{itr: itr, name: name, lower: lowerASCII(name), prefix: prefix}
+}
+
+// Next returns the next matching measurement.
+func (itr *foldMeasurementIterator) Next() MeasurementElem {
+	for {
+		e := itr.itr.Next()
+		if e == nil {
+			return nil
+		}
+
+		// Uppercase letters sort before lowercase letters so every case of
+		// the name sorts at or before the lowercase name. Once a name sorts
+		// after it, & does not begin with it, no later name can match.
+		name := e.Name()
+		if bytes.Compare(name, itr.lower) == 1 && !bytes.HasPrefix(name, itr.lower) {
+			return nil
+		}
+
+		if !itr.prefix && len(name) != len(itr.name) {
+			continue
+		} else if hasPrefixFoldASCII(name, itr.name) {
+			return e
+		}
+	}
+}
+
+// hasPrefixFoldASCII returns true if s begins with prefix, ignoring the case
+// of ASCII letters.
+func hasPrefixFoldASCII(s, prefix []byte) bool {
+	if len(s) < len(prefix) {
+		return false
+	}
+	for i, c := range prefix {
+		if lowerASCIIByte(s[i]) != lowerASCIIByte(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerASCII returns a copy of b with the ASCII letters lowercased.
+func lowerASCII(b []byte) []byte {
+	other := make([]byte, len(b))
+	for i, c := range b {
+		other[i] = lowerASCIIByte(c)
+	}
+	return other
+}
+
+// upperASCII returns a copy of b with the ASCII letters uppercased.
+func upperASCII(b []byte) []byte {
+	other := make([]byte, len(b))
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		other[i] = c
+	}
+	return other
+}
+
+// lowerASCIIByte returns the lowercase of c if it is an ASCII letter.
+func lowerASCIIByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// foldASCIIVariants returns every ASCII case of the longest leading part of b
+// that has at most max cases, in sorted order. Every case of b begins with one
+// of the variants.
+func foldASCIIVariants(b []byte, max int) [][]byte {
+	// Find the end of the leading part & the positions of its letters.
+	var letters []int
+	n := len(b)
+	for i, c := range b {
+		if lowerASCIIByte(c) < 'a' || lowerASCIIByte(c) > 'z' {
+			continue
+		} else if 1<<uint(len(letters)+1) > max {
+			n = i
+			break
+		}
+		letters = append(letters, i)
+	}
+
+	// Uppercase sorts before lowercase so counting with the first letter as
+	// the most significant bit, & a set bit as lowercase, generates the
+	// variants in sorted order.
+	base := upperASCII(b[:n])
+	variants := make([][]byte, 0, 1<<uint(len(letters)))
+	for mask := 0; mask < 1<<uint(len(letters)); mask++ {
+		v := copyBytes(base)
+		for j, i := range letters {
+			if mask&(1<<uint(len(letters)-1-j)) != 0 {
+				v[i] = lowerASCIIByte(v[i])
+			}
+		}
+		variants = append(variants, v)
+	}
+	return variants
+}
+
 // TagKeyElem represents a generic tag key element.
 type TagKeyElem interface {
 	Key() []byte
@@ -151,6 +385,13 @@ type TagKeyIterator interface {
 	Next() TagKeyElem
 }
 
+// TagKeyIteratorCloser represents a tag key iterator which holds resources, such as
+// references to files, until it is closed.
+type TagKeyIteratorCloser interface {
+	TagKeyIterator
+	io.Closer
+}
+
 // MergeTagKeyIterators returns an iterator that merges a set of iterators.
 // Iterators that are first in the list take precendence and a deletion by those
 // early iterators will invalidate elements by later iterators.
@@ -232,6 +473,73 @@ func (p tagKeyMergeElem) Deleted() bool {
 	return p[0].Deleted()
 }
 
+// filterLiveTagKeyIterator returns tag keys which have at least one live value.
+type filterLiveTagKeyIterator struct {
+	itr TagKeyIterator
+}
+
+// FilterLiveTagKeyIterator returns an iterator which filters deleted tag keys
+// & tag keys whose values are all deleted. The values of each key are peeked
+// until a live value is found. For a merged key, the values are merged across
+// the files down to the most recent deletion of the key so a value deleted in
+// every file, or only present in files older than a deletion of the key, does
+// not keep the key alive.
+func FilterLiveTagKeyIterator(itr TagKeyIterator) TagKeyIterator {
+	if itr == nil {
+		return nil
+	}
+	return &filterLiveTagKeyIterator{itr: itr}
+}
+
+func (itr *filterLiveTagKeyIterator) Next() TagKeyElem {
+	for {
+		e := itr.itr.Next()
+		if e == nil {
+			return nil
+		} else if e.Deleted() || !hasLiveTagValue(e.TagValueIterator()) {
+			continue
+		}
+		return e
+	}
+}
+
+// hasLiveTagValue returns true if itr returns a value which is not deleted.
+func hasLiveTagValue(itr TagValueIterator) bool {
+	for e := nextTagValueElem(itr); e != nil; e = itr.Next() {
+		if !e.Deleted() {
+			return true
+		}
+	}
+	return false
+}
+
+// tagKeyFileCounts returns the number of iterators merged by itr which
+// contain each key. Keys whose most recent element is deleted are omitted and
+// iterators in which the key is deleted are not counted.
+func tagKeyFileCounts(itr TagKeyIterator) map[string]int {
+	m := make(map[string]int)
+	for e := nextTagKeyElem(itr); e != nil; e = itr.Next() {
+		if e.Deleted() {
+			continue
+		}
+
+		a, ok := e.(tagKeyMergeElem)
+		if !ok {
+			m[string(e.Key())] = 1
+			continue
+		}
+
+		var n int
+		for _, e := range a {
+			if !e.Deleted() {
+				n++
+			}
+		}
+		m[string(e.Key())] = n
+	}
+	return m
+}
+
 // TagValueIterator returns a merge iterator for all elements until a tombstone occurs.
 func (p tagKeyMergeElem) TagValueIterator() TagValueIterator {
 	if len(p) == 0 {
@@ -261,6 +569,13 @@ type TagValueIterator interface {
 	Next() TagValueElem
 }
 
+// TagValueIteratorCloser represents a tag value iterator which holds resources, such as
+// references to files, until it is closed.
+type TagValueIteratorCloser interface {
+	TagValueIterator
+	io.Closer
+}
+
 // MergeTagValueIterators returns an iterator that merges a set of iterators.
 // Iterators that are first in the list take precendence and a deletion by those
 // early iterators will invalidate elements by later iterators.
@@ -319,7 +634,9 @@ func (itr *tagValueMergeIterator) Next() TagValueElem {
 		itr.e = append(itr.e, buf)
 		itr.buf[i] = nil
 	}
-	return itr.e
+
+	// Return a pointer so the slice header is not allocated on each call.
+	return &itr.e
 }
 
 // tagValueMergeElem represents a merged tag value element.
@@ -341,6 +658,26 @@ func (p tagValueMergeElem) Deleted() bool {
 	return p[0].Deleted()
 }
 
+// TagPair represents a single tag key/value pair within a measurement.
+type TagPair struct {
+	Name    []byte
+	Key     []byte
+	Value   []byte
+	Deleted bool
+}
+
+// TagPairIterator represents a iterator over a list of tag pairs.
+type TagPairIterator interface {
+	Next() *TagPair
+}
+
+// TagPairIteratorCloser represents a tag pair iterator which holds resources, such as
+// references to files, until it is closed.
+type TagPairIteratorCloser interface {
+	TagPairIterator
+	io.Closer
+}
+
 // SeriesElem represents a generic series element.
 type SeriesElem interface {
 	Name() []byte
@@ -394,9 +731,93 @@ type SeriesIterator interface {
 	Next() SeriesElem
 }
 
+// SeriesIteratorCloser represents a series iterator which holds resources, such as
+// references to files, until it is closed.
+type SeriesIteratorCloser interface {
+	SeriesIterator
+	io.Closer
+}
+
+// ErrSeriesIterator represents a series iterator which can fail partway
+// through iteration. Next() returns nil once an error occurs and Err() returns
+// the first error encountered. Callers should check Err() after the loop.
+type ErrSeriesIterator interface {
+	SeriesIterator
+	Err() error
+}
+
+// SeriesIteratorErr returns the error from itr if it implements
+// ErrSeriesIterator. Returns nil otherwise.
+func SeriesIteratorErr(itr SeriesIterator) error {
+	if itr, ok := itr.(ErrSeriesIterator); ok {
+		return itr.Err()
+	}
+	return nil
+}
+
+// EstimatedCountSeriesIterator represents a series iterator which can estimate
+// how many elements it has left to return, such as for a query planner to
+// choose between iterating the index & another strategy.
+//
+// The estimate is an upper bound rather than an exact count. Iterators which
+// merge or filter other iterators add up or forward the estimates of their
+// inputs without deduplicating or filtering, so a series in several files is
+// counted once per file & filtered series, including tombstones, are counted.
+type EstimatedCountSeriesIterator interface {
+	SeriesIterator
+
+	// EstimatedCount returns the estimate & true, or false if no estimate is
+	// available because an input iterator cannot estimate its count.
+	EstimatedCount() (uint64, bool)
+}
+
+// SeriesIteratorEstimatedCount returns the estimate from itr if it implements
+// EstimatedCountSeriesIterator. Returns zero & true for a nil iterator, and
+// false for any other iterator.
+func SeriesIteratorEstimatedCount(itr SeriesIterator) (uint64, bool) {
+	if itr == nil {
+		return 0, true
+	} else if itr, ok := itr.(EstimatedCountSeriesIterator); ok {
+		return itr.EstimatedCount()
+	}
+	return 0, false
+}
+
+// estimatedSeriesCount returns the sum of the estimates of itrs & the number
+// of non-nil elements in buf, which have been read from the iterators but not
+// returned yet.
+func estimatedSeriesCount(itrs []SeriesIterator, buf []SeriesElem) (uint64, bool) {
+	var n uint64
+	for _, itr := range itrs {
+		nn, ok := SeriesIteratorEstimatedCount(itr)
+		if !ok {
+			return 0, false
+		}
+		n += nn
+	}
+	for _, e := range buf {
+		if e != nil {
+			n++
+		}
+	}
+	return n, true
+}
+
+// seriesIteratorsErr returns the first error from a set of iterators.
+func seriesIteratorsErr(itrs ...SeriesIterator) error {
+	for _, itr := range itrs {
+		if err := SeriesIteratorErr(itr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // MergeSeriesIterators returns an iterator that merges a set of iterators.
-// Iterators that are first in the list take precendence and a deletion by those
-// early iterators will invalidate elements by later iterators.
+// Iterators that are first in the list take precedence and a deletion by those
+// early iterators will invalidate elements by later iterators. The precedence
+// only depends on the order of itrs so callers merging files must pass the
+// newest file first.
 func MergeSeriesIterators(itrs ...SeriesIterator) SeriesIterator {
 	if n := len(itrs); n == 0 {
 		return nil
@@ -404,16 +825,189 @@ func MergeSeriesIterators(itrs ...SeriesIterator) SeriesIterator {
 		return itrs[0]
 	}
 
-	return &seriesMergeIterator{
-		buf:  make([]SeriesElem, len(itrs)),
-		itrs: itrs,
+	itr := seriesMergeIteratorPool.Get().(*seriesMergeIterator)
+	itr.Reset(itrs...)
+	return itr
+}
+
+// seriesMergeIteratorPool recycles merge iterators released by
+// ReleaseSeriesIterator so repeated queries reuse their buffers.
+var seriesMergeIteratorPool = sync.Pool{
+	New: func() interface{} { return &seriesMergeIterator{} },
+}
+
+// ReleaseSeriesIterator returns the pooled structures of itr, & the iterators
+// it wraps, to be reused by later merges. The iterator must not be used once
+// it is released. Releasing is optional as iterators which are not released
+// are garbage collected. Iterators returned by IndexFiles are released when
+// they are closed.
+func ReleaseSeriesIterator(itr SeriesIterator) {
+	if itr, ok := itr.(seriesIteratorReleaser); ok {
+		itr.release()
+	}
+}
+
+// releaseSeriesIteratorPair releases the iterators of a two-way iterator &
+// clears its buffers.
+func releaseSeriesIteratorPair(itrs *[2]SeriesIterator, buf *[2]SeriesElem) {
+	for i := range itrs {
+		ReleaseSeriesIterator(itrs[i])
+		itrs[i], buf[i] = nil, nil
+	}
+}
+
+// seriesIteratorReleaser is implemented by series iterators holding pooled
+// structures or wrapping iterators which may.
+type seriesIteratorReleaser interface {
+	release()
+}
+
+// MergeSeriesIteratorsWithStats returns an iterator that merges a set of
+// iterators like MergeSeriesIterators and also counts the elements that pass
+// through the merge. The counters are available from the Stats() method.
+func MergeSeriesIteratorsWithStats(itrs ...SeriesIterator) StatsSeriesIterator {
+	return &statsSeriesMergeIterator{
+		seriesMergeIterator: seriesMergeIterator{
+			buf:   make([]SeriesElem, len(itrs)),
+			itrs:  itrs,
+			stats: &MergeStats{},
+		},
 	}
 }
 
+// MergeStats holds counters accumulated by a merge iterator.
+type MergeStats struct {
+	InputN     uint64 // elements read from all input iterators
+	OutputN    uint64 // unique elements returned
+	DuplicateN uint64 // elements dropped because an earlier iterator had the same element
+	TombstoneN uint64 // returned elements which are tombstoned
+}
+
+// OverlapStats holds the number of series which are in more than one of a set
+// of merged iterators, such as the series block iterators of index files. High
+// overlap means compacting the files together rewrites many series which are
+// then discarded.
+type OverlapStats struct {
+	SeriesN  uint64   // distinct series across all iterators
+	OverlapN uint64   // distinct series in more than one iterator
+	InputN   []uint64 // series in each iterator
+
+	// PairN[i][j-i-1] is the number of series in both iterator i & iterator j,
+	// for i < j.
+	PairN [][]uint64
+}
+
+// newOverlapStats returns stats for merging n iterators.
+func newOverlapStats(n int) *OverlapStats {
+	s := &OverlapStats{InputN: make([]uint64, n), PairN: make([][]uint64, n)}
+	for i := range s.PairN {
+		s.PairN[i] = make([]uint64, n-i-1)
+	}
+	return s
+}
+
+// add counts a series contained by the iterators at indexes srcs, which are
+// in ascending order.
+func (s *OverlapStats) add(srcs []int) {
+	s.SeriesN++
+	if len(srcs) > 1 {
+		s.OverlapN++
+	}
+	for k, i := range srcs {
+		s.InputN[i]++
+		for _, j := range srcs[k+1:] {
+			s.PairN[i][j-i-1]++
+		}
+	}
+}
+
+// Pair returns the number of series in both iterator i & iterator j.
+func (s *OverlapStats) Pair(i, j int) uint64 {
+	if i == j {
+		return s.InputN[i]
+	} else if i > j {
+		i, j = j, i
+	}
+	return s.PairN[i][j-i-1]
+}
+
+// OverlapRatio returns the fraction of distinct series which are in more than
+// one iterator. Returns zero if there are no series.
+func (s *OverlapStats) OverlapRatio() float64 {
+	if s.SeriesN == 0 {
+		return 0
+	}
+	return float64(s.OverlapN) / float64(s.SeriesN)
+}
+
+// StatsSeriesIterator represents a series iterator that tracks merge statistics.
+type StatsSeriesIterator interface {
+	SeriesIterator
+	Stats() MergeStats
+}
+
+// statsSeriesMergeIterator is a seriesMergeIterator which exposes its stats.
+type statsSeriesMergeIterator struct {
+	seriesMergeIterator
+}
+
+// Stats returns the counters accumulated so far.
+func (itr *statsSeriesMergeIterator) Stats() MergeStats { return *itr.stats }
+
+// release releases the merged iterators. The iterator itself is not pooled.
+func (itr *statsSeriesMergeIterator) release() { itr.releaseInputs() }
+
 // seriesMergeIterator is an iterator that merges multiple iterators together.
 type seriesMergeIterator struct {
 	buf  []SeriesElem
 	itrs []SeriesIterator
+
+	// Optional counters. Only tracked when non-nil.
+	stats   *MergeStats
+	overlap *OverlapStats
+	srcs    []int // indexes of the iterators containing the last element
+}
+
+// Reset sets the iterators to merge, reusing the buffers of the iterator.
+func (itr *seriesMergeIterator) Reset(itrs ...SeriesIterator) {
+	if cap(itr.buf) < len(itrs) {
+		itr.buf = make([]SeriesElem, len(itrs))
+	} else {
+		itr.buf = itr.buf[:len(itrs)]
+		for i := range itr.buf {
+			itr.buf[i] = nil
+		}
+	}
+	itr.itrs = append(itr.itrs[:0], itrs...)
+	itr.stats, itr.overlap = nil, nil
+}
+
+// release releases the merged iterators & returns itr to the pool.
+func (itr *seriesMergeIterator) release() {
+	itr.releaseInputs()
+	seriesMergeIteratorPool.Put(itr)
+}
+
+// releaseInputs releases the merged iterators & clears the buffers so a
+// pooled iterator holds no references to elements of released files.
+func (itr *seriesMergeIterator) releaseInputs() {
+	for i := range itr.itrs {
+		ReleaseSeriesIterator(itr.itrs[i])
+		itr.itrs[i] = nil
+	}
+	for i := range itr.buf {
+		itr.buf[i] = nil
+	}
+	itr.buf, itr.itrs = itr.buf[:0], itr.itrs[:0]
+}
+
+// Err returns the first error from the underlying iterators.
+func (itr *seriesMergeIterator) Err() error { return seriesIteratorsErr(itr.itrs...) }
+
+// EstimatedCount returns the sum of the estimates of the merged iterators.
+// Series in more than one iterator are counted once per iterator.
+func (itr *seriesMergeIterator) EstimatedCount() (uint64, bool) {
+	return estimatedSeriesCount(itr.itrs, itr.buf)
 }
 
 // Next returns the element with the next lowest name/tags across the iterators.
@@ -429,6 +1023,9 @@ func (itr *seriesMergeIterator) Next() SeriesElem {
 		if buf == nil {
 			if buf = itr.itrs[i].Next(); buf != nil {
 				itr.buf[i] = buf
+				if itr.stats != nil {
+					itr.stats.InputN++
+				}
 			} else {
 				continue
 			}
@@ -453,19 +1050,35 @@ func (itr *seriesMergeIterator) Next() SeriesElem {
 
 	// Refill buffer.
 	var e SeriesElem
+	itr.srcs = itr.srcs[:0]
 	for i, buf := range itr.buf {
 		if buf == nil || !bytes.Equal(buf.Name(), name) || models.CompareTags(buf.Tags(), tags) != 0 {
 			continue
 		}
+		if itr.overlap != nil {
+			itr.srcs = append(itr.srcs, i)
+		}
 
 		// Copy first matching buffer to the return buffer.
 		if e == nil {
 			e = buf
+		} else if itr.stats != nil {
+			itr.stats.DuplicateN++
 		}
 
 		// Clear buffer.
 		itr.buf[i] = nil
 	}
+
+	if itr.stats != nil {
+		itr.stats.OutputN++
+		if e.Deleted() {
+			itr.stats.TombstoneN++
+		}
+	}
+	if itr.overlap != nil {
+		itr.overlap.add(itr.srcs)
+	}
 	return e
 }
 
@@ -487,6 +1100,24 @@ type seriesIntersectIterator struct {
 	itrs [2]SeriesIterator
 }
 
+// release releases the underlying iterators.
+func (itr *seriesIntersectIterator) release() { releaseSeriesIteratorPair(&itr.itrs, &itr.buf) }
+
+// Err returns the first error from the underlying iterators.
+func (itr *seriesIntersectIterator) Err() error { return seriesIteratorsErr(itr.itrs[:]...) }
+
+// EstimatedCount returns the lower of the estimates of the two iterators.
+func (itr *seriesIntersectIterator) EstimatedCount() (uint64, bool) {
+	n0, ok0 := estimatedSeriesCount(itr.itrs[:1], itr.buf[:1])
+	n1, ok1 := estimatedSeriesCount(itr.itrs[1:], itr.buf[1:])
+	if !ok0 || !ok1 {
+		return 0, false
+	} else if n1 < n0 {
+		return n1, true
+	}
+	return n0, true
+}
+
 // Next returns the next element which occurs in both iterators.
 func (itr *seriesIntersectIterator) Next() (e SeriesElem) {
 	for {
@@ -556,6 +1187,17 @@ type seriesUnionIterator struct {
 	itrs [2]SeriesIterator
 }
 
+// release releases the underlying iterators.
+func (itr *seriesUnionIterator) release() { releaseSeriesIteratorPair(&itr.itrs, &itr.buf) }
+
+// Err returns the first error from the underlying iterators.
+func (itr *seriesUnionIterator) Err() error { return seriesIteratorsErr(itr.itrs[:]...) }
+
+// EstimatedCount returns the sum of the estimates of the two iterators.
+func (itr *seriesUnionIterator) EstimatedCount() (uint64, bool) {
+	return estimatedSeriesCount(itr.itrs[:], itr.buf[:])
+}
+
 // Next returns the next element which occurs in both iterators.
 func (itr *seriesUnionIterator) Next() (e SeriesElem) {
 	// Fill buffers.
@@ -621,6 +1263,17 @@ type seriesDifferenceIterator struct {
 	itrs [2]SeriesIterator
 }
 
+// release releases the underlying iterators.
+func (itr *seriesDifferenceIterator) release() { releaseSeriesIteratorPair(&itr.itrs, &itr.buf) }
+
+// Err returns the first error from the underlying iterators.
+func (itr *seriesDifferenceIterator) Err() error { return seriesIteratorsErr(itr.itrs[:]...) }
+
+// EstimatedCount returns the estimate of the first iterator.
+func (itr *seriesDifferenceIterator) EstimatedCount() (uint64, bool) {
+	return estimatedSeriesCount(itr.itrs[:1], itr.buf[:1])
+}
+
 // Next returns the next element which occurs only in the first iterator.
 func (itr *seriesDifferenceIterator) Next() (e SeriesElem) {
 	for {
@@ -656,6 +1309,68 @@ func (itr *seriesDifferenceIterator) Next() (e SeriesElem) {
 	}
 }
 
+// seriesDiffIterator returns the series of the first iterator whose state
+// differs from the second iterator. Both iterators must return the most recent
+// state of each series, including tombstones.
+type seriesDiffIterator struct {
+	buf  [2]SeriesElem
+	itrs [2]SeriesIterator
+}
+
+// release releases the underlying iterators.
+func (itr *seriesDiffIterator) release() { releaseSeriesIteratorPair(&itr.itrs, &itr.buf) }
+
+// Err returns the first error from the underlying iterators.
+func (itr *seriesDiffIterator) Err() error {
+	if itr.itrs[1] == nil {
+		return SeriesIteratorErr(itr.itrs[0])
+	}
+	return seriesIteratorsErr(itr.itrs[:]...)
+}
+
+// Next returns the next series which is live in the first iterator & absent
+// or tombstoned in the second, or tombstoned in the first & live in the
+// second.
+func (itr *seriesDiffIterator) Next() (e SeriesElem) {
+	for {
+		// Fill buffers.
+		if itr.buf[0] == nil {
+			itr.buf[0] = itr.itrs[0].Next()
+		}
+		if itr.buf[1] == nil && itr.itrs[1] != nil {
+			itr.buf[1] = itr.itrs[1].Next()
+		}
+
+		// Exit if first buffer is still empty.
+		if itr.buf[0] == nil {
+			return nil
+		}
+
+		// Series which only exist in the second iterator are skipped. Series
+		// which only exist in the first are returned unless tombstoned. Series
+		// in both are returned if their deletion state differs.
+		cmp := -1
+		if itr.buf[1] != nil {
+			cmp = CompareSeriesElem(itr.buf[0], itr.buf[1])
+		}
+		if cmp == 1 {
+			itr.buf[1] = nil
+			continue
+		}
+
+		e, itr.buf[0] = itr.buf[0], nil
+		if cmp == 0 {
+			deleted := itr.buf[1].Deleted()
+			itr.buf[1] = nil
+			if e.Deleted() != deleted {
+				return e
+			}
+		} else if !e.Deleted() {
+			return e
+		}
+	}
+}
+
 // filterUndeletedSeriesIterator returns all series which are not deleted.
 type filterUndeletedSeriesIterator struct {
 	itr SeriesIterator
@@ -669,6 +1384,21 @@ func FilterUndeletedSeriesIterator(itr SeriesIterator) SeriesIterator {
 	return &filterUndeletedSeriesIterator{itr: itr}
 }
 
+// Err returns the error from the underlying iterator.
+func (itr *filterUndeletedSeriesIterator) Err() error { return SeriesIteratorErr(itr.itr) }
+
+// EstimatedCount returns the estimate of the underlying iterator, which
+// includes tombstones.
+func (itr *filterUndeletedSeriesIterator) EstimatedCount() (uint64, bool) {
+	return SeriesIteratorEstimatedCount(itr.itr)
+}
+
+// release releases the underlying iterator.
+func (itr *filterUndeletedSeriesIterator) release() {
+	ReleaseSeriesIterator(itr.itr)
+	itr.itr = nil
+}
+
 func (itr *filterUndeletedSeriesIterator) Next() SeriesElem {
 	for {
 		e := itr.itr.Next()
@@ -681,6 +1411,62 @@ func (itr *filterUndeletedSeriesIterator) Next() SeriesElem {
 	}
 }
 
+// SeriesPredicate returns true if a series should be included by an iterator.
+type SeriesPredicate func(name []byte, tags models.Tags) bool
+
+// TagEqualsPredicate returns a predicate matching series where the tag key
+// has the given value. Series without the key have an empty value.
+func TagEqualsPredicate(key, value []byte) SeriesPredicate {
+	return func(name []byte, tags models.Tags) bool {
+		return bytes.Equal(tags.Get(key), value)
+	}
+}
+
+// TagRegexPredicate returns a predicate matching series where the value of
+// the tag key matches re. Series without the key have an empty value.
+func TagRegexPredicate(key []byte, re *regexp.Regexp) SeriesPredicate {
+	return func(name []byte, tags models.Tags) bool {
+		return re.Match(tags.Get(key))
+	}
+}
+
+// filterSeriesIterator returns series which match a predicate.
+type filterSeriesIterator struct {
+	itr  SeriesIterator
+	pred SeriesPredicate
+}
+
+// FilterSeriesIterator returns an iterator which only returns series matching
+// pred. The predicate is evaluated as each series is read from itr.
+func FilterSeriesIterator(itr SeriesIterator, pred SeriesPredicate) SeriesIterator {
+	if itr == nil {
+		return nil
+	}
+	return &filterSeriesIterator{itr: itr, pred: pred}
+}
+
+// Err returns the error from the underlying iterator.
+func (itr *filterSeriesIterator) Err() error { return SeriesIteratorErr(itr.itr) }
+
+// EstimatedCount returns the estimate of the underlying iterator, which
+// includes series not matching the predicate.
+func (itr *filterSeriesIterator) EstimatedCount() (uint64, bool) {
+	return SeriesIteratorEstimatedCount(itr.itr)
+}
+
+// Next returns the next matching series.
+func (itr *filterSeriesIterator) Next() SeriesElem {
+	for {
+		e := itr.itr.Next()
+		if e == nil {
+			return nil
+		} else if !itr.pred(e.Name(), e.Tags()) {
+			continue
+		}
+		return e
+	}
+}
+
 // seriesExprElem holds a series and its associated filter expression.
 type seriesExprElem struct {
 	SeriesElem
@@ -710,6 +1496,15 @@ func newSeriesExprIterator(itr SeriesIterator, expr influxql.Expr) SeriesIterato
 	}
 }
 
+// Err returns the error from the underlying iterator.
+func (itr *seriesExprIterator) Err() error { return SeriesIteratorErr(itr.itr) }
+
+// release releases the underlying iterator.
+func (itr *seriesExprIterator) release() {
+	ReleaseSeriesIterator(itr.itr)
+	itr.itr = nil
+}
+
 // Next returns the next element in the iterator.
 func (itr *seriesExprIterator) Next() SeriesElem {
 	itr.e.SeriesElem = itr.itr.Next()
@@ -724,6 +1519,12 @@ type seriesIDIterator interface {
 	next() uint32
 }
 
+// seriesIDCounter is implemented by series id iterators which know how many
+// ids they have left.
+type seriesIDCounter interface {
+	remaining() uint64
+}
+
 // writeTo writes write v into w. Updates n.
 func writeTo(w io.Writer, v []byte, n *int64) error {
 	nn, err := w.Write(v)
@@ -774,6 +1575,53 @@ func writeUvarintTo(w io.Writer, v uint64, n *int64) error {
 	return err
 }
 
+// appendUvarint appends v to dst using variable length encoding.
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	i := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:i]...)
+}
+
+// commonPrefixLen returns the number of leading bytes shared by a & b.
+func commonPrefixLen(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// checksumWriter passes writes through to an underlying writer while
+// computing the CRC32 checksum of the block currently being written.
+type checksumWriter struct {
+	w io.Writer
+	h hash.Hash32
+}
+
+// newChecksumWriter returns a new instance of checksumWriter wrapping w.
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{w: w, h: crc32.NewIEEE()}
+}
+
+// Write writes p to the underlying writer and adds the written bytes to the checksum.
+func (w *checksumWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	w.h.Write(p[:n])
+	return n, err
+}
+
+// Sum returns the checksum of the data written since the previous call to Sum.
+func (w *checksumWriter) Sum() uint32 {
+	v := w.h.Sum32()
+	w.h.Reset()
+	return v
+}
+
 type uint32Slice []uint32
 
 func (a uint32Slice) Len() int           { return len(a) }
@@ -792,6 +1640,25 @@ func (a byteSlices) Len() int           { return len(a) }
 func (a byteSlices) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byteSlices) Less(i, j int) bool { return bytes.Compare(a[i], a[j]) == -1 }
 
+// blockSection returns the size bytes at offset within data or false if the
+// section is not entirely within data.
+func blockSection(data []byte, offset, size int64) ([]byte, bool) {
+	if offset < 0 || size < 0 || offset > int64(len(data)) || size > int64(len(data))-offset {
+		return nil, false
+	}
+	return data[offset : offset+size], true
+}
+
+// validHashIndex returns true if data holds a non-zero capacity followed by
+// that many 8-byte offsets, as written for measurement & tag key hash indexes.
+func validHashIndex(data []byte) bool {
+	if len(data) < 8 || (len(data)-8)%8 != 0 {
+		return false
+	}
+	n := binary.BigEndian.Uint64(data[:8])
+	return n > 0 && n == uint64(len(data)-8)/8
+}
+
 // copyBytes returns a copy of b.
 func copyBytes(b []byte) []byte {
 	if b == nil {
@@ -817,3 +1684,9 @@ func (t byTagKey) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
 
 // hexdump is a helper for dumping binary data to stderr.
 func hexdump(data []byte) { os.Stderr.Write([]byte(hex.Dump(data))) }
+
+// ReferenceLeak describes a file with outstanding references.
+type ReferenceLeak struct {
+	Path   string
+	Stacks []string // stack of each caller holding a reference
+}
@@ -2,8 +2,11 @@ package tsi1_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"reflect"
+	"regexp"
 	"testing"
 
 	"github.com/influxdata/influxdb/influxql"
@@ -57,6 +60,36 @@ func TestMergeMeasurementIterators(t *testing.T) {
 	}
 }
 
+// Ensure iterator only returns measurements matching an expression.
+func TestFilterRegexMeasurementIterator(t *testing.T) {
+	names := []string{"cpu", "cpu_idle", "disk", "mem_cpu", "net"}
+	for _, tt := range []struct {
+		expr string
+		exp  []string
+	}{
+		{expr: `cpu`, exp: []string{"cpu", "cpu_idle", "mem_cpu"}},
+		{expr: `^cpu`, exp: []string{"cpu", "cpu_idle"}},
+		{expr: `^cpu$`, exp: []string{"cpu"}},
+		{expr: `^(?i)CPU`, exp: []string{"cpu", "cpu_idle"}},
+		{expr: `^d|^n`, exp: []string{"disk", "net"}},
+		{expr: `^zzz`, exp: nil},
+	} {
+		var elems []MeasurementElem
+		for _, name := range names {
+			elems = append(elems, MeasurementElem{name: []byte(name)})
+		}
+
+		var a []string
+		itr := tsi1.FilterRegexMeasurementIterator(&MeasurementIterator{Elems: elems}, regexp.MustCompile(tt.expr))
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			a = append(a, string(e.Name()))
+		}
+		if !reflect.DeepEqual(a, tt.exp) {
+			t.Errorf("%s: unexpected names: %v", tt.expr, a)
+		}
+	}
+}
+
 // Ensure iterator can operate over an in-memory list of tag key elements.
 func TestTagKeyIterator(t *testing.T) {
 	elems := []TagKeyElem{
@@ -74,6 +107,35 @@ func TestTagKeyIterator(t *testing.T) {
 	}
 }
 
+// Ensure iterator can merge multiple iterators together in descending order.
+func TestMergeReverseMeasurementIterators(t *testing.T) {
+	itr := tsi1.MergeReverseMeasurementIterators(
+		&MeasurementIterator{Elems: []MeasurementElem{
+			{name: []byte("ccc")},
+			{name: []byte("bbb"), deleted: true},
+			{name: []byte("aaa")},
+		}},
+		&MeasurementIterator{},
+		&MeasurementIterator{Elems: []MeasurementElem{
+			{name: []byte("ddd")},
+			{name: []byte("ccc"), deleted: true},
+			{name: []byte("bbb")},
+		}},
+	)
+
+	if e := itr.Next(); !bytes.Equal(e.Name(), []byte("ddd")) || e.Deleted() {
+		t.Fatalf("unexpected elem(0): %s/%v", e.Name(), e.Deleted())
+	} else if e := itr.Next(); !bytes.Equal(e.Name(), []byte("ccc")) || e.Deleted() {
+		t.Fatalf("unexpected elem(1): %s/%v", e.Name(), e.Deleted())
+	} else if e := itr.Next(); !bytes.Equal(e.Name(), []byte("bbb")) || !e.Deleted() {
+		t.Fatalf("unexpected elem(2): %s/%v", e.Name(), e.Deleted())
+	} else if e := itr.Next(); !bytes.Equal(e.Name(), []byte("aaa")) || e.Deleted() {
+		t.Fatalf("unexpected elem(3): %s/%v", e.Name(), e.Deleted())
+	} else if e := itr.Next(); e != nil {
+		t.Fatalf("expected nil elem: %#v", e)
+	}
+}
+
 // Ensure iterator can merge multiple iterators together.
 func TestMergeTagKeyIterators(t *testing.T) {
 	itr := tsi1.MergeTagKeyIterators(
@@ -199,6 +261,184 @@ func TestMergeSeriesIterators(t *testing.T) {
 	}
 }
 
+// Ensure merge statistics are accumulated across iterators.
+func TestMergeSeriesIteratorsWithStats(t *testing.T) {
+	itr := tsi1.MergeSeriesIteratorsWithStats(
+		&SeriesIterator{Elems: []SeriesElem{
+			{name: []byte("aaa"), deleted: true},
+			{name: []byte("bbb")},
+		}},
+		&SeriesIterator{},
+		&SeriesIterator{Elems: []SeriesElem{
+			{name: []byte("aaa")},
+			{name: []byte("bbb"), deleted: true},
+			{name: []byte("ccc")},
+		}},
+	)
+
+	var n int
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("unexpected elem count: %d", n)
+	}
+
+	if stats := itr.Stats(); !reflect.DeepEqual(stats, tsi1.MergeStats{InputN: 5, OutputN: 3, DuplicateN: 2, TombstoneN: 1}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+// Ensure series can be filtered by a tag predicate.
+func TestFilterSeriesIterator(t *testing.T) {
+	elems := []SeriesElem{
+		{name: []byte("cpu"), tags: models.NewTags(map[string]string{"region": "east"})},
+		{name: []byte("cpu"), tags: models.NewTags(map[string]string{"region": "west"})},
+		{name: []byte("cpu"), tags: models.NewTags(map[string]string{"host": "a"})},
+		{name: []byte("mem"), tags: models.NewTags(map[string]string{"region": "eu-east"})},
+	}
+
+	for i, tt := range []struct {
+		pred tsi1.SeriesPredicate
+		exp  []string
+	}{
+		{pred: tsi1.TagEqualsPredicate([]byte("region"), []byte("east")), exp: []string{"cpu,region=east"}},
+		{pred: tsi1.TagEqualsPredicate([]byte("region"), nil), exp: []string{"cpu,host=a"}},
+		{pred: tsi1.TagRegexPredicate([]byte("region"), regexp.MustCompile(`east$`)), exp: []string{"cpu,region=east", "mem,region=eu-east"}},
+		{pred: func(name []byte, tags models.Tags) bool { return string(name) == "mem" }, exp: []string{"mem,region=eu-east"}},
+	} {
+		var a []string
+		itr := tsi1.FilterSeriesIterator(&SeriesIterator{Elems: append([]SeriesElem(nil), elems...)}, tt.pred)
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			a = append(a, string(models.MakeKey(e.Name(), e.Tags())))
+		}
+		if !reflect.DeepEqual(a, tt.exp) {
+			t.Errorf("%d. unexpected series: %v", i, a)
+		}
+	}
+
+	if itr := tsi1.FilterSeriesIterator(nil, nil); itr != nil {
+		t.Fatal("expected nil iterator")
+	}
+}
+
+// Ensure errors from a source iterator are surfaced by the merged iterators.
+func TestMergeSeriesIterators_Err(t *testing.T) {
+	errFail := errors.New("marker")
+	newItrs := func() (tsi1.SeriesIterator, tsi1.SeriesIterator) {
+		itr0 := &SeriesIterator{Elems: []SeriesElem{{name: []byte("aaa")}, {name: []byte("ccc")}}}
+		itr1 := &FailingSeriesIterator{
+			SeriesIterator: SeriesIterator{Elems: []SeriesElem{{name: []byte("aaa")}, {name: []byte("bbb")}}},
+			Failure:        errFail,
+		}
+		return itr0, itr1
+	}
+
+	for _, tt := range []struct {
+		name string
+		fn   func(itr0, itr1 tsi1.SeriesIterator) tsi1.SeriesIterator
+		exp  []string
+	}{
+		{name: "Merge", fn: func(itr0, itr1 tsi1.SeriesIterator) tsi1.SeriesIterator { return tsi1.MergeSeriesIterators(itr0, itr1) }, exp: []string{"aaa", "bbb", "ccc"}},
+		{name: "Intersect", fn: tsi1.IntersectSeriesIterators, exp: []string{"aaa"}},
+		{name: "Union", fn: tsi1.UnionSeriesIterators, exp: []string{"aaa", "bbb", "ccc"}},
+		{name: "Difference", fn: tsi1.DifferenceSeriesIterators, exp: []string{"ccc"}},
+		{name: "FilterUndeleted", fn: func(itr0, itr1 tsi1.SeriesIterator) tsi1.SeriesIterator {
+			return tsi1.FilterUndeletedSeriesIterator(tsi1.MergeSeriesIterators(itr0, itr1))
+		}, exp: []string{"aaa", "bbb", "ccc"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			itr := tt.fn(newItrs())
+
+			var a []string
+			for e := itr.Next(); e != nil; e = itr.Next() {
+				a = append(a, string(e.Name()))
+			}
+			if !reflect.DeepEqual(a, tt.exp) {
+				t.Fatalf("unexpected series: %v", a)
+			} else if err := tsi1.SeriesIteratorErr(itr); err != errFail {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	// Iterators without errors report nil.
+	if err := tsi1.SeriesIteratorErr(&SeriesIterator{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := tsi1.SeriesIteratorErr(tsi1.MergeSeriesIterators(&SeriesIterator{}, &SeriesIterator{})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure released merge iterators are reused without leaking elements into
+// later merges.
+func TestReleaseSeriesIterator(t *testing.T) {
+	newItr := func() tsi1.SeriesIterator {
+		return tsi1.UnionSeriesIterators(
+			tsi1.FilterUndeletedSeriesIterator(tsi1.MergeSeriesIterators(
+				&SeriesIterator{Elems: []SeriesElem{{name: []byte("aaa")}, {name: []byte("ccc"), deleted: true}}},
+				&SeriesIterator{Elems: []SeriesElem{{name: []byte("bbb")}, {name: []byte("ccc")}}},
+			)),
+			tsi1.MergeSeriesIterators(
+				&SeriesIterator{Elems: []SeriesElem{{name: []byte("ddd")}}},
+				&SeriesIterator{Elems: []SeriesElem{{name: []byte("aaa")}, {name: []byte("eee")}}},
+				&SeriesIterator{},
+			),
+		)
+	}
+
+	for i := 0; i < 10; i++ {
+		itr := newItr()
+
+		// Partially consumed iterators are released too.
+		if i%2 == 1 {
+			if e := itr.Next(); e == nil || string(e.Name()) != "aaa" {
+				t.Fatalf("unexpected elem: %v", e)
+			}
+			tsi1.ReleaseSeriesIterator(itr)
+			continue
+		}
+
+		var a []string
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			a = append(a, string(e.Name()))
+		}
+		if exp := []string{"aaa", "bbb", "ddd", "eee"}; !reflect.DeepEqual(a, exp) {
+			t.Fatalf("unexpected series(%d): %v", i, a)
+		}
+		tsi1.ReleaseSeriesIterator(itr)
+	}
+
+	// Iterators without pooled structures are ignored.
+	tsi1.ReleaseSeriesIterator(nil)
+	tsi1.ReleaseSeriesIterator(&SeriesIterator{})
+}
+
+func BenchmarkMergeSeriesIterators(b *testing.B) {
+	elems := make([]SeriesElem, 10)
+	for i := range elems {
+		elems[i].name = []byte(fmt.Sprintf("m%d", i))
+	}
+
+	for _, release := range []bool{false, true} {
+		b.Run(fmt.Sprintf("release=%v", release), func(b *testing.B) {
+			b.ReportAllocs()
+			itrs := make([]SeriesIterator, 4)
+			for i := 0; i < b.N; i++ {
+				for j := range itrs {
+					itrs[j].Elems = elems
+				}
+				itr := tsi1.FilterUndeletedSeriesIterator(tsi1.MergeSeriesIterators(&itrs[0], &itrs[1], &itrs[2], &itrs[3]))
+				for e := itr.Next(); e != nil; e = itr.Next() {
+				}
+				if release {
+					tsi1.ReleaseSeriesIterator(itr)
+				}
+			}
+		})
+	}
+}
+
 // MeasurementElem represents a test implementation of tsi1.MeasurementElem.
 type MeasurementElem struct {
 	name    []byte
@@ -298,6 +538,21 @@ func (itr *SeriesIterator) Next() (e tsi1.SeriesElem) {
 	return e
 }
 
+// FailingSeriesIterator represents a series iterator which fails with Failure
+// once its elements are exhausted.
+type FailingSeriesIterator struct {
+	SeriesIterator
+	Failure error
+}
+
+// Err returns Failure if the iterator has been exhausted.
+func (itr *FailingSeriesIterator) Err() error {
+	if len(itr.Elems) > 0 {
+		return nil
+	}
+	return itr.Failure
+}
+
 // MustTempDir returns a temporary directory. Panic on error.
 func MustTempDir() string {
 	path, err := ioutil.TempDir("", "tsi-")